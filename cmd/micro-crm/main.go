@@ -22,6 +22,18 @@ func main() {
 	customVars.DbPath = customVars.DataPath + "/database/micro-crm.db"
 	customVars.CertFilePath = os.Getenv("CERT_FILE_PATH")
 	customVars.KeyFilePath = os.Getenv("KEY_FILE_PATH")
+	customVars.MailIngestMaildir = os.Getenv("MAIL_INGEST_MAILDIR")
+	customVars.MailIngestSMTPAddr = os.Getenv("MAIL_INGEST_SMTP_ADDR")
+	customVars.IMAPSyncInterval = os.Getenv("IMAP_SYNC_INTERVAL")
+	customVars.CalDAVSyncInterval = os.Getenv("CALDAV_SYNC_INTERVAL")
+	customVars.SMTPHost = os.Getenv("SMTP_HOST")
+	customVars.SMTPPort = os.Getenv("SMTP_PORT")
+	customVars.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	customVars.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	customVars.SMTPFrom = os.Getenv("SMTP_FROM")
+	customVars.ReminderLeadTime = os.Getenv("REMINDER_LEAD_TIME")
+	customVars.ReminderSchedule = os.Getenv("REMINDER_SCHEDULE")
+	customVars.TrashRetention = os.Getenv("TRASH_RETENTION")
 
 	_, err := os.Stat(customVars.DataPath)
 	if os.IsNotExist(err) {
@@ -8,17 +8,27 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	"log"
+	"micro-CRM/internal/caldav"
 	"micro-CRM/internal/database"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/handlers"
+	"micro-CRM/internal/imapsync"
 	"micro-CRM/internal/logger"
+	"micro-CRM/internal/mailer"
+	"micro-CRM/internal/mailin"
 	"micro-CRM/internal/middleware"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/oidc"
 	_ "micro-CRM/internal/oidc"
+	"micro-CRM/internal/reminders"
+	"micro-CRM/internal/scheduler"
+	"micro-CRM/internal/trash"
 	"micro-CRM/internal/utils"
+	"micro-CRM/internal/webhooks"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -35,6 +45,12 @@ type Api struct {
 	handlers.CRMHandlers
 	database.DBManager
 	log logger.Logger
+
+	// Background services are stopped by cancelling this context
+	services     context.Context
+	stopServices context.CancelFunc
+	mailSender   mailer.Sender // nil when outbound email is disabled
+	scheduler    *scheduler.Scheduler
 }
 
 func NewApi(p models.EnvParams) *Api {
@@ -44,11 +60,11 @@ func NewApi(p models.EnvParams) *Api {
 }
 func (a *Api) SetupAuthRouter() {
 	a.authRouter = a.router.PathPrefix("/api").Subrouter()
-	a.authRouter.Use(middleware.AuthMiddleware)
+	a.authRouter.Use(middleware.AuthMiddleware, middleware.OrgMiddleware(a.db))
 }
 func (a *Api) SetupDashRouter() {
 	a.dashRouter = a.router.PathPrefix("/dash").Subrouter()
-	a.dashRouter.Use(middleware.AuthMiddleware)
+	a.dashRouter.Use(middleware.AuthMiddleware, middleware.OrgMiddleware(a.db))
 }
 func (a *Api) SetupAdminRouter() {
 	a.adminRouter = a.router.PathPrefix("/admin").Subrouter()
@@ -74,6 +90,20 @@ func (a *Api) SetupAllRoutes() {
 	a.SetupInteractionRoutes()
 	a.SetupDashboardRoutes()
 	a.SetupProfileRoutes()
+	a.SetupMailboxRoutes()
+	a.SetupEmailRoutes()
+	a.SetupCalendarRoutes()
+	a.SetupDealRoutes()
+	a.SetupPipelineRoutes()
+	a.SetupNotificationRoutes()
+	a.SetupEventRoutes()
+	a.SetupWebhookRoutes()
+	a.SetupOrganizationRoutes()
+	a.SetupShareRoutes()
+	a.SetupTrashRoutes()
+	a.SetupTagRoutes()
+	a.SetupCustomFieldRoutes()
+	a.SetupSegmentRoutes()
 }
 func (a *Api) SetupAuthenticationRoutes() {
 	a.router.HandleFunc("/register", a.CRMHandlers.RegisterUser).Methods("POST")
@@ -91,13 +121,28 @@ func (a *Api) SetupCompanyRoutes() {
 	a.authRouter.HandleFunc("/companies/{id}", a.CRMHandlers.GetCompany).Methods("GET")
 	a.authRouter.HandleFunc("/companies/{id}", a.CRMHandlers.UpdateCompany).Methods("PUT")
 	a.authRouter.HandleFunc("/companies/{id}", a.CRMHandlers.DeleteCompany).Methods("DELETE")
+	a.authRouter.HandleFunc("/companies/{id}/stage-history", a.CRMHandlers.GetCompanyStageHistory).Methods("GET")
+	a.authRouter.HandleFunc("/companies/{id}/timeline", a.CRMHandlers.GetCompanyTimeline).Methods("GET")
+	a.authRouter.HandleFunc("/companies/{id}/affiliations", a.CRMHandlers.ListCompanyAffiliations).Methods("GET")
+	a.authRouter.HandleFunc("/companies/{id}/org-chart", a.CRMHandlers.GetCompanyOrgChart).Methods("GET")
 }
 func (a *Api) SetupContactRoutes() {
 	a.authRouter.HandleFunc("/contacts", a.CRMHandlers.CreateContact).Methods("POST")
 	a.authRouter.HandleFunc("/contacts", a.CRMHandlers.ListContacts).Methods("GET")
+	a.authRouter.HandleFunc("/contacts/duplicates", a.CRMHandlers.FindContactDuplicates).Methods("GET")
 	a.authRouter.HandleFunc("/contacts/{id}", a.CRMHandlers.GetContact).Methods("GET")
 	a.authRouter.HandleFunc("/contacts/{id}", a.CRMHandlers.UpdateContact).Methods("PUT")
 	a.authRouter.HandleFunc("/contacts/{id}", a.CRMHandlers.DeleteContact).Methods("DELETE")
+	a.authRouter.HandleFunc("/contacts/{id}/stage-history", a.CRMHandlers.GetContactStageHistory).Methods("GET")
+	a.authRouter.HandleFunc("/contacts/{id}/timeline", a.CRMHandlers.GetContactTimeline).Methods("GET")
+	a.authRouter.HandleFunc("/contacts/{id}/merge", a.CRMHandlers.MergeContacts).Methods("POST")
+	a.authRouter.HandleFunc("/contacts/{id}/relationships", a.CRMHandlers.ListContactRelationships).Methods("GET")
+	a.authRouter.HandleFunc("/contacts/{id}/relationships", a.CRMHandlers.CreateContactRelationship).Methods("POST")
+	a.authRouter.HandleFunc("/contacts/{id}/relationships/{relationshipId}", a.CRMHandlers.DeleteContactRelationship).Methods("DELETE")
+	a.authRouter.HandleFunc("/contacts/{id}/affiliations", a.CRMHandlers.ListContactAffiliations).Methods("GET")
+	a.authRouter.HandleFunc("/contacts/{id}/affiliations", a.CRMHandlers.CreateContactAffiliation).Methods("POST")
+	a.authRouter.HandleFunc("/contacts/{id}/affiliations/{affiliationId}", a.CRMHandlers.UpdateContactAffiliation).Methods("PUT")
+	a.authRouter.HandleFunc("/contacts/{id}/affiliations/{affiliationId}", a.CRMHandlers.DeleteContactAffiliation).Methods("DELETE")
 }
 func (a *Api) SetupFileRoutes() {
 	// a.authRouter.HandleFunc("/files", a.CRMHandlers.CreateFile).Methods("POST") # Will reuse this later
@@ -124,6 +169,7 @@ func (a *Api) SetupTaskRoutes() {
 	a.authRouter.HandleFunc("/tasks/{id}", a.CRMHandlers.GetTask).Methods("GET")
 	a.authRouter.HandleFunc("/tasks/{id}", a.CRMHandlers.UpdateTask).Methods("PUT")
 	a.authRouter.HandleFunc("/tasks/{id}", a.CRMHandlers.DeleteTask).Methods("DELETE")
+	a.authRouter.HandleFunc("/tasks/{id}/assign", a.CRMHandlers.AssignTask).Methods("POST")
 }
 func (a *Api) SetupInteractionRoutes() {
 	a.authRouter.HandleFunc("/interactions", a.CRMHandlers.CreateInteraction).Methods("POST")
@@ -132,10 +178,130 @@ func (a *Api) SetupInteractionRoutes() {
 	a.authRouter.HandleFunc("/interactions/{id}", a.CRMHandlers.UpdateInteraction).Methods("PUT")
 	a.authRouter.HandleFunc("/interactions/{id}", a.CRMHandlers.DeleteInteraction).Methods("DELETE")
 }
+func (a *Api) SetupDealRoutes() {
+	a.authRouter.HandleFunc("/deals", a.CRMHandlers.CreateDeal).Methods("POST")
+	a.authRouter.HandleFunc("/deals", a.CRMHandlers.ListDeals).Methods("GET")
+	a.authRouter.HandleFunc("/deals/{id}", a.CRMHandlers.GetDeal).Methods("GET")
+	a.authRouter.HandleFunc("/deals/{id}", a.CRMHandlers.UpdateDeal).Methods("PUT")
+	a.authRouter.HandleFunc("/deals/{id}", a.CRMHandlers.DeleteDeal).Methods("DELETE")
+	a.authRouter.HandleFunc("/deals/{id}/stage-history", a.CRMHandlers.GetDealStageHistory).Methods("GET")
+}
+func (a *Api) SetupPipelineRoutes() {
+	a.authRouter.HandleFunc("/pipelines", a.CRMHandlers.CreatePipeline).Methods("POST")
+	a.authRouter.HandleFunc("/pipelines", a.CRMHandlers.ListPipelines).Methods("GET")
+	a.authRouter.HandleFunc("/pipelines/{id}", a.CRMHandlers.GetPipeline).Methods("GET")
+	a.authRouter.HandleFunc("/pipelines/{id}", a.CRMHandlers.UpdatePipeline).Methods("PUT")
+	a.authRouter.HandleFunc("/pipelines/{id}", a.CRMHandlers.DeletePipeline).Methods("DELETE")
+	a.authRouter.HandleFunc("/pipelines/{id}/stages", a.CRMHandlers.CreatePipelineStage).Methods("POST")
+	a.authRouter.HandleFunc("/pipelines/{id}/stages/{stageId}", a.CRMHandlers.UpdatePipelineStage).Methods("PUT")
+	a.authRouter.HandleFunc("/pipelines/{id}/stages/{stageId}", a.CRMHandlers.DeletePipelineStage).Methods("DELETE")
+}
+func (a *Api) SetupNotificationRoutes() {
+	a.authRouter.HandleFunc("/notifications", a.CRMHandlers.ListNotifications).Methods("GET")
+	a.authRouter.HandleFunc("/notifications/unread-count", a.CRMHandlers.GetUnreadNotificationCount).Methods("GET")
+	a.authRouter.HandleFunc("/notifications/read-all", a.CRMHandlers.MarkAllNotificationsRead).Methods("POST")
+	a.authRouter.HandleFunc("/notifications/preferences", a.CRMHandlers.GetNotificationPreferences).Methods("GET")
+	a.authRouter.HandleFunc("/notifications/preferences", a.CRMHandlers.UpdateNotificationPreferences).Methods("PUT")
+	a.authRouter.HandleFunc("/notifications/{id}/read", a.CRMHandlers.MarkNotificationRead).Methods("POST")
+}
+func (a *Api) SetupEventRoutes() {
+	a.authRouter.HandleFunc("/events", a.CRMHandlers.StreamEvents).Methods("GET")
+}
+func (a *Api) SetupWebhookRoutes() {
+	a.authRouter.HandleFunc("/webhooks", a.CRMHandlers.CreateWebhook).Methods("POST")
+	a.authRouter.HandleFunc("/webhooks", a.CRMHandlers.ListWebhooks).Methods("GET")
+	a.authRouter.HandleFunc("/webhooks/event-types", a.CRMHandlers.ListWebhookEventTypes).Methods("GET")
+	a.authRouter.HandleFunc("/webhooks/{id}", a.CRMHandlers.GetWebhook).Methods("GET")
+	a.authRouter.HandleFunc("/webhooks/{id}", a.CRMHandlers.UpdateWebhook).Methods("PUT")
+	a.authRouter.HandleFunc("/webhooks/{id}", a.CRMHandlers.DeleteWebhook).Methods("DELETE")
+	a.authRouter.HandleFunc("/webhooks/{id}/deliveries", a.CRMHandlers.ListWebhookDeliveries).Methods("GET")
+	a.authRouter.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}", a.CRMHandlers.GetWebhookDelivery).Methods("GET")
+	a.authRouter.HandleFunc("/webhooks/{id}/deliveries/{deliveryId}/redeliver", a.CRMHandlers.RedeliverWebhookDelivery).Methods("POST")
+}
+func (a *Api) SetupOrganizationRoutes() {
+	a.authRouter.HandleFunc("/organization", a.CRMHandlers.GetOrganization).Methods("GET")
+	a.authRouter.HandleFunc("/organization", a.CRMHandlers.UpdateOrganization).Methods("PUT")
+	a.authRouter.HandleFunc("/organization/members", a.CRMHandlers.ListOrganizationMembers).Methods("GET")
+	a.authRouter.HandleFunc("/organization/members/{userId}", a.CRMHandlers.UpdateOrganizationMember).Methods("PUT")
+	a.authRouter.HandleFunc("/organization/members/{userId}", a.CRMHandlers.RemoveOrganizationMember).Methods("DELETE")
+	a.authRouter.HandleFunc("/organization/members/{userId}/deactivate", a.CRMHandlers.DeactivateOrganizationMember).Methods("POST")
+	a.authRouter.HandleFunc("/organization/members/{userId}/reactivate", a.CRMHandlers.ReactivateOrganizationMember).Methods("POST")
+	a.authRouter.HandleFunc("/organization/members/{userId}/transfer", a.CRMHandlers.TransferMemberRecords).Methods("POST")
+	a.authRouter.HandleFunc("/organization/invitations", a.CRMHandlers.CreateOrganizationInvitation).Methods("POST")
+	a.authRouter.HandleFunc("/organization/invitations", a.CRMHandlers.ListOrganizationInvitations).Methods("GET")
+	a.authRouter.HandleFunc("/organization/invitations/{id}", a.CRMHandlers.DeleteOrganizationInvitation).Methods("DELETE")
+	a.authRouter.HandleFunc("/invitations", a.CRMHandlers.ListMyInvitations).Methods("GET")
+	a.authRouter.HandleFunc("/invitations/accept", a.CRMHandlers.AcceptInvitation).Methods("POST")
+}
+func (a *Api) SetupShareRoutes() {
+	a.authRouter.HandleFunc("/{entity:companies|contacts|deals|files}/{id}/shares", a.CRMHandlers.ListShares).Methods("GET")
+	a.authRouter.HandleFunc("/{entity:companies|contacts|deals|files}/{id}/shares", a.CRMHandlers.ShareRecord).Methods("POST")
+	a.authRouter.HandleFunc("/{entity:companies|contacts|deals|files}/{id}/shares/{shareId}", a.CRMHandlers.UnshareRecord).Methods("DELETE")
+}
+func (a *Api) SetupTrashRoutes() {
+	a.authRouter.HandleFunc("/trash", a.CRMHandlers.ListTrash).Methods("GET")
+	a.authRouter.HandleFunc("/trash/{entity:companies|contacts|deals|interactions|tasks|files}/{id}/restore", a.CRMHandlers.RestoreRecord).Methods("POST")
+}
+func (a *Api) SetupTagRoutes() {
+	a.authRouter.HandleFunc("/tags", a.CRMHandlers.CreateTag).Methods("POST")
+	a.authRouter.HandleFunc("/tags", a.CRMHandlers.ListTags).Methods("GET")
+	a.authRouter.HandleFunc("/tags/bulk", a.CRMHandlers.BulkTagRecords).Methods("POST")
+	a.authRouter.HandleFunc("/tags/{id}", a.CRMHandlers.UpdateTag).Methods("PUT")
+	a.authRouter.HandleFunc("/tags/{id}", a.CRMHandlers.DeleteTag).Methods("DELETE")
+	a.authRouter.HandleFunc("/{entity:companies|contacts|tasks|interactions|files}/{id}/tags", a.CRMHandlers.ListRecordTags).Methods("GET")
+	a.authRouter.HandleFunc("/{entity:companies|contacts|tasks|interactions|files}/{id}/tags", a.CRMHandlers.SetRecordTags).Methods("PUT")
+}
+func (a *Api) SetupCustomFieldRoutes() {
+	a.authRouter.HandleFunc("/custom-fields", a.CRMHandlers.CreateCustomField).Methods("POST")
+	a.authRouter.HandleFunc("/custom-fields", a.CRMHandlers.ListCustomFields).Methods("GET")
+	a.authRouter.HandleFunc("/custom-fields/{id}", a.CRMHandlers.UpdateCustomField).Methods("PUT")
+	a.authRouter.HandleFunc("/custom-fields/{id}", a.CRMHandlers.DeleteCustomField).Methods("DELETE")
+}
+func (a *Api) SetupSegmentRoutes() {
+	a.authRouter.HandleFunc("/segments", a.CRMHandlers.CreateSegment).Methods("POST")
+	a.authRouter.HandleFunc("/segments", a.CRMHandlers.ListSegments).Methods("GET")
+	a.authRouter.HandleFunc("/segments/{id}", a.CRMHandlers.GetSegment).Methods("GET")
+	a.authRouter.HandleFunc("/segments/{id}", a.CRMHandlers.UpdateSegment).Methods("PUT")
+	a.authRouter.HandleFunc("/segments/{id}", a.CRMHandlers.DeleteSegment).Methods("DELETE")
+	a.authRouter.HandleFunc("/segments/{id}/export", a.CRMHandlers.ExportSegment).Methods("GET")
+}
+func (a *Api) SetupMailboxRoutes() {
+	a.authRouter.HandleFunc("/mailboxes", a.CRMHandlers.CreateMailbox).Methods("POST")
+	a.authRouter.HandleFunc("/mailboxes", a.CRMHandlers.ListMailboxes).Methods("GET")
+	a.authRouter.HandleFunc("/mailboxes/{id}", a.CRMHandlers.GetMailbox).Methods("GET")
+	a.authRouter.HandleFunc("/mailboxes/{id}", a.CRMHandlers.UpdateMailbox).Methods("PUT")
+	a.authRouter.HandleFunc("/mailboxes/{id}", a.CRMHandlers.DeleteMailbox).Methods("DELETE")
+	a.authRouter.HandleFunc("/mailboxes/{id}/sync", a.CRMHandlers.SyncMailbox).Methods("POST")
+}
+func (a *Api) SetupCalendarRoutes() {
+	a.authRouter.HandleFunc("/calendars", a.CRMHandlers.CreateCalendar).Methods("POST")
+	a.authRouter.HandleFunc("/calendars", a.CRMHandlers.ListCalendars).Methods("GET")
+	a.authRouter.HandleFunc("/calendars/{id}", a.CRMHandlers.GetCalendar).Methods("GET")
+	a.authRouter.HandleFunc("/calendars/{id}", a.CRMHandlers.UpdateCalendar).Methods("PUT")
+	a.authRouter.HandleFunc("/calendars/{id}", a.CRMHandlers.DeleteCalendar).Methods("DELETE")
+	a.authRouter.HandleFunc("/calendars/{id}/sync", a.CRMHandlers.SyncCalendar).Methods("POST")
+}
+func (a *Api) SetupEmailRoutes() {
+	a.authRouter.HandleFunc("/email-templates", a.CRMHandlers.CreateEmailTemplate).Methods("POST")
+	a.authRouter.HandleFunc("/email-templates", a.CRMHandlers.ListEmailTemplates).Methods("GET")
+	a.authRouter.HandleFunc("/email-templates/{id}", a.CRMHandlers.GetEmailTemplate).Methods("GET")
+	a.authRouter.HandleFunc("/email-templates/{id}", a.CRMHandlers.UpdateEmailTemplate).Methods("PUT")
+	a.authRouter.HandleFunc("/email-templates/{id}", a.CRMHandlers.DeleteEmailTemplate).Methods("DELETE")
+	a.authRouter.HandleFunc("/email-templates/{id}/preview", a.CRMHandlers.PreviewEmailTemplate).Methods("POST")
+	a.authRouter.HandleFunc("/emails", a.CRMHandlers.SendEmail).Methods("POST")
+	a.authRouter.HandleFunc("/outbox", a.CRMHandlers.ListOutbox).Methods("GET")
+	a.authRouter.HandleFunc("/outbox/{id}", a.CRMHandlers.GetOutboxMessage).Methods("GET")
+	a.authRouter.HandleFunc("/outbox/{id}", a.CRMHandlers.CancelOutboxMessage).Methods("DELETE")
+	a.authRouter.HandleFunc("/outbox/{id}/retry", a.CRMHandlers.RetryOutboxMessage).Methods("POST")
+}
 func (a *Api) SetupDashboardRoutes() {
 	a.dashRouter.Use(middleware.AuthMiddleware)
 	a.dashRouter.HandleFunc("/stats", a.CRMHandlers.GetDashboardStats).Methods("GET")
 	a.dashRouter.HandleFunc("/pipeline", a.CRMHandlers.GetPipelineData).Methods("GET")
+	a.dashRouter.HandleFunc("/pipeline/velocity", a.CRMHandlers.GetStageVelocity).Methods("GET")
+	a.dashRouter.HandleFunc("/pipeline/conversion", a.CRMHandlers.GetStageConversion).Methods("GET")
+	a.dashRouter.HandleFunc("/deals/stuck", a.CRMHandlers.GetStuckDeals).Methods("GET")
+	a.dashRouter.HandleFunc("/forecast", a.CRMHandlers.GetForecast).Methods("GET")
 	a.dashRouter.HandleFunc("/interactions", a.CRMHandlers.GetInteractionTrends).Methods("GET")
 	a.dashRouter.HandleFunc("/recent-interactions", a.CRMHandlers.GetRecentInteractions).Methods("GET")
 	a.dashRouter.HandleFunc("/suggested-contacts", a.CRMHandlers.GetSuggestedContacts).Methods("GET")
@@ -149,6 +315,13 @@ func (a *Api) SetupLogger() {
 func (a *Api) SetupAdminRoutes() {
 	a.adminRouter.HandleFunc("/health/API", a.CRMHandlers.Hello).Methods("GET")
 	a.adminRouter.HandleFunc("/health/DB", a.CRMHandlers.DBPing).Methods("GET")
+
+	// The health checks stay open; audit routes need a signed-in owner or admin
+	authenticated := func(h http.HandlerFunc) http.Handler {
+		return middleware.AuthMiddleware(middleware.OrgMiddleware(a.db)(h))
+	}
+	a.adminRouter.Handle("/audit", authenticated(a.CRMHandlers.ListAuditEvents)).Methods("GET")
+	a.adminRouter.Handle("/audit/verify", authenticated(a.CRMHandlers.VerifyAuditLog)).Methods("GET")
 }
 func (a *Api) SetupDatabases() {
 	a.log.Info("Setting up API databases")
@@ -175,6 +348,134 @@ func (a *Api) SetupDatabases() {
 
 	a.log.Info("DB setup complete")
 }
+func (a *Api) SetupMailServices() {
+	ingester := mailin.NewIngester(a.db, a.log, models.DefaultUploadDir)
+
+	if a.Params.MailIngestMaildir != "" {
+		a.log.Info("Watching maildir for inbound mail: %s", a.Params.MailIngestMaildir)
+		watcher := mailin.NewMaildirWatcher(a.Params.MailIngestMaildir, 30*time.Second, ingester)
+		go func() {
+			if err := watcher.Run(a.services); err != nil {
+				a.log.Error("Maildir watcher stopped: %v", err)
+			}
+		}()
+	}
+	if a.Params.MailIngestSMTPAddr != "" {
+		server := mailin.NewSMTPServer(a.Params.MailIngestSMTPAddr, ingester)
+		go func() {
+			if err := server.ListenAndServe(a.services); err != nil {
+				a.log.Error("SMTP listener stopped: %v", err)
+			}
+		}()
+	}
+
+	// IMAP accounts are per user, so the syncer always exists for on-demand syncs;
+	// IMAP_SYNC_INTERVAL=0 turns off background polling
+	interval := 5 * time.Minute
+	if a.Params.IMAPSyncInterval != "" {
+		parsed, err := time.ParseDuration(a.Params.IMAPSyncInterval)
+		if err != nil {
+			a.log.Warn("Invalid IMAP_SYNC_INTERVAL %q, using %s", a.Params.IMAPSyncInterval, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	a.CRMHandlers.IMAPSync = imapsync.NewSyncer(a.db, a.log, ingester, interval)
+	if interval > 0 {
+		a.log.Info("Polling IMAP mailboxes every %s", interval)
+		go a.CRMHandlers.IMAPSync.Run(a.services)
+	}
+
+	if a.Params.SMTPHost == "" {
+		a.log.Info("SMTP_HOST not set, outbound email disabled")
+		return
+	}
+	port, err := strconv.Atoi(a.Params.SMTPPort)
+	if err != nil {
+		port = 587
+	}
+	from := a.Params.SMTPFrom
+	if from == "" {
+		from = a.Params.SMTPUsername
+	}
+	sender := mailer.NewSMTPSender(a.Params.SMTPHost, port, a.Params.SMTPUsername, a.Params.SMTPPassword, from)
+	a.mailSender = sender
+	a.CRMHandlers.Outbox = mailer.NewOutbox(a.db, a.log, sender, 30*time.Second)
+	a.log.Info("Outbound email via %s:%d", a.Params.SMTPHost, port)
+	go a.CRMHandlers.Outbox.Run(a.services)
+}
+func (a *Api) SetupCalendarServices() {
+	// Same as IMAP: on-demand syncs always work, CALDAV_SYNC_INTERVAL=0 turns off polling
+	interval := 15 * time.Minute
+	if a.Params.CalDAVSyncInterval != "" {
+		parsed, err := time.ParseDuration(a.Params.CalDAVSyncInterval)
+		if err != nil {
+			a.log.Warn("Invalid CALDAV_SYNC_INTERVAL %q, using %s", a.Params.CalDAVSyncInterval, interval)
+		} else {
+			interval = parsed
+		}
+	}
+	a.CRMHandlers.CalDAVSync = caldav.NewSyncer(a.db, a.log, interval)
+	if interval > 0 {
+		a.log.Info("Syncing CalDAV calendars every %s", interval)
+		go a.CRMHandlers.CalDAVSync.Run(a.services)
+	}
+}
+func (a *Api) SetupWebhooks() {
+	a.CRMHandlers.Webhooks = webhooks.NewDispatcher(a.db, a.log, 30*time.Second)
+	a.CRMHandlers.Events.Handle(a.CRMHandlers.Webhooks.Enqueue)
+	go a.CRMHandlers.Webhooks.Run(a.services)
+}
+func (a *Api) SetupScheduler() {
+	a.scheduler = scheduler.NewScheduler(a.db, a.log)
+
+	// REMINDER_LEAD_TIME=0 leaves only the overdue notices
+	leadTime := 24 * time.Hour
+	if a.Params.ReminderLeadTime != "" {
+		parsed, err := time.ParseDuration(a.Params.ReminderLeadTime)
+		if err != nil {
+			a.log.Warn("Invalid REMINDER_LEAD_TIME %q, using %s", a.Params.ReminderLeadTime, leadTime)
+		} else {
+			leadTime = parsed
+		}
+	}
+	channels := []reminders.Channel{reminders.LogChannel{Log: a.log}, reminders.InAppChannel{DB: a.db}}
+	if a.mailSender != nil {
+		channels = append(channels, reminders.EmailChannel{Sender: a.mailSender})
+	}
+	notifier := reminders.NewNotifier(a.db, a.log, leadTime, channels...)
+
+	schedule := a.Params.ReminderSchedule
+	if schedule == "" {
+		schedule = "*/5 * * * *"
+	}
+	if err := a.scheduler.Register("reminders", schedule, notifier.Run); err != nil {
+		a.log.Error("Reminders disabled: %v", err)
+	}
+
+	// Clients offline for longer than a week reload instead of resuming
+	pruneEvents := func(context.Context) error { return a.CRMHandlers.Events.Prune(7 * 24 * time.Hour) }
+	if err := a.scheduler.Register("prune-events", "@daily", pruneEvents); err != nil {
+		a.log.Error("Event pruning disabled: %v", err)
+	}
+
+	// TRASH_RETENTION is a duration such as 720h
+	a.CRMHandlers.TrashRetention = trash.DefaultRetention
+	if a.Params.TrashRetention != "" {
+		parsed, err := time.ParseDuration(a.Params.TrashRetention)
+		if err != nil || parsed <= 0 {
+			a.log.Warn("Invalid TRASH_RETENTION %q, using %s", a.Params.TrashRetention, trash.DefaultRetention)
+		} else {
+			a.CRMHandlers.TrashRetention = parsed
+		}
+	}
+	purger := trash.NewPurger(a.db, a.log, a.CRMHandlers.TrashRetention)
+	if err := a.scheduler.Register("purge-trash", "@daily", purger.Run); err != nil {
+		a.log.Error("Trash purging disabled: %v", err)
+	}
+
+	go a.scheduler.Run(a.services)
+}
 func (a *Api) Start() {
 	var (
 		startErr error
@@ -201,20 +502,31 @@ func (a *Api) Start() {
 	// Database Setup
 	a.SetupDatabases()
 
+	// Background services
+	a.services, a.stopServices = context.WithCancel(context.Background())
+	a.CRMHandlers.Events = events.NewBus(a.db, a.log)
+	a.SetupMailServices()
+	a.SetupCalendarServices()
+	a.SetupWebhooks()
+	a.SetupScheduler()
+
 	// Router initialization
 	a.router = mux.NewRouter()
+	a.router.Use(middleware.RequestID)
 
 	// Setup routes
 	a.log.Info("Setting up routes")
 	a.SetupAllRoutes()
 	// Kill channel
-	var killSignal = make(chan os.Signal)
+	var killSignal = make(chan os.Signal, 1)
 	signal.Notify(killSignal, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGKILL)
 	handler := cors.AllowAll().Handler(a.router)
 	server := &http.Server{
 		Addr:    ":" + a.Params.ApiPort,
 		Handler: handler,
 	}
+	// Open event streams never finish on their own
+	server.RegisterOnShutdown(a.CRMHandlers.Events.Close)
 
 	go func() {
 		startSting := "Starting API at endpoint: " + a.Params.ApiPort
@@ -237,6 +549,7 @@ func (a *Api) Start() {
 }
 func (a *Api) Stop() {
 	a.log.Info("Graceful shutdown of services")
+	a.stopServices()
 	err := a.db.Close()
 	err = a.TokenStore.DB.Close()
 	if err != nil {
@@ -0,0 +1,278 @@
+// Package audit keeps an append-only log of changes to CRM records. Each
+// organization's events form a hash chain: an event's hash covers its content
+// and the hash of the event before it, so editing or removing a stored event
+// breaks the chain from that point on.
+package audit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ActionPurged records that a trashed record was removed for good; the other
+// actions are the event actions of the change.
+const ActionPurged = "purged"
+
+// TimeLayout is how created_at is stored. Its fixed width keeps string order the
+// same as time order, which RFC3339Nano's trimmed fractions do not.
+const TimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// Tables maps the audited record types to their tables.
+var Tables = map[string]string{
+	models.EntityCompany:     "companies",
+	models.EntityContact:     "contacts",
+	models.EntityTask:        "tasks",
+	models.EntityInteraction: "interactions",
+	models.EntityFile:        "files",
+	models.EntityUser:        "users",
+}
+
+// redacted fields are logged as changed without their values.
+var redacted = map[string]bool{"password_hash": true}
+
+// ignored fields change with every write and carry no information of their own.
+var ignored = map[string]bool{"updated_at": true}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Columns lists the columns of an audit_events query in the order scanned by Scan.
+const Columns = `id, org_id, actor_id, action, entity_type, entity_id, request_id, changes, created_at, prev_hash, hash`
+
+// Scan reads an event selected with Columns.
+func Scan(row interface{ Scan(...interface{}) error }, e *models.AuditEvent) error {
+	var changes string
+	if err := row.Scan(&e.ID, &e.OrgID, &e.ActorID, &e.Action, &e.EntityType, &e.EntityID, &e.RequestID,
+		&changes, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+		return err
+	}
+	e.Changes = json.RawMessage(changes)
+	return nil
+}
+
+// Snapshot loads every stored field of a record, or nil when it does not exist.
+// Custom field values are included as custom_fields.<key>.
+func Snapshot(q Querier, entityType string, id int) (map[string]interface{}, error) {
+	table, ok := Tables[entityType]
+	if !ok {
+		return nil, fmt.Errorf("cannot audit %s records", entityType)
+	}
+	rows, err := q.Query("SELECT * FROM "+table+" WHERE id = ?", id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s %d: %w", entityType, id, err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, fmt.Errorf("cannot load %s %d: %w", entityType, id, err)
+	}
+	record := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		if b, ok := values[i].([]byte); ok {
+			values[i] = string(b)
+		}
+		record[column] = values[i]
+	}
+	rows.Close()
+
+	custom, err := q.Query(`
+	SELECT f.field_key, v.value FROM custom_field_values v JOIN custom_fields f ON f.id = v.field_id
+	WHERE v.entity_type = ? AND v.entity_id = ?`, entityType, id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s %d custom fields: %w", entityType, id, err)
+	}
+	defer custom.Close()
+	for custom.Next() {
+		var (
+			key   string
+			value interface{}
+		)
+		if err := custom.Scan(&key, &value); err != nil {
+			return nil, fmt.Errorf("cannot load %s %d custom fields: %w", entityType, id, err)
+		}
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		record["custom_fields."+key] = value
+	}
+	return record, custom.Err()
+}
+
+// Diff lists the fields that differ between two snapshots of a record; a nil
+// before means it was created and a nil after that it was deleted.
+func Diff(before, after map[string]interface{}) map[string]models.AuditChange {
+	fields := make(map[string]bool)
+	for field := range before {
+		fields[field] = true
+	}
+	for field := range after {
+		fields[field] = true
+	}
+	changes := make(map[string]models.AuditChange)
+	for field := range fields {
+		if ignored[field] {
+			continue
+		}
+		b, a := before[field], after[field]
+		if reflect.DeepEqual(b, a) {
+			continue
+		}
+		if redacted[field] {
+			b, a = redact(b), redact(a)
+		}
+		changes[field] = models.AuditChange{Before: b, After: a}
+	}
+	return changes
+}
+
+func redact(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return "[redacted]"
+}
+
+// OrgOf returns the organization a snapshot belongs to, if it has one.
+func OrgOf(record map[string]interface{}) (int, bool) {
+	orgID, ok := record["org_id"].(int64)
+	return int(orgID), ok
+}
+
+// Hash computes an event's chain hash from its stored fields and PrevHash.
+func Hash(e models.AuditEvent) string {
+	// A JSON array fixes the field order and keeps values from running together
+	content, _ := json.Marshal([]interface{}{
+		e.PrevHash, e.OrgID, e.ActorID, e.Action, e.EntityType, e.EntityID, e.RequestID, string(e.Changes), e.CreatedAt,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// mu serializes appends so that two events never link to the same predecessor.
+var mu sync.Mutex
+
+// Record appends a change to its organization's chain. Changes is the field
+// diff; an update that changed nothing is not recorded.
+func Record(db *sql.DB, e models.AuditEvent, changes map[string]models.AuditChange) error {
+	if len(changes) == 0 && e.Action == events.ActionUpdated {
+		return nil
+	}
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit changes: %w", err)
+	}
+	e.Changes = encoded
+
+	mu.Lock()
+	defer mu.Unlock()
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start audit transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT hash FROM audit_events WHERE org_id = ? ORDER BY id DESC LIMIT 1", e.OrgID).Scan(&e.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("cannot load previous audit event: %w", err)
+	}
+	e.CreatedAt = time.Now().UTC().Format(TimeLayout)
+	e.Hash = Hash(e)
+	if _, err := tx.Exec(`
+	INSERT INTO audit_events (org_id, actor_id, action, entity_type, entity_id, request_id, changes, created_at, prev_hash, hash)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.OrgID, e.ActorID, e.Action, e.EntityType, e.EntityID, e.RequestID, string(e.Changes), e.CreatedAt, e.PrevHash, e.Hash,
+	); err != nil {
+		return fmt.Errorf("cannot record audit event: %w", err)
+	}
+	return tx.Commit()
+}
+
+// Track records that actorID created, updated or deleted a record, diffing before
+// (nil for created records) against its stored state. A zero actorID records no
+// actor, as for mail ingestion and calendar sync. The event joins the chain of
+// the organization owning the record, or orgID for records outside any
+// organization; a record moving between organizations is recorded in both.
+func Track(db *sql.DB, actorID, orgID int, requestID, action, entityType string, id int, before map[string]interface{}) error {
+	after, err := Snapshot(db, entityType, id)
+	if err != nil {
+		return fmt.Errorf("cannot load %s %d: %w", entityType, id, err)
+	}
+	var chains []int
+	for _, record := range []map[string]interface{}{before, after} {
+		if recordOrg, ok := OrgOf(record); ok && (len(chains) == 0 || chains[0] != recordOrg) {
+			chains = append(chains, recordOrg)
+		}
+	}
+	if len(chains) == 0 {
+		chains = []int{orgID}
+	}
+
+	e := models.AuditEvent{Action: action, EntityType: entityType, EntityID: id}
+	if actorID != 0 {
+		e.ActorID = &actorID
+	}
+	if requestID != "" {
+		e.RequestID = &requestID
+	}
+	changes := Diff(before, after)
+	var errs []error
+	for _, chain := range chains {
+		e.OrgID = chain
+		if err := Record(db, e, changes); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Verify walks an organization's chain from its first event and reports the
+// first event whose hash does not match its content or whose link does not
+// match the event before it.
+func Verify(q Querier, orgID int) (models.AuditVerification, error) {
+	result := models.AuditVerification{Valid: true}
+	rows, err := q.Query("SELECT "+Columns+" FROM audit_events WHERE org_id = ? ORDER BY id", orgID)
+	if err != nil {
+		return result, fmt.Errorf("cannot load audit events: %w", err)
+	}
+	defer rows.Close()
+
+	previous := ""
+	for rows.Next() {
+		var e models.AuditEvent
+		if err := Scan(rows, &e); err != nil {
+			return result, fmt.Errorf("cannot load audit event: %w", err)
+		}
+		result.Checked++
+		if e.PrevHash != previous || Hash(e) != e.Hash {
+			result.Valid = false
+			result.BrokenAt = &e.ID
+			return result, nil
+		}
+		previous = e.Hash
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"database/sql"
+	"encoding/json"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestHash(t *testing.T) {
+	actor, request := 7, "req-1"
+	base := models.AuditEvent{
+		OrgID: 1, ActorID: &actor, Action: events.ActionUpdated, EntityType: models.EntityContact, EntityID: 3,
+		RequestID: &request, Changes: json.RawMessage(`{"notes":{"before":"a","after":"b"}}`),
+		CreatedAt: "2024-01-31T10:00:00.000000000Z", PrevHash: "abc",
+	}
+	if Hash(base) != Hash(base) {
+		t.Fatal("Hash is not deterministic")
+	}
+	otherActor, otherRequest := 8, "req-2"
+	tests := []struct {
+		name   string
+		change func(e *models.AuditEvent)
+	}{
+		{"org", func(e *models.AuditEvent) { e.OrgID = 2 }},
+		{"actor", func(e *models.AuditEvent) { e.ActorID = &otherActor }},
+		{"no actor", func(e *models.AuditEvent) { e.ActorID = nil }},
+		{"action", func(e *models.AuditEvent) { e.Action = events.ActionDeleted }},
+		{"entity type", func(e *models.AuditEvent) { e.EntityType = models.EntityCompany }},
+		{"entity id", func(e *models.AuditEvent) { e.EntityID = 4 }},
+		{"request id", func(e *models.AuditEvent) { e.RequestID = &otherRequest }},
+		{"changes", func(e *models.AuditEvent) { e.Changes = json.RawMessage(`{"notes":{"before":"a","after":"c"}}`) }},
+		{"created at", func(e *models.AuditEvent) { e.CreatedAt = "2024-01-31T10:00:00.000000001Z" }},
+		{"previous hash", func(e *models.AuditEvent) { e.PrevHash = "abd" }},
+		// Values must not run together across fields
+		{"shifted text", func(e *models.AuditEvent) { e.Action, e.EntityType = "updatedc", "ontact" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := base
+			tt.change(&e)
+			if Hash(e) == Hash(base) {
+				t.Errorf("changing the %s keeps the hash", tt.name)
+			}
+		})
+	}
+}
+
+// chain stores events 1, 3 and 4 for organization 1 and event 2 for
+// organization 2.
+func chain(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`
+	CREATE TABLE audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		org_id INTEGER NOT NULL,
+		actor_id INTEGER,
+		action TEXT NOT NULL,
+		entity_type TEXT NOT NULL,
+		entity_id INTEGER NOT NULL,
+		request_id TEXT,
+		changes TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	actor := 7
+	for i, orgID := range []int{1, 2, 1, 1} {
+		e := models.AuditEvent{OrgID: orgID, ActorID: &actor, Action: events.ActionUpdated, EntityType: models.EntityContact, EntityID: i + 1}
+		changes := map[string]models.AuditChange{"notes": {Before: "old", After: "new"}}
+		if err := Record(db, e, changes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(t *testing.T, db *sql.DB)
+		valid    bool
+		brokenAt int
+		checked  int
+	}{
+		{name: "untouched", valid: true, checked: 3},
+		{
+			name:     "edited event",
+			tamper:   exec(`UPDATE audit_events SET changes = '{"notes":{"before":"old","after":"forged"}}' WHERE id = 3`),
+			brokenAt: 3, checked: 2,
+		},
+		{
+			name: "edited event with its hash recomputed",
+			tamper: func(t *testing.T, db *sql.DB) {
+				var e models.AuditEvent
+				if err := Scan(db.QueryRow("SELECT "+Columns+" FROM audit_events WHERE id = 3"), &e); err != nil {
+					t.Fatal(err)
+				}
+				e.Changes = json.RawMessage(`{"notes":{"before":"old","after":"forged"}}`)
+				exec("UPDATE audit_events SET changes = ?, hash = ? WHERE id = 3", string(e.Changes), Hash(e))(t, db)
+			},
+			brokenAt: 4, checked: 3,
+		},
+		{name: "removed event", tamper: exec("DELETE FROM audit_events WHERE id = 3"), brokenAt: 4, checked: 2},
+		{name: "removed first event", tamper: exec("DELETE FROM audit_events WHERE id = 1"), brokenAt: 3, checked: 1},
+		{
+			name:     "event moved from another organization",
+			tamper:   exec("UPDATE audit_events SET org_id = 1 WHERE id = 2"),
+			brokenAt: 2, checked: 2,
+		},
+		{
+			name:   "other organization edited",
+			tamper: exec("UPDATE audit_events SET entity_id = 99 WHERE id = 2"),
+			valid:  true, checked: 3,
+		},
+		// The chain cannot tell its newest events were cut off
+		{name: "removed newest event", tamper: exec("DELETE FROM audit_events WHERE id = 4"), valid: true, checked: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := chain(t)
+			if tt.tamper != nil {
+				tt.tamper(t, db)
+			}
+			got, err := Verify(db, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Valid != tt.valid || got.Checked != tt.checked {
+				t.Errorf("Verify = valid %v after %d events, want valid %v after %d", got.Valid, got.Checked, tt.valid, tt.checked)
+			}
+			if tt.valid != (got.BrokenAt == nil) {
+				t.Fatalf("Verify broken at %v, want %d", got.BrokenAt, tt.brokenAt)
+			}
+			if got.BrokenAt != nil && *got.BrokenAt != tt.brokenAt {
+				t.Errorf("Verify broken at %d, want %d", *got.BrokenAt, tt.brokenAt)
+			}
+		})
+	}
+}
+
+func exec(query string, args ...interface{}) func(t *testing.T, db *sql.DB) {
+	return func(t *testing.T, db *sql.DB) {
+		t.Helper()
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordSkipsEmptyUpdates(t *testing.T) {
+	db := chain(t)
+	if err := Record(db, models.AuditEvent{OrgID: 1, Action: events.ActionUpdated, EntityType: models.EntityContact, EntityID: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_events").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("%d events stored, want 4", n)
+	}
+}
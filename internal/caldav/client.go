@@ -0,0 +1,199 @@
+package caldav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed means the server copy changed since we last saw it.
+var ErrPreconditionFailed = errors.New("calendar object changed on server")
+
+// Client talks to a single CalDAV calendar collection using HTTP basic auth.
+type Client struct {
+	CalendarURL string
+	Username    string
+	Password    string
+	HTTP        *http.Client
+}
+
+func NewClient(calendarURL, username, password string) *Client {
+	if !strings.HasSuffix(calendarURL, "/") {
+		calendarURL += "/"
+	}
+	return &Client{
+		CalendarURL: calendarURL,
+		Username:    username,
+		Password:    password,
+		HTTP:        &http.Client{Timeout: time.Minute},
+	}
+}
+
+// RemoteEvent is a calendar object resource as returned by the server.
+type RemoteEvent struct {
+	Href  string
+	ETag  string
+	Event Event
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ETag         string `xml:"getetag"`
+				CalendarData string `xml:"calendar-data"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const calendarQuery = `<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop><D:getetag/><C:calendar-data/></D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+// Events lists every event ending after since.
+func (c *Client) Events(since time.Time) ([]RemoteEvent, error) {
+	body := fmt.Sprintf(calendarQuery, since.UTC().Format("20060102T150405Z"))
+	req, err := c.newRequest("REPORT", c.CalendarURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("calendar query failed: %s", resp.Status)
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid calendar query response: %w", err)
+	}
+
+	var out []RemoteEvent
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstat {
+			if ps.Prop.CalendarData == "" || (ps.Status != "" && !strings.Contains(ps.Status, " 200 ")) {
+				continue
+			}
+			events, err := ParseEvents(ps.Prop.CalendarData)
+			if err != nil || len(events) == 0 {
+				continue
+			}
+			out = append(out, RemoteEvent{
+				Href:  c.resolve(r.Href),
+				ETag:  ps.Prop.ETag,
+				Event: events[0],
+			})
+		}
+	}
+	return out, nil
+}
+
+// Put creates or replaces an event. An empty etag means the object must not exist yet.
+// It returns the object URL and the new ETag when the server reports one.
+func (c *Client) Put(href, etag string, e Event) (string, string, error) {
+	if href == "" {
+		href = c.CalendarURL + url.PathEscape(e.UID) + ".ics"
+	}
+	req, err := c.newRequest(http.MethodPut, href, strings.NewReader(Encode(e)))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	if etag == "" {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return href, resp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed:
+		return "", "", ErrPreconditionFailed
+	default:
+		return "", "", fmt.Errorf("cannot store event: %s", resp.Status)
+	}
+}
+
+// Delete removes an event. A missing object counts as deleted.
+func (c *Client) Delete(href, etag string) error {
+	req, err := c.newRequest(http.MethodDelete, href, nil)
+	if err != nil {
+		return err
+	}
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusGone:
+		return nil
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	default:
+		return fmt.Errorf("cannot delete event: %s", resp.Status)
+	}
+}
+
+func (c *Client) newRequest(method, target string, body io.Reader) (*http.Request, error) {
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	return req, nil
+}
+
+// resolve turns a server-relative href into an absolute URL.
+func (c *Client) resolve(href string) string {
+	base, err := url.Parse(c.CalendarURL)
+	if err != nil {
+		return href
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		return href
+	}
+	return base.ResolveReference(ref).String()
+}
@@ -0,0 +1,274 @@
+package caldav
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// followUpProperty carries an interaction's follow_up_date on the event. Calendar
+// clients ignore unknown X- properties but preserve them on edit.
+const followUpProperty = "X-MICROCRM-FOLLOW-UP"
+
+// Event is the part of a VEVENT that maps onto a meeting interaction.
+type Event struct {
+	UID         string
+	Summary     string
+	Description string
+	Start       time.Time
+	End         time.Time
+	FollowUp    *time.Time
+	Organizer   string
+	Attendees   []string // lower-cased email addresses
+}
+
+// Duration is the event length rounded to whole minutes.
+func (e *Event) Duration() int {
+	if e.End.IsZero() || e.End.Before(e.Start) {
+		return 0
+	}
+	return int(e.End.Sub(e.Start).Round(time.Minute) / time.Minute)
+}
+
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// ParseEvents returns every VEVENT in an iCalendar object. Recurrence overrides
+// (RECURRENCE-ID) are skipped; only the master instance is synced.
+func ParseEvents(data string) ([]Event, error) {
+	var (
+		events  []Event
+		current *Event
+		depth   int // nesting inside the current VEVENT, e.g. VALARM
+		skip    bool
+	)
+	for _, line := range unfold(data) {
+		if line == "" {
+			continue
+		}
+		prop, err := parseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case prop.name == "BEGIN" && prop.value == "VEVENT" && current == nil:
+			current = &Event{}
+			skip = false
+			continue
+		case prop.name == "END" && prop.value == "VEVENT" && current != nil && depth == 0:
+			if !skip && current.UID != "" && !current.Start.IsZero() {
+				if current.End.IsZero() {
+					current.End = current.Start
+				}
+				events = append(events, *current)
+			}
+			current = nil
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if prop.name == "BEGIN" {
+			depth++
+			continue
+		}
+		if prop.name == "END" {
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+
+		switch prop.name {
+		case "UID":
+			current.UID = prop.value
+		case "SUMMARY":
+			current.Summary = unescapeText(prop.value)
+		case "DESCRIPTION":
+			current.Description = unescapeText(prop.value)
+		case "DTSTART":
+			current.Start, err = parseDateTime(prop)
+		case "DTEND":
+			current.End, err = parseDateTime(prop)
+		case "DURATION":
+			if !current.Start.IsZero() {
+				var d time.Duration
+				d, err = parseDuration(prop.value)
+				current.End = current.Start.Add(d)
+			}
+		case "RECURRENCE-ID":
+			skip = true
+		case "ORGANIZER":
+			current.Organizer = mailtoAddress(prop.value)
+		case "ATTENDEE":
+			if addr := mailtoAddress(prop.value); addr != "" {
+				current.Attendees = append(current.Attendees, addr)
+			}
+		case followUpProperty:
+			if t, perr := time.Parse(time.RFC3339, prop.value); perr == nil {
+				current.FollowUp = &t
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %w", current.UID, err)
+		}
+	}
+	return events, nil
+}
+
+// Encode serializes e as a standalone VCALENDAR object.
+func Encode(e Event) string {
+	var b strings.Builder
+	line := func(s string) {
+		// Fold at 75 octets as required by RFC 5545
+		for len(s) > 75 {
+			cut := 75
+			for cut > 0 && s[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			b.WriteString(s[:cut] + "\r\n ")
+			s = s[cut:]
+		}
+		b.WriteString(s + "\r\n")
+	}
+	utc := func(t time.Time) string { return t.UTC().Format("20060102T150405Z") }
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//micro-CRM//CalDAV sync//EN")
+	line("BEGIN:VEVENT")
+	line("UID:" + e.UID)
+	line("DTSTAMP:" + utc(time.Now()))
+	line("DTSTART:" + utc(e.Start))
+	line("DTEND:" + utc(e.End))
+	line("SUMMARY:" + escapeText(e.Summary))
+	if e.Description != "" {
+		line("DESCRIPTION:" + escapeText(e.Description))
+	}
+	if e.Organizer != "" {
+		line("ORGANIZER:mailto:" + e.Organizer)
+	}
+	for _, a := range e.Attendees {
+		line("ATTENDEE;ROLE=REQ-PARTICIPANT:mailto:" + a)
+	}
+	if e.FollowUp != nil {
+		line(followUpProperty + ":" + e.FollowUp.UTC().Format(time.RFC3339))
+	}
+	line("END:VEVENT")
+	line("END:VCALENDAR")
+	return b.String()
+}
+
+func unfold(data string) []string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+	return strings.Split(data, "\n")
+}
+
+func parseProperty(line string) (property, error) {
+	// The value starts after the first colon that is not inside a quoted parameter
+	inQuotes := false
+	colon := -1
+	for i, r := range line {
+		if r == '"' {
+			inQuotes = !inQuotes
+		} else if r == ':' && !inQuotes {
+			colon = i
+			break
+		}
+	}
+	if colon == -1 {
+		return property{}, fmt.Errorf("malformed content line %q", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop := property{
+		name:   strings.ToUpper(parts[0]),
+		params: make(map[string]string),
+		value:  line[colon+1:],
+	}
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			prop.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return prop, nil
+}
+
+func parseDateTime(p property) (time.Time, error) {
+	if p.params["VALUE"] == "DATE" || len(p.value) == 8 {
+		return time.ParseInLocation("20060102", p.value, time.UTC)
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		return time.Parse("20060102T150405Z", p.value)
+	}
+	loc := time.UTC
+	if tzid := p.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation("20060102T150405", p.value, loc)
+}
+
+// parseDuration handles the RFC 5545 subset used for event lengths, e.g. PT1H30M or P1D.
+func parseDuration(s string) (time.Duration, error) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+	}
+	s = strings.TrimLeft(s, "+-")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	var total time.Duration
+	num := 0
+	inTime := false
+	for _, r := range s[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			num = num*10 + int(r-'0')
+		case r == 'T':
+			inTime = true
+		case r == 'W':
+			total += time.Duration(num) * 7 * 24 * time.Hour
+			num = 0
+		case r == 'D':
+			total += time.Duration(num) * 24 * time.Hour
+			num = 0
+		case r == 'H' && inTime:
+			total += time.Duration(num) * time.Hour
+			num = 0
+		case r == 'M' && inTime:
+			total += time.Duration(num) * time.Minute
+			num = 0
+		case r == 'S' && inTime:
+			total += time.Duration(num) * time.Second
+			num = 0
+		default:
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return sign * total, nil
+}
+
+func mailtoAddress(value string) string {
+	if len(value) < 7 || !strings.EqualFold(value[:7], "mailto:") {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(value[7:]))
+}
+
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func unescapeText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\;`, ";", `\,`, ",", `\\`, `\`).Replace(s)
+}
@@ -0,0 +1,567 @@
+package caldav
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syncWindow bounds how far back events are compared. Older meetings are left alone
+// on both sides, which keeps each pass cheap and avoids mass deletes on a bad query.
+const syncWindow = 30 * 24 * time.Hour
+
+// Syncer two-way syncs meeting interactions with each connected calendar.
+//
+// Events whose attendees (or organizer) match a contact become meeting interactions;
+// meetings logged in the CRM are pushed as events. When both sides changed an event
+// since the last pass, the calendar copy wins.
+type Syncer struct {
+	DB       *sql.DB
+	Log      logger.Logger
+	Interval time.Duration
+
+	running sync.Map
+}
+
+func NewSyncer(db *sql.DB, log logger.Logger, interval time.Duration) *Syncer {
+	return &Syncer{
+		DB:       db,
+		Log:      log,
+		Interval: interval,
+	}
+}
+
+// SyncResult counts what one pass changed.
+type SyncResult struct {
+	Imported      int `json:"imported"`
+	UpdatedLocal  int `json:"updated_local"`
+	DeletedLocal  int `json:"deleted_local"`
+	Exported      int `json:"exported"`
+	UpdatedRemote int `json:"updated_remote"`
+	DeletedRemote int `json:"deleted_remote"`
+}
+
+// Run blocks until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.SyncAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncAll runs one pass over every enabled calendar.
+func (s *Syncer) SyncAll() {
+	rows, err := s.DB.Query("SELECT id FROM caldav_accounts WHERE enabled = 1")
+	if err != nil {
+		s.Log.Error("CalDAVSync: cannot list calendars: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := s.SyncAccount(id); err != nil {
+			s.Log.Warn("CalDAVSync: calendar %d: %v", id, err)
+		}
+	}
+}
+
+type calendarAccount struct {
+	id        int
+	userID    int
+	userEmail string
+	client    *Client
+}
+
+// mapping links a calendar object to the interaction it was synced with.
+type mapping struct {
+	id    int
+	uid   string
+	href  string
+	etag  string
+	hash  string
+	local *meeting // nil when the interaction was deleted
+}
+
+type meeting struct {
+	id            int
+	contactID     int
+	subject       string
+	description   string
+	interactionAt time.Time
+	duration      int
+	followUp      *time.Time
+	contactEmail  string
+}
+
+// SyncAccount runs one pass for a calendar and records the outcome on its row.
+func (s *Syncer) SyncAccount(accountID int) (SyncResult, error) {
+	if _, busy := s.running.LoadOrStore(accountID, true); busy {
+		return SyncResult{}, errors.New("sync already in progress")
+	}
+	defer s.running.Delete(accountID)
+
+	var (
+		acc                    calendarAccount
+		calURL, user, password string
+	)
+	err := s.DB.QueryRow(`
+	SELECT a.id, a.user_id, u.email, a.calendar_url, a.username, a.password
+	FROM caldav_accounts a JOIN users u ON u.id = a.user_id
+	WHERE a.id = ?`, accountID,
+	).Scan(&acc.id, &acc.userID, &acc.userEmail, &calURL, &user, &password)
+	if err != nil {
+		return SyncResult{}, fmt.Errorf("cannot load calendar: %w", err)
+	}
+	acc.userEmail = strings.ToLower(acc.userEmail)
+	acc.client = NewClient(calURL, user, password)
+
+	result, syncErr := s.sync(acc)
+
+	var lastError *string
+	if syncErr != nil {
+		msg := syncErr.Error()
+		lastError = &msg
+	}
+	if _, err := s.DB.Exec("UPDATE caldav_accounts SET last_error = ?, last_synced_at = ? WHERE id = ?",
+		lastError, time.Now().Format(time.RFC3339), acc.id); err != nil {
+		s.Log.Error("CalDAVSync: cannot save state for calendar %d: %v", acc.id, err)
+	}
+	return result, syncErr
+}
+
+func (s *Syncer) sync(acc calendarAccount) (SyncResult, error) {
+	var result SyncResult
+	windowStart := time.Now().Add(-syncWindow)
+
+	remote, err := acc.client.Events(windowStart)
+	if err != nil {
+		return result, err
+	}
+	remoteByUID := make(map[string]RemoteEvent, len(remote))
+	for _, r := range remote {
+		remoteByUID[r.Event.UID] = r
+	}
+
+	mappings, err := s.loadMappings(acc)
+	if err != nil {
+		return result, err
+	}
+
+	for _, m := range mappings {
+		r, onServer := remoteByUID[m.uid]
+		delete(remoteByUID, m.uid)
+
+		switch {
+		case m.local == nil:
+			// Deleted in the CRM: remove the event unless someone edited it meanwhile
+			if onServer {
+				// The last-seen ETag makes the server refuse if the event was edited since;
+				// dropping the mapping then lets the next pass re-import it.
+				err := acc.client.Delete(r.Href, m.etag)
+				if err != nil && !errors.Is(err, ErrPreconditionFailed) {
+					return result, err
+				}
+				if err == nil {
+					result.DeletedRemote++
+				}
+			}
+			if err := s.deleteMapping(m.id); err != nil {
+				return result, err
+			}
+
+		case !onServer:
+			// Gone from the calendar. Outside the window we simply can't tell, so leave it.
+			if m.local.interactionAt.Before(windowStart) {
+				continue
+			}
+			// To the trash, from where restoring it exports it again
+			before := s.snapshot(m.local.id)
+			if _, err := s.DB.Exec("UPDATE interactions SET deleted_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND deleted_at IS NULL", m.local.id, acc.userID); err != nil {
+				return result, fmt.Errorf("cannot delete interaction: %w", err)
+			}
+			s.audit(events.ActionDeleted, m.local.id, before)
+			if err := s.deleteMapping(m.id); err != nil {
+				return result, err
+			}
+			result.DeletedLocal++
+
+		default:
+			remoteChanged := m.etag != "" && r.ETag != m.etag
+			localChanged := hashMeeting(m.local) != m.hash
+			switch {
+			case remoteChanged:
+				if err := s.applyRemote(acc, m.local, r.Event); err != nil {
+					return result, err
+				}
+				if err := s.saveMapping(m.id, r.Href, r.ETag, hashMeeting(m.local)); err != nil {
+					return result, err
+				}
+				result.UpdatedLocal++
+			case localChanged:
+				event := eventFromMeeting(m.local, r.Event)
+				href, etag, err := acc.client.Put(r.Href, r.ETag, event)
+				if errors.Is(err, ErrPreconditionFailed) {
+					continue // changed on the server since the query; picked up next pass
+				}
+				if err != nil {
+					return result, err
+				}
+				if err := s.saveMapping(m.id, href, etag, hashMeeting(m.local)); err != nil {
+					return result, err
+				}
+				result.UpdatedRemote++
+			case m.etag == "" || m.href != r.Href:
+				if err := s.saveMapping(m.id, r.Href, r.ETag, m.hash); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+
+	// Events we have never seen: import those involving a contact
+	for _, r := range remoteByUID {
+		imported, err := s.importEvent(acc, r)
+		if err != nil {
+			return result, err
+		}
+		if imported {
+			result.Imported++
+		}
+	}
+
+	exported, err := s.exportMeetings(acc, windowStart)
+	result.Exported = exported
+	return result, err
+}
+
+func (s *Syncer) loadMappings(acc calendarAccount) ([]mapping, error) {
+	rows, err := s.DB.Query(`
+	SELECT m.id, m.uid, m.href, m.etag, m.content_hash,
+		i.id, i.contact_id, i.subject, i.description, i.interaction_at, i.duration, i.follow_up_date, c.email
+	FROM caldav_events m
+	LEFT JOIN interactions i ON i.id = m.interaction_id AND i.deleted_at IS NULL
+	LEFT JOIN contacts c ON c.id = i.contact_id
+	WHERE m.account_id = ?`, acc.id)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load event mappings: %w", err)
+	}
+	defer rows.Close()
+
+	var mappings []mapping
+	for rows.Next() {
+		var (
+			m                                      mapping
+			localID, contactID, duration           sql.NullInt64
+			subject, description, at, followUp, em sql.NullString
+		)
+		if err := rows.Scan(&m.id, &m.uid, &m.href, &m.etag, &m.hash,
+			&localID, &contactID, &subject, &description, &at, &duration, &followUp, &em); err != nil {
+			return nil, err
+		}
+		if localID.Valid {
+			m.local = &meeting{
+				id:            int(localID.Int64),
+				contactID:     int(contactID.Int64),
+				subject:       subject.String,
+				description:   description.String,
+				interactionAt: parseTimestamp(at.String),
+				duration:      int(duration.Int64),
+				contactEmail:  strings.ToLower(em.String),
+			}
+			if followUp.Valid && followUp.String != "" {
+				t := parseTimestamp(followUp.String)
+				m.local.followUp = &t
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, rows.Err()
+}
+
+// applyRemote overwrites the interaction with the calendar copy of the event.
+func (s *Syncer) applyRemote(acc calendarAccount, local *meeting, e Event) error {
+	local.subject = e.Summary
+	local.description = e.Description
+	local.interactionAt = e.Start
+	local.duration = e.Duration()
+	local.followUp = e.FollowUp
+
+	before := s.snapshot(local.id)
+	_, err := s.DB.Exec(`
+	UPDATE interactions SET subject = ?, description = ?, interaction_at = ?, duration = ?, follow_up_date = ?
+	WHERE id = ? AND user_id = ?`,
+		local.subject, local.description, formatTimestamp(local.interactionAt), local.duration,
+		formatOptional(local.followUp), local.id, acc.userID,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot update interaction: %w", err)
+	}
+	s.audit(events.ActionUpdated, local.id, before)
+	return nil
+}
+
+// snapshot loads an interaction before the sync changes it, for audit. A failure
+// is logged and audits the change without the previous values.
+func (s *Syncer) snapshot(id int) map[string]interface{} {
+	record, err := audit.Snapshot(s.DB, models.EntityInteraction, id)
+	if err != nil {
+		s.Log.Error("CalDAVSync: cannot load interaction %d for audit: %v", id, err)
+	}
+	return record
+}
+
+// audit records a change the sync made to an interaction, with no actor. The
+// change is already saved, so a failure is logged.
+func (s *Syncer) audit(action string, id int, before map[string]interface{}) {
+	if err := audit.Track(s.DB, 0, 0, "", action, models.EntityInteraction, id, before); err != nil {
+		s.Log.Error("CalDAVSync: cannot audit interaction %d: %v", id, err)
+	}
+}
+
+func (s *Syncer) importEvent(acc calendarAccount, r RemoteEvent) (bool, error) {
+	contactID, err := s.matchContact(acc, r.Event)
+	if err != nil || contactID == 0 {
+		return false, err
+	}
+
+	e := r.Event
+	subject := e.Summary
+	if subject == "" {
+		subject = "(no title)"
+	}
+	local := &meeting{
+		contactID:     contactID,
+		subject:       subject,
+		description:   e.Description,
+		interactionAt: e.Start,
+		duration:      e.Duration(),
+		followUp:      e.FollowUp,
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+	INSERT INTO interactions (user_id, contact_id, type, subject, description, interaction_at, duration, follow_up, follow_up_date)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		acc.userID, contactID, models.InteractionTypeMeeting, local.subject, local.description,
+		formatTimestamp(local.interactionAt), local.duration, boolToInt(local.followUp != nil), formatOptional(local.followUp),
+	)
+	if err != nil {
+		return false, fmt.Errorf("cannot insert interaction: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	local.id = int(id)
+
+	if _, err := tx.Exec(`
+	INSERT INTO caldav_events (account_id, interaction_id, uid, href, etag, content_hash) VALUES (?, ?, ?, ?, ?, ?)`,
+		acc.id, local.id, e.UID, r.Href, r.ETag, hashMeeting(local),
+	); err != nil {
+		return false, fmt.Errorf("cannot record event mapping: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	s.audit(events.ActionCreated, local.id, nil)
+	return true, nil
+}
+
+// matchContact returns the first attendee (then organizer) that is one of the contacts
+// of the user's organization.
+func (s *Syncer) matchContact(acc calendarAccount, e Event) (int, error) {
+	candidates := append(append([]string{}, e.Attendees...), e.Organizer)
+	for _, addr := range candidates {
+		if addr == "" || addr == acc.userEmail {
+			continue
+		}
+		var id int
+		err := s.DB.QueryRow("SELECT id FROM contacts WHERE org_id = (SELECT org_id FROM users WHERE id = ?) AND deleted_at IS NULL AND LOWER(email) = ? ORDER BY id LIMIT 1", acc.userID, addr).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot match attendee: %w", err)
+		}
+		return id, nil
+	}
+	return 0, nil
+}
+
+// exportMeetings pushes meetings logged in the CRM that this calendar has not seen yet.
+func (s *Syncer) exportMeetings(acc calendarAccount, windowStart time.Time) (int, error) {
+	rows, err := s.DB.Query(`
+	SELECT i.id, i.contact_id, i.subject, i.description, i.interaction_at, COALESCE(i.duration, 0), i.follow_up_date, c.email
+	FROM interactions i
+	JOIN contacts c ON c.id = i.contact_id
+	WHERE i.user_id = ? AND i.deleted_at IS NULL AND LOWER(i.type) = LOWER(?)
+		AND NOT EXISTS (SELECT 1 FROM caldav_events m WHERE m.account_id = ? AND m.interaction_id = i.id)`,
+		acc.userID, models.InteractionTypeMeeting, acc.id)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list meetings: %w", err)
+	}
+	var pending []*meeting
+	for rows.Next() {
+		var (
+			m                         meeting
+			description, followUp, em sql.NullString
+			at                        string
+		)
+		if err := rows.Scan(&m.id, &m.contactID, &m.subject, &description, &at, &m.duration, &followUp, &em); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		m.description = description.String
+		m.interactionAt = parseTimestamp(at)
+		m.contactEmail = strings.ToLower(em.String)
+		if followUp.Valid && followUp.String != "" {
+			t := parseTimestamp(followUp.String)
+			m.followUp = &t
+		}
+		if !m.interactionAt.Before(windowStart) {
+			pending = append(pending, &m)
+		}
+	}
+	rows.Close()
+
+	exported := 0
+	for _, m := range pending {
+		event := eventFromMeeting(m, Event{UID: newUID(m.id), Organizer: acc.userEmail})
+		href, etag, err := acc.client.Put("", "", event)
+		if err != nil {
+			return exported, err
+		}
+		if _, err := s.DB.Exec(`
+		INSERT INTO caldav_events (account_id, interaction_id, uid, href, etag, content_hash) VALUES (?, ?, ?, ?, ?, ?)`,
+			acc.id, m.id, event.UID, href, etag, hashMeeting(m),
+		); err != nil {
+			return exported, fmt.Errorf("cannot record event mapping: %w", err)
+		}
+		exported++
+	}
+	return exported, nil
+}
+
+func (s *Syncer) saveMapping(id int, href, etag, hash string) error {
+	_, err := s.DB.Exec("UPDATE caldav_events SET href = ?, etag = ?, content_hash = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", href, etag, hash, id)
+	if err != nil {
+		return fmt.Errorf("cannot update event mapping: %w", err)
+	}
+	return nil
+}
+
+func (s *Syncer) deleteMapping(id int) error {
+	if _, err := s.DB.Exec("DELETE FROM caldav_events WHERE id = ?", id); err != nil {
+		return fmt.Errorf("cannot delete event mapping: %w", err)
+	}
+	return nil
+}
+
+// eventFromMeeting builds the event for m, keeping the UID and people of base.
+func eventFromMeeting(m *meeting, base Event) Event {
+	e := base
+	e.Summary = m.subject
+	e.Description = m.description
+	e.Start = m.interactionAt
+	e.End = m.interactionAt.Add(time.Duration(m.duration) * time.Minute)
+	e.FollowUp = m.followUp
+	if m.contactEmail != "" && !containsString(e.Attendees, m.contactEmail) {
+		e.Attendees = append(e.Attendees, m.contactEmail)
+	}
+	return e
+}
+
+// hashMeeting fingerprints the synced fields so local edits can be detected without
+// an updated_at column on interactions.
+func hashMeeting(m *meeting) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%s",
+		m.subject, m.description, m.interactionAt.Unix(), m.duration, formatOptionalString(m.followUp))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newUID(interactionID int) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("micro-crm-%d-%s", interactionID, hex.EncodeToString(b))
+}
+
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+func parseTimestamp(s string) time.Time {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// formatTimestamp stores times in UTC in the form of CURRENT_TIMESTAMP, so synced
+// interactions sort with the others.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func formatOptional(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := formatTimestamp(*t)
+	return &s
+}
+
+func formatOptionalString(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
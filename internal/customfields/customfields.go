@@ -0,0 +1,418 @@
+// Package customfields keeps the fields an organization defines on top of the
+// built-in ones of contacts, companies, tasks and deals: their definitions,
+// the validation and storage of their values, and list filters and sorting.
+package customfields
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"micro-CRM/internal/models"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxTextLength bounds text values.
+const MaxTextLength = 2000
+
+// DateLayout is the format of date values.
+const DateLayout = "2006-01-02"
+
+// ParamPrefix starts the list query parameters that filter on a custom field:
+// cf.<key>=<value> matches a value (an option of a multi-select), and
+// cf.<key>.min and cf.<key>.max bound numbers and dates, inclusive. The sort
+// parameter takes cf.<key>, or -cf.<key> for descending.
+const ParamPrefix = "cf."
+
+// Tables maps the record types that have custom fields to their table.
+var Tables = map[string]string{
+	models.EntityCompany: "companies",
+	models.EntityContact: "contacts",
+	models.EntityTask:    "tasks",
+	models.EntityDeal:    "deals",
+}
+
+// Types lists the field types.
+var Types = []string{
+	models.CustomFieldText, models.CustomFieldNumber, models.CustomFieldDate,
+	models.CustomFieldSelect, models.CustomFieldMultiSelect, models.CustomFieldBoolean,
+}
+
+var keyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// Columns are the custom_fields columns in the order Scan reads them.
+const Columns = `id, org_id, entity_type, field_key, label, field_type, options, required, position, created_at, updated_at`
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Scan reads a row selected with Columns.
+func Scan(row interface{ Scan(...interface{}) error }, f *models.CustomField) error {
+	var options sql.NullString
+	if err := row.Scan(&f.ID, &f.OrgID, &f.EntityType, &f.Key, &f.Label, &f.Type, &options, &f.Required, &f.Position, &f.CreatedAt, &f.UpdatedAt); err != nil {
+		return err
+	}
+	f.Options = nil
+	if options.Valid {
+		return json.Unmarshal([]byte(options.String), &f.Options)
+	}
+	return nil
+}
+
+// Validate normalizes a field definition and returns a client-facing message
+// when it is invalid.
+func Validate(f *models.CustomField) string {
+	if _, ok := Tables[f.EntityType]; !ok {
+		return "entity_type must be company, contact, task or deal"
+	}
+	f.Key = strings.TrimSpace(f.Key)
+	if !keyPattern.MatchString(f.Key) {
+		return "key must start with a lowercase letter and hold at most 50 lowercase letters, digits and underscores"
+	}
+	f.Label = strings.TrimSpace(f.Label)
+	if f.Label == "" {
+		return "label is required"
+	}
+	if !slices.Contains(Types, f.Type) {
+		return "type must be one of " + strings.Join(Types, ", ")
+	}
+	if f.Type != models.CustomFieldSelect && f.Type != models.CustomFieldMultiSelect {
+		if len(f.Options) > 0 {
+			return "options are only for select and multi_select fields"
+		}
+		f.Options = nil
+		return ""
+	}
+	if len(f.Options) == 0 {
+		return "options are required for select and multi_select fields"
+	}
+	for i, option := range f.Options {
+		f.Options[i] = strings.TrimSpace(option)
+		if f.Options[i] == "" {
+			return "options cannot be empty"
+		}
+		if slices.Contains(f.Options[:i], f.Options[i]) {
+			return "Duplicate option " + strconv.Quote(f.Options[i])
+		}
+	}
+	return ""
+}
+
+// EncodeOptions returns the stored form of a definition's options.
+func EncodeOptions(f models.CustomField) (interface{}, error) {
+	if f.Options == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(f.Options)
+	return string(b), err
+}
+
+// Definitions returns the organization's fields for entityType in display order.
+func Definitions(q Querier, orgID int, entityType string) ([]models.CustomField, error) {
+	rows, err := q.Query("SELECT "+Columns+" FROM custom_fields WHERE org_id = ? AND entity_type = ? ORDER BY position, id", orgID, entityType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fields []models.CustomField
+	for rows.Next() {
+		var f models.CustomField
+		if err := Scan(rows, &f); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+func find(fields []models.CustomField, key string) (models.CustomField, bool) {
+	for _, f := range fields {
+		if f.Key == key {
+			return f, true
+		}
+	}
+	return models.CustomField{}, false
+}
+
+// Value is a validated value of one field; a nil Stored clears it.
+type Value struct {
+	FieldID int
+	Stored  interface{}
+}
+
+// Parse validates the custom_fields of a record payload against the fields of
+// its type. A null value clears a field. When creating, every required field
+// needs a value; on updates, fields left out of the payload keep theirs. The
+// error is client-facing.
+func Parse(fields []models.CustomField, input map[string]interface{}, creating bool) ([]Value, error) {
+	var values []Value
+	for key, raw := range input {
+		f, ok := find(fields, key)
+		if !ok {
+			return nil, fmt.Errorf("unknown custom field %q", key)
+		}
+		if raw == nil {
+			if f.Required {
+				return nil, fmt.Errorf("custom field %q is required", key)
+			}
+			values = append(values, Value{FieldID: f.ID})
+			continue
+		}
+		stored, err := encode(f, raw)
+		if err != nil {
+			return nil, fmt.Errorf("custom field %q %v", key, err)
+		}
+		values = append(values, Value{FieldID: f.ID, Stored: stored})
+	}
+	if creating {
+		for _, f := range fields {
+			if f.Required && input[f.Key] == nil {
+				return nil, fmt.Errorf("custom field %q is required", f.Key)
+			}
+		}
+	}
+	return values, nil
+}
+
+// encode validates a JSON value for a field and returns its stored form:
+// numbers as REAL, booleans as 0 or 1, multi-selects as a JSON array in
+// option order and everything else as text.
+func encode(f models.CustomField, raw interface{}) (interface{}, error) {
+	switch f.Type {
+	case models.CustomFieldText:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a string")
+		}
+		if len(s) > MaxTextLength {
+			return nil, fmt.Errorf("must be at most %d bytes", MaxTextLength)
+		}
+		return s, nil
+	case models.CustomFieldNumber:
+		n, ok := raw.(float64)
+		if !ok {
+			return nil, fmt.Errorf("must be a number")
+		}
+		return n, nil
+	case models.CustomFieldDate:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("must be a date formatted as YYYY-MM-DD")
+		}
+		if _, err := time.Parse(DateLayout, s); err != nil {
+			return nil, fmt.Errorf("must be a date formatted as YYYY-MM-DD")
+		}
+		return s, nil
+	case models.CustomFieldSelect:
+		s, ok := raw.(string)
+		if !ok || !slices.Contains(f.Options, s) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(f.Options, ", "))
+		}
+		return s, nil
+	case models.CustomFieldMultiSelect:
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("must be a list of options")
+		}
+		chosen := make(map[string]bool, len(list))
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok || !slices.Contains(f.Options, s) {
+				return nil, fmt.Errorf("options must be among %s", strings.Join(f.Options, ", "))
+			}
+			chosen[s] = true
+		}
+		selected := []string{}
+		for _, option := range f.Options {
+			if chosen[option] {
+				selected = append(selected, option)
+			}
+		}
+		b, err := json.Marshal(selected)
+		return string(b), err
+	case models.CustomFieldBoolean:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("must be true or false")
+		}
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return nil, fmt.Errorf("has an unknown type")
+}
+
+// decode turns a stored value back into its JSON form.
+func decode(fieldType string, stored interface{}) interface{} {
+	switch fieldType {
+	case models.CustomFieldNumber:
+		switch n := stored.(type) {
+		case int64:
+			return float64(n)
+		case float64:
+			return n
+		}
+	case models.CustomFieldBoolean:
+		n, _ := stored.(int64)
+		return n != 0
+	case models.CustomFieldMultiSelect:
+		var selected []string
+		if s, ok := stored.(string); ok && json.Unmarshal([]byte(s), &selected) == nil {
+			return selected
+		}
+		return []string{}
+	}
+	if b, ok := stored.([]byte); ok {
+		return string(b)
+	}
+	return stored
+}
+
+// Save stores a record's values, replacing those of the same fields.
+func Save(q Querier, entityType string, entityID int, values []Value) error {
+	for _, v := range values {
+		var err error
+		if v.Stored == nil {
+			_, err = q.Exec("DELETE FROM custom_field_values WHERE field_id = ? AND entity_id = ?", v.FieldID, entityID)
+		} else {
+			_, err = q.Exec(`
+			INSERT INTO custom_field_values (field_id, entity_type, entity_id, value) VALUES (?, ?, ?, ?)
+			ON CONFLICT (field_id, entity_id) DO UPDATE SET value = excluded.value`, v.FieldID, entityType, entityID, v.Stored)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load returns the custom field values of the records of entityType with the
+// given ids, by record id and then field key. Records without values get an
+// empty map.
+func Load(q Querier, entityType string, ids []int) (map[int]map[string]interface{}, error) {
+	byRecord := make(map[int]map[string]interface{}, len(ids))
+	if len(ids) == 0 {
+		return byRecord, nil
+	}
+	args := []interface{}{entityType}
+	for _, id := range ids {
+		byRecord[id] = map[string]interface{}{}
+		args = append(args, id)
+	}
+	rows, err := q.Query(`
+	SELECT v.entity_id, f.field_key, f.field_type, v.value
+	FROM custom_field_values v JOIN custom_fields f ON f.id = v.field_id
+	WHERE v.entity_type = ? AND v.entity_id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			entityID       int
+			key, fieldType string
+			stored         interface{}
+		)
+		if err := rows.Scan(&entityID, &key, &fieldType, &stored); err != nil {
+			return nil, err
+		}
+		byRecord[entityID][key] = decode(fieldType, stored)
+	}
+	return byRecord, rows.Err()
+}
+
+// Query turns the custom field parameters of a list request into a condition
+// to AND to the query, keeping the records whose column is the id of a record
+// matching every filter, and an ORDER BY expression for the sort parameter,
+// "" without one. Records without a value sort last. Parameters that do not
+// start with ParamPrefix are ignored; the error is client-facing.
+func Query(fields []models.CustomField, column string, params url.Values) (filter string, args []interface{}, order string, orderArgs []interface{}, err error) {
+	for param, values := range params {
+		if !strings.HasPrefix(param, ParamPrefix) {
+			continue
+		}
+		key, bound, _ := strings.Cut(strings.TrimPrefix(param, ParamPrefix), ".")
+		f, ok := find(fields, key)
+		if !ok {
+			return "", nil, "", nil, fmt.Errorf("unknown custom field %q", key)
+		}
+		for _, value := range values {
+			condition, arg, err := condition(f, bound, value)
+			if err != nil {
+				return "", nil, "", nil, fmt.Errorf("invalid %s parameter: %v", param, err)
+			}
+			filter += " AND " + column + " IN (SELECT entity_id FROM custom_field_values WHERE field_id = ? AND " + condition + ")"
+			args = append(args, f.ID, arg)
+		}
+	}
+
+	sort := params.Get("sort")
+	if sort == "" {
+		return filter, args, "", nil, nil
+	}
+	direction := "ASC"
+	if strings.HasPrefix(sort, "-") {
+		direction, sort = "DESC", sort[1:]
+	}
+	if !strings.HasPrefix(sort, ParamPrefix) {
+		return "", nil, "", nil, fmt.Errorf("sort must be %s<key> or -%s<key>", ParamPrefix, ParamPrefix)
+	}
+	f, ok := find(fields, strings.TrimPrefix(sort, ParamPrefix))
+	if !ok {
+		return "", nil, "", nil, fmt.Errorf("unknown custom field %q", strings.TrimPrefix(sort, ParamPrefix))
+	}
+	value := "(SELECT value FROM custom_field_values WHERE field_id = ? AND entity_id = " + column + ")"
+	return filter, args, value + " IS NULL, " + value + " " + direction, []interface{}{f.ID, f.ID}, nil
+}
+
+// condition returns the SQL condition on a stored value for one filter
+// parameter, with its argument.
+func condition(f models.CustomField, bound, value string) (string, interface{}, error) {
+	switch bound {
+	case "":
+	case "min", "max":
+		if f.Type != models.CustomFieldNumber && f.Type != models.CustomFieldDate {
+			return "", nil, fmt.Errorf("only number and date fields take bounds")
+		}
+	default:
+		return "", nil, fmt.Errorf("use %s<key>, %s<key>.min or %s<key>.max", ParamPrefix, ParamPrefix, ParamPrefix)
+	}
+	var raw interface{} = value
+	switch f.Type {
+	case models.CustomFieldNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("must be a number")
+		}
+		raw = n
+	case models.CustomFieldBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("must be true or false")
+		}
+		raw = b
+	case models.CustomFieldMultiSelect:
+		// Matches records having this option among others
+		return "EXISTS (SELECT 1 FROM json_each(custom_field_values.value) option WHERE option.value = ?)", value, nil
+	}
+	stored, err := encode(models.CustomField{Type: f.Type, Options: f.Options}, raw)
+	if err != nil {
+		return "", nil, err
+	}
+	switch bound {
+	case "min":
+		return "value >= ?", stored, nil
+	case "max":
+		return "value <= ?", stored, nil
+	}
+	return "value = ?", stored, nil
+}
@@ -29,7 +29,8 @@ func (dm *DBManager) Connect() error {
 		log.Println("No database found. Creating database...")
 	}
 	log.Println("Connecting to Database")
-	db, err := sql.Open("sqlite", dm.path)
+	// Pragmas in the DSN apply to every pooled connection, not just the first
+	db, err := sql.Open("sqlite", dm.path+"?_pragma=foreign_keys(1)")
 	if err != nil {
 
 		return fmt.Errorf("failed to open database connection: %w", err)
@@ -70,12 +71,22 @@ func (dm *DBManager) ApplyMigrations() error {
 	if err != nil {
 		return fmt.Errorf("failed to apply migrations: %w", err)
 	}
-	log.Println("Database migrations applied successfully.")
-	_, err = dm.DB.Exec("PRAGMA foreign_keys = ON;")
-	if err != nil {
-		return fmt.Errorf("failed to enable foreign keys: %w", err)
+	if err := addMissingColumns(dm.DB); err != nil {
+		return fmt.Errorf("failed to apply column migrations: %w", err)
+	}
+	if err := migrateOrganizations(dm.DB); err != nil {
+		return fmt.Errorf("failed to migrate organizations: %w", err)
+	}
+	if err := migratePipelineNames(dm.DB); err != nil {
+		return fmt.Errorf("failed to migrate pipeline names: %w", err)
 	}
-	log.Println("Foreign keys enabled for connection.")
+	if err := migrateEmailMessages(dm.DB); err != nil {
+		return fmt.Errorf("failed to migrate email messages: %w", err)
+	}
+	if err := migratePipelineStages(dm.DB); err != nil {
+		return fmt.Errorf("failed to migrate pipeline stages: %w", err)
+	}
+	log.Println("Database migrations applied successfully.")
 
 	return nil
 }
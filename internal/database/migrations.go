@@ -1,6 +1,15 @@
 package database
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/orgs"
+	"micro-CRM/internal/pipelines"
+	"strings"
+
 	_ "modernc.org/sqlite" // Ensure the driver is imported here too
 )
 
@@ -19,7 +28,9 @@ CREATE TABLE IF NOT EXISTS users (
 	status TEXT DEFAULT 'active',
     last_name TEXT,
     created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
-    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id),
+    org_role TEXT NOT NULL DEFAULT 'member' -- 'owner', 'admin' or 'member'
 );
 
 -- Table: companies
@@ -36,6 +47,8 @@ CREATE TABLE IF NOT EXISTS companies (
     created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
     pipeline_stage TEXT DEFAULT 'Lead',
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );
 CREATE INDEX IF NOT EXISTS idx_companies_user_id ON companies(user_id);
@@ -58,6 +71,8 @@ CREATE TABLE IF NOT EXISTS contacts (
     next_action_at TEXT,
     next_action_description TEXT,
     pipeline_stage TEXT DEFAULT 'Lead',
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE SET NULL
 );
@@ -80,6 +95,8 @@ CREATE TABLE IF NOT EXISTS interactions (
     interaction_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	follow_up_date TEXT,
     created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE
 );
@@ -99,8 +116,20 @@ CREATE TABLE IF NOT EXISTS tasks (
     priority TEXT DEFAULT 'Medium', -- e.g., 'Low', 'Medium', 'High'
     created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    series_id INTEGER, -- NULL unless the task is an occurrence of a recurring series
+    occurrence INTEGER,
+    parent_id INTEGER, -- NULL for top-level tasks
+    assignee_id INTEGER, -- NULL when the creator works on it
+    assigned_by INTEGER,
+    assigned_at TEXT,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
-    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE SET NULL
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE SET NULL,
+    FOREIGN KEY (series_id) REFERENCES task_series(id) ON DELETE SET NULL,
+    FOREIGN KEY (parent_id) REFERENCES tasks(id) ON DELETE CASCADE,
+    FOREIGN KEY (assignee_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (assigned_by) REFERENCES users(id) ON DELETE SET NULL
 );
 CREATE INDEX IF NOT EXISTS idx_tasks_user_id ON tasks(user_id);
 CREATE INDEX IF NOT EXISTS idx_tasks_contact_id ON tasks(contact_id);
@@ -119,6 +148,8 @@ CREATE TABLE IF NOT EXISTS files (
     file_type TEXT, -- MIME type
     file_size INTEGER, -- In bytes
     uploaded_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
     FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE SET NULL,
     FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE SET NULL
@@ -127,6 +158,544 @@ CREATE INDEX IF NOT EXISTS idx_files_user_id ON files(user_id);
 CREATE INDEX IF NOT EXISTS idx_files_contact_id ON files(contact_id);
 CREATE INDEX IF NOT EXISTS idx_files_company_id ON files(company_id);
 
+-- Table: email_messages
+-- Maps ingested mail to the interactions created from it so re-delivery is a no-op
+CREATE TABLE IF NOT EXISTS email_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    contact_id INTEGER NOT NULL,
+    message_id TEXT NOT NULL,
+    interaction_id INTEGER NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    UNIQUE (org_id, contact_id, message_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE,
+    FOREIGN KEY (interaction_id) REFERENCES interactions(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_email_messages_interaction_id ON email_messages(interaction_id);
+
+-- Table: imap_accounts
+-- Mailboxes polled for mail exchanged with contacts; uid_validity/last_uid track sync progress
+CREATE TABLE IF NOT EXISTS imap_accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    host TEXT NOT NULL,
+    port INTEGER NOT NULL DEFAULT 993,
+    username TEXT NOT NULL,
+    password TEXT NOT NULL,
+    mailbox TEXT NOT NULL DEFAULT 'INBOX',
+    use_tls INTEGER NOT NULL DEFAULT 1,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    uid_validity INTEGER NOT NULL DEFAULT 0,
+    last_uid INTEGER NOT NULL DEFAULT 0,
+    last_synced_at TEXT,
+    last_error TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_imap_accounts_user_id ON imap_accounts(user_id);
+
+-- Table: email_templates
+CREATE TABLE IF NOT EXISTS email_templates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_email_templates_user_id ON email_templates(user_id);
+
+-- Table: outbox
+-- Outgoing mail; next_attempt_at is RFC3339 UTC so it sorts and compares as text
+CREATE TABLE IF NOT EXISTS outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    contact_id INTEGER NOT NULL,
+    template_id INTEGER,
+    to_address TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    message_id TEXT NOT NULL UNIQUE,
+    status TEXT NOT NULL DEFAULT 'queued', -- 'queued', 'sending', 'sent', 'failed', 'cancelled'
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    send_at TEXT NOT NULL,
+    next_attempt_at TEXT NOT NULL,
+    sent_at TEXT,
+    interaction_id INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE,
+    FOREIGN KEY (template_id) REFERENCES email_templates(id) ON DELETE SET NULL,
+    FOREIGN KEY (interaction_id) REFERENCES interactions(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_user_id ON outbox(user_id);
+CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox(status, next_attempt_at);
+
+-- Table: pipelines
+CREATE TABLE IF NOT EXISTS pipelines (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    is_default INTEGER NOT NULL DEFAULT 0,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    UNIQUE (org_id, name),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_pipelines_user_id ON pipelines(user_id);
+
+-- Table: pipeline_stages
+-- outcome is 'open', 'won' or 'lost'; probability is the default for deals entering the stage
+CREATE TABLE IF NOT EXISTS pipeline_stages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    pipeline_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    color TEXT NOT NULL DEFAULT '#999999',
+    probability INTEGER NOT NULL DEFAULT 0,
+    outcome TEXT NOT NULL DEFAULT 'open',
+    UNIQUE (pipeline_id, name),
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id) ON DELETE CASCADE
+);
+
+-- Table: stage_transitions
+-- Pipeline stage history of companies, contacts and deals; changed_by is the acting user
+CREATE TABLE IF NOT EXISTS stage_transitions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    pipeline_id INTEGER,
+    from_stage TEXT,
+    to_stage TEXT NOT NULL,
+    changed_by INTEGER NOT NULL,
+    changed_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_stage_transitions_entity ON stage_transitions(entity_type, entity_id, changed_at);
+CREATE INDEX IF NOT EXISTS idx_stage_transitions_pipeline ON stage_transitions(pipeline_id, changed_at);
+
+-- Table: deals
+-- user_id is the deal owner; probability is a percentage used for the weighted pipeline value
+CREATE TABLE IF NOT EXISTS deals (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    company_id INTEGER,
+    pipeline_id INTEGER REFERENCES pipelines(id) ON DELETE SET NULL,
+    title TEXT NOT NULL,
+    amount REAL NOT NULL DEFAULT 0,
+    currency TEXT NOT NULL DEFAULT 'USD',
+    stage TEXT NOT NULL DEFAULT 'Lead',
+    probability INTEGER NOT NULL DEFAULT 0,
+    expected_close_date TEXT,
+    notes TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    org_id INTEGER REFERENCES organizations(id), -- Filled from the creator's organization on insert
+    deleted_at TEXT, -- Set while the record is in the trash
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_deals_user_id ON deals(user_id);
+CREATE INDEX IF NOT EXISTS idx_deals_company_id ON deals(company_id);
+CREATE INDEX IF NOT EXISTS idx_deals_stage ON deals(stage);
+
+-- Table: deal_contacts
+CREATE TABLE IF NOT EXISTS deal_contacts (
+    deal_id INTEGER NOT NULL,
+    contact_id INTEGER NOT NULL,
+    PRIMARY KEY (deal_id, contact_id),
+    FOREIGN KEY (deal_id) REFERENCES deals(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_deal_contacts_contact_id ON deal_contacts(contact_id);
+
+-- Table: caldav_accounts
+CREATE TABLE IF NOT EXISTS caldav_accounts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    calendar_url TEXT NOT NULL,
+    username TEXT NOT NULL,
+    password TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    last_synced_at TEXT,
+    last_error TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_caldav_accounts_user_id ON caldav_accounts(user_id);
+
+-- Table: caldav_events
+-- Links calendar objects to meeting interactions; interaction_id goes NULL when the
+-- interaction is deleted so the next sync can remove the event too
+CREATE TABLE IF NOT EXISTS caldav_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    account_id INTEGER NOT NULL,
+    interaction_id INTEGER,
+    uid TEXT NOT NULL,
+    href TEXT NOT NULL,
+    etag TEXT NOT NULL DEFAULT '',
+    content_hash TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (account_id, uid),
+    FOREIGN KEY (account_id) REFERENCES caldav_accounts(id) ON DELETE CASCADE,
+    FOREIGN KEY (interaction_id) REFERENCES interactions(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_caldav_events_interaction_id ON caldav_events(interaction_id);
+
+-- Table: task_series
+-- A recurring task: the rule, the first due date the occurrences are computed
+-- from, and the template the next occurrence is created from
+CREATE TABLE IF NOT EXISTS task_series (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    rrule TEXT NOT NULL,
+    dtstart TEXT NOT NULL,
+    contact_id INTEGER,
+    title TEXT NOT NULL,
+    description TEXT,
+    priority TEXT DEFAULT 'Medium',
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_task_series_user_id ON task_series(user_id);
+
+-- Table: scheduled_jobs
+-- State of background jobs; locked_by/locked_until is the lease of a running job
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+    name TEXT PRIMARY KEY,
+    schedule TEXT NOT NULL,
+    next_run_at TEXT NOT NULL,
+    last_run_at TEXT,
+    last_duration_ms INTEGER,
+    last_status TEXT,
+    last_error TEXT,
+    run_count INTEGER NOT NULL DEFAULT 0,
+    locked_by TEXT,
+    locked_until TEXT
+);
+
+-- Table: reminders_sent
+-- One row per reminder delivered, so each is sent once per due time; moving the
+-- due time makes the record eligible again
+CREATE TABLE IF NOT EXISTS reminders_sent (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    kind TEXT NOT NULL, -- 'upcoming' or 'overdue'
+    due_at TEXT NOT NULL,
+    sent_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (entity_type, entity_id, kind, due_at),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Table: notifications
+-- In-app inbox; entity_type/entity_id point at the record the event is about
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT,
+    entity_type TEXT,
+    entity_id INTEGER,
+    actor_id INTEGER,
+    read_at TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON notifications(user_id, read_at);
+
+-- Table: notification_preferences
+-- Only opt-outs need a row; every event type is generated by default
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Table: events
+-- Record changes streamed to clients; kept for a week so reconnecting clients can resume
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    data TEXT NOT NULL,
+    created_at TEXT NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_events_user_id ON events(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_events_created_at ON events(created_at);
+
+-- Table: webhooks
+-- events is a comma separated list of event types, or '*'
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    failure_count INTEGER NOT NULL DEFAULT 0,
+    disabled_reason TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks(user_id);
+
+-- Table: webhook_deliveries
+-- The payload is fixed when the event happens so retries send the same body
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    event_id INTEGER NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- 'pending', 'delivering', 'succeeded', 'failed'
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_status INTEGER,
+    response_body TEXT,
+    last_error TEXT,
+    duration_ms INTEGER,
+    next_attempt_at TEXT NOT NULL,
+    delivered_at TEXT,
+    redelivery_of INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+
+-- Table: task_checklist_items
+CREATE TABLE IF NOT EXISTS task_checklist_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    done INTEGER NOT NULL DEFAULT 0,
+    position INTEGER NOT NULL,
+    FOREIGN KEY (task_id) REFERENCES tasks(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_task_checklist_items_task_id ON task_checklist_items(task_id, position);
+
+-- Table: task_dependencies
+-- task_id cannot be worked on until blocked_by_id is done
+CREATE TABLE IF NOT EXISTS task_dependencies (
+    task_id INTEGER NOT NULL,
+    blocked_by_id INTEGER NOT NULL,
+    PRIMARY KEY (task_id, blocked_by_id),
+    FOREIGN KEY (task_id) REFERENCES tasks(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_by_id) REFERENCES tasks(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_task_dependencies_blocked_by_id ON task_dependencies(blocked_by_id);
+
+-- Table: organizations
+-- Members are the users whose org_id points here
+CREATE TABLE IF NOT EXISTS organizations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: organization_invitations
+CREATE TABLE IF NOT EXISTS organization_invitations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER NOT NULL,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member',
+    token TEXT NOT NULL UNIQUE,
+    invited_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TEXT NOT NULL,
+    accepted_at TEXT,
+    FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_organization_invitations_org_id ON organization_invitations(org_id);
+CREATE INDEX IF NOT EXISTS idx_organization_invitations_email ON organization_invitations(email);
+
+-- Table: record_shares
+-- Exactly one of user_id and org_id names the grantee
+CREATE TABLE IF NOT EXISTS record_shares (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity_type TEXT NOT NULL, -- 'company', 'contact', 'deal' or 'file'
+    entity_id INTEGER NOT NULL,
+    user_id INTEGER,
+    org_id INTEGER,
+    permission TEXT NOT NULL DEFAULT 'read', -- 'read' or 'write'
+    granted_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (granted_by) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_record_shares_entity ON record_shares(entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_record_shares_user_id ON record_shares(user_id, entity_type);
+CREATE INDEX IF NOT EXISTS idx_record_shares_org_id ON record_shares(org_id, entity_type);
+
+-- Table: audit_events
+-- Append-only; each organization's events form a hash chain through prev_hash
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER NOT NULL,
+    actor_id INTEGER, -- NULL for changes without a signed-in user
+    action TEXT NOT NULL, -- 'created', 'updated' or 'deleted'
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    request_id TEXT,
+    changes TEXT NOT NULL, -- JSON object of field -> {before, after}
+    created_at TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_org_id ON audit_events(org_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_entity ON audit_events(entity_type, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events(actor_id);
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_update
+BEFORE UPDATE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are immutable');
+END;
+
+CREATE TRIGGER IF NOT EXISTS audit_events_no_delete
+BEFORE DELETE ON audit_events
+BEGIN
+    SELECT RAISE(ABORT, 'audit events are immutable');
+END;
+
+-- Table: tags
+-- The organization's tag catalogue; names are unique ignoring case
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER NOT NULL,
+    name TEXT NOT NULL COLLATE NOCASE,
+    color TEXT NOT NULL DEFAULT '#999999',
+    created_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name),
+    FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Table: record_tags
+CREATE TABLE IF NOT EXISTS record_tags (
+    tag_id INTEGER NOT NULL,
+    entity_type TEXT NOT NULL, -- 'company', 'contact', 'task', 'interaction' or 'file'
+    entity_id INTEGER NOT NULL,
+    tagged_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (tag_id, entity_type, entity_id),
+    FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE,
+    FOREIGN KEY (tagged_by) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_record_tags_entity ON record_tags(entity_type, entity_id);
+
+-- Table: custom_fields
+-- Fields an organization adds to its records of one type
+CREATE TABLE IF NOT EXISTS custom_fields (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER NOT NULL,
+    entity_type TEXT NOT NULL, -- 'company', 'contact', 'task' or 'deal'
+    field_key TEXT NOT NULL,
+    label TEXT NOT NULL,
+    field_type TEXT NOT NULL, -- 'text', 'number', 'date', 'select', 'multi_select' or 'boolean'
+    options TEXT, -- JSON array of the choices of select and multi_select fields
+    required INTEGER NOT NULL DEFAULT 0,
+    position INTEGER NOT NULL DEFAULT 0,
+    created_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, entity_type, field_key),
+    FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Table: custom_field_values
+-- value keeps its storage class: REAL numbers, 0 or 1 booleans, JSON arrays for
+-- multi-selects and text otherwise, so comparisons and sorting follow the type
+CREATE TABLE IF NOT EXISTS custom_field_values (
+    field_id INTEGER NOT NULL,
+    entity_type TEXT NOT NULL,
+    entity_id INTEGER NOT NULL,
+    value BLOB NOT NULL,
+    PRIMARY KEY (field_id, entity_id),
+    FOREIGN KEY (field_id) REFERENCES custom_fields(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_custom_field_values_entity ON custom_field_values(entity_type, entity_id);
+
+-- Table: contact_relationships
+-- Reads "contact_id <type> related_id", e.g. contact_id reports_to related_id
+CREATE TABLE IF NOT EXISTS contact_relationships (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    contact_id INTEGER NOT NULL,
+    related_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    notes TEXT,
+    created_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (contact_id, related_id, type),
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE,
+    FOREIGN KEY (related_id) REFERENCES contacts(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS idx_contact_relationships_related ON contact_relationships(related_id);
+
+-- Table: contact_affiliations
+-- A contact's positions at companies over time; end_date is NULL while current
+CREATE TABLE IF NOT EXISTS contact_affiliations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    contact_id INTEGER NOT NULL,
+    company_id INTEGER NOT NULL,
+    title TEXT,
+    start_date TEXT,
+    end_date TEXT,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE,
+    FOREIGN KEY (company_id) REFERENCES companies(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_contact_affiliations_contact ON contact_affiliations(contact_id);
+CREATE INDEX IF NOT EXISTS idx_contact_affiliations_company ON contact_affiliations(company_id);
+
+-- Table: segments
+CREATE TABLE IF NOT EXISTS segments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    org_id INTEGER NOT NULL,
+    name TEXT NOT NULL COLLATE NOCASE,
+    entity_type TEXT NOT NULL, -- 'contact' or 'company'
+    expression TEXT NOT NULL,
+    created_by INTEGER,
+    created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name),
+    FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
 CREATE TRIGGER IF NOT EXISTS update_contact_on_interaction_insert
 AFTER INSERT ON interactions
 FOR EACH ROW
@@ -141,3 +710,353 @@ END;
 `
 
 // ApplyMigrations executes the SQL schema creation
+
+// columnMigrations adds columns introduced after a table was first created.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so every column added
+// to a table in createSchemaSQL later on must also be listed here.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"deals", "pipeline_id", "INTEGER REFERENCES pipelines(id) ON DELETE SET NULL"},
+	{"tasks", "series_id", "INTEGER REFERENCES task_series(id) ON DELETE SET NULL"},
+	{"tasks", "occurrence", "INTEGER"},
+	{"tasks", "parent_id", "INTEGER REFERENCES tasks(id) ON DELETE CASCADE"},
+	{"tasks", "assignee_id", "INTEGER REFERENCES users(id) ON DELETE SET NULL"},
+	{"tasks", "assigned_by", "INTEGER REFERENCES users(id) ON DELETE SET NULL"},
+	{"tasks", "assigned_at", "TEXT"},
+	{"users", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"users", "org_role", "TEXT NOT NULL DEFAULT 'member'"},
+	{"companies", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"contacts", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"interactions", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"tasks", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"deals", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"pipelines", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"files", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"stage_transitions", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"email_messages", "org_id", "INTEGER REFERENCES organizations(id)"},
+	{"companies", "deleted_at", "TEXT"},
+	{"contacts", "deleted_at", "TEXT"},
+	{"interactions", "deleted_at", "TEXT"},
+	{"tasks", "deleted_at", "TEXT"},
+	{"deals", "deleted_at", "TEXT"},
+	{"files", "deleted_at", "TEXT"},
+}
+
+// indexMigrations are created after columnMigrations since they may depend on them.
+const indexMigrations = `
+CREATE INDEX IF NOT EXISTS idx_deals_pipeline_id ON deals(pipeline_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_series_id ON tasks(series_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_parent_id ON tasks(parent_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_assignee_id ON tasks(assignee_id);
+CREATE INDEX IF NOT EXISTS idx_users_org_id ON users(org_id);
+CREATE INDEX IF NOT EXISTS idx_companies_org_id ON companies(org_id);
+CREATE INDEX IF NOT EXISTS idx_contacts_org_id ON contacts(org_id);
+CREATE INDEX IF NOT EXISTS idx_interactions_org_id ON interactions(org_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_org_id ON tasks(org_id);
+CREATE INDEX IF NOT EXISTS idx_deals_org_id ON deals(org_id);
+CREATE INDEX IF NOT EXISTS idx_pipelines_org_id ON pipelines(org_id);
+CREATE INDEX IF NOT EXISTS idx_files_org_id ON files(org_id);
+CREATE INDEX IF NOT EXISTS idx_stage_transitions_org_id ON stage_transitions(org_id, entity_type);
+`
+
+func addMissingColumns(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("cannot add %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	_, err := db.Exec(indexMigrations)
+	return err
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migrateOrganizations gives every user without one a personal organization,
+// files their existing records under it and installs the triggers that set
+// org_id on new records. Safe to re-run.
+func migrateOrganizations(db *sql.DB) error {
+	rows, err := db.Query("SELECT id FROM users WHERE org_id IS NULL")
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		if _, err := orgs.Ensure(db, userID); err != nil {
+			return fmt.Errorf("user %d: %w", userID, err)
+		}
+	}
+	for _, table := range orgs.Tables {
+		if _, err := db.Exec(fmt.Sprintf(`
+		UPDATE %[1]s SET org_id = (SELECT org_id FROM users WHERE users.id = %[1]s.user_id) WHERE org_id IS NULL`, table)); err != nil {
+			return fmt.Errorf("cannot backfill %s organizations: %w", table, err)
+		}
+		if _, err := db.Exec(fmt.Sprintf(`
+		CREATE TRIGGER IF NOT EXISTS set_%[1]s_org_id
+		AFTER INSERT ON %[1]s
+		FOR EACH ROW WHEN NEW.org_id IS NULL
+		BEGIN
+			UPDATE %[1]s SET org_id = (SELECT org_id FROM users WHERE id = NEW.user_id) WHERE id = NEW.id;
+		END;`, table)); err != nil {
+			return fmt.Errorf("cannot create %s organization trigger: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// migratePipelineNames rebuilds a pipelines table created when names were unique
+// per user so that they are unique per organization instead, renaming pipelines
+// of different members that share a name. Safe to re-run.
+func migratePipelineNames(db *sql.DB) error {
+	return rebuildTable(db, "pipelines", "UNIQUE (user_id, name)", []string{
+		`UPDATE pipelines SET name = name || ' (' || id || ')'
+		WHERE EXISTS (SELECT 1 FROM pipelines p WHERE p.org_id = pipelines.org_id AND p.name = pipelines.name AND p.id < pipelines.id)`,
+	}, `CREATE TABLE pipelines_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		is_default INTEGER NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		org_id INTEGER REFERENCES organizations(id),
+		UNIQUE (org_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	)`, "id, user_id, name, is_default, created_at, updated_at, org_id")
+}
+
+// migrateEmailMessages rebuilds an email_messages table created when messages
+// were recorded per user so that they are recorded once per organization and
+// contact, keeping the first record of each message. Safe to re-run.
+func migrateEmailMessages(db *sql.DB) error {
+	return rebuildTable(db, "email_messages", "UNIQUE (user_id, contact_id, message_id)", []string{
+		`DELETE FROM email_messages WHERE EXISTS (
+			SELECT 1 FROM email_messages m WHERE m.org_id = email_messages.org_id AND m.contact_id = email_messages.contact_id
+			AND m.message_id = email_messages.message_id AND m.id < email_messages.id)`,
+	}, `CREATE TABLE email_messages_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		contact_id INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		interaction_id INTEGER NOT NULL,
+		created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		org_id INTEGER REFERENCES organizations(id),
+		UNIQUE (org_id, contact_id, message_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (contact_id) REFERENCES contacts(id) ON DELETE CASCADE,
+		FOREIGN KEY (interaction_id) REFERENCES interactions(id) ON DELETE CASCADE
+	)`, "id, user_id, contact_id, message_id, interaction_id, created_at, org_id")
+}
+
+// rebuildTable replaces table with the one create makes as <table>_new when the
+// stored schema still contains outdated, copying columns across after running
+// prepare on the old table. SQLite cannot drop a constraint, so the table is
+// copied with foreign keys off on a single connection; dropping it would
+// otherwise cascade to the rows referencing it. Its indexes and triggers are
+// recreated on the new table.
+func rebuildTable(db *sql.DB, table, outdated string, prepare []string, create, columns string) error {
+	var schema string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema); err != nil {
+		return err
+	}
+	if !strings.Contains(schema, outdated) {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT sql FROM sqlite_master WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL", table)
+	if err != nil {
+		return err
+	}
+	var recreate []string
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			rows.Close()
+			return err
+		}
+		recreate = append(recreate, stmt)
+	}
+	rows.Close()
+
+	stmts := append(prepare, create,
+		fmt.Sprintf("INSERT INTO %[1]s_new (%[2]s) SELECT %[2]s FROM %[1]s", table, columns),
+		"DROP TABLE "+table,
+		fmt.Sprintf("ALTER TABLE %[1]s_new RENAME TO %[1]s", table),
+	)
+	for _, stmt := range append(stmts, recreate...) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migratePipelineStages gives every organization a default pipeline and maps the
+// free-text pipeline_stage values written before pipelines existed onto its
+// stages. Values that match no stage become new stages rather than being lost.
+// Safe to re-run.
+func migratePipelineStages(db *sql.DB) error {
+	// A default pipeline created here is credited to an owner of the organization
+	rows, err := db.Query(`
+	SELECT o.id, u.id FROM organizations o
+	JOIN users u ON u.id = (SELECT id FROM users WHERE org_id = o.id ORDER BY org_role = ? DESC, id LIMIT 1)`,
+		models.OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+	type org struct{ id, userID int }
+	var list []org
+	for rows.Next() {
+		var o org
+		if err := rows.Scan(&o.id, &o.userID); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, o)
+	}
+	rows.Close()
+
+	for _, o := range list {
+		if err := migrateOrgStages(db, o.id, o.userID); err != nil {
+			return fmt.Errorf("organization %d: %w", o.id, err)
+		}
+	}
+	return nil
+}
+
+func migrateOrgStages(db *sql.DB, orgID, userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	pipelineID, err := pipelines.EnsureDefault(tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	// Values that are not already an exact stage name
+	rows, err := tx.Query(`
+	SELECT DISTINCT v FROM (
+		SELECT pipeline_stage AS v FROM companies WHERE org_id = ? AND pipeline_stage IS NOT NULL
+		UNION SELECT pipeline_stage FROM contacts WHERE org_id = ? AND pipeline_stage IS NOT NULL
+		UNION SELECT stage FROM deals WHERE org_id = ? AND (pipeline_id IS NULL OR pipeline_id = ?)
+	) WHERE v NOT IN (SELECT name FROM pipeline_stages WHERE pipeline_id = ?)`,
+		orgID, orgID, orgID, pipelineID, pipelineID)
+	if err != nil {
+		return err
+	}
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		values = append(values, v)
+	}
+	rows.Close()
+
+	for _, v := range values {
+		stage, err := pipelines.FindStage(tx, pipelineID, v)
+		if errors.Is(err, pipelines.ErrUnknownStage) {
+			stage.Name = strings.TrimSpace(v)
+			_, err = tx.Exec(`
+			INSERT INTO pipeline_stages (pipeline_id, name, position, color, probability, outcome)
+			SELECT ?, ?, COALESCE(MAX(position), -1) + 1, ?, 0, ? FROM pipeline_stages WHERE pipeline_id = ?`,
+				pipelineID, stage.Name, pipelines.DefaultColor, models.StageOpen, pipelineID)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE companies SET pipeline_stage = ? WHERE org_id = ? AND pipeline_stage = ?", stage.Name, orgID, v); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE contacts SET pipeline_stage = ? WHERE org_id = ? AND pipeline_stage = ?", stage.Name, orgID, v); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE deals SET stage = ? WHERE org_id = ? AND stage = ? AND (pipeline_id IS NULL OR pipeline_id = ?)",
+			stage.Name, orgID, v, pipelineID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE deals SET pipeline_id = ? WHERE org_id = ? AND pipeline_id IS NULL", pipelineID, orgID); err != nil {
+		return err
+	}
+
+	// Records from before stage history get a starting entry. updated_at is the latest
+	// they can have entered their current stage.
+	if _, err := tx.Exec(`
+	INSERT INTO stage_transitions (user_id, entity_type, entity_id, pipeline_id, to_stage, changed_by, changed_at)
+	SELECT user_id, 'deal', id, pipeline_id, stage, user_id, updated_at FROM deals r
+	WHERE org_id = ? AND NOT EXISTS (SELECT 1 FROM stage_transitions t WHERE t.entity_type = 'deal' AND t.entity_id = r.id)`,
+		orgID); err != nil {
+		return fmt.Errorf("cannot backfill deal stage history: %w", err)
+	}
+	for entityType, table := range map[string]string{models.EntityCompany: "companies", models.EntityContact: "contacts"} {
+		if _, err := tx.Exec(`
+		INSERT INTO stage_transitions (user_id, entity_type, entity_id, pipeline_id, to_stage, changed_by, changed_at)
+		SELECT user_id, ?, id, ?, pipeline_stage, user_id, updated_at FROM `+table+` r
+		WHERE org_id = ? AND pipeline_stage IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM stage_transitions t WHERE t.entity_type = ? AND t.entity_id = r.id)`,
+			entityType, pipelineID, orgID, entityType); err != nil {
+			return fmt.Errorf("cannot backfill %s stage history: %w", entityType, err)
+		}
+	}
+	return tx.Commit()
+}
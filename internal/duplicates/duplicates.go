@@ -0,0 +1,174 @@
+// Package duplicates finds contacts that are likely the same person: the same
+// email address, the same phone number once normalized, or near-identical names
+// at the same company.
+package duplicates
+
+import (
+	"math"
+	"micro-CRM/internal/models"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// NameThreshold is the name similarity from which two contacts of the same
+// company are reported.
+const NameThreshold = 0.85
+
+// minPhoneDigits keeps extensions and partial numbers from matching each other.
+const minPhoneDigits = 7
+
+// NormalizeEmail returns the comparable form of an email address.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone returns the comparable form of a phone number: its last ten
+// digits, so that numbers written with and without a country code or
+// punctuation match. Numbers too short to tell apart return "".
+func NormalizePhone(phone string) string {
+	var digits []rune
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) < minPhoneDigits {
+		return ""
+	}
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return string(digits)
+}
+
+// normalizeName lowercases a name and reduces it to letters and digits
+// separated by single spaces.
+func normalizeName(name string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// NameSimilarity compares two contacts' full names from 0 (nothing in common)
+// to 1 (the same once normalized); a name written last name first still matches.
+func NameSimilarity(a, b models.Contact) float64 {
+	nameA := normalizeName(a.FirstName + " " + a.LastName)
+	nameB := normalizeName(b.FirstName + " " + b.LastName)
+	swapped := normalizeName(b.LastName + " " + b.FirstName)
+	if nameA == "" || nameB == "" {
+		return 0
+	}
+	if s := similarity(nameA, swapped); s > similarity(nameA, nameB) {
+		return s
+	}
+	return similarity(nameA, nameB)
+}
+
+// similarity is one minus the edit distance relative to the longer string.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Find returns the pairs of contacts that look like duplicates, those with the
+// most reasons and the most similar names first.
+func Find(contacts []models.Contact) []models.ContactDuplicate {
+	byEmail := make(map[string][]int)
+	byPhone := make(map[string][]int)
+	byCompany := make(map[int][]int)
+	for i, contact := range contacts {
+		if contact.Email != nil {
+			if key := NormalizeEmail(*contact.Email); key != "" {
+				byEmail[key] = append(byEmail[key], i)
+			}
+		}
+		if contact.PhoneNumber != nil {
+			if key := NormalizePhone(*contact.PhoneNumber); key != "" {
+				byPhone[key] = append(byPhone[key], i)
+			}
+		}
+		if contact.CompanyID != nil {
+			byCompany[*contact.CompanyID] = append(byCompany[*contact.CompanyID], i)
+		}
+	}
+
+	type pair struct{ a, b int }
+	reasons := make(map[pair][]string)
+	add := func(group []int, reason string, match func(a, b int) bool) {
+		for x := 0; x < len(group); x++ {
+			for y := x + 1; y < len(group); y++ {
+				if match == nil || match(group[x], group[y]) {
+					p := pair{group[x], group[y]}
+					reasons[p] = append(reasons[p], reason)
+				}
+			}
+		}
+	}
+	for _, group := range byEmail {
+		add(group, models.DuplicateEmail, nil)
+	}
+	for _, group := range byPhone {
+		add(group, models.DuplicatePhone, nil)
+	}
+	for _, group := range byCompany {
+		add(group, models.DuplicateName, func(a, b int) bool {
+			return NameSimilarity(contacts[a], contacts[b]) >= NameThreshold
+		})
+	}
+
+	found := make([]models.ContactDuplicate, 0, len(reasons))
+	for p, why := range reasons {
+		a, b := contacts[p.a], contacts[p.b]
+		if b.ID < a.ID {
+			a, b = b, a
+		}
+		sort.Strings(why)
+		found = append(found, models.ContactDuplicate{
+			Contacts:       []models.Contact{a, b},
+			Reasons:        why,
+			NameSimilarity: math.Round(NameSimilarity(a, b)*100) / 100,
+		})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		x, y := found[i], found[j]
+		if len(x.Reasons) != len(y.Reasons) {
+			return len(x.Reasons) > len(y.Reasons)
+		}
+		if x.NameSimilarity != y.NameSimilarity {
+			return x.NameSimilarity > y.NameSimilarity
+		}
+		if x.Contacts[0].ID != y.Contacts[0].ID {
+			return x.Contacts[0].ID < y.Contacts[0].ID
+		}
+		return x.Contacts[1].ID < y.Contacts[1].ID
+	})
+	return found
+}
@@ -0,0 +1,197 @@
+// Package events is the in-process event bus handlers publish record changes to.
+// Events are stored in the events table before being fanned out, so a client
+// that reconnects can replay what it missed from its last event id.
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"micro-CRM/internal/logger"
+	"sync"
+	"time"
+)
+
+// Actions, combined with the entity type into the event type ("contact.created").
+const (
+	ActionCreated      = "created"
+	ActionUpdated      = "updated"
+	ActionDeleted      = "deleted"
+	ActionStageChanged = "stage_changed" // Companies, contacts and deals
+	ActionWon          = "won"           // Moved to a stage with the won outcome
+	ActionCompleted    = "completed"     // Tasks marked done
+	ActionAssigned     = "assigned"      // Tasks given to a new assignee
+	ActionRestored     = "restored"      // Taken out of the trash
+)
+
+// subscriberBuffer is how many events a slow subscriber may fall behind before it
+// is dropped; it then reconnects and catches up from the table.
+const subscriberBuffer = 64
+
+// Event is one change to a user's record.
+type Event struct {
+	ID         int64           `json:"id"`
+	UserID     int             `json:"user_id"`
+	Type       string          `json:"type"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	Data       json.RawMessage `json:"data"`
+	CreatedAt  string          `json:"created_at"`
+}
+
+// Subscription receives a user's events until Close is called or the bus drops it
+// for falling behind, in which case C is closed.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	userID int
+	bus    *Bus
+	once   sync.Once
+}
+
+// Close stops delivery and releases the subscription.
+func (s *Subscription) Close() {
+	s.bus.remove(s)
+}
+
+// Bus stores events and delivers them to live subscribers.
+type Bus struct {
+	DB  *sql.DB
+	Log logger.Logger
+
+	mu       sync.Mutex
+	subs     map[*Subscription]struct{}
+	handlers []func(Event)
+}
+
+func NewBus(db *sql.DB, log logger.Logger) *Bus {
+	return &Bus{
+		DB:   db,
+		Log:  log,
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish records a change and delivers it. data is the record as the API returns
+// it, or its id for deletions. Publishing never fails the caller; errors are logged.
+func (b *Bus) Publish(userID int, entityType, action string, entityID int, data interface{}) {
+	if b == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		b.Log.Error("Events: cannot encode %s %d: %v", entityType, entityID, err)
+		return
+	}
+	e := Event{
+		UserID:     userID,
+		Type:       entityType + "." + action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Data:       payload,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	// Storing and delivering under one lock hands events to subscribers in id
+	// order, which streams rely on to skip what they replayed
+	b.mu.Lock()
+	result, err := b.DB.Exec(`
+	INSERT INTO events (user_id, type, entity_type, entity_id, data, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.UserID, e.Type, e.EntityType, e.EntityID, string(e.Data), e.CreatedAt,
+	)
+	if err != nil {
+		b.mu.Unlock()
+		b.Log.Error("Events: cannot store %s: %v", e.Type, err)
+		return
+	}
+	e.ID, _ = result.LastInsertId()
+
+	for s := range b.subs {
+		if s.userID != e.UserID {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			b.Log.Warn("Events: dropping slow subscriber of user %d", s.userID)
+			b.removeLocked(s)
+		}
+	}
+	handlers := make([]func(Event), len(b.handlers))
+	copy(handlers, b.handlers)
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// Subscribe starts delivering the user's events published from now on.
+func (b *Bus) Subscribe(userID int) *Subscription {
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{C: c, c: c, userID: userID, bus: b}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Handle registers fn to be called synchronously with every published event, for
+// in-process consumers that are not tied to one user. fn must not block.
+func (b *Bus) Handle(fn func(Event)) {
+	b.mu.Lock()
+	b.handlers = append(b.handlers, fn)
+	b.mu.Unlock()
+}
+
+// Replay returns up to limit of the user's stored events after afterID, oldest first.
+func (b *Bus) Replay(userID int, afterID int64, limit int) ([]Event, error) {
+	rows, err := b.DB.Query(`
+	SELECT id, user_id, type, entity_type, entity_id, data, created_at
+	FROM events WHERE user_id = ? AND id > ? ORDER BY id LIMIT ?`, userID, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("cannot replay events: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Event
+	for rows.Next() {
+		var (
+			e    Event
+			data string
+		)
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.EntityType, &e.EntityID, &data, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("cannot scan event: %w", err)
+		}
+		e.Data = json.RawMessage(data)
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// Prune deletes stored events older than maxAge; clients offline for longer
+// cannot resume and should reload instead.
+func (b *Bus) Prune(maxAge time.Duration) error {
+	cutoff := time.Now().UTC().Add(-maxAge).Format(time.RFC3339)
+	_, err := b.DB.Exec("DELETE FROM events WHERE created_at < ?", cutoff)
+	return err
+}
+
+// Close ends every subscription, e.g. so open streams return on shutdown.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		b.removeLocked(s)
+	}
+}
+
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(s)
+}
+
+func (b *Bus) removeLocked(s *Subscription) {
+	delete(b.subs, s)
+	s.once.Do(func() { close(s.c) })
+}
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 500
+)
+
+// snapshot loads a record's stored fields before it changes, so audit can
+// record the difference. A failure is logged and audits the change without
+// the previous values.
+func (c *CRMHandlers) snapshot(entityType string, id int) map[string]interface{} {
+	record, err := audit.Snapshot(c.DB, entityType, id)
+	if err != nil {
+		log.Printf("Error loading %s %d for audit: %v", entityType, id, err)
+	}
+	return record
+}
+
+// requestID returns the ID middleware.RequestID tagged the request with.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(models.RequestIDContextKey).(string)
+	return id
+}
+
+// auditErrorHeader is set on the response to a change that was saved but is
+// missing from the audit log. Failing the request instead would invite a retry
+// of a change that already happened.
+const auditErrorHeader = "X-CRM-Audit-Error"
+
+// audit records that the request's user created, updated or deleted a record,
+// diffing before (nil for created records) against its stored state. It must be
+// called before the response is written so a failure can be reported.
+func (c *CRMHandlers) audit(w http.ResponseWriter, r *http.Request, action, entityType string, id int, before map[string]interface{}) {
+	actorID, _ := r.Context().Value(models.UserIDContextKey).(int)
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+	if err := c.recordAudit(actorID, orgID, requestID(r), action, entityType, id, before); err != nil {
+		markUnaudited(w)
+	}
+}
+
+// recordAudit is audit for changes made without a signed-in user; a zero actorID
+// records no actor. Failures are logged and returned.
+func (c *CRMHandlers) recordAudit(actorID, orgID int, requestID, action, entityType string, id int, before map[string]interface{}) error {
+	err := audit.Track(c.DB, actorID, orgID, requestID, action, entityType, id, before)
+	if err != nil {
+		log.Printf("Error auditing %s %d: %v", entityType, id, err)
+	}
+	return err
+}
+
+// pendingAudit is a record a transaction updates, audited once it commits.
+type pendingAudit struct {
+	entityType string
+	id         int
+	before     map[string]interface{}
+}
+
+// snapshotRecords loads the records of entityType that query selects before tx
+// changes them, for auditPending to diff once tx commits.
+func snapshotRecords(tx *sql.Tx, entityType, query string, args ...interface{}) ([]pendingAudit, error) {
+	ids, err := queryIDs(tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]pendingAudit, 0, len(ids))
+	for _, id := range ids {
+		before, err := audit.Snapshot(tx, entityType, id)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, pendingAudit{entityType, id, before})
+	}
+	return pending, nil
+}
+
+// auditPending audits the updates to records snapshotted by snapshotRecords.
+func (c *CRMHandlers) auditPending(w http.ResponseWriter, r *http.Request, pending []pendingAudit) {
+	for _, p := range pending {
+		c.audit(w, r, events.ActionUpdated, p.entityType, p.id, p.before)
+	}
+}
+
+// markUnaudited flags the response to a change the audit log is missing.
+func markUnaudited(w http.ResponseWriter) {
+	w.Header().Set(auditErrorHeader, "change saved but not audited")
+}
+
+// ListAuditEvents returns the audit events of the user's organization, newest
+// first. Owners and admins only.
+// Query parameters: entity_type, entity_id, actor_id, action, request_id, since
+// and until (RFC3339), limit, and before_id to page back from the oldest id of
+// the previous page.
+func (c *CRMHandlers) ListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+
+	query := "SELECT " + audit.Columns + " FROM audit_events WHERE org_id = ?"
+	args := []interface{}{orgID}
+	params := r.URL.Query()
+	for _, filter := range []string{"entity_type", "action", "request_id"} {
+		if value := params.Get(filter); value != "" {
+			query += " AND " + filter + " = ?"
+			args = append(args, value)
+		}
+	}
+	for _, filter := range []string{"entity_id", "actor_id", "before_id"} {
+		value := params.Get(filter)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid "+filter+" parameter")
+			return
+		}
+		if filter == "before_id" {
+			query += " AND id < ?"
+		} else {
+			query += " AND " + filter + " = ?"
+		}
+		args = append(args, id)
+	}
+	for filter, op := range map[string]string{"since": ">=", "until": "<"} {
+		value := params.Get(filter)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid "+filter+" parameter; use RFC3339")
+			return
+		}
+		query += " AND created_at " + op + " ?"
+		args = append(args, t.UTC().Format(audit.TimeLayout))
+	}
+	limit := defaultAuditLimit
+	if limitStr := params.Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxAuditLimit {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid limit parameter")
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying audit events: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.AuditEvent{}
+	for rows.Next() {
+		var e models.AuditEvent
+		if err := audit.Scan(rows, &e); err != nil {
+			log.Printf("Error scanning audit event: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		list = append(list, e)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating audit events: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// VerifyAuditLog recomputes the organization's audit hash chain and reports the
+// first event that was altered or follows a removed one. Owners and admins only.
+func (c *CRMHandlers) VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+
+	result, err := audit.Verify(c.DB, orgID)
+	if err != nil {
+		log.Printf("Error verifying audit log: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, result)
+}
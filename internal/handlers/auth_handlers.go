@@ -6,17 +6,32 @@ import (
 	"errors"
 	"golang.org/x/crypto/bcrypt"
 	"log"
+	"micro-CRM/internal/caldav"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/imapsync"
 	"micro-CRM/internal/logger"
+	"micro-CRM/internal/mailer"
 	"micro-CRM/internal/models"
+	"micro-CRM/internal/orgs"
 	"micro-CRM/internal/tokenstore"
 	"micro-CRM/internal/utils"
+	"micro-CRM/internal/webhooks"
 	"net/http"
+	"time"
 )
 
 type CRMHandlers struct {
 	DB         *sql.DB
 	Log        logger.Logger
 	TokenStore *tokenstore.BuntDBTokenStore
+	IMAPSync   *imapsync.Syncer
+	Outbox     *mailer.Outbox
+	CalDAVSync *caldav.Syncer
+	Events     *events.Bus
+	Webhooks   *webhooks.Dispatcher
+
+	// TrashRetention is how long deleted records stay restorable
+	TrashRetention time.Duration
 }
 
 // RegisterUser handles user registration.
@@ -56,6 +71,13 @@ func (c *CRMHandlers) RegisterUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userID, _ := result.LastInsertId()
+	// Start the user's organization now so their registration is audited in it
+	if _, err := orgs.Ensure(db, int(userID)); err != nil {
+		log.Printf("Error creating organization: %v", err)
+	}
+	if err := c.recordAudit(int(userID), 0, requestID(r), events.ActionCreated, models.EntityUser, int(userID), nil); err != nil {
+		markUnaudited(w)
+	}
 	token, err := utils.GenerateJWT(int(userID))
 	if err != nil {
 		log.Printf("Error generating JWT: %v", err)
@@ -91,7 +113,7 @@ func (c *CRMHandlers) LoginUser(w http.ResponseWriter, r *http.Request) {
 	db := c.DB
 	c.Log.Info("User login request")
 	var user models.User
-	err := db.QueryRow("SELECT id,first_name,last_name,username,email,role,phone_number,created_at,password_hash FROM users WHERE username = ?", payload.Username).Scan(&user.ID, &user.FirstName, &user.LastName, &user.Username, &user.Email, &user.Role, &user.PhoneNumber, &user.CreatedAt, &user.PasswordHash)
+	err := db.QueryRow("SELECT id,first_name,last_name,username,email,role,phone_number,created_at,password_hash,COALESCE(status,'') FROM users WHERE username = ?", payload.Username).Scan(&user.ID, &user.FirstName, &user.LastName, &user.Username, &user.Email, &user.Role, &user.PhoneNumber, &user.CreatedAt, &user.PasswordHash, &user.Status)
 	if errors.Is(err, sql.ErrNoRows) {
 		utils.RespondError(w, http.StatusUnauthorized, "Invalid username or password")
 		return
@@ -101,7 +123,7 @@ func (c *CRMHandlers) LoginUser(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
-	if user.Status == "inactive" {
+	if user.Status == models.UserStatusInactive {
 		c.Log.Info("User is inactive")
 		utils.RespondJSON(w, http.StatusUnauthorized, map[string]interface{}{
 			"message": "User is inactive, Contact administrator to configure your user",
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const calendarColumns = `id, user_id, calendar_url, username, enabled, last_synced_at, last_error, created_at, updated_at`
+
+func scanCalendar(row interface{ Scan(...interface{}) error }, cal *models.CalDAVAccount) error {
+	return row.Scan(
+		&cal.ID, &cal.UserID, &cal.CalendarURL, &cal.Username, &cal.Enabled,
+		&cal.LastSyncedAt, &cal.LastError, &cal.CreatedAt, &cal.UpdatedAt,
+	)
+}
+
+// CreateCalendar connects a CalDAV calendar collection for the authenticated user.
+func (c *CRMHandlers) CreateCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	calendar := models.CalDAVAccount{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&calendar); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if calendar.CalendarURL == "" || calendar.Username == "" || calendar.Password == "" {
+		utils.RespondError(w, http.StatusBadRequest, "calendar_url, username and password are required")
+		return
+	}
+	calendar.UserID = userID
+
+	result, err := c.DB.Exec(`
+	INSERT INTO caldav_accounts (user_id, calendar_url, username, password, enabled)
+	VALUES (?, ?, ?, ?, ?)`,
+		calendar.UserID, calendar.CalendarURL, calendar.Username, calendar.Password, calendar.Enabled,
+	)
+	if err != nil {
+		log.Printf("Error inserting calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create calendar")
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	calendar.Password = ""
+	err = scanCalendar(c.DB.QueryRow("SELECT "+calendarColumns+" FROM caldav_accounts WHERE id = ?", id), &calendar)
+	if err != nil {
+		log.Printf("Error fetching created calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Error fetching created calendar")
+		return
+	}
+	utils.RespondJSON(w, http.StatusCreated, calendar)
+}
+
+// ListCalendars retrieves all CalDAV calendars of the authenticated user.
+func (c *CRMHandlers) ListCalendars(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT "+calendarColumns+" FROM caldav_accounts WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("Error querying calendars: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var calendars []models.CalDAVAccount
+	for rows.Next() {
+		var calendar models.CalDAVAccount
+		if err := scanCalendar(rows, &calendar); err != nil {
+			log.Printf("Error scanning calendar row: %v", err)
+			continue
+		}
+		calendars = append(calendars, calendar)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating calendar rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, calendars)
+}
+
+// GetCalendar retrieves a single CalDAV calendar and its sync state.
+func (c *CRMHandlers) GetCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	calendarID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid calendar ID")
+		return
+	}
+
+	var calendar models.CalDAVAccount
+	err = scanCalendar(c.DB.QueryRow("SELECT "+calendarColumns+" FROM caldav_accounts WHERE id = ? AND user_id = ?", calendarID, userID), &calendar)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Calendar not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, calendar)
+}
+
+// UpdateCalendar changes connection settings. An empty password keeps the stored one.
+// Moving to a different calendar URL forgets the event links of the old one.
+func (c *CRMHandlers) UpdateCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	calendarID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid calendar ID")
+		return
+	}
+
+	var calendar models.CalDAVAccount
+	if err := json.NewDecoder(r.Body).Decode(&calendar); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if calendar.CalendarURL == "" || calendar.Username == "" {
+		utils.RespondError(w, http.StatusBadRequest, "calendar_url and username are required")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var currentURL string
+	err = tx.QueryRow("SELECT calendar_url FROM caldav_accounts WHERE id = ? AND user_id = ?", calendarID, userID).Scan(&currentURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Calendar not found or unauthorized to update")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	_, err = tx.Exec(`
+	UPDATE caldav_accounts SET
+		calendar_url = ?, username = ?, password = COALESCE(NULLIF(?, ''), password), enabled = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`,
+		calendar.CalendarURL, calendar.Username, calendar.Password, calendar.Enabled, calendarID,
+	)
+	if err != nil {
+		log.Printf("Error updating calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update calendar")
+		return
+	}
+	if currentURL != calendar.CalendarURL {
+		if _, err := tx.Exec("DELETE FROM caldav_events WHERE account_id = ?", calendarID); err != nil {
+			log.Printf("Error resetting calendar events: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update calendar")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing calendar update: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update calendar")
+		return
+	}
+
+	calendar.Password = ""
+	if err := scanCalendar(c.DB.QueryRow("SELECT "+calendarColumns+" FROM caldav_accounts WHERE id = ?", calendarID), &calendar); err != nil {
+		log.Printf("Error fetching updated calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve updated calendar")
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, calendar)
+}
+
+// DeleteCalendar disconnects a calendar. Meetings already synced are kept on both sides.
+func (c *CRMHandlers) DeleteCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	calendarID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid calendar ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM caldav_accounts WHERE id = ? AND user_id = ?", calendarID, userID)
+	if err != nil {
+		log.Printf("Error deleting calendar: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete calendar")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Calendar not found or unauthorized to delete")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// SyncCalendar runs a sync pass immediately and reports what changed.
+func (c *CRMHandlers) SyncCalendar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if c.CalDAVSync == nil {
+		utils.RespondError(w, http.StatusServiceUnavailable, "Calendar sync is not enabled on this server")
+		return
+	}
+
+	calendarID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid calendar ID")
+		return
+	}
+
+	var exists bool
+	err = c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM caldav_accounts WHERE id = ? AND user_id = ?)", calendarID, userID).Scan(&exists)
+	if err != nil || !exists {
+		utils.RespondError(w, http.StatusNotFound, "Calendar not found or unauthorized")
+		return
+	}
+
+	result, err := c.CalDAVSync.SyncAccount(calendarID)
+	if err != nil {
+		c.Log.Warn("SyncCalendar: calendar %d: %v", calendarID, err)
+		utils.RespondError(w, http.StatusBadGateway, "Calendar sync failed: "+err.Error())
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, result)
+}
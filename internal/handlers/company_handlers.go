@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/utils"
 	"net/http"
@@ -21,6 +22,7 @@ func (c *CRMHandlers) CreateCompany(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	var company models.Company
 	if err := json.NewDecoder(r.Body).Decode(&company); err != nil {
@@ -28,6 +30,15 @@ func (c *CRMHandlers) CreateCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	company.UserID = userID // Assign the authenticated user's ID
+	stage, ok := c.resolvePipelineStage(w, orgID, userID, company.PipelineStage)
+	if !ok {
+		return
+	}
+	company.PipelineStage = stage.Name
+	customValues, ok := c.customFieldValues(w, orgID, models.EntityCompany, company.CustomFields, true)
+	if !ok {
+		return
+	}
 
 	db := c.DB
 	stmt, err := db.Prepare(`
@@ -53,9 +64,20 @@ func (c *CRMHandlers) CreateCompany(w http.ResponseWriter, r *http.Request) {
 
 	id, _ := result.LastInsertId()
 	company.ID = int(id)
+	if !c.saveCustomFields(w, c.DB, models.EntityCompany, company.ID, customValues) {
+		return
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityCompany, []int{company.ID})
+	if !ok {
+		return
+	}
+	company.CustomFields = custom[company.ID]
+	c.recordStageChange(userID, userID, models.EntityCompany, company.ID, stage, nil)
 	company.CreatedAt = time.Now().Format(time.RFC3339)
 	company.UpdatedAt = company.CreatedAt
 
+	c.audit(w, r, events.ActionCreated, models.EntityCompany, company.ID, nil)
+	c.publish(userID, models.EntityCompany, events.ActionCreated, company.ID, company)
 	utils.RespondJSON(w, http.StatusCreated, company)
 }
 
@@ -66,6 +88,7 @@ func (c *CRMHandlers) GetCompany(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	companyID, err := strconv.Atoi(vars["id"])
@@ -78,8 +101,8 @@ func (c *CRMHandlers) GetCompany(w http.ResponseWriter, r *http.Request) {
 	var company models.Company
 	err = db.QueryRow(`
 	SELECT id, user_id, name, website, industry, notes, company_size, address, phone_number, created_at, updated_at, pipeline_stage
-	FROM companies WHERE id = ? AND user_id = ?`,
-		companyID, userID,
+	FROM companies WHERE id = ? AND `+visibleClause(false),
+		append([]interface{}{companyID}, visibleArgs(models.EntityCompany, orgID, userID)...)...,
 	).Scan(
 		&company.ID, &company.UserID, &company.Name, &company.Website, &company.Industry,
 		&company.Notes, &company.CompanySize, &company.Address, &company.PhoneNumber,
@@ -94,24 +117,59 @@ func (c *CRMHandlers) GetCompany(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityCompany, []int{company.ID})
+	if !ok {
+		return
+	}
+	company.Tags = tagged[company.ID]
+	custom, ok := c.loadCustomFields(w, models.EntityCompany, []int{company.ID})
+	if !ok {
+		return
+	}
+	company.CustomFields = custom[company.ID]
 
 	utils.RespondJSON(w, http.StatusOK, company)
 }
 
-// ListCompanies retrieves all companies for the authenticated user.
+// ListCompanies retrieves all companies of the authenticated user's organization
+// and those shared with the user, optionally filtered by tag (repeatable; a
+// company must carry every tag named), by custom fields, by a saved segment and
+// by a filter expression, and sorted by a custom field.
 func (c *CRMHandlers) ListCompanies(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	db := c.DB
-	rows, err := db.Query(`
+	query := `
 	SELECT id, user_id, name, website, industry, notes, company_size, address, phone_number, created_at, updated_at, pipeline_stage
-	FROM companies WHERE user_id = ?`,
-		userID,
-	)
+	FROM companies WHERE ` + visibleClause(false)
+	args := visibleArgs(models.EntityCompany, orgID, userID)
+
+	filter, filterArgs := tagFilter(r, orgID, models.EntityCompany, "id")
+	query += filter
+	args = append(args, filterArgs...)
+	filter, filterArgs, ok = c.segmentFilter(w, r, orgID, models.EntityCompany, "companies.id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	filter, filterArgs, order, orderArgs, ok := c.customFieldQuery(w, r, orgID, models.EntityCompany, "id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	if order != "" {
+		query += " ORDER BY " + order + ", id"
+		args = append(args, orderArgs...)
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying companies: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
@@ -139,6 +197,23 @@ func (c *CRMHandlers) ListCompanies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ids := make([]int, len(companies))
+	for i, company := range companies {
+		ids[i] = company.ID
+	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityCompany, ids)
+	if !ok {
+		return
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityCompany, ids)
+	if !ok {
+		return
+	}
+	for i := range companies {
+		companies[i].Tags = tagged[companies[i].ID]
+		companies[i].CustomFields = custom[companies[i].ID]
+	}
+
 	utils.RespondJSON(w, http.StatusOK, companies)
 }
 
@@ -149,6 +224,7 @@ func (c *CRMHandlers) UpdateCompany(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	companyID, err := strconv.Atoi(vars["id"])
@@ -163,11 +239,29 @@ func (c *CRMHandlers) UpdateCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	company.ID = companyID // Ensure the ID from the URL is used
+	// Records shared for writing are edited in their owner's organization
+	ownerOrg, ownerID, ok := c.writableRecord(w, models.EntityCompany, companyID, orgID, userID)
+	if !ok {
+		return
+	}
+	stage, ok := c.resolvePipelineStage(w, ownerOrg, ownerID, company.PipelineStage)
+	if !ok {
+		return
+	}
+	company.PipelineStage = stage.Name
+	customValues, ok := c.customFieldValues(w, ownerOrg, models.EntityCompany, company.CustomFields, false)
+	if !ok {
+		return
+	}
+
+	before := c.snapshot(models.EntityCompany, companyID)
+	var previousStage *string
+	c.DB.QueryRow("SELECT pipeline_stage FROM companies WHERE id = ? AND org_id = ?", companyID, ownerOrg).Scan(&previousStage)
 
 	db := c.DB
 	stmt, err := db.Prepare(`
 	UPDATE companies SET name = ?, website = ?, industry = ?, notes = ?, company_size = ?, address = ?, phone_number = ?, pipeline_stage = ?, updated_at = CURRENT_TIMESTAMP
-	WHERE id = ? AND user_id = ?
+	WHERE id = ? AND org_id = ?
 	`)
 	if err != nil {
 		log.Printf("Error preparing statement: %v", err)
@@ -186,7 +280,7 @@ func (c *CRMHandlers) UpdateCompany(w http.ResponseWriter, r *http.Request) {
 		company.PhoneNumber,
 		company.PipelineStage,
 		company.ID,
-		userID,
+		ownerOrg,
 	)
 	if err != nil {
 		log.Printf("Error updating company: %v", err)
@@ -199,19 +293,31 @@ func (c *CRMHandlers) UpdateCompany(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusNotFound, "Company not found or unauthorized to update")
 		return
 	}
+	if !c.saveCustomFields(w, c.DB, models.EntityCompany, companyID, customValues) {
+		return
+	}
+	c.recordStageChange(ownerID, userID, models.EntityCompany, companyID, stage, previousStage)
+	custom, ok := c.loadCustomFields(w, models.EntityCompany, []int{companyID})
+	if !ok {
+		return
+	}
+	company.CustomFields = custom[companyID]
 
 	// Retrieve updated company to return
 	company.UpdatedAt = time.Now().Format(time.RFC3339) // Update timestamp
+	c.audit(w, r, events.ActionUpdated, models.EntityCompany, companyID, before)
+	c.publish(ownerID, models.EntityCompany, events.ActionUpdated, companyID, company)
 	utils.RespondJSON(w, http.StatusOK, company)
 }
 
-// DeleteCompany deletes a company.
+// DeleteCompany moves a company to the trash.
 func (c *CRMHandlers) DeleteCompany(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	companyID, err := strconv.Atoi(vars["id"])
@@ -220,19 +326,18 @@ func (c *CRMHandlers) DeleteCompany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := c.DB
-	result, err := db.Exec("DELETE FROM companies WHERE id = ? AND user_id = ?", companyID, userID)
+	trashed, err := c.moveToTrash(orgID, models.EntityCompany, companyID)
 	if err != nil {
 		log.Printf("Error deleting company: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete company")
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if len(trashed) == 0 {
 		utils.RespondError(w, http.StatusNotFound, "Company not found or unauthorized to delete")
 		return
 	}
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+	c.publish(userID, models.EntityCompany, events.ActionDeleted, companyID, nil)
 
 	utils.RespondJSON(w, http.StatusNoContent, nil) // 204 No Content for successful deletion
 }
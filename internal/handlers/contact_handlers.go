@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/utils"
 	"net/http"
@@ -21,6 +22,7 @@ func (c *CRMHandlers) CreateContact(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	var contact models.Contact
 	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
@@ -28,6 +30,17 @@ func (c *CRMHandlers) CreateContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	contact.UserID = userID // Assign the authenticated user's ID
+	var stage models.Stage
+	if contact.PipelineStage != nil {
+		if stage, ok = c.resolvePipelineStage(w, orgID, userID, *contact.PipelineStage); !ok {
+			return
+		}
+		contact.PipelineStage = &stage.Name
+	}
+	customValues, ok := c.customFieldValues(w, orgID, models.EntityContact, contact.CustomFields, true)
+	if !ok {
+		return
+	}
 
 	db := c.DB
 	stmt, err := db.Prepare(`INSERT INTO contacts (user_id, company_id, first_name, last_name, email, phone_number, job_title, notes, last_interaction_at, next_action_at, next_action_description, pipeline_stage) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
@@ -60,9 +73,22 @@ func (c *CRMHandlers) CreateContact(w http.ResponseWriter, r *http.Request) {
 
 	id, _ := result.LastInsertId()
 	contact.ID = int(id)
+	if !c.saveCustomFields(w, db, models.EntityContact, contact.ID, customValues) {
+		return
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityContact, []int{contact.ID})
+	if !ok {
+		return
+	}
+	contact.CustomFields = custom[contact.ID]
+	if contact.PipelineStage != nil {
+		c.recordStageChange(userID, userID, models.EntityContact, contact.ID, stage, nil)
+	}
 	contact.CreatedAt = time.Now().Format(time.RFC3339)
 	contact.UpdatedAt = contact.CreatedAt
 
+	c.audit(w, r, events.ActionCreated, models.EntityContact, contact.ID, nil)
+	c.publish(userID, models.EntityContact, events.ActionCreated, contact.ID, contact)
 	utils.RespondJSON(w, http.StatusCreated, contact)
 }
 
@@ -73,6 +99,7 @@ func (c *CRMHandlers) GetContact(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	contactID, err := strconv.Atoi(vars["id"])
@@ -87,10 +114,9 @@ func (c *CRMHandlers) GetContact(w http.ResponseWriter, r *http.Request) {
 			phone_number, job_title, notes, created_at, updated_at,
 			last_interaction_at, next_action_at, next_action_description, pipeline_stage
 		FROM contacts 
-		WHERE id = ? AND user_id = ?
-	`
+		WHERE id = ? AND ` + visibleClause(false)
 
-	err = c.DB.QueryRow(query, contactID, userID).Scan(
+	err = c.DB.QueryRow(query, append([]interface{}{contactID}, visibleArgs(models.EntityContact, orgID, userID)...)...).Scan(
 		&contact.ID, &contact.UserID, &contact.CompanyID, &contact.FirstName, &contact.LastName, &contact.Email,
 		&contact.PhoneNumber, &contact.JobTitle, &contact.Notes, &contact.CreatedAt, &contact.UpdatedAt,
 		&contact.LastInteractionAt, &contact.NextActionAt, &contact.NextActionDescription, &contact.PipelineStage,
@@ -105,17 +131,31 @@ func (c *CRMHandlers) GetContact(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityContact, []int{contact.ID})
+	if !ok {
+		return
+	}
+	contact.Tags = tagged[contact.ID]
+	custom, ok := c.loadCustomFields(w, models.EntityContact, []int{contact.ID})
+	if !ok {
+		return
+	}
+	contact.CustomFields = custom[contact.ID]
 
 	utils.RespondJSON(w, http.StatusOK, contact)
 }
 
-// ListContacts retrieves all contacts for the authenticated user.
+// ListContacts retrieves all contacts of the authenticated user's organization
+// and those shared with the user, optionally filtered by tag (repeatable; a
+// contact must carry every tag named), by custom fields, by a saved segment and
+// by a filter expression, and sorted by a custom field.
 func (c *CRMHandlers) ListContacts(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	query := `
 		SELECT 
@@ -123,10 +163,30 @@ func (c *CRMHandlers) ListContacts(w http.ResponseWriter, r *http.Request) {
 			phone_number, job_title, notes, created_at, updated_at,
 			last_interaction_at, next_action_at, next_action_description, pipeline_stage
 		FROM contacts
-		WHERE user_id = ?
-	`
+		WHERE ` + visibleClause(false)
+	args := visibleArgs(models.EntityContact, orgID, userID)
 
-	rows, err := c.DB.Query(query, userID)
+	filter, filterArgs := tagFilter(r, orgID, models.EntityContact, "id")
+	query += filter
+	args = append(args, filterArgs...)
+	filter, filterArgs, ok = c.segmentFilter(w, r, orgID, models.EntityContact, "contacts.id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	filter, filterArgs, order, orderArgs, ok := c.customFieldQuery(w, r, orgID, models.EntityContact, "id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	if order != "" {
+		query += " ORDER BY " + order + ", id"
+		args = append(args, orderArgs...)
+	}
+
+	rows, err := c.DB.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying contacts: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
@@ -168,6 +228,23 @@ func (c *CRMHandlers) ListContacts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ids := make([]int, len(contacts))
+	for i, contact := range contacts {
+		ids[i] = contact.ID
+	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityContact, ids)
+	if !ok {
+		return
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityContact, ids)
+	if !ok {
+		return
+	}
+	for i := range contacts {
+		contacts[i].Tags = tagged[contacts[i].ID]
+		contacts[i].CustomFields = custom[contacts[i].ID]
+	}
+
 	utils.RespondJSON(w, http.StatusOK, contacts)
 }
 
@@ -178,6 +255,7 @@ func (c *CRMHandlers) UpdateContact(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	contactID, err := strconv.Atoi(vars["id"])
@@ -192,9 +270,29 @@ func (c *CRMHandlers) UpdateContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	contact.ID = contactID // Ensure the ID from the URL is used
+	// Records shared for writing are edited in their owner's organization
+	ownerOrg, ownerID, ok := c.writableRecord(w, models.EntityContact, contactID, orgID, userID)
+	if !ok {
+		return
+	}
+	var stage models.Stage
+	if contact.PipelineStage != nil {
+		if stage, ok = c.resolvePipelineStage(w, ownerOrg, ownerID, *contact.PipelineStage); !ok {
+			return
+		}
+		contact.PipelineStage = &stage.Name
+	}
+	customValues, ok := c.customFieldValues(w, ownerOrg, models.EntityContact, contact.CustomFields, false)
+	if !ok {
+		return
+	}
+
+	before := c.snapshot(models.EntityContact, contactID)
+	var previousStage *string
+	c.DB.QueryRow("SELECT pipeline_stage FROM contacts WHERE id = ? AND org_id = ?", contactID, ownerOrg).Scan(&previousStage)
 
 	db := c.DB
-	stmt, err := db.Prepare(`UPDATE contacts SET company_id = ?, first_name = ?, last_name = ?, email = ?, phone_number = ?, job_title = ?, notes = ?, last_interaction_at = ?, next_action_at = ?, next_action_description = ?, pipeline_stage = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`)
+	stmt, err := db.Prepare(`UPDATE contacts SET company_id = ?, first_name = ?, last_name = ?, email = ?, phone_number = ?, job_title = ?, notes = ?, last_interaction_at = ?, next_action_at = ?, next_action_description = ?, pipeline_stage = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND org_id = ?`)
 	if err != nil {
 		log.Printf("Error preparing statement: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
@@ -215,7 +313,7 @@ func (c *CRMHandlers) UpdateContact(w http.ResponseWriter, r *http.Request) {
 		contact.NextActionDescription,
 		contact.PipelineStage,
 		contact.ID,
-		userID,
+		ownerOrg,
 	)
 	if err != nil {
 		log.Printf("Error updating contact: %v", err)
@@ -228,18 +326,32 @@ func (c *CRMHandlers) UpdateContact(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusNotFound, "Contact not found or unauthorized to update")
 		return
 	}
+	if !c.saveCustomFields(w, db, models.EntityContact, contactID, customValues) {
+		return
+	}
+	if contact.PipelineStage != nil {
+		c.recordStageChange(ownerID, userID, models.EntityContact, contactID, stage, previousStage)
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityContact, []int{contactID})
+	if !ok {
+		return
+	}
+	contact.CustomFields = custom[contactID]
 
 	contact.UpdatedAt = time.Now().Format(time.RFC3339)
+	c.audit(w, r, events.ActionUpdated, models.EntityContact, contactID, before)
+	c.publish(ownerID, models.EntityContact, events.ActionUpdated, contactID, contact)
 	utils.RespondJSON(w, http.StatusOK, contact)
 }
 
-// DeleteContact deletes a contact.
+// DeleteContact moves a contact and its interactions to the trash.
 func (c *CRMHandlers) DeleteContact(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	contactID, err := strconv.Atoi(vars["id"])
@@ -248,19 +360,18 @@ func (c *CRMHandlers) DeleteContact(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := c.DB
-	result, err := db.Exec("DELETE FROM contacts WHERE id = ? AND user_id = ?", contactID, userID)
+	trashed, err := c.moveToTrash(orgID, models.EntityContact, contactID)
 	if err != nil {
 		log.Printf("Error deleting contact: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete contact")
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if len(trashed) == 0 {
 		utils.RespondError(w, http.StatusNotFound, "Contact not found or unauthorized to delete")
 		return
 	}
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+	c.publish(userID, models.EntityContact, events.ActionDeleted, contactID, nil)
 
 	utils.RespondJSON(w, http.StatusNoContent, nil)
 }
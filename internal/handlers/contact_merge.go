@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/duplicates"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/trash"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const contactColumns = `id, user_id, company_id, first_name, last_name, email,
+	phone_number, job_title, notes, created_at, updated_at,
+	last_interaction_at, next_action_at, next_action_description, pipeline_stage`
+
+func scanContact(row interface{ Scan(...interface{}) error }, contact *models.Contact) error {
+	return row.Scan(
+		&contact.ID, &contact.UserID, &contact.CompanyID, &contact.FirstName, &contact.LastName, &contact.Email,
+		&contact.PhoneNumber, &contact.JobTitle, &contact.Notes, &contact.CreatedAt, &contact.UpdatedAt,
+		&contact.LastInteractionAt, &contact.NextActionAt, &contact.NextActionDescription, &contact.PipelineStage,
+	)
+}
+
+// mergeFields are the contact fields a merge can take from a duplicate. The
+// pipeline stage stays the surviving contact's, and last_interaction_at becomes
+// the latest of all.
+var mergeFields = []string{
+	"company_id", "first_name", "last_name", "email", "phone_number", "job_title", "notes",
+	"next_action_at", "next_action_description",
+}
+
+// mergedRecords are the records moved to the surviving contact, audited as updates.
+var mergedRecords = []struct{ entityType, table string }{
+	{models.EntityInteraction, "interactions"},
+	{models.EntityTask, "tasks"},
+	{models.EntityFile, "files"},
+}
+
+// FindContactDuplicates lists pairs of the organization's contacts that look
+// like the same person: the same email, the same normalized phone number, or
+// similar names at the same company. Pairs with the most reasons come first.
+// Query parameters: contact_id, to list only the duplicates of one contact.
+func (c *CRMHandlers) FindContactDuplicates(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var contactID int
+	if contactIDStr := r.URL.Query().Get("contact_id"); contactIDStr != "" {
+		id, err := strconv.Atoi(contactIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid contact_id parameter")
+			return
+		}
+		contactID = id
+	}
+
+	rows, err := c.DB.Query("SELECT "+contactColumns+" FROM contacts WHERE org_id = ? AND deleted_at IS NULL ORDER BY id", orgID)
+	if err != nil {
+		log.Printf("Error querying contacts: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var contacts []models.Contact
+	for rows.Next() {
+		var contact models.Contact
+		if err := scanContact(rows, &contact); err != nil {
+			log.Printf("Error scanning contact row: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Row iteration error: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database iteration error")
+		return
+	}
+
+	list := []models.ContactDuplicate{}
+	for _, d := range duplicates.Find(contacts) {
+		if contactID == 0 || d.Contacts[0].ID == contactID || d.Contacts[1].ID == contactID {
+			list = append(list, d)
+		}
+	}
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// MergeContacts merges duplicates into the contact of the request path in one
+// transaction: the surviving contact takes the chosen field values, the
+// duplicates' interactions, tasks, files, deals, mail, tags, custom field
+// values, relationships and affiliations are moved over to it, and the
+// duplicates go to the trash.
+func (c *CRMHandlers) MergeContacts(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	contactID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid contact ID")
+		return
+	}
+	var payload models.ContactMergePayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if len(payload.DuplicateIDs) == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "duplicate_ids is required")
+		return
+	}
+	merged := map[int]bool{contactID: true}
+	for _, id := range payload.DuplicateIDs {
+		if merged[id] {
+			utils.RespondError(w, http.StatusBadRequest, "duplicate_ids must be distinct and exclude the surviving contact")
+			return
+		}
+		merged[id] = true
+	}
+	for field, id := range payload.Fields {
+		if !slices.Contains(mergeFields, field) {
+			utils.RespondError(w, http.StatusBadRequest, "Fields cannot include "+field+"; use one of "+strings.Join(mergeFields, ", "))
+			return
+		}
+		if !merged[id] {
+			utils.RespondError(w, http.StatusBadRequest, "Field "+field+" must come from one of the merged contacts")
+			return
+		}
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// Snapshots hold every stored field, which is what the field picks need
+	ids := append([]int{contactID}, payload.DuplicateIDs...)
+	snapshots := make(map[int]map[string]interface{}, len(ids))
+	for _, id := range ids {
+		snapshot, err := audit.Snapshot(tx, models.EntityContact, id)
+		if err != nil {
+			log.Printf("Error loading contact: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if org, _ := audit.OrgOf(snapshot); snapshot == nil || org != orgID || snapshot["deleted_at"] != nil {
+			utils.RespondError(w, http.StatusNotFound, "Contact not found or unauthorized")
+			return
+		}
+		snapshots[id] = snapshot
+	}
+
+	var (
+		sets []string
+		args []interface{}
+	)
+	for _, field := range mergeFields {
+		value := snapshots[contactID][field]
+		if from, ok := payload.Fields[field]; ok {
+			value = snapshots[from][field]
+		} else {
+			for _, id := range ids {
+				if !emptyValue(snapshots[id][field]) {
+					value = snapshots[id][field]
+					break
+				}
+			}
+		}
+		sets = append(sets, field+" = ?")
+		args = append(args, value)
+	}
+	var lastInteraction interface{}
+	for _, id := range ids {
+		if at, ok := snapshots[id]["last_interaction_at"].(string); ok {
+			if latest, _ := lastInteraction.(string); at > latest {
+				lastInteraction = at
+			}
+		}
+	}
+	sets = append(sets, "last_interaction_at = ?", "updated_at = CURRENT_TIMESTAMP")
+	args = append(args, lastInteraction, contactID)
+	if _, err := tx.Exec("UPDATE contacts SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		log.Printf("Error updating merged contact: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to merge contacts")
+		return
+	}
+
+	var (
+		moves   []pendingAudit
+		trashed []trash.Record
+	)
+	deletedAt := trash.Now()
+	for _, duplicateID := range payload.DuplicateIDs {
+		for _, ref := range mergedRecords {
+			records, err := snapshotRecords(tx, ref.entityType, "SELECT id FROM "+ref.table+" WHERE contact_id = ?", duplicateID)
+			if err != nil {
+				log.Printf("Error querying %s of merged contact: %v", ref.table, err)
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to merge contacts")
+				return
+			}
+			moves = append(moves, records...)
+		}
+		if err := moveContactReferences(tx, duplicateID, contactID); err != nil {
+			log.Printf("Error moving records of merged contact: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to merge contacts")
+			return
+		}
+		records, err := trash.Move(tx, models.EntityContact, duplicateID, orgID, deletedAt)
+		if err != nil {
+			log.Printf("Error deleting merged contact: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to merge contacts")
+			return
+		}
+		trashed = append(trashed, records...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing contact merge: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to merge contacts")
+		return
+	}
+
+	c.audit(w, r, events.ActionUpdated, models.EntityContact, contactID, snapshots[contactID])
+	c.auditPending(w, r, moves)
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+
+	var contact models.Contact
+	if err := scanContact(c.DB.QueryRow("SELECT "+contactColumns+" FROM contacts WHERE id = ?", contactID), &contact); err != nil {
+		log.Printf("Error fetching merged contact: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve contact")
+		return
+	}
+	c.publish(userID, models.EntityContact, events.ActionUpdated, contactID, contact)
+	for _, record := range trashed {
+		c.publish(userID, models.EntityContact, events.ActionDeleted, record.ID, nil)
+	}
+	utils.RespondJSON(w, http.StatusOK, contact)
+}
+
+// moveContactReferences points everything that referenced contact from at
+// contact to instead. Deal and mail links, tags, custom field values and
+// relationships contact to already has are dropped, and so are relationships
+// between the two.
+func moveContactReferences(tx *sql.Tx, from, to int) error {
+	for _, stmt := range []string{
+		"UPDATE interactions SET contact_id = ?2 WHERE contact_id = ?1",
+		"UPDATE tasks SET contact_id = ?2 WHERE contact_id = ?1",
+		"UPDATE files SET contact_id = ?2 WHERE contact_id = ?1",
+		"UPDATE task_series SET contact_id = ?2 WHERE contact_id = ?1",
+		"UPDATE outbox SET contact_id = ?2 WHERE contact_id = ?1",
+		"UPDATE OR IGNORE email_messages SET contact_id = ?2 WHERE contact_id = ?1",
+		"DELETE FROM email_messages WHERE contact_id = ?1",
+		"INSERT OR IGNORE INTO deal_contacts (deal_id, contact_id) SELECT deal_id, ?2 FROM deal_contacts WHERE contact_id = ?1",
+		"DELETE FROM deal_contacts WHERE contact_id = ?1",
+		"UPDATE OR IGNORE record_tags SET entity_id = ?2 WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?1",
+		"DELETE FROM record_tags WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?1",
+		"UPDATE OR IGNORE custom_field_values SET entity_id = ?2 WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?1",
+		"DELETE FROM custom_field_values WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?1",
+		"UPDATE OR IGNORE contact_relationships SET contact_id = ?2 WHERE contact_id = ?1 AND related_id != ?2",
+		"UPDATE OR IGNORE contact_relationships SET related_id = ?2 WHERE related_id = ?1 AND contact_id != ?2",
+		"DELETE FROM contact_relationships WHERE contact_id = ?1 OR related_id = ?1",
+		"UPDATE contact_affiliations SET contact_id = ?2 WHERE contact_id = ?1",
+	} {
+		if _, err := tx.Exec(stmt, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// emptyValue reports whether a snapshot field holds no value worth keeping.
+func emptyValue(v interface{}) bool {
+	s, isString := v.(string)
+	return v == nil || (isString && strings.TrimSpace(s) == "")
+}
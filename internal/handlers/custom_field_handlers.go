@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/customfields"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// customFieldValues validates the custom_fields of a record payload against the
+// organization's fields for entityType, writing the error response itself when
+// they are rejected.
+func (c *CRMHandlers) customFieldValues(w http.ResponseWriter, orgID int, entityType string, input map[string]interface{}, creating bool) ([]customfields.Value, bool) {
+	if len(input) == 0 && !creating {
+		return nil, true
+	}
+	fields, err := customfields.Definitions(c.DB, orgID, entityType)
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	values, err := customfields.Parse(fields, input, creating)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return values, true
+}
+
+// saveCustomFields stores validated custom field values of a record, writing
+// the error response itself when it fails.
+func (c *CRMHandlers) saveCustomFields(w http.ResponseWriter, q customfields.Querier, entityType string, id int, values []customfields.Value) bool {
+	if err := customfields.Save(q, entityType, id, values); err != nil {
+		log.Printf("Error saving %s custom fields: %v", entityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to save custom fields")
+		return false
+	}
+	return true
+}
+
+// loadCustomFields loads the custom field values of records of entityType by
+// record id, writing the error response itself when it fails.
+func (c *CRMHandlers) loadCustomFields(w http.ResponseWriter, entityType string, ids []int) (map[int]map[string]interface{}, bool) {
+	values, err := customfields.Load(c.DB, entityType, ids)
+	if err != nil {
+		log.Printf("Error loading %s custom fields: %v", entityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	return values, true
+}
+
+// customFieldQuery reads the custom field filters and sort of a list request
+// for records of entityType whose id is column. It returns the condition to AND
+// to the query and the ORDER BY expression, "" without a sort, each with its
+// arguments, and writes the error response itself when not ok.
+func (c *CRMHandlers) customFieldQuery(w http.ResponseWriter, r *http.Request, orgID int, entityType, column string) (string, []interface{}, string, []interface{}, bool) {
+	params := r.URL.Query()
+	used := params.Get("sort") != ""
+	for param := range params {
+		used = used || strings.HasPrefix(param, customfields.ParamPrefix)
+	}
+	if !used {
+		return "", nil, "", nil, true
+	}
+	fields, err := customfields.Definitions(c.DB, orgID, entityType)
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return "", nil, "", nil, false
+	}
+	filter, args, order, orderArgs, err := customfields.Query(fields, column, params)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, err.Error())
+		return "", nil, "", nil, false
+	}
+	return filter, args, order, orderArgs, true
+}
+
+// customFieldFromRequest loads the field named by the {id} route variable,
+// writing the error response itself when it is missing or belongs to another
+// organization.
+func (c *CRMHandlers) customFieldFromRequest(w http.ResponseWriter, r *http.Request, orgID int) (models.CustomField, bool) {
+	var field models.CustomField
+	fieldID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid custom field ID")
+		return field, false
+	}
+	err = customfields.Scan(c.DB.QueryRow("SELECT "+customfields.Columns+" FROM custom_fields WHERE id = ? AND org_id = ?", fieldID, orgID), &field)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Custom field not found or unauthorized")
+		return field, false
+	}
+	if err != nil {
+		log.Printf("Error querying custom field: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return field, false
+	}
+	return field, true
+}
+
+// respondCustomField writes the stored field.
+func (c *CRMHandlers) respondCustomField(w http.ResponseWriter, status int, fieldID int) {
+	var field models.CustomField
+	if err := customfields.Scan(c.DB.QueryRow("SELECT "+customfields.Columns+" FROM custom_fields WHERE id = ?", fieldID), &field); err != nil {
+		log.Printf("Error fetching custom field: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve custom field")
+		return
+	}
+	utils.RespondJSON(w, status, field)
+}
+
+// ListCustomFields retrieves the organization's custom fields in display order.
+// Query parameters: entity_type.
+func (c *CRMHandlers) ListCustomFields(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	query := "SELECT " + customfields.Columns + " FROM custom_fields WHERE org_id = ?"
+	args := []interface{}{orgID}
+	if entityType := r.URL.Query().Get("entity_type"); entityType != "" {
+		if _, ok := customfields.Tables[entityType]; !ok {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid entity_type parameter")
+			return
+		}
+		query += " AND entity_type = ?"
+		args = append(args, entityType)
+	}
+	rows, err := c.DB.Query(query+" ORDER BY entity_type, position, id", args...)
+	if err != nil {
+		log.Printf("Error querying custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.CustomField{}
+	for rows.Next() {
+		var field models.CustomField
+		if err := customfields.Scan(rows, &field); err != nil {
+			log.Printf("Error scanning custom field row: %v", err)
+			continue
+		}
+		list = append(list, field)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating custom field rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// CreateCustomField defines a custom field for one record type. Owners and
+// admins only.
+func (c *CRMHandlers) CreateCustomField(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+	var field models.CustomField
+	if err := json.NewDecoder(r.Body).Decode(&field); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := customfields.Validate(&field); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	options, err := customfields.EncodeOptions(field)
+	if err != nil {
+		log.Printf("Error encoding custom field options: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create custom field")
+		return
+	}
+
+	var exists bool
+	c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM custom_fields WHERE org_id = ? AND entity_type = ? AND field_key = ?)",
+		orgID, field.EntityType, field.Key).Scan(&exists)
+	if exists {
+		utils.RespondError(w, http.StatusConflict, "A custom field with this key already exists")
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	INSERT INTO custom_fields (org_id, entity_type, field_key, label, field_type, options, required, position, created_by)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		orgID, field.EntityType, field.Key, field.Label, field.Type, options, field.Required, field.Position, userID,
+	)
+	if err != nil {
+		log.Printf("Error inserting custom field: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create custom field")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	c.respondCustomField(w, http.StatusCreated, int(id))
+}
+
+// UpdateCustomField changes a field's label, options, required flag or
+// position. Its entity type, key and type stay; options still in use cannot be
+// removed. Owners and admins only.
+func (c *CRMHandlers) UpdateCustomField(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+	field, ok := c.customFieldFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	var payload models.CustomField
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if (payload.EntityType != "" && payload.EntityType != field.EntityType) ||
+		(payload.Key != "" && payload.Key != field.Key) ||
+		(payload.Type != "" && payload.Type != field.Type) {
+		utils.RespondError(w, http.StatusBadRequest, "entity_type, key and type cannot change; create another field instead")
+		return
+	}
+	payload.EntityType, payload.Key, payload.Type = field.EntityType, field.Key, field.Type
+	if msg := customfields.Validate(&payload); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	options, err := customfields.EncodeOptions(payload)
+	if err != nil {
+		log.Printf("Error encoding custom field options: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update custom field")
+		return
+	}
+
+	if payload.Options != nil {
+		inUse, err := optionsInUse(c.DB, field.ID, payload.Options)
+		if err != nil {
+			log.Printf("Error checking custom field options: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if inUse {
+			utils.RespondError(w, http.StatusConflict, "Records still use an option being removed")
+			return
+		}
+	}
+
+	if _, err := c.DB.Exec("UPDATE custom_fields SET label = ?, options = ?, required = ?, position = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		payload.Label, options, payload.Required, payload.Position, field.ID); err != nil {
+		log.Printf("Error updating custom field: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update custom field")
+		return
+	}
+
+	c.respondCustomField(w, http.StatusOK, field.ID)
+}
+
+// optionsInUse reports whether a select or multi_select field has a value
+// outside options.
+func optionsInUse(q customfields.Querier, fieldID int, options []string) (bool, error) {
+	args := []interface{}{fieldID}
+	for _, option := range options {
+		args = append(args, option)
+	}
+	in := "(?" + strings.Repeat(", ?", len(options)-1) + ")"
+	var inUse bool
+	err := q.QueryRow(`
+	SELECT EXISTS(
+		SELECT 1 FROM custom_field_values v,
+			json_each(CASE WHEN json_valid(v.value) AND json_type(v.value) = 'array' THEN v.value ELSE json_array(v.value) END) o
+		WHERE v.field_id = ? AND o.value NOT IN `+in+`)`, args...).Scan(&inUse)
+	return inUse, err
+}
+
+// DeleteCustomField removes a field and its values from every record. Owners
+// and admins only.
+func (c *CRMHandlers) DeleteCustomField(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+	field, ok := c.customFieldFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM custom_fields WHERE id = ?", field.ID); err != nil {
+		log.Printf("Error deleting custom field: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete custom field")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing custom field delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete custom field")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
@@ -3,57 +3,78 @@ package handlers
 import (
 	"encoding/json"
 	"micro-CRM/internal/models"
+	"micro-CRM/internal/pipelines"
 	"micro-CRM/internal/utils"
 	"net/http"
+	"strings"
 )
 
 func (c *CRMHandlers) GetDashboardStats(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
 
 	// Query your database for stats
 	var stats models.DashboardStats
 
 	// Example queries (adjust based on your database schema)
-	c.DB.QueryRow("SELECT COUNT(*) FROM contacts WHERE user_id = ?", userID).Scan(&stats.TotalContacts)
-	c.DB.QueryRow("SELECT COUNT(*) FROM companies WHERE user_id = ?", userID).Scan(&stats.TotalCompanies)
-	c.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE user_id = ?", userID).Scan(&stats.TotalTasks)
-	c.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE user_id = ? AND status = 'pending'", userID).Scan(&stats.PendingTasks)
-	c.DB.QueryRow("SELECT COUNT(*) FROM interactions WHERE user_id = ? AND follow_up_date > CURRENT_TIMESTAMP ", userID).Scan(&stats.UpcomingInteractions)
-	c.DB.QueryRow("SELECT COUNT(*) FROM files WHERE user_id = ?", userID).Scan(&stats.FilesUploaded)
+	c.DB.QueryRow("SELECT COUNT(*) FROM contacts WHERE org_id = ? AND deleted_at IS NULL", orgID).Scan(&stats.TotalContacts)
+	c.DB.QueryRow("SELECT COUNT(*) FROM companies WHERE org_id = ? AND deleted_at IS NULL", orgID).Scan(&stats.TotalCompanies)
+	c.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE org_id = ? AND deleted_at IS NULL", orgID).Scan(&stats.TotalTasks)
+	c.DB.QueryRow("SELECT COUNT(*) FROM tasks WHERE org_id = ? AND deleted_at IS NULL AND status = 'pending'", orgID).Scan(&stats.PendingTasks)
+	c.DB.QueryRow("SELECT COUNT(*) FROM interactions WHERE org_id = ? AND deleted_at IS NULL AND follow_up_date > CURRENT_TIMESTAMP ", orgID).Scan(&stats.UpcomingInteractions)
+	c.DB.QueryRow("SELECT COUNT(*) FROM files WHERE org_id = ? AND deleted_at IS NULL", orgID).Scan(&stats.FilesUploaded)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
 func (c *CRMHandlers) GetPipelineData(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
 
-	rows, err := c.DB.Query(`
-		SELECT pipeline_stage, COUNT(*) as count 
-		FROM companies 
-		WHERE user_id = ? 
-		GROUP BY pipeline_stage
-	`, userID)
+	pipelineID, ok := c.pipelineParam(w, r, orgID, userID)
+	if !ok {
+		return
+	}
+	stages, err := pipelines.Stages(c.DB, pipelineID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var pipelineData []models.PipelineStage
-	colors := map[string]string{
-		"Lead":        "#8884d8",
-		"Qualified":   "#82ca9d",
-		"Proposal":    "#ffc658",
-		"Prospect":    "#aabbcc",
-		"Negotiation": "#ff7300",
-		"Closed Won":  "#00ff00",
-		"Closed Lost": "#ff0000",
+	// Amounts are summed as-is; pass ?currency= to keep totals in one currency
+	query := `
+		SELECT stage, COUNT(*) as count, COALESCE(SUM(amount), 0), COALESCE(SUM(amount * probability / 100.0), 0)
+		FROM deals
+		WHERE org_id = ? AND pipeline_id = ? AND deleted_at IS NULL`
+	args := []interface{}{orgID, pipelineID}
+	if currency := r.URL.Query().Get("currency"); currency != "" {
+		query += " AND currency = ?"
+		args = append(args, strings.ToUpper(currency))
+	}
+	query += " GROUP BY stage"
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	defer rows.Close()
 
+	byStage := make(map[string]models.PipelineStage)
 	for rows.Next() {
 		var stage models.PipelineStage
-		rows.Scan(&stage.Stage, &stage.Count)
-		stage.Color = colors[stage.Stage]
+		if err := rows.Scan(&stage.Stage, &stage.Count, &stage.Value, &stage.WeightedValue); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byStage[stage.Stage] = stage
+	}
+
+	// Every stage is reported in pipeline order, empty ones with zero counts
+	pipelineData := make([]models.PipelineStage, 0, len(stages))
+	for _, s := range stages {
+		stage := byStage[s.Name]
+		stage.Stage = s.Name
+		stage.Color = s.Color
 		pipelineData = append(pipelineData, stage)
 	}
 
@@ -63,7 +84,7 @@ func (c *CRMHandlers) GetPipelineData(w http.ResponseWriter, r *http.Request) {
 
 // GetInteractionTrends returns interaction trends over time
 func (c *CRMHandlers) GetInteractionTrends(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
 
 	rows, err := c.DB.Query(`
 		SELECT
@@ -72,11 +93,11 @@ func (c *CRMHandlers) GetInteractionTrends(w http.ResponseWriter, r *http.Reques
 			SUM(CASE WHEN type = 'Email' THEN 1 ELSE 0 END) as emails,
 			SUM(CASE WHEN type = 'Meeting' THEN 1 ELSE 0 END) as meetings
 		FROM interactions
-		WHERE user_id = ?
+		WHERE org_id = ? AND deleted_at IS NULL
 			AND DATE(interaction_at) >= DATE('now', '-30 days')
 		GROUP BY DATE(interaction_at)
 		ORDER BY DATE(interaction_at)
-	`, userID)
+	`, orgID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -101,15 +122,15 @@ func (c *CRMHandlers) GetInteractionTrends(w http.ResponseWriter, r *http.Reques
 	utils.RespondJSON(w, http.StatusOK, trends)
 }
 func (c *CRMHandlers) GetRecentInteractions(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
 	rows, err := c.DB.Query(`
 		SELECT i.contact_id, c.first_name, c.last_name, i.type, i.description, i.duration, i.interaction_at
 		FROM interactions i
 		JOIN contacts c ON i.contact_id = c.id
-		WHERE i.user_id = ?
+		WHERE i.org_id = ? AND i.deleted_at IS NULL
 		ORDER BY i.interaction_at DESC
 		LIMIT 5
-	`, userID)
+	`, orgID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -139,7 +160,7 @@ func (c *CRMHandlers) GetRecentInteractions(w http.ResponseWriter, r *http.Reque
 	utils.RespondJSON(w, http.StatusOK, recentInteractions)
 }
 func (c *CRMHandlers) GetSuggestedContacts(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
 
 	query := `
         SELECT 
@@ -150,24 +171,24 @@ func (c *CRMHandlers) GetSuggestedContacts(w http.ResponseWriter, r *http.Reques
             co.name AS company,
             MIN(due_info.due) AS next_due
         FROM contacts c
-        LEFT JOIN companies co ON c.company_id = co.id
+        LEFT JOIN companies co ON c.company_id = co.id AND co.deleted_at IS NULL
         LEFT JOIN (
             SELECT contact_id, MIN(due_date) AS due FROM tasks 
-            WHERE user_id = ? AND status != 'Done' AND due_date IS NOT NULL 
+            WHERE org_id = ? AND deleted_at IS NULL AND status != 'Done' AND due_date IS NOT NULL 
             GROUP BY contact_id
             UNION
             SELECT contact_id, MIN(follow_up_date) AS due FROM interactions 
-            WHERE user_id = ? AND follow_up_date IS NOT NULL 
+            WHERE org_id = ? AND deleted_at IS NULL AND follow_up_date IS NOT NULL 
             GROUP BY contact_id
         ) AS due_info ON c.id = due_info.contact_id
-        WHERE c.user_id = ?
+        WHERE c.org_id = ? AND c.deleted_at IS NULL
         GROUP BY c.id
         HAVING next_due IS NOT NULL
         ORDER BY next_due ASC
         LIMIT 5;
     `
 
-	rows, err := c.DB.Query(query, userID, userID, userID)
+	rows, err := c.DB.Query(query, orgID, orgID, orgID)
 	if err != nil {
 		http.Error(w, "Failed to query suggested contacts", http.StatusInternalServerError)
 		return
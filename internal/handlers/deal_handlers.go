@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/pipelines"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const dealColumns = `id, user_id, company_id, pipeline_id, title, amount, currency, stage, probability, expected_close_date, notes, created_at, updated_at`
+
+func scanDeal(row interface{ Scan(...interface{}) error }, d *models.Deal) error {
+	d.Probability = new(int)
+	return row.Scan(
+		&d.ID, &d.UserID, &d.CompanyID, &d.PipelineID, &d.Title, &d.Amount, &d.Currency, &d.Stage, d.Probability,
+		&d.ExpectedCloseDate, &d.Notes, &d.CreatedAt, &d.UpdatedAt,
+	)
+}
+
+// validateDeal normalizes a deal payload and checks that everything it references belongs to
+// the organization. It returns a client-facing message when the payload is rejected.
+func (c *CRMHandlers) validateDeal(d *models.Deal, orgID, userID int) string {
+	d.Title = strings.TrimSpace(d.Title)
+	if d.Title == "" {
+		return "title is required"
+	}
+	if d.Amount < 0 {
+		return "amount cannot be negative"
+	}
+	d.Currency = strings.ToUpper(strings.TrimSpace(d.Currency))
+	if d.Currency == "" {
+		d.Currency = "USD"
+	}
+	if len(d.Currency) != 3 {
+		return "currency must be a three-letter ISO 4217 code"
+	}
+	if d.PipelineID == nil {
+		pipelineID, err := pipelines.EnsureDefault(c.DB, orgID, userID)
+		if err != nil {
+			log.Printf("Error loading default pipeline: %v", err)
+			return "Could not load default pipeline"
+		}
+		d.PipelineID = &pipelineID
+	} else if err := utils.ValidateOwnership(c.DB, "pipelines", *d.PipelineID, orgID); err != nil {
+		return "Invalid pipeline_id"
+	}
+	stage, err := pipelines.FindStage(c.DB, *d.PipelineID, d.Stage)
+	if errors.Is(err, pipelines.ErrUnknownStage) {
+		return "Unknown stage " + strconv.Quote(d.Stage)
+	}
+	if err != nil {
+		log.Printf("Error loading pipeline stages: %v", err)
+		return "Could not load pipeline stages"
+	}
+	d.Stage = stage.Name
+	if d.Probability == nil {
+		d.Probability = &stage.Probability
+	}
+	if *d.Probability < 0 || *d.Probability > 100 {
+		return "probability must be between 0 and 100"
+	}
+	if d.ExpectedCloseDate != nil && *d.ExpectedCloseDate != "" {
+		if _, err := time.Parse("2006-01-02", *d.ExpectedCloseDate); err != nil {
+			return "expected_close_date must be YYYY-MM-DD"
+		}
+	}
+	if d.CompanyID != nil {
+		if err := utils.ValidateOwnership(c.DB, "companies", *d.CompanyID, orgID); err != nil {
+			return "Invalid company_id"
+		}
+	}
+	for _, contactID := range d.ContactIDs {
+		if err := utils.ValidateOwnership(c.DB, "contacts", contactID, orgID); err != nil {
+			return "Invalid contact_id " + strconv.Itoa(contactID)
+		}
+	}
+	return ""
+}
+
+// setDealContacts replaces the contacts linked to a deal.
+func setDealContacts(tx *sql.Tx, dealID int, contactIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM deal_contacts WHERE deal_id = ?", dealID); err != nil {
+		return err
+	}
+	for _, contactID := range contactIDs {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO deal_contacts (deal_id, contact_id) VALUES (?, ?)", dealID, contactID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dealContactIDs fills ContactIDs for every deal in the slice.
+func (c *CRMHandlers) dealContactIDs(deals []models.Deal) error {
+	if len(deals) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Deal, len(deals))
+	args := make([]interface{}, len(deals))
+	for i := range deals {
+		deals[i].ContactIDs = []int{}
+		index[deals[i].ID] = &deals[i]
+		args[i] = deals[i].ID
+	}
+
+	rows, err := c.DB.Query(
+		"SELECT dc.deal_id, dc.contact_id FROM deal_contacts dc JOIN contacts c ON c.id = dc.contact_id"+
+			" WHERE c.deleted_at IS NULL AND dc.deal_id IN (?"+strings.Repeat(", ?", len(deals)-1)+") ORDER BY dc.contact_id",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dealID, contactID int
+		if err := rows.Scan(&dealID, &contactID); err != nil {
+			return err
+		}
+		index[dealID].ContactIDs = append(index[dealID].ContactIDs, contactID)
+	}
+	return rows.Err()
+}
+
+// publishDealStage announces a deal's stage change once it is committed.
+func (c *CRMHandlers) publishDealStage(userID, dealID, pipelineID int, stageName string, from *string) {
+	stage, err := pipelines.FindStage(c.DB, pipelineID, stageName)
+	if err != nil {
+		log.Printf("Error loading deal stage for event: %v", err)
+		return
+	}
+	c.publishStageChange(userID, models.EntityDeal, dealID, stage, from)
+}
+
+// CreateDeal handles the creation of a new deal owned by the authenticated user.
+func (c *CRMHandlers) CreateDeal(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var deal models.Deal
+	if err := json.NewDecoder(r.Body).Decode(&deal); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := c.validateDeal(&deal, orgID, userID); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	customValues, ok := c.customFieldValues(w, orgID, models.EntityDeal, deal.CustomFields, true)
+	if !ok {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	INSERT INTO deals (user_id, company_id, pipeline_id, title, amount, currency, stage, probability, expected_close_date, notes)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, deal.CompanyID, deal.PipelineID, deal.Title, deal.Amount, deal.Currency, deal.Stage, *deal.Probability,
+		deal.ExpectedCloseDate, deal.Notes,
+	)
+	if err != nil {
+		log.Printf("Error inserting deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create deal")
+		return
+	}
+	id, _ := result.LastInsertId()
+	if err := pipelines.RecordTransition(tx, userID, userID, models.EntityDeal, int(id), *deal.PipelineID, nil, deal.Stage); err != nil {
+		log.Printf("Error recording deal stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create deal")
+		return
+	}
+	if err := setDealContacts(tx, int(id), deal.ContactIDs); err != nil {
+		log.Printf("Error linking deal contacts: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create deal")
+		return
+	}
+	if !c.saveCustomFields(w, tx, models.EntityDeal, int(id), customValues) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create deal")
+		return
+	}
+
+	c.publishDealStage(userID, int(id), *deal.PipelineID, deal.Stage, nil)
+	c.respondDeal(w, http.StatusCreated, int(id))
+}
+
+// ListDeals retrieves the organization's deals and those shared with the user,
+// optionally filtered by pipeline_id, stage, company_id, contact_id or custom
+// fields. They come by expected close date unless sorted by a custom field.
+func (c *CRMHandlers) ListDeals(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	query := "SELECT " + dealColumns + " FROM deals WHERE " + visibleClause(false)
+	args := visibleArgs(models.EntityDeal, orgID, userID)
+	if pipelineIDStr := r.URL.Query().Get("pipeline_id"); pipelineIDStr != "" {
+		pipelineID, err := strconv.Atoi(pipelineIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid pipeline_id parameter")
+			return
+		}
+		query += " AND pipeline_id = ?"
+		args = append(args, pipelineID)
+	}
+	if stage := r.URL.Query().Get("stage"); stage != "" {
+		query += " AND stage = ?"
+		args = append(args, stage)
+	}
+	if companyIDStr := r.URL.Query().Get("company_id"); companyIDStr != "" {
+		companyID, err := strconv.Atoi(companyIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid company_id parameter")
+			return
+		}
+		query += " AND company_id = ?"
+		args = append(args, companyID)
+	}
+	if contactIDStr := r.URL.Query().Get("contact_id"); contactIDStr != "" {
+		contactID, err := strconv.Atoi(contactIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid contact_id parameter")
+			return
+		}
+		query += " AND id IN (SELECT deal_id FROM deal_contacts WHERE contact_id = ?)"
+		args = append(args, contactID)
+	}
+	filter, filterArgs, order, orderArgs, ok := c.customFieldQuery(w, r, orgID, models.EntityDeal, "id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	if order != "" {
+		query += " ORDER BY " + order + ", id"
+		args = append(args, orderArgs...)
+	} else {
+		query += " ORDER BY expected_close_date IS NULL, expected_close_date, id"
+	}
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying deals: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var deals []models.Deal
+	for rows.Next() {
+		var deal models.Deal
+		if err := scanDeal(rows, &deal); err != nil {
+			log.Printf("Error scanning deal row: %v", err)
+			continue
+		}
+		deals = append(deals, deal)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating deal rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	rows.Close()
+
+	if err := c.dealContactIDs(deals); err != nil {
+		log.Printf("Error querying deal contacts: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	ids := make([]int, len(deals))
+	for i, deal := range deals {
+		ids[i] = deal.ID
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityDeal, ids)
+	if !ok {
+		return
+	}
+	for i := range deals {
+		deals[i].CustomFields = custom[deals[i].ID]
+	}
+	utils.RespondJSON(w, http.StatusOK, deals)
+}
+
+// GetDeal retrieves a single deal with its linked contacts.
+func (c *CRMHandlers) GetDeal(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	dealID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid deal ID")
+		return
+	}
+	var visible bool
+	err = c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM deals WHERE id = ? AND "+visibleClause(false)+")",
+		append([]interface{}{dealID}, visibleArgs(models.EntityDeal, orgID, userID)...)...).Scan(&visible)
+	if err != nil {
+		log.Printf("Error querying deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if !visible {
+		utils.RespondError(w, http.StatusNotFound, "Deal not found or unauthorized")
+		return
+	}
+
+	c.respondDeal(w, http.StatusOK, dealID)
+}
+
+// UpdateDeal replaces a deal's fields and linked contacts.
+func (c *CRMHandlers) UpdateDeal(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	dealID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid deal ID")
+		return
+	}
+
+	var deal models.Deal
+	if err := json.NewDecoder(r.Body).Decode(&deal); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	// Deals shared for writing are edited in their owner's organization
+	ownerOrg, ownerID, ok := c.writableRecord(w, models.EntityDeal, dealID, orgID, userID)
+	if !ok {
+		return
+	}
+	if msg := c.validateDeal(&deal, ownerOrg, ownerID); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	customValues, ok := c.customFieldValues(w, ownerOrg, models.EntityDeal, deal.CustomFields, false)
+	if !ok {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		previousStage    string
+		previousPipeline sql.NullInt64
+	)
+	err = tx.QueryRow("SELECT stage, pipeline_id FROM deals WHERE id = ? AND org_id = ?", dealID, ownerOrg).Scan(&previousStage, &previousPipeline)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Deal not found or unauthorized to update")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	result, err := tx.Exec(`
+	UPDATE deals SET company_id = ?, pipeline_id = ?, title = ?, amount = ?, currency = ?, stage = ?, probability = ?,
+		expected_close_date = ?, notes = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND org_id = ?`,
+		deal.CompanyID, deal.PipelineID, deal.Title, deal.Amount, deal.Currency, deal.Stage, *deal.Probability,
+		deal.ExpectedCloseDate, deal.Notes, dealID, ownerOrg,
+	)
+	if err != nil {
+		log.Printf("Error updating deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update deal")
+		return
+	}
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Deal not found or unauthorized to update")
+		return
+	}
+	stageChanged := previousStage != deal.Stage || int(previousPipeline.Int64) != *deal.PipelineID
+	if stageChanged {
+		err := pipelines.RecordTransition(tx, ownerID, userID, models.EntityDeal, dealID, *deal.PipelineID, &previousStage, deal.Stage)
+		if err != nil {
+			log.Printf("Error recording deal stage change: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update deal")
+			return
+		}
+	}
+	if deal.ContactIDs != nil {
+		if err := setDealContacts(tx, dealID, deal.ContactIDs); err != nil {
+			log.Printf("Error linking deal contacts: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update deal")
+			return
+		}
+	}
+	if !c.saveCustomFields(w, tx, models.EntityDeal, dealID, customValues) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing deal update: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update deal")
+		return
+	}
+	if stageChanged {
+		c.publishDealStage(ownerID, dealID, *deal.PipelineID, deal.Stage, &previousStage)
+	}
+
+	c.respondDeal(w, http.StatusOK, dealID)
+}
+
+// DeleteDeal moves a deal to the trash. Linked contacts and the company are kept.
+func (c *CRMHandlers) DeleteDeal(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	dealID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid deal ID")
+		return
+	}
+
+	trashed, err := c.moveToTrash(orgID, models.EntityDeal, dealID)
+	if err != nil {
+		log.Printf("Error deleting deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete deal")
+		return
+	}
+	if len(trashed) == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Deal not found or unauthorized to delete")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// respondDeal writes the stored deal with its contacts and custom fields.
+func (c *CRMHandlers) respondDeal(w http.ResponseWriter, status int, dealID int) {
+	var deal models.Deal
+	if err := scanDeal(c.DB.QueryRow("SELECT "+dealColumns+" FROM deals WHERE id = ?", dealID), &deal); err != nil {
+		log.Printf("Error fetching deal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve deal")
+		return
+	}
+	deals := []models.Deal{deal}
+	if err := c.dealContactIDs(deals); err != nil {
+		log.Printf("Error querying deal contacts: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve deal")
+		return
+	}
+	custom, ok := c.loadCustomFields(w, models.EntityDeal, []int{dealID})
+	if !ok {
+		return
+	}
+	deals[0].CustomFields = custom[dealID]
+	utils.RespondJSON(w, status, deals[0])
+}
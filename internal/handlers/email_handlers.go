@@ -0,0 +1,522 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/mailer"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const outboxColumns = `id, user_id, contact_id, template_id, to_address, subject, body, message_id, status, attempts, last_error, send_at, next_attempt_at, sent_at, interaction_id, created_at, updated_at`
+
+func scanOutboxMessage(row interface{ Scan(...interface{}) error }, m *models.OutboxMessage) error {
+	return row.Scan(
+		&m.ID, &m.UserID, &m.ContactID, &m.TemplateID, &m.ToAddress, &m.Subject, &m.Body, &m.MessageID,
+		&m.Status, &m.Attempts, &m.LastError, &m.SendAt, &m.NextAttemptAt, &m.SentAt, &m.InteractionID,
+		&m.CreatedAt, &m.UpdatedAt,
+	)
+}
+
+// templateData loads the contact, its company and the sending user for rendering.
+// The contact must belong to the sender's organization.
+func (c *CRMHandlers) templateData(userID, contactID int) (mailer.TemplateData, *string, error) {
+	var contact models.Contact
+	err := c.DB.QueryRow(`
+	SELECT id, company_id, first_name, last_name, email, phone_number, job_title, pipeline_stage
+	FROM contacts WHERE id = ? AND org_id = (SELECT org_id FROM users WHERE id = ?) AND deleted_at IS NULL`, contactID, userID,
+	).Scan(&contact.ID, &contact.CompanyID, &contact.FirstName, &contact.LastName, &contact.Email,
+		&contact.PhoneNumber, &contact.JobTitle, &contact.PipelineStage)
+	if err != nil {
+		return mailer.TemplateData{}, nil, err
+	}
+
+	var company *models.Company
+	if contact.CompanyID != nil {
+		var co models.Company
+		err := c.DB.QueryRow(`
+		SELECT name, website, industry, address, phone_number, pipeline_stage
+		FROM companies WHERE id = ? AND org_id = (SELECT org_id FROM users WHERE id = ?) AND deleted_at IS NULL`, *contact.CompanyID, userID,
+		).Scan(&co.Name, &co.Website, &co.Industry, &co.Address, &co.PhoneNumber, &co.PipelineStage)
+		if err == nil {
+			company = &co
+		}
+	}
+
+	var sender models.User
+	err = c.DB.QueryRow("SELECT email, first_name, last_name FROM users WHERE id = ?", userID).
+		Scan(&sender.Email, &sender.FirstName, &sender.LastName)
+	if err != nil {
+		return mailer.TemplateData{}, nil, err
+	}
+
+	return mailer.NewTemplateData(contact, company, sender), contact.Email, nil
+}
+
+// CreateEmailTemplate stores a new email template after checking its syntax.
+func (c *CRMHandlers) CreateEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var tpl models.EmailTemplate
+	if err := json.NewDecoder(r.Body).Decode(&tpl); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if tpl.Name == "" || tpl.Subject == "" || tpl.Body == "" {
+		utils.RespondError(w, http.StatusBadRequest, "name, subject and body are required")
+		return
+	}
+	if err := mailer.Validate(tpl.Subject, tpl.Body); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template: "+err.Error())
+		return
+	}
+	tpl.UserID = userID
+
+	result, err := c.DB.Exec("INSERT INTO email_templates (user_id, name, subject, body) VALUES (?, ?, ?, ?)",
+		tpl.UserID, tpl.Name, tpl.Subject, tpl.Body)
+	if err != nil {
+		log.Printf("Error inserting email template: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create email template")
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	tpl.ID = int(id)
+	tpl.CreatedAt = time.Now().Format(time.RFC3339)
+	tpl.UpdatedAt = tpl.CreatedAt
+	utils.RespondJSON(w, http.StatusCreated, tpl)
+}
+
+// ListEmailTemplates retrieves all email templates of the authenticated user.
+func (c *CRMHandlers) ListEmailTemplates(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT id, user_id, name, subject, body, created_at, updated_at FROM email_templates WHERE user_id = ? ORDER BY name", userID)
+	if err != nil {
+		log.Printf("Error querying email templates: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var templates []models.EmailTemplate
+	for rows.Next() {
+		var tpl models.EmailTemplate
+		if err := rows.Scan(&tpl.ID, &tpl.UserID, &tpl.Name, &tpl.Subject, &tpl.Body, &tpl.CreatedAt, &tpl.UpdatedAt); err != nil {
+			log.Printf("Error scanning email template row: %v", err)
+			continue
+		}
+		templates = append(templates, tpl)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating email template rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, templates)
+}
+
+// GetEmailTemplate retrieves a single email template by ID.
+func (c *CRMHandlers) GetEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+
+	var tpl models.EmailTemplate
+	err = c.DB.QueryRow("SELECT id, user_id, name, subject, body, created_at, updated_at FROM email_templates WHERE id = ? AND user_id = ?", templateID, userID).
+		Scan(&tpl.ID, &tpl.UserID, &tpl.Name, &tpl.Subject, &tpl.Body, &tpl.CreatedAt, &tpl.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Email template not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying email template: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, tpl)
+}
+
+// UpdateEmailTemplate updates an existing email template.
+func (c *CRMHandlers) UpdateEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+
+	var tpl models.EmailTemplate
+	if err := json.NewDecoder(r.Body).Decode(&tpl); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if tpl.Name == "" || tpl.Subject == "" || tpl.Body == "" {
+		utils.RespondError(w, http.StatusBadRequest, "name, subject and body are required")
+		return
+	}
+	if err := mailer.Validate(tpl.Subject, tpl.Body); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template: "+err.Error())
+		return
+	}
+	tpl.ID = templateID
+	tpl.UserID = userID
+
+	result, err := c.DB.Exec(`UPDATE email_templates SET name = ?, subject = ?, body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`,
+		tpl.Name, tpl.Subject, tpl.Body, tpl.ID, userID)
+	if err != nil {
+		log.Printf("Error updating email template: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update email template")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Email template not found or unauthorized to update")
+		return
+	}
+
+	tpl.UpdatedAt = time.Now().Format(time.RFC3339)
+	utils.RespondJSON(w, http.StatusOK, tpl)
+}
+
+// DeleteEmailTemplate deletes an email template. Messages already queued from it are unaffected.
+func (c *CRMHandlers) DeleteEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM email_templates WHERE id = ? AND user_id = ?", templateID, userID)
+	if err != nil {
+		log.Printf("Error deleting email template: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete email template")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Email template not found or unauthorized to delete")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// PreviewEmailTemplate renders a template for a contact without sending anything.
+func (c *CRMHandlers) PreviewEmailTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	templateID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid template ID")
+		return
+	}
+
+	var payload struct {
+		ContactID int `json:"contact_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	var subject, body string
+	err = c.DB.QueryRow("SELECT subject, body FROM email_templates WHERE id = ? AND user_id = ?", templateID, userID).Scan(&subject, &body)
+	if err != nil {
+		utils.RespondError(w, http.StatusNotFound, "Email template not found or unauthorized")
+		return
+	}
+
+	data, _, err := c.templateData(userID, payload.ContactID)
+	if err != nil {
+		utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
+		return
+	}
+
+	subject, body, err = mailer.Render(subject, body, data)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Template rendering failed: "+err.Error())
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]string{"subject": subject, "body": body})
+}
+
+// SendEmail renders and queues a message to a contact. It is delivered immediately
+// unless send_at is in the future, and logged as an interaction once sent.
+func (c *CRMHandlers) SendEmail(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if c.Outbox == nil {
+		utils.RespondError(w, http.StatusServiceUnavailable, "Outbound email is not configured on this server")
+		return
+	}
+
+	var payload models.SendEmailPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+
+	sendAt := time.Now().UTC()
+	if payload.SendAt != nil && *payload.SendAt != "" {
+		parsed, err := time.Parse(time.RFC3339, *payload.SendAt)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "send_at must be an RFC3339 timestamp")
+			return
+		}
+		if parsed.After(sendAt) {
+			sendAt = parsed.UTC()
+		}
+	}
+
+	data, to, err := c.templateData(userID, payload.ContactID)
+	if err != nil {
+		utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
+		return
+	}
+	if to == nil || strings.TrimSpace(*to) == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Contact has no email address")
+		return
+	}
+
+	subject, body := payload.Subject, payload.Body
+	if payload.TemplateID != nil {
+		err := c.DB.QueryRow("SELECT subject, body FROM email_templates WHERE id = ? AND user_id = ?", *payload.TemplateID, userID).Scan(&subject, &body)
+		if err != nil {
+			utils.RespondError(w, http.StatusForbidden, "Email template not found or does not belong to the user")
+			return
+		}
+	}
+	if subject == "" || body == "" {
+		utils.RespondError(w, http.StatusBadRequest, "Either template_id or subject and body are required")
+		return
+	}
+	subject, body, err = mailer.Render(subject, body, data)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Template rendering failed: "+err.Error())
+		return
+	}
+
+	domain := "micro-crm"
+	if at := strings.LastIndex(data.Sender.Email, "@"); at != -1 {
+		domain = data.Sender.Email[at+1:]
+	}
+	scheduled := sendAt.Format(time.RFC3339)
+	result, err := c.DB.Exec(`
+	INSERT INTO outbox (user_id, contact_id, template_id, to_address, subject, body, message_id, status, send_at, next_attempt_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, payload.ContactID, payload.TemplateID, strings.TrimSpace(*to), subject, body,
+		mailer.NewMessageID(domain), models.OutboxQueued, scheduled, scheduled,
+	)
+	if err != nil {
+		log.Printf("Error queueing email: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to queue email")
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	var message models.OutboxMessage
+	if err := scanOutboxMessage(c.DB.QueryRow("SELECT "+outboxColumns+" FROM outbox WHERE id = ?", id), &message); err != nil {
+		log.Printf("Error fetching queued email: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Error fetching queued email")
+		return
+	}
+	c.Outbox.Wake()
+	utils.RespondJSON(w, http.StatusAccepted, message)
+}
+
+// ListOutbox retrieves queued and sent mail for the authenticated user (optionally filtered by status/contact_id).
+func (c *CRMHandlers) ListOutbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	query := "SELECT " + outboxColumns + " FROM outbox WHERE user_id = ?"
+	args := []interface{}{userID}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if contactIDStr := r.URL.Query().Get("contact_id"); contactIDStr != "" {
+		contactID, err := strconv.Atoi(contactIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid contact_id parameter")
+			return
+		}
+		query += " AND contact_id = ?"
+		args = append(args, contactID)
+	}
+	query += " ORDER BY send_at DESC"
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying outbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var messages []models.OutboxMessage
+	for rows.Next() {
+		var message models.OutboxMessage
+		if err := scanOutboxMessage(rows, &message); err != nil {
+			log.Printf("Error scanning outbox row: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating outbox rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, messages)
+}
+
+// GetOutboxMessage retrieves a single outgoing message and its delivery state.
+func (c *CRMHandlers) GetOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	var message models.OutboxMessage
+	err = scanOutboxMessage(c.DB.QueryRow("SELECT "+outboxColumns+" FROM outbox WHERE id = ? AND user_id = ?", messageID, userID), &message)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Message not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying outbox message: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, message)
+}
+
+// CancelOutboxMessage stops a queued or scheduled message from being sent.
+func (c *CRMHandlers) CancelOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	result, err := c.DB.Exec("UPDATE outbox SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ? AND status = ?",
+		models.OutboxCancelled, messageID, userID, models.OutboxQueued)
+	if err != nil {
+		log.Printf("Error cancelling outbox message: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to cancel message")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusConflict, "Message not found, unauthorized or no longer queued")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// RetryOutboxMessage re-queues a failed message for immediate delivery.
+func (c *CRMHandlers) RetryOutboxMessage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if c.Outbox == nil {
+		utils.RespondError(w, http.StatusServiceUnavailable, "Outbound email is not configured on this server")
+		return
+	}
+
+	messageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid message ID")
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	UPDATE outbox SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ? AND status = ?`,
+		models.OutboxQueued, time.Now().UTC().Format(time.RFC3339), messageID, userID, models.OutboxFailed)
+	if err != nil {
+		log.Printf("Error re-queueing outbox message: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to retry message")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusConflict, "Message not found, unauthorized or not failed")
+		return
+	}
+
+	c.Outbox.Wake()
+	utils.RespondJSON(w, http.StatusOK, map[string]string{"status": models.OutboxQueued})
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// replayLimit caps how many missed events a reconnecting client gets; one that
+	// missed more should reload its data instead
+	replayLimit = 1000
+	// heartbeatInterval keeps proxies from closing an idle stream
+	heartbeatInterval = 25 * time.Second
+)
+
+// publish sends a record change made by userID to the event streams of every
+// active member of their organization, who all share the record. data is the
+// record as returned by the API; deletions send just the id.
+func (c *CRMHandlers) publish(userID int, entityType, action string, entityID int, data interface{}) {
+	if c.Events == nil {
+		return
+	}
+	if (action == events.ActionDeleted || action == events.ActionRestored) && data == nil {
+		data = map[string]int{"id": entityID}
+	}
+	rows, err := c.DB.Query(`
+	SELECT id FROM users
+	WHERE org_id = (SELECT org_id FROM users WHERE id = ?) AND status = 'active'`, userID)
+	if err != nil {
+		log.Printf("Error loading organization members for event: %v", err)
+		return
+	}
+	var members []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error loading organization members for event: %v", err)
+			return
+		}
+		members = append(members, id)
+	}
+	rows.Close()
+	for _, memberID := range members {
+		c.Events.Publish(memberID, entityType, action, entityID, data)
+	}
+}
+
+// StreamEvents streams changes to the user's records as Server-Sent Events. Each
+// event has the stored event id, a type such as "contact.updated" and the record
+// as JSON. A client reconnecting with the Last-Event-ID header (or the
+// last_event_id query parameter) first receives the events it missed.
+func (c *CRMHandlers) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if c.Events == nil {
+		utils.RespondError(w, http.StatusServiceUnavailable, "Event stream not available")
+		return
+	}
+
+	var lastID int64
+	lastIDStr := r.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = r.URL.Query().Get("last_event_id")
+	}
+	if lastIDStr != "" {
+		id, err := strconv.ParseInt(lastIDStr, 10, 64)
+		if err != nil || id < 0 {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid last event ID")
+			return
+		}
+		lastID = id
+	}
+
+	rc := http.NewResponseController(w)
+	// The stream outlives any server write timeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		log.Printf("Error clearing write deadline: %v", err)
+	}
+
+	// Subscribe before replaying so nothing published in between is lost; the
+	// bus delivers in id order, so the overlap is skipped by id below
+	sub := c.Events.Subscribe(userID)
+	defer sub.Close()
+
+	var missed []events.Event
+	if lastIDStr != "" {
+		var err error
+		if missed, err = c.Events.Replay(userID, lastID, replayLimit); err != nil {
+			log.Printf("Error replaying events: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Ask the browser to wait a few seconds before reconnecting
+	if _, err := fmt.Fprint(w, "retry: 3000\n\n"); err != nil {
+		return
+	}
+	for _, e := range missed {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+		lastID = e.ID
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, open := <-sub.C:
+			if !open {
+				// Dropped for falling behind or shutting down; the client
+				// reconnects and resumes from its last id
+				return
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			lastID = e.ID
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes one event in the text/event-stream format.
+func writeEvent(w http.ResponseWriter, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
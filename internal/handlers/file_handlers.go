@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/logger"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/utils"
@@ -23,7 +24,7 @@ import (
 
 const (
 	maxUploadSize = 10 << 20
-	uploadDir     = "./data/uploads"
+	uploadDir     = models.DefaultUploadDir
 )
 
 func ensureUploadsDir(c logger.Logger) {
@@ -40,6 +41,7 @@ func (c *CRMHandlers) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	// 1. Uploads Dir Check
 	c.Log.Debug("UploadFile: received request to upload file")
@@ -195,21 +197,21 @@ func (c *CRMHandlers) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 
 	// 9. Validate ownership to user
 	if contactID != nil {
-		if err := utils.ValidateOwnership(c.DB, "contacts", *contactID, userID); err != nil {
+		if err := utils.ValidateOwnership(c.DB, "contacts", *contactID, orgID); err != nil {
 			utils.RespondError(w, http.StatusForbidden, err.Error())
 			return
 		}
 	}
 
 	if companyID != nil {
-		if err := utils.ValidateOwnership(c.DB, "companies", *companyID, userID); err != nil {
+		if err := utils.ValidateOwnership(c.DB, "companies", *companyID, orgID); err != nil {
 			utils.RespondError(w, http.StatusForbidden, err.Error())
 			return
 		}
 	}
 
 	if interactionID != nil {
-		if err := utils.ValidateOwnership(c.DB, "interactions", *interactionID, userID); err != nil {
+		if err := utils.ValidateOwnership(c.DB, "interactions", *interactionID, orgID); err != nil {
 			utils.RespondError(w, http.StatusForbidden, err.Error())
 			return
 		}
@@ -247,6 +249,8 @@ func (c *CRMHandlers) UploadFileHandler(w http.ResponseWriter, r *http.Request)
 	fileRecord.UploadedAt = now
 
 	c.Log.Info("UploadFile: File record created successfully for file %s", fileRecord.FileName)
+	c.audit(w, r, events.ActionCreated, models.EntityFile, fileRecord.ID, nil)
+	c.publish(userID, models.EntityFile, events.ActionCreated, fileRecord.ID, fileRecord)
 	utils.RespondJSON(w, http.StatusCreated, fileRecord)
 }
 func intPointer(i int) *int {
@@ -322,6 +326,7 @@ func (c *CRMHandlers) GetFile(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	fileID, err := strconv.Atoi(vars["id"])
@@ -332,7 +337,8 @@ func (c *CRMHandlers) GetFile(w http.ResponseWriter, r *http.Request) {
 
 	db := c.DB
 	var file models.File
-	err = db.QueryRow(`SELECT id, user_id, contact_id, company_id, file_name, storage_path, file_type, file_size, uploaded_at, interaction_id FROM files WHERE id = ? AND user_id = ?`, fileID, userID).
+	err = db.QueryRow(`SELECT id, user_id, contact_id, company_id, file_name, storage_path, file_type, file_size, uploaded_at, interaction_id FROM files WHERE id = ? AND `+visibleClause(false),
+		append([]interface{}{fileID}, visibleArgs(models.EntityFile, orgID, userID)...)...).
 		Scan(&file.ID, &file.UserID, &file.ContactID, &file.CompanyID, &file.FileName, &file.StoragePath, &file.FileType, &file.FileSize, &file.UploadedAt, &file.InteractionID)
 	if errors.Is(err, sql.ErrNoRows) {
 		utils.RespondError(w, http.StatusNotFound, "File not found or unauthorized")
@@ -343,21 +349,29 @@ func (c *CRMHandlers) GetFile(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityFile, []int{file.ID})
+	if !ok {
+		return
+	}
+	file.Tags = tagged[file.ID]
 
 	utils.RespondJSON(w, http.StatusOK, file)
 }
 
-// ListFiles retrieves all file records for the authenticated user (or filtered).
+// ListFiles retrieves the file records of the organization and those shared with the user (or
+// filtered by contact_id, interaction_id, company_id, and by tag, repeatable, keeping
+// those carrying every tag named).
 func (c *CRMHandlers) ListFiles(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	db := c.DB
-	query := `SELECT id, user_id, contact_id, company_id, file_name, storage_path, file_type, file_size, uploaded_at,interaction_id FROM files WHERE user_id = ?`
-	args := []interface{}{userID}
+	query := `SELECT id, user_id, contact_id, company_id, file_name, storage_path, file_type, file_size, uploaded_at,interaction_id FROM files WHERE ` + visibleClause(false)
+	args := visibleArgs(models.EntityFile, orgID, userID)
 
 	// Filtering by contact_id
 	contactIDStr := r.URL.Query().Get("contact_id")
@@ -394,6 +408,10 @@ func (c *CRMHandlers) ListFiles(w http.ResponseWriter, r *http.Request) {
 		args = append(args, companyID)
 	}
 
+	filter, filterArgs := tagFilter(r, orgID, models.EntityFile, "id")
+	query += filter
+	args = append(args, filterArgs...)
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying files: %v", err)
@@ -421,6 +439,18 @@ func (c *CRMHandlers) ListFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ids := make([]int, len(files))
+	for i, file := range files {
+		ids[i] = file.ID
+	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityFile, ids)
+	if !ok {
+		return
+	}
+	for i := range files {
+		files[i].Tags = tagged[files[i].ID]
+	}
+
 	utils.RespondJSON(w, http.StatusOK, files)
 }
 
@@ -431,6 +461,7 @@ func (c *CRMHandlers) UpdateFile(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	fileID, err := strconv.Atoi(vars["id"])
@@ -456,36 +487,43 @@ func (c *CRMHandlers) UpdateFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Files shared for writing are edited in their owner's organization
+	ownerOrg, ownerID, ok := c.writableRecord(w, models.EntityFile, fileID, orgID, userID)
+	if !ok {
+		return
+	}
+
 	// Validate ownership of contact_id and company_id
 	if payload.ContactID != nil && *payload.ContactID != 0 {
 		var exists bool
-		err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND user_id = ?)", *payload.ContactID, userID).Scan(&exists)
+		err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", *payload.ContactID, ownerOrg).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Associated contact not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Associated contact not found or does not belong to the organization")
 			return
 		}
 	}
 	if payload.CompanyID != nil && *payload.CompanyID != 0 {
 		var exists bool
-		err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM companies WHERE id = ? AND user_id = ?)", *payload.CompanyID, userID).Scan(&exists)
+		err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM companies WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", *payload.CompanyID, ownerOrg).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Associated company not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Associated company not found or does not belong to the organization")
 			return
 		}
 	}
 	if payload.InteractionID != nil && *payload.InteractionID != 0 {
 		var exists bool
-		err = c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM interactions WHERE id = ? AND user_id = ?)", *payload.InteractionID, userID).Scan(&exists)
+		err = c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM interactions WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", *payload.InteractionID, ownerOrg).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Associated interaction not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Associated interaction not found or does not belong to the organization")
 			return
 		}
 	}
 
+	before := c.snapshot(models.EntityFile, fileID)
 	stmt, err := c.DB.Prepare(`
 		UPDATE files
 		SET contact_id = ?, company_id = ?, file_name = ?, interaction_id = ?
-		WHERE id = ? AND user_id = ?
+		WHERE id = ? AND org_id = ?
 	`)
 	if err != nil {
 		c.Log.Error("UpdateFile: Prepare failed: %v", err)
@@ -500,7 +538,7 @@ func (c *CRMHandlers) UpdateFile(w http.ResponseWriter, r *http.Request) {
 		payload.FileName,
 		payload.InteractionID,
 		fileID,
-		userID,
+		ownerOrg,
 	)
 	if err != nil {
 		c.Log.Error("UpdateFile: Exec failed: %v", err)
@@ -514,6 +552,17 @@ func (c *CRMHandlers) UpdateFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	c.audit(w, r, events.ActionUpdated, models.EntityFile, fileID, before)
+
+	var file models.File
+	err = c.DB.QueryRow(`SELECT id, user_id, contact_id, company_id, file_name, storage_path, file_type, file_size, uploaded_at, interaction_id FROM files WHERE id = ?`, fileID).
+		Scan(&file.ID, &file.UserID, &file.ContactID, &file.CompanyID, &file.FileName, &file.StoragePath, &file.FileType, &file.FileSize, &file.UploadedAt, &file.InteractionID)
+	if err != nil {
+		c.Log.Error("UpdateFile: Reload failed: %v", err)
+	} else {
+		c.publish(ownerID, models.EntityFile, events.ActionUpdated, fileID, file)
+	}
+
 	utils.RespondJSON(w, http.StatusOK, map[string]string{"status": "updated file"})
 }
 func (c *CRMHandlers) CleanupOrphanedFiles(w http.ResponseWriter, r *http.Request) {
@@ -526,13 +575,14 @@ func (c *CRMHandlers) CleanupOrphanedFiles(w http.ResponseWriter, r *http.Reques
 	utils.RespondJSON(w, http.StatusOK, map[string]string{"status": "cleanup completed"})
 }
 
-// DeleteFile deletes a file record.
+// DeleteFile moves a file to the trash; its blob is kept until it is purged.
 func (c *CRMHandlers) DeleteFile(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	fileID, err := strconv.Atoi(vars["id"])
@@ -541,29 +591,20 @@ func (c *CRMHandlers) DeleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	db := c.DB
-	result, err := db.Exec("DELETE FROM files WHERE id = ? AND user_id = ?", fileID, userID)
+	trashed, err := c.moveToTrash(orgID, models.EntityFile, fileID)
 	if err != nil {
 		log.Printf("Error deleting file: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete file record")
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if len(trashed) == 0 {
 		utils.RespondError(w, http.StatusNotFound, "File not found or unauthorized to delete")
 		return
 	}
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+	c.publish(userID, models.EntityFile, events.ActionDeleted, fileID, nil)
 
 	utils.RespondJSON(w, http.StatusNoContent, nil)
-	// Clear out orphaned files
-	go func() {
-		c.Log.Info("Running Files cleanup")
-		err = utils.CleanOrphanedFiles(c.DB, uploadDir)
-		if err != nil {
-			return
-		}
-	}()
 }
 
 var downloadSemaphore = make(chan struct{}, 100) // Max 100 concurrent downloads
@@ -594,7 +635,7 @@ func (c *CRMHandlers) DownloadFileHandler(w http.ResponseWriter, r *http.Request
 	var fileName, storagePath, fileType string
 	var fileSize int64
 
-	query := `SELECT file_name, storage_path, file_type, file_size FROM files WHERE id = ?`
+	query := `SELECT file_name, storage_path, file_type, file_size FROM files WHERE id = ? AND deleted_at IS NULL`
 	row := c.DB.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(&fileName, &storagePath, &fileType, &fileSize)
@@ -705,7 +746,7 @@ func (c *CRMHandlers) ViewFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	var fileName, storagePath, fileType string
 	var fileSize int64
-	query := `SELECT file_name, storage_path, file_type, file_size FROM files WHERE id = ?`
+	query := `SELECT file_name, storage_path, file_type, file_size FROM files WHERE id = ? AND deleted_at IS NULL`
 	row := c.DB.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(&fileName, &storagePath, &fileType, &fileSize)
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Open deals at or above these probabilities count towards best case and commit.
+const (
+	bestCaseProbability = 50
+	commitProbability   = 75
+)
+
+const (
+	defaultForecastMonths  = 6
+	defaultForecastHistory = 3
+	maxForecastMonths      = 24
+)
+
+// addOpen counts an open deal towards the forecast categories.
+func addOpen(t *models.ForecastTotals, amount float64, probability int) {
+	t.Pipeline += amount
+	if probability >= bestCaseProbability {
+		t.BestCase += amount
+	}
+	if probability >= commitProbability {
+		t.Commit += amount
+	}
+	t.Weighted += amount * float64(probability) / 100
+	t.OpenDeals++
+}
+
+func addWon(t *models.ForecastTotals, amount float64) {
+	t.ClosedWon += amount
+	t.WonDeals++
+}
+
+// monthsParam reads a month count query parameter within 0..maxForecastMonths.
+func monthsParam(r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > maxForecastMonths {
+		return 0, false
+	}
+	return n, true
+}
+
+// GetForecast projects revenue by month from open deals using their probability
+// and expected close date, next to the revenue actually won in each month.
+// Query parameters: months ahead including the current one (default 6), history
+// months back (default 3), pipeline_id (all pipelines when omitted) and currency.
+// The owner breakdown covers the months in the window only.
+func (c *CRMHandlers) GetForecast(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
+
+	months, ok := monthsParam(r, "months", defaultForecastMonths)
+	if !ok || months == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid months parameter")
+		return
+	}
+	history, ok := monthsParam(r, "history", defaultForecastHistory)
+	if !ok {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid history parameter")
+		return
+	}
+
+	// Won deals are dated by when they last entered their stage, falling back to
+	// the expected close date for deals won before stage history was recorded
+	query := `
+	SELECT d.user_id, u.username, d.amount, COALESCE(d.probability, ps.probability), ps.outcome,
+		d.expected_close_date, d.updated_at,
+		(SELECT MAX(st.changed_at) FROM stage_transitions st
+			WHERE st.entity_type = ? AND st.entity_id = d.id AND st.to_stage = d.stage)
+	FROM deals d
+	JOIN pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.name = d.stage
+	JOIN users u ON u.id = d.user_id
+	WHERE d.org_id = ? AND d.deleted_at IS NULL AND ps.outcome != ?`
+	args := []interface{}{models.EntityDeal, orgID, models.StageLost}
+	if pipelineIDStr := r.URL.Query().Get("pipeline_id"); pipelineIDStr != "" {
+		pipelineID, err := strconv.Atoi(pipelineIDStr)
+		if err != nil || utils.ValidateOwnership(c.DB, "pipelines", pipelineID, orgID) != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid pipeline_id parameter")
+			return
+		}
+		query += " AND d.pipeline_id = ?"
+		args = append(args, pipelineID)
+	}
+	// Amounts are summed as-is; pass ?currency= to keep totals in one currency
+	currency := strings.ToUpper(r.URL.Query().Get("currency"))
+	if currency != "" {
+		query += " AND d.currency = ?"
+		args = append(args, currency)
+	}
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	forecast := models.Forecast{Currency: currency, Owners: []models.ForecastOwner{}}
+	monthIndex := make(map[string]int, history+months)
+	for i := -history; i < months; i++ {
+		month := currentMonth.AddDate(0, i, 0).Format("2006-01")
+		monthIndex[month] = len(forecast.Months)
+		forecast.Months = append(forecast.Months, models.ForecastMonth{Month: month})
+	}
+	owners := make(map[int]*models.ForecastOwner)
+	owner := func(id int, username string) *models.ForecastOwner {
+		if o, ok := owners[id]; ok {
+			return o
+		}
+		o := &models.ForecastOwner{UserID: id, Username: username}
+		owners[id] = o
+		return o
+	}
+
+	for rows.Next() {
+		var (
+			ownerID, probability         int
+			username, outcome, updatedAt string
+			amount                       float64
+			closeDate, enteredAt         *string
+		)
+		if err := rows.Scan(&ownerID, &username, &amount, &probability, &outcome, &closeDate, &updatedAt, &enteredAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if outcome == models.StageWon {
+			wonAt := parseDBTime(updatedAt)
+			if enteredAt != nil {
+				wonAt = parseDBTime(*enteredAt)
+			} else if closeDate != nil {
+				if t, err := time.Parse("2006-01-02", *closeDate); err == nil {
+					wonAt = t
+				}
+			}
+			i, inWindow := monthIndex[wonAt.Format("2006-01")]
+			if !inWindow {
+				continue
+			}
+			addWon(&forecast.Months[i].ForecastTotals, amount)
+			addWon(&forecast.Total, amount)
+			addWon(&owner(ownerID, username).ForecastTotals, amount)
+			continue
+		}
+
+		if closeDate == nil {
+			addOpen(&forecast.Undated, amount, probability)
+			continue
+		}
+		closeAt, err := time.Parse("2006-01-02", *closeDate)
+		if err != nil {
+			addOpen(&forecast.Undated, amount, probability)
+			continue
+		}
+		if closeAt.Before(currentMonth) {
+			addOpen(&forecast.Overdue, amount, probability)
+			continue
+		}
+		i, inWindow := monthIndex[closeAt.Format("2006-01")]
+		if !inWindow {
+			continue
+		}
+		addOpen(&forecast.Months[i].ForecastTotals, amount, probability)
+		addOpen(&forecast.Total, amount, probability)
+		addOpen(&owner(ownerID, username).ForecastTotals, amount, probability)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, o := range owners {
+		forecast.Owners = append(forecast.Owners, *o)
+	}
+	sort.Slice(forecast.Owners, func(i, j int) bool { return forecast.Owners[i].Username < forecast.Owners[j].Username })
+
+	utils.RespondJSON(w, http.StatusOK, forecast)
+}
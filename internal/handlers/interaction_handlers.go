@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/utils"
 	"net/http"
@@ -21,6 +22,7 @@ func (c *CRMHandlers) CreateInteraction(w http.ResponseWriter, r *http.Request)
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	var interaction models.Interaction
 	if err := json.NewDecoder(r.Body).Decode(&interaction); err != nil {
@@ -33,9 +35,9 @@ func (c *CRMHandlers) CreateInteraction(w http.ResponseWriter, r *http.Request)
 
 	// Validate contact_id belongs to the user
 	var exists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND user_id = ?)", interaction.ContactID, userID).Scan(&exists)
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", interaction.ContactID, orgID).Scan(&exists)
 	if err != nil || !exists {
-		utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the user")
+		utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
 		return
 	}
 
@@ -78,13 +80,16 @@ func (c *CRMHandlers) CreateInteraction(w http.ResponseWriter, r *http.Request)
 	id, _ := result.LastInsertId()
 	interaction.ID = int(id)
 	interaction.CreatedAt = time.Now().Format(time.RFC3339)
+	c.notifyMentions(userID, models.EntityInteraction, interaction.ID, interaction.Subject, interaction.Description, nil)
+	c.audit(w, r, events.ActionCreated, models.EntityInteraction, interaction.ID, nil)
+	c.publish(userID, models.EntityInteraction, events.ActionCreated, interaction.ID, interaction)
 
 	utils.RespondJSON(w, http.StatusCreated, interaction)
 }
 
 // GetInteraction retrieves a single interaction by ID.
 func (c *CRMHandlers) GetInteraction(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
@@ -102,8 +107,8 @@ func (c *CRMHandlers) GetInteraction(w http.ResponseWriter, r *http.Request) {
 	err = db.QueryRow(`
   SELECT id, user_id, contact_id, type, subject, duration, outcome, follow_up, description, interaction_at, follow_up_date, created_at 
   FROM interactions 
-  WHERE id = ? AND user_id = ?`,
-		interactionID, userID,
+  WHERE id = ? AND org_id = ? AND deleted_at IS NULL`,
+		interactionID, orgID,
 	).Scan(
 		&interaction.ID,
 		&interaction.UserID,
@@ -127,13 +132,19 @@ func (c *CRMHandlers) GetInteraction(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityInteraction, []int{interaction.ID})
+	if !ok {
+		return
+	}
+	interaction.Tags = tagged[interaction.ID]
 
 	utils.RespondJSON(w, http.StatusOK, interaction)
 }
 
-// ListInteractions retrieves all interactions for the authenticated user (or filtered by contact_id).
+// ListInteractions retrieves all interactions of the user's organization (or
+// filtered by contact_id, and by tag, repeatable, keeping those carrying every tag named).
 func (c *CRMHandlers) ListInteractions(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
@@ -143,9 +154,9 @@ func (c *CRMHandlers) ListInteractions(w http.ResponseWriter, r *http.Request) {
 	query := `
   SELECT id, user_id, contact_id, type, subject, duration, outcome, follow_up, description, interaction_at, follow_up_date, created_at 
   FROM interactions 
-  WHERE user_id = ?
+  WHERE org_id = ? AND deleted_at IS NULL
 `
-	args := []interface{}{userID}
+	args := []interface{}{orgID}
 
 	if contactIDStr := r.URL.Query().Get("contact_id"); contactIDStr != "" {
 		contactID, err := strconv.Atoi(contactIDStr)
@@ -157,6 +168,10 @@ func (c *CRMHandlers) ListInteractions(w http.ResponseWriter, r *http.Request) {
 		args = append(args, contactID)
 	}
 
+	filter, filterArgs := tagFilter(r, orgID, models.EntityInteraction, "id")
+	query += filter
+	args = append(args, filterArgs...)
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying interactions: %v", err)
@@ -194,6 +209,18 @@ func (c *CRMHandlers) ListInteractions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ids := make([]int, len(interactions))
+	for i, interaction := range interactions {
+		ids[i] = interaction.ID
+	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityInteraction, ids)
+	if !ok {
+		return
+	}
+	for i := range interactions {
+		interactions[i].Tags = tagged[interactions[i].ID]
+	}
+
 	utils.RespondJSON(w, http.StatusOK, interactions)
 }
 
@@ -204,6 +231,7 @@ func (c *CRMHandlers) UpdateInteraction(w http.ResponseWriter, r *http.Request)
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	interactionID, err := strconv.Atoi(vars["id"])
@@ -221,20 +249,24 @@ func (c *CRMHandlers) UpdateInteraction(w http.ResponseWriter, r *http.Request)
 
 	db := c.DB
 
-	// Validate contact_id belongs to the user if provided in payload
+	// Validate contact_id belongs to the organization if provided in payload
 	if interaction.ContactID != 0 { // 0 is default int value, indicates not set by JSON
 		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND user_id = ?)", interaction.ContactID, userID).Scan(&exists)
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", interaction.ContactID, orgID).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
 			return
 		}
 	}
 
+	before := c.snapshot(models.EntityInteraction, interactionID)
+	var previousDescription *string
+	db.QueryRow("SELECT description FROM interactions WHERE id = ? AND org_id = ?", interactionID, orgID).Scan(&previousDescription)
+
 	stmt, err := db.Prepare(`
 	  UPDATE interactions
 	  SET contact_id = ?, type = ?, subject = ?, duration = ?, outcome = ?, follow_up = ?, description = ?, interaction_at = ?, follow_up_date = ?
-	  WHERE id = ? AND user_id = ?
+	  WHERE id = ? AND org_id = ? AND deleted_at IS NULL
 	`)
 	if err != nil {
 		log.Printf("Error preparing statement: %v", err)
@@ -254,7 +286,7 @@ func (c *CRMHandlers) UpdateInteraction(w http.ResponseWriter, r *http.Request)
 		interaction.InteractionAt,
 		interaction.FollowUpDate,
 		interaction.ID,
-		userID,
+		orgID,
 	)
 	if err != nil {
 		log.Printf("Error updating interaction: %v", err)
@@ -267,17 +299,21 @@ func (c *CRMHandlers) UpdateInteraction(w http.ResponseWriter, r *http.Request)
 		utils.RespondError(w, http.StatusNotFound, "Interaction not found or unauthorized to update")
 		return
 	}
+	c.notifyMentions(userID, models.EntityInteraction, interactionID, interaction.Subject, interaction.Description, previousDescription)
+	c.audit(w, r, events.ActionUpdated, models.EntityInteraction, interactionID, before)
+	c.publish(userID, models.EntityInteraction, events.ActionUpdated, interactionID, interaction)
 
 	utils.RespondJSON(w, http.StatusOK, interaction)
 }
 
-// DeleteInteraction deletes an interaction.
+// DeleteInteraction moves an interaction to the trash.
 func (c *CRMHandlers) DeleteInteraction(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	interactionID, err := strconv.Atoi(vars["id"])
@@ -286,19 +322,18 @@ func (c *CRMHandlers) DeleteInteraction(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	db := c.DB
-	result, err := db.Exec("DELETE FROM interactions WHERE id = ? AND user_id = ?", interactionID, userID)
+	trashed, err := c.moveToTrash(orgID, models.EntityInteraction, interactionID)
 	if err != nil {
 		log.Printf("Error deleting interaction: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete interaction")
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if len(trashed) == 0 {
 		utils.RespondError(w, http.StatusNotFound, "Interaction not found or unauthorized to delete")
 		return
 	}
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+	c.publish(userID, models.EntityInteraction, events.ActionDeleted, interactionID, nil)
 
 	utils.RespondJSON(w, http.StatusNoContent, nil)
 }
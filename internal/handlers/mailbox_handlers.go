@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const mailboxColumns = `id, user_id, host, port, username, mailbox, use_tls, enabled, uid_validity, last_uid, last_synced_at, last_error, created_at, updated_at`
+
+func scanMailbox(row interface{ Scan(...interface{}) error }, m *models.IMAPAccount) error {
+	return row.Scan(
+		&m.ID, &m.UserID, &m.Host, &m.Port, &m.Username, &m.Mailbox, &m.UseTLS, &m.Enabled,
+		&m.UIDValidity, &m.LastUID, &m.LastSyncedAt, &m.LastError, &m.CreatedAt, &m.UpdatedAt,
+	)
+}
+
+// CreateMailbox connects a new IMAP mailbox for the authenticated user.
+func (c *CRMHandlers) CreateMailbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	mailbox := models.IMAPAccount{Port: 993, Mailbox: "INBOX", UseTLS: true, Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&mailbox); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if mailbox.Host == "" || mailbox.Username == "" || mailbox.Password == "" {
+		utils.RespondError(w, http.StatusBadRequest, "host, username and password are required")
+		return
+	}
+	mailbox.UserID = userID
+
+	result, err := c.DB.Exec(`
+	INSERT INTO imap_accounts (user_id, host, port, username, password, mailbox, use_tls, enabled)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		mailbox.UserID, mailbox.Host, mailbox.Port, mailbox.Username, mailbox.Password,
+		mailbox.Mailbox, mailbox.UseTLS, mailbox.Enabled,
+	)
+	if err != nil {
+		log.Printf("Error inserting mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create mailbox")
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	mailbox.Password = ""
+	err = scanMailbox(c.DB.QueryRow("SELECT "+mailboxColumns+" FROM imap_accounts WHERE id = ?", id), &mailbox)
+	if err != nil {
+		log.Printf("Error fetching created mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Error fetching created mailbox")
+		return
+	}
+	utils.RespondJSON(w, http.StatusCreated, mailbox)
+}
+
+// ListMailboxes retrieves all IMAP mailboxes of the authenticated user.
+func (c *CRMHandlers) ListMailboxes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT "+mailboxColumns+" FROM imap_accounts WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("Error querying mailboxes: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var mailboxes []models.IMAPAccount
+	for rows.Next() {
+		var mailbox models.IMAPAccount
+		if err := scanMailbox(rows, &mailbox); err != nil {
+			log.Printf("Error scanning mailbox row: %v", err)
+			continue
+		}
+		mailboxes = append(mailboxes, mailbox)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating mailbox rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, mailboxes)
+}
+
+// GetMailbox retrieves a single IMAP mailbox and its sync state.
+func (c *CRMHandlers) GetMailbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	mailboxID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid mailbox ID")
+		return
+	}
+
+	var mailbox models.IMAPAccount
+	err = scanMailbox(c.DB.QueryRow("SELECT "+mailboxColumns+" FROM imap_accounts WHERE id = ? AND user_id = ?", mailboxID, userID), &mailbox)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Mailbox not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, mailbox)
+}
+
+// UpdateMailbox changes connection settings. An empty password keeps the stored one,
+// and pointing the account at a different server or folder restarts sync from scratch.
+func (c *CRMHandlers) UpdateMailbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	mailboxID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid mailbox ID")
+		return
+	}
+
+	var mailbox models.IMAPAccount
+	if err := json.NewDecoder(r.Body).Decode(&mailbox); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if mailbox.Host == "" || mailbox.Username == "" || mailbox.Mailbox == "" || mailbox.Port == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "host, port, username and mailbox are required")
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	UPDATE imap_accounts SET
+		host = ?, port = ?, username = ?, password = COALESCE(NULLIF(?, ''), password), mailbox = ?, use_tls = ?, enabled = ?,
+		uid_validity = CASE WHEN host = ? AND mailbox = ? THEN uid_validity ELSE 0 END,
+		last_uid = CASE WHEN host = ? AND mailbox = ? THEN last_uid ELSE 0 END,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ?`,
+		mailbox.Host, mailbox.Port, mailbox.Username, mailbox.Password, mailbox.Mailbox, mailbox.UseTLS, mailbox.Enabled,
+		mailbox.Host, mailbox.Mailbox, mailbox.Host, mailbox.Mailbox,
+		mailboxID, userID,
+	)
+	if err != nil {
+		log.Printf("Error updating mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update mailbox")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Mailbox not found or unauthorized to update")
+		return
+	}
+
+	mailbox.Password = ""
+	if err := scanMailbox(c.DB.QueryRow("SELECT "+mailboxColumns+" FROM imap_accounts WHERE id = ?", mailboxID), &mailbox); err != nil {
+		log.Printf("Error fetching updated mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve updated mailbox")
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, mailbox)
+}
+
+// DeleteMailbox disconnects a mailbox. Interactions already imported are kept.
+func (c *CRMHandlers) DeleteMailbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	mailboxID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid mailbox ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM imap_accounts WHERE id = ? AND user_id = ?", mailboxID, userID)
+	if err != nil {
+		log.Printf("Error deleting mailbox: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete mailbox")
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Mailbox not found or unauthorized to delete")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// SyncMailbox runs a sync pass immediately instead of waiting for the next poll.
+func (c *CRMHandlers) SyncMailbox(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	if c.IMAPSync == nil {
+		utils.RespondError(w, http.StatusServiceUnavailable, "Mailbox sync is not enabled on this server")
+		return
+	}
+
+	mailboxID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid mailbox ID")
+		return
+	}
+
+	var exists bool
+	err = c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM imap_accounts WHERE id = ? AND user_id = ?)", mailboxID, userID).Scan(&exists)
+	if err != nil || !exists {
+		utils.RespondError(w, http.StatusNotFound, "Mailbox not found or unauthorized")
+		return
+	}
+
+	created, err := c.IMAPSync.SyncAccount(mailboxID)
+	if err != nil {
+		c.Log.Warn("SyncMailbox: account %d: %v", mailboxID, err)
+		utils.RespondError(w, http.StatusBadGateway, "Mailbox sync failed: "+err.Error())
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, map[string]int{"interactions_created": created})
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 200
+)
+
+// notifyMentions tells users @mentioned in a record's text, skipping those already
+// mentioned in the previous text. Failures are logged rather than failing the write.
+func (c *CRMHandlers) notifyMentions(actorID int, entityType string, entityID int, label string, text, previous *string) {
+	if text == nil || len(notifications.Mentions(*text)) == 0 {
+		return
+	}
+	before := ""
+	if previous != nil {
+		before = *previous
+	}
+	var actor string
+	if err := c.DB.QueryRow("SELECT username FROM users WHERE id = ?", actorID).Scan(&actor); err != nil {
+		log.Printf("Error loading mentioning user: %v", err)
+		return
+	}
+	title := fmt.Sprintf("%s mentioned you in %s %q", actor, entityType, label)
+	if err := notifications.NotifyMentions(c.DB, actorID, entityType, entityID, title, *text, before); err != nil {
+		log.Printf("Error notifying mentions: %v", err)
+	}
+}
+
+// ListNotifications returns the user's notifications, newest first.
+// Query parameters: unread=true for unread only, limit, and before_id to page
+// back from the oldest id of the previous page.
+func (c *CRMHandlers) ListNotifications(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	query := `
+	SELECT id, user_id, type, title, body, entity_type, entity_id, actor_id, read_at, created_at
+	FROM notifications WHERE user_id = ?`
+	args := []interface{}{userID}
+
+	if unread := r.URL.Query().Get("unread"); unread != "" {
+		onlyUnread, err := strconv.ParseBool(unread)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid unread parameter")
+			return
+		}
+		if onlyUnread {
+			query += " AND read_at IS NULL"
+		}
+	}
+	if beforeIDStr := r.URL.Query().Get("before_id"); beforeIDStr != "" {
+		beforeID, err := strconv.Atoi(beforeIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid before_id parameter")
+			return
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	limit := defaultNotificationLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxNotificationLimit {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid limit parameter")
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying notifications: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.Notification{}
+	for rows.Next() {
+		var n models.Notification
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.Title, &n.Body, &n.EntityType, &n.EntityID, &n.ActorID, &n.ReadAt, &n.CreatedAt); err != nil {
+			log.Printf("Error scanning notification row: %v", err)
+			continue
+		}
+		list = append(list, n)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating notification rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// GetUnreadNotificationCount returns how many notifications the user has not read.
+func (c *CRMHandlers) GetUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var count int
+	if err := c.DB.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count); err != nil {
+		log.Printf("Error counting notifications: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, map[string]int{"unread": count})
+}
+
+// MarkNotificationRead marks one notification as read. Marking it again keeps
+// the original read time.
+func (c *CRMHandlers) MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	notificationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid notification ID")
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	UPDATE notifications SET read_at = COALESCE(read_at, CURRENT_TIMESTAMP) WHERE id = ? AND user_id = ?`,
+		notificationID, userID,
+	)
+	if err != nil {
+		log.Printf("Error marking notification read: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update notification")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Notification not found or unauthorized")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// MarkAllNotificationsRead marks every unread notification of the user as read.
+func (c *CRMHandlers) MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	result, err := c.DB.Exec("UPDATE notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		log.Printf("Error marking notifications read: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update notifications")
+		return
+	}
+	marked, _ := result.RowsAffected()
+
+	utils.RespondJSON(w, http.StatusOK, map[string]int64{"marked": marked})
+}
+
+// GetNotificationPreferences returns whether each notification type is on.
+func (c *CRMHandlers) GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	prefs := make(map[string]bool, len(models.NotificationTypes))
+	for _, t := range models.NotificationTypes {
+		enabled, err := notifications.Enabled(c.DB, userID, t)
+		if err != nil {
+			log.Printf("Error loading notification preferences: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		prefs[t] = enabled
+	}
+
+	utils.RespondJSON(w, http.StatusOK, prefs)
+}
+
+// UpdateNotificationPreferences turns notification types on or off, e.g.
+// {"mention": false}. Types left out of the payload keep their setting.
+func (c *CRMHandlers) UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var payload map[string]bool
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	known := make(map[string]bool, len(models.NotificationTypes))
+	for _, t := range models.NotificationTypes {
+		known[t] = true
+	}
+	for t := range payload {
+		if !known[t] {
+			utils.RespondError(w, http.StatusBadRequest, "Unknown notification type: "+t)
+			return
+		}
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	for t, enabled := range payload {
+		if _, err := tx.Exec(`
+		INSERT INTO notification_preferences (user_id, type, enabled) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, type) DO UPDATE SET enabled = excluded.enabled`,
+			userID, t, enabled,
+		); err != nil {
+			log.Printf("Error saving notification preference: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update preferences")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing notification preferences: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update preferences")
+		return
+	}
+
+	c.GetNotificationPreferences(w, r)
+}
@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/oidc"
+	"micro-CRM/internal/orgs"
 	"micro-CRM/internal/utils"
 	"net/http"
 	"net/url"
@@ -57,6 +60,10 @@ func (c *CRMHandlers) FindOrCreateUserByEmail(email, fullName string) (*models.U
 	if err != nil {
 		return nil, fmt.Errorf("retrieving last insert ID failed: %w", err)
 	}
+	if _, err := orgs.Ensure(db, int(id)); err != nil {
+		log.Printf("Error creating organization: %v", err)
+	}
+	c.recordAudit(int(id), 0, "", events.ActionCreated, models.EntityUser, int(id), nil)
 
 	user = models.User{
 		ID:           int(id),
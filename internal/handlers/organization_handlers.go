@@ -0,0 +1,885 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"micro-CRM/internal/orgs"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const invitationColumns = `i.id, i.org_id, o.name, i.email, i.role, i.invited_by, i.created_at, i.expires_at, i.accepted_at`
+
+func scanInvitation(row interface{ Scan(...interface{}) error }, inv *models.OrganizationInvitation) error {
+	return row.Scan(&inv.ID, &inv.OrgID, &inv.OrganizationName, &inv.Email, &inv.Role, &inv.InvitedBy,
+		&inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt)
+}
+
+// orgManager loads the user's role and checks that it may manage the organization,
+// writing the error response when not.
+func (c *CRMHandlers) orgManager(w http.ResponseWriter, orgID, userID int) (string, bool) {
+	role, err := orgs.Role(c.DB, orgID, userID)
+	if err != nil {
+		log.Printf("Error loading organization role: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return "", false
+	}
+	if !orgs.CanManage(role) {
+		utils.RespondError(w, http.StatusForbidden, "Only organization owners and admins can do this")
+		return "", false
+	}
+	return role, true
+}
+
+// GetOrganization retrieves the user's organization and their role in it.
+func (c *CRMHandlers) GetOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var org models.Organization
+	err := c.DB.QueryRow(`
+	SELECT o.id, o.name, u.org_role, o.created_at, o.updated_at
+	FROM organizations o JOIN users u ON u.org_id = o.id
+	WHERE o.id = ? AND u.id = ?`, orgID, userID).Scan(&org.ID, &org.Name, &org.Role, &org.CreatedAt, &org.UpdatedAt)
+	if err != nil {
+		log.Printf("Error querying organization: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, org)
+}
+
+// UpdateOrganization renames the organization. Owners and admins only.
+func (c *CRMHandlers) UpdateOrganization(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.Organization
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		utils.RespondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+
+	if _, err := c.DB.Exec("UPDATE organizations SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", payload.Name, orgID); err != nil {
+		log.Printf("Error updating organization: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update organization")
+		return
+	}
+
+	c.GetOrganization(w, r)
+}
+
+// ListOrganizationMembers lists the members of the user's organization, owners first.
+func (c *CRMHandlers) ListOrganizationMembers(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT id, username, email, COALESCE(first_name, ''), COALESCE(last_name, ''), org_role, COALESCE(status, '')
+	FROM users WHERE org_id = ?
+	ORDER BY CASE org_role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, username`, orgID)
+	if err != nil {
+		log.Printf("Error querying organization members: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	members := []models.OrganizationMember{}
+	for rows.Next() {
+		var m models.OrganizationMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Email, &m.FirstName, &m.LastName, &m.Role, &m.Status); err != nil {
+			log.Printf("Error scanning organization member: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating organization members: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, members)
+}
+
+// memberParam reads {userId} and loads that member's role, writing the error
+// response when they are not in the organization.
+func (c *CRMHandlers) memberParam(w http.ResponseWriter, r *http.Request, orgID int) (int, string, bool) {
+	memberID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid user ID")
+		return 0, "", false
+	}
+	role, err := orgs.Role(c.DB, orgID, memberID)
+	if err != nil {
+		log.Printf("Error loading organization role: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return 0, "", false
+	}
+	if role == "" {
+		utils.RespondError(w, http.StatusNotFound, "Member not found")
+		return 0, "", false
+	}
+	return memberID, role, true
+}
+
+// unassignMember hands the open tasks a departing member was assigned in the
+// organization back to their creators, returning them for auditing.
+func unassignMember(tx *sql.Tx, orgID, userID int) ([]pendingAudit, error) {
+	const open = "org_id = ? AND assignee_id = ? AND status != ?"
+	tasks, err := snapshotRecords(tx, models.EntityTask, "SELECT id FROM tasks WHERE "+open, orgID, userID, models.TaskStatusDone)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+	UPDATE tasks SET assignee_id = NULL, assigned_by = NULL, assigned_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE `+open, orgID, userID, models.TaskStatusDone)
+	return tasks, err
+}
+
+// orgRecordTypes are the audited record types that belong to an organization.
+var orgRecordTypes = []string{models.EntityCompany, models.EntityContact, models.EntityInteraction, models.EntityTask, models.EntityFile}
+
+// transferRecords runs orgs.TransferRecords, returning the audited records it
+// changes: those from created and the open tasks assigned to them.
+func transferRecords(tx *sql.Tx, orgID, from, to int) (map[string]int64, []pendingAudit, error) {
+	var pending []pendingAudit
+	for _, entityType := range orgRecordTypes {
+		query := "SELECT id FROM " + audit.Tables[entityType] + " WHERE org_id = ?1 AND user_id = ?2"
+		args := []interface{}{orgID, from}
+		if entityType == models.EntityTask {
+			query += " OR (org_id = ?1 AND assignee_id = ?2 AND status != ?3)"
+			args = append(args, models.TaskStatusDone)
+		}
+		records, err := snapshotRecords(tx, entityType, query, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		pending = append(pending, records...)
+	}
+	moved, err := orgs.TransferRecords(tx, orgID, from, to)
+	return moved, pending, err
+}
+
+// lastOwner reports whether taking the owner role from a member with role would
+// leave the organization without one, writing a 409 when it would.
+func (c *CRMHandlers) lastOwner(w http.ResponseWriter, q orgs.Querier, orgID int, role string) (bool, error) {
+	if role != models.OrgRoleOwner {
+		return false, nil
+	}
+	owners, err := orgs.Owners(q, orgID)
+	if err != nil {
+		return false, err
+	}
+	if owners <= 1 {
+		utils.RespondError(w, http.StatusConflict, "An organization needs an owner; make someone else owner first")
+		return true, nil
+	}
+	return false, nil
+}
+
+// UpdateOrganizationMember changes a member's role. Owners and admins manage
+// roles, but only owners grant or take away the owner role.
+func (c *CRMHandlers) UpdateOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.OrganizationMember
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !orgs.ValidRole(payload.Role) {
+		utils.RespondError(w, http.StatusBadRequest, "role must be owner, admin or member")
+		return
+	}
+	actorRole, ok := c.orgManager(w, orgID, userID)
+	if !ok {
+		return
+	}
+	memberID, role, ok := c.memberParam(w, r, orgID)
+	if !ok {
+		return
+	}
+	if (role == models.OrgRoleOwner || payload.Role == models.OrgRoleOwner) && actorRole != models.OrgRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only owners can grant or take away the owner role")
+		return
+	}
+
+	if payload.Role != role {
+		before := c.snapshot(models.EntityUser, memberID)
+		if payload.Role != models.OrgRoleOwner {
+			blocked, err := c.lastOwner(w, c.DB, orgID, role)
+			if err != nil {
+				log.Printf("Error counting organization owners: %v", err)
+				utils.RespondError(w, http.StatusInternalServerError, "Database error")
+				return
+			}
+			if blocked {
+				return
+			}
+		}
+		if _, err := c.DB.Exec("UPDATE users SET org_role = ? WHERE id = ? AND org_id = ?", payload.Role, memberID, orgID); err != nil {
+			log.Printf("Error updating organization member: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update member")
+			return
+		}
+		c.audit(w, r, events.ActionUpdated, models.EntityUser, memberID, before)
+	}
+
+	c.respondMember(w, memberID)
+}
+
+// respondMember writes the stored member.
+func (c *CRMHandlers) respondMember(w http.ResponseWriter, memberID int) {
+	m := models.OrganizationMember{UserID: memberID}
+	err := c.DB.QueryRow(`
+	SELECT username, email, COALESCE(first_name, ''), COALESCE(last_name, ''), org_role, COALESCE(status, '')
+	FROM users WHERE id = ?`, memberID).
+		Scan(&m.Username, &m.Email, &m.FirstName, &m.LastName, &m.Role, &m.Status)
+	if err != nil {
+		log.Printf("Error querying organization member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, m)
+}
+
+// RemoveOrganizationMember takes a member out of the organization; members may
+// also remove themselves to leave. The records they created stay with the team
+// and they start over in a new personal organization.
+func (c *CRMHandlers) RemoveOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	memberID, role, ok := c.memberParam(w, r, orgID)
+	if !ok {
+		return
+	}
+	if memberID != userID {
+		actorRole, ok := c.orgManager(w, orgID, userID)
+		if !ok {
+			return
+		}
+		if role == models.OrgRoleOwner && actorRole != models.OrgRoleOwner {
+			utils.RespondError(w, http.StatusForbidden, "Only owners can remove an owner")
+			return
+		}
+	}
+
+	before := c.snapshot(models.EntityUser, memberID)
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	blocked, err := c.lastOwner(w, tx, orgID, role)
+	if err != nil {
+		log.Printf("Error counting organization owners: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if blocked {
+		return
+	}
+	var username string
+	if err := tx.QueryRow("SELECT username FROM users WHERE id = ?", memberID).Scan(&username); err != nil {
+		log.Printf("Error querying organization member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	unassigned, err := unassignMember(tx, orgID, memberID)
+	if err != nil {
+		log.Printf("Error unassigning tasks: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if _, err := orgs.Create(tx, username, memberID); err != nil {
+		log.Printf("Error removing organization member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing member removal: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to remove member")
+		return
+	}
+
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, memberID, before)
+	c.auditPending(w, r, unassigned)
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// deactivateMember marks a member inactive and stops the work done on their
+// behalf: mailbox and calendar syncing, webhooks and queued email. Their records
+// stay in the organization; their open tasks go back to the creators and are
+// returned for auditing.
+func deactivateMember(tx *sql.Tx, orgID, userID int) ([]pendingAudit, error) {
+	unassigned, err := unassignMember(tx, orgID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unassign tasks: %w", err)
+	}
+	for _, table := range []string{"imap_accounts", "caldav_accounts", "webhooks"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET enabled = 0, updated_at = CURRENT_TIMESTAMP WHERE user_id = ?", userID); err != nil {
+			return nil, fmt.Errorf("cannot disable %s: %w", table, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE outbox SET status = ? WHERE user_id = ? AND status = ?", models.OutboxCancelled, userID, models.OutboxQueued); err != nil {
+		return nil, fmt.Errorf("cannot cancel queued email: %w", err)
+	}
+	_, err = tx.Exec("UPDATE users SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", models.UserStatusInactive, userID)
+	return unassigned, err
+}
+
+// transferTarget checks that a member may receive another member's records,
+// writing the error response when not.
+func (c *CRMHandlers) transferTarget(w http.ResponseWriter, q notifications.Querier, orgID, fromID, toID int) bool {
+	if toID == fromID {
+		utils.RespondError(w, http.StatusBadRequest, "to_user_id must be another member")
+		return false
+	}
+	msg, err := checkAssignee(q, orgID, toID)
+	if err != nil {
+		log.Printf("Error checking transfer target: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return false
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, "to_user_id: "+msg)
+		return false
+	}
+	return true
+}
+
+// DeactivateOrganizationMember disables a member's account instead of deleting it,
+// so the team keeps their records. With a to_user_id, their records and open
+// tasks are first transferred to that member. Owners and admins only, and only
+// owners deactivate an owner.
+func (c *CRMHandlers) DeactivateOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.OwnershipTransfer
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	actorRole, ok := c.orgManager(w, orgID, userID)
+	if !ok {
+		return
+	}
+	memberID, role, ok := c.memberParam(w, r, orgID)
+	if !ok {
+		return
+	}
+	if role == models.OrgRoleOwner && actorRole != models.OrgRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only owners can deactivate an owner")
+		return
+	}
+
+	before := c.snapshot(models.EntityUser, memberID)
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var status sql.NullString
+	if err := tx.QueryRow("SELECT status FROM users WHERE id = ?", memberID).Scan(&status); err != nil {
+		log.Printf("Error querying organization member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if status.String == models.UserStatusInactive {
+		utils.RespondError(w, http.StatusConflict, "Member is already inactive")
+		return
+	}
+	blocked, err := c.lastOwner(w, tx, orgID, role)
+	if err != nil {
+		log.Printf("Error counting organization owners: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if blocked {
+		return
+	}
+	var transferred []pendingAudit
+	if payload.ToUserID != 0 {
+		if !c.transferTarget(w, tx, orgID, memberID, payload.ToUserID) {
+			return
+		}
+		if _, transferred, err = transferRecords(tx, orgID, memberID, payload.ToUserID); err != nil {
+			log.Printf("Error transferring records: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to deactivate member")
+			return
+		}
+	}
+	unassigned, err := deactivateMember(tx, orgID, memberID)
+	if err != nil {
+		log.Printf("Error deactivating member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to deactivate member")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing member deactivation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to deactivate member")
+		return
+	}
+
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, memberID, before)
+	c.auditPending(w, r, transferred)
+	c.auditPending(w, r, unassigned)
+	c.respondMember(w, memberID)
+}
+
+// ReactivateOrganizationMember lets a deactivated member sign in again. Their
+// mailbox, calendar and webhook integrations stay disabled until they re-enable
+// them. Owners and admins only.
+func (c *CRMHandlers) ReactivateOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	actorRole, ok := c.orgManager(w, orgID, userID)
+	if !ok {
+		return
+	}
+	memberID, role, ok := c.memberParam(w, r, orgID)
+	if !ok {
+		return
+	}
+	if role == models.OrgRoleOwner && actorRole != models.OrgRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only owners can reactivate an owner")
+		return
+	}
+
+	before := c.snapshot(models.EntityUser, memberID)
+	if _, err := c.DB.Exec("UPDATE users SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND org_id = ?", models.UserStatusActive, memberID, orgID); err != nil {
+		log.Printf("Error reactivating member: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to reactivate member")
+		return
+	}
+
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, memberID, before)
+	c.respondMember(w, memberID)
+}
+
+// TransferMemberRecords hands every record a member created in the organization,
+// and the open tasks assigned to them, to another active member. Owners and
+// admins only; the response counts the records moved per table.
+func (c *CRMHandlers) TransferMemberRecords(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.OwnershipTransfer
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+	memberID, _, ok := c.memberParam(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	if !c.transferTarget(w, tx, orgID, memberID, payload.ToUserID) {
+		return
+	}
+	var transferred []pendingAudit
+	payload.Transferred, transferred, err = transferRecords(tx, orgID, memberID, payload.ToUserID)
+	if err != nil {
+		log.Printf("Error transferring records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to transfer records")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing record transfer: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to transfer records")
+		return
+	}
+
+	c.auditPending(w, r, transferred)
+	utils.RespondJSON(w, http.StatusOK, payload)
+}
+
+// CreateOrganizationInvitation invites an email address to the organization. The
+// response carries the token for the invitation link; the invitee also sees the
+// invitation under /invitations once signed in with that address.
+func (c *CRMHandlers) CreateOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var inv models.OrganizationInvitation
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	inv.Email = strings.ToLower(strings.TrimSpace(inv.Email))
+	if !strings.Contains(inv.Email, "@") {
+		utils.RespondError(w, http.StatusBadRequest, "A valid email is required")
+		return
+	}
+	if inv.Role == "" {
+		inv.Role = models.OrgRoleMember
+	}
+	if !orgs.ValidRole(inv.Role) {
+		utils.RespondError(w, http.StatusBadRequest, "role must be owner, admin or member")
+		return
+	}
+	actorRole, ok := c.orgManager(w, orgID, userID)
+	if !ok {
+		return
+	}
+	if inv.Role == models.OrgRoleOwner && actorRole != models.OrgRoleOwner {
+		utils.RespondError(w, http.StatusForbidden, "Only owners can invite owners")
+		return
+	}
+
+	var member bool
+	err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE org_id = ? AND LOWER(email) = ?)", orgID, inv.Email).Scan(&member)
+	if err != nil {
+		log.Printf("Error checking organization members: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if member {
+		utils.RespondError(w, http.StatusConflict, "That user is already a member")
+		return
+	}
+
+	token, err := orgs.NewInvitationToken()
+	if err != nil {
+		log.Printf("Error generating invitation token: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	expiresAt := time.Now().UTC().Add(orgs.InvitationTTL).Format("2006-01-02 15:04:05")
+	res, err := c.DB.Exec(`
+	INSERT INTO organization_invitations (org_id, email, role, token, invited_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		orgID, inv.Email, inv.Role, token, userID, expiresAt)
+	if err != nil {
+		log.Printf("Error creating invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create invitation")
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	err = scanInvitation(c.DB.QueryRow(`
+	SELECT `+invitationColumns+` FROM organization_invitations i JOIN organizations o ON o.id = i.org_id
+	WHERE i.id = ?`, id), &inv)
+	if err != nil {
+		log.Printf("Error querying invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	inv.Token = token
+	utils.RespondJSON(w, http.StatusCreated, inv)
+}
+
+// ListOrganizationInvitations lists the organization's pending invitations.
+func (c *CRMHandlers) ListOrganizationInvitations(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT `+invitationColumns+` FROM organization_invitations i JOIN organizations o ON o.id = i.org_id
+	WHERE i.org_id = ? AND i.accepted_at IS NULL AND i.expires_at > CURRENT_TIMESTAMP
+	ORDER BY i.created_at DESC, i.id DESC`, orgID)
+	if err != nil {
+		log.Printf("Error querying invitations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	invitations := []models.OrganizationInvitation{}
+	for rows.Next() {
+		var inv models.OrganizationInvitation
+		if err := scanInvitation(rows, &inv); err != nil {
+			log.Printf("Error scanning invitation: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating invitations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, invitations)
+}
+
+// DeleteOrganizationInvitation revokes an invitation. Owners and admins only.
+func (c *CRMHandlers) DeleteOrganizationInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	invitationID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid invitation ID")
+		return
+	}
+	if _, ok := c.orgManager(w, orgID, userID); !ok {
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM organization_invitations WHERE id = ? AND org_id = ?", invitationID, orgID)
+	if err != nil {
+		log.Printf("Error deleting invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete invitation")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Invitation not found or unauthorized")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// ListMyInvitations lists the pending invitations sent to the user's email
+// address, with the tokens needed to accept them.
+func (c *CRMHandlers) ListMyInvitations(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT `+invitationColumns+`, i.token FROM organization_invitations i JOIN organizations o ON o.id = i.org_id
+	WHERE i.email = (SELECT LOWER(email) FROM users WHERE id = ?) AND i.accepted_at IS NULL AND i.expires_at > CURRENT_TIMESTAMP
+	ORDER BY i.created_at DESC, i.id DESC`, userID)
+	if err != nil {
+		log.Printf("Error querying invitations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	invitations := []models.OrganizationInvitation{}
+	for rows.Next() {
+		var inv models.OrganizationInvitation
+		if err := rows.Scan(&inv.ID, &inv.OrgID, &inv.OrganizationName, &inv.Email, &inv.Role, &inv.InvitedBy,
+			&inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt, &inv.Token); err != nil {
+			log.Printf("Error scanning invitation: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating invitations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, invitations)
+}
+
+// AcceptInvitation moves the user into the organization that invited them. A user
+// who was alone in their previous organization brings its records along and that
+// organization is removed; otherwise the records stay with the previous team,
+// which must keep an owner.
+func (c *CRMHandlers) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.OrganizationInvitation
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Token == "" {
+		utils.RespondError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	before := c.snapshot(models.EntityUser, userID)
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var inv models.OrganizationInvitation
+	err = scanInvitation(tx.QueryRow(`
+	SELECT `+invitationColumns+` FROM organization_invitations i JOIN organizations o ON o.id = i.org_id
+	WHERE i.token = ? AND i.accepted_at IS NULL AND i.expires_at > CURRENT_TIMESTAMP
+		AND i.email = (SELECT LOWER(email) FROM users WHERE id = ?)`, payload.Token, userID), &inv)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Invitation not found, expired or for another email address")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if inv.OrgID == orgID {
+		utils.RespondError(w, http.StatusConflict, "Already a member of this organization")
+		return
+	}
+
+	members, err := orgs.Members(tx, orgID)
+	if err != nil {
+		log.Printf("Error counting organization members: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	var changed []pendingAudit
+	if members == 1 {
+		// Every record of the organization joins the other one
+		for _, entityType := range orgRecordTypes {
+			records, err := snapshotRecords(tx, entityType, "SELECT id FROM "+audit.Tables[entityType]+" WHERE org_id = ?", orgID)
+			if err != nil {
+				log.Printf("Error loading organization records for audit: %v", err)
+				utils.RespondError(w, http.StatusInternalServerError, "Database error")
+				return
+			}
+			changed = append(changed, records...)
+		}
+		if err := orgs.MoveData(tx, orgID, inv.OrgID); err != nil {
+			log.Printf("Error moving organization data: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to accept invitation")
+			return
+		}
+	} else {
+		role, err := orgs.Role(tx, orgID, userID)
+		if err == nil {
+			var blocked bool
+			if blocked, err = c.lastOwner(w, tx, orgID, role); blocked {
+				return
+			}
+		}
+		if err == nil {
+			changed, err = unassignMember(tx, orgID, userID)
+		}
+		if err != nil {
+			log.Printf("Error leaving organization: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE users SET org_id = ?, org_role = ? WHERE id = ?", inv.OrgID, inv.Role, userID); err != nil {
+		log.Printf("Error joining organization: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+	if _, err := tx.Exec("UPDATE organization_invitations SET accepted_at = CURRENT_TIMESTAMP WHERE id = ?", inv.ID); err != nil {
+		log.Printf("Error accepting invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+	if members == 1 {
+		if _, err := tx.Exec("DELETE FROM organizations WHERE id = ?", orgID); err != nil {
+			log.Printf("Error deleting organization: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to accept invitation")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing invitation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to accept invitation")
+		return
+	}
+
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, userID, before)
+	c.auditPending(w, r, changed)
+
+	var org models.Organization
+	err = c.DB.QueryRow("SELECT id, name, created_at, updated_at FROM organizations WHERE id = ?", inv.OrgID).
+		Scan(&org.ID, &org.Name, &org.CreatedAt, &org.UpdatedAt)
+	if err != nil {
+		log.Printf("Error querying organization: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	org.Role = inv.Role
+	utils.RespondJSON(w, http.StatusOK, org)
+}
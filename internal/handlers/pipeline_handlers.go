@@ -0,0 +1,787 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/pipelines"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const pipelineColumns = `id, user_id, org_id, name, is_default, created_at, updated_at`
+
+func scanPipeline(row interface{ Scan(...interface{}) error }, p *models.Pipeline) error {
+	return row.Scan(&p.ID, &p.UserID, &p.OrgID, &p.Name, &p.IsDefault, &p.CreatedAt, &p.UpdatedAt)
+}
+
+// resolvePipelineStage validates a company or contact pipeline_stage against the
+// organization's default pipeline, creating it for userID when missing. It writes
+// the error response itself and reports whether to continue.
+func (c *CRMHandlers) resolvePipelineStage(w http.ResponseWriter, orgID, userID int, name string) (models.Stage, bool) {
+	stage, err := pipelines.ResolveDefaultStage(c.DB, orgID, userID, name)
+	if errors.Is(err, pipelines.ErrUnknownStage) {
+		utils.RespondError(w, http.StatusBadRequest, "Unknown pipeline_stage "+strconv.Quote(name))
+		return stage, false
+	}
+	if err != nil {
+		log.Printf("Error resolving pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return stage, false
+	}
+	return stage, true
+}
+
+// recordStageChange appends to a company or contact stage history, kept by the
+// record's owner. The record is already saved at this point, so a failure is
+// logged rather than reported to the client.
+func (c *CRMHandlers) recordStageChange(ownerID, actorID int, entityType string, entityID int, stage models.Stage, from *string) {
+	if from != nil && *from == stage.Name {
+		return
+	}
+	if err := pipelines.RecordTransition(c.DB, ownerID, actorID, entityType, entityID, stage.PipelineID, from, stage.Name); err != nil {
+		log.Printf("Error recording %s %d stage change: %v", entityType, entityID, err)
+	}
+	c.publishStageChange(ownerID, entityType, entityID, stage, from)
+}
+
+// publishStageChange announces that a record moved to stage, followed by a "won"
+// event when the stage closes it as won.
+func (c *CRMHandlers) publishStageChange(userID int, entityType string, entityID int, stage models.Stage, from *string) {
+	data := map[string]interface{}{
+		"id":          entityID,
+		"pipeline_id": stage.PipelineID,
+		"from_stage":  from,
+		"to_stage":    stage.Name,
+		"outcome":     stage.Outcome,
+	}
+	c.publish(userID, entityType, events.ActionStageChanged, entityID, data)
+	if stage.Outcome == models.StageWon {
+		c.publish(userID, entityType, events.ActionWon, entityID, data)
+	}
+}
+
+// validateStage normalizes a stage payload and returns a client-facing message when it is invalid.
+func validateStage(s *models.Stage) string {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return "stage name is required"
+	}
+	if s.Color == "" {
+		s.Color = pipelines.DefaultColor
+	}
+	if s.Outcome == "" {
+		s.Outcome = models.StageOpen
+	}
+	switch s.Outcome {
+	case models.StageOpen, models.StageWon, models.StageLost:
+	default:
+		return "stage outcome must be open, won or lost"
+	}
+	if s.Probability < 0 || s.Probability > 100 {
+		return "stage probability must be between 0 and 100"
+	}
+	return ""
+}
+
+// stageNameTaken reports whether another stage of the pipeline already uses name, ignoring case.
+func stageNameTaken(q pipelines.Querier, pipelineID, exceptID int, name string) (bool, error) {
+	var taken bool
+	err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM pipeline_stages WHERE pipeline_id = ? AND id != ? AND LOWER(name) = LOWER(?))",
+		pipelineID, exceptID, name).Scan(&taken)
+	return taken, err
+}
+
+// renumberStages rewrites positions as 0..n-1, placing movedID at position when movedID is non-zero.
+func renumberStages(tx *sql.Tx, pipelineID, movedID, position int) error {
+	stages, err := pipelines.Stages(tx, pipelineID)
+	if err != nil {
+		return err
+	}
+	order := make([]int, 0, len(stages))
+	for _, s := range stages {
+		if s.ID != movedID {
+			order = append(order, s.ID)
+		}
+	}
+	if movedID != 0 {
+		if position < 0 {
+			position = 0
+		}
+		if position > len(order) {
+			position = len(order)
+		}
+		order = append(order[:position], append([]int{movedID}, order[position:]...)...)
+	}
+	for i, id := range order {
+		if _, err := tx.Exec("UPDATE pipeline_stages SET position = ? WHERE id = ?", i, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipelineFromRequest loads the pipeline named by the {id} route variable, writing
+// the error response itself when it is missing or belongs to another organization.
+func (c *CRMHandlers) pipelineFromRequest(w http.ResponseWriter, r *http.Request, orgID int) (models.Pipeline, bool) {
+	var pipeline models.Pipeline
+	pipelineID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid pipeline ID")
+		return pipeline, false
+	}
+	err = scanPipeline(c.DB.QueryRow("SELECT "+pipelineColumns+" FROM pipelines WHERE id = ? AND org_id = ?", pipelineID, orgID), &pipeline)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Pipeline not found or unauthorized")
+		return pipeline, false
+	}
+	if err != nil {
+		log.Printf("Error querying pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return pipeline, false
+	}
+	return pipeline, true
+}
+
+// respondPipeline writes the stored pipeline with its stages.
+func (c *CRMHandlers) respondPipeline(w http.ResponseWriter, status int, pipelineID int) {
+	var pipeline models.Pipeline
+	if err := scanPipeline(c.DB.QueryRow("SELECT "+pipelineColumns+" FROM pipelines WHERE id = ?", pipelineID), &pipeline); err != nil {
+		log.Printf("Error fetching pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve pipeline")
+		return
+	}
+	stages, err := pipelines.Stages(c.DB, pipelineID)
+	if err != nil {
+		log.Printf("Error fetching pipeline stages: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve pipeline")
+		return
+	}
+	pipeline.Stages = stages
+	utils.RespondJSON(w, status, pipeline)
+}
+
+// CreatePipeline creates a pipeline. Without stages it starts from the default set.
+func (c *CRMHandlers) CreatePipeline(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var pipeline models.Pipeline
+	if err := json.NewDecoder(r.Body).Decode(&pipeline); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	pipeline.Name = strings.TrimSpace(pipeline.Name)
+	if pipeline.Name == "" {
+		utils.RespondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if len(pipeline.Stages) == 0 {
+		pipeline.Stages = append([]models.Stage(nil), pipelines.DefaultStages...)
+	}
+	seen := make(map[string]bool)
+	for i := range pipeline.Stages {
+		if msg := validateStage(&pipeline.Stages[i]); msg != "" {
+			utils.RespondError(w, http.StatusBadRequest, msg)
+			return
+		}
+		key := strings.ToLower(pipeline.Stages[i].Name)
+		if seen[key] {
+			utils.RespondError(w, http.StatusBadRequest, "Duplicate stage "+strconv.Quote(pipeline.Stages[i].Name))
+			return
+		}
+		seen[key] = true
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// Make sure the organization's implicit default exists before adding another pipeline next to it
+	if _, err := pipelines.EnsureDefault(tx, orgID, userID); err != nil {
+		log.Printf("Error ensuring default pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	var exists bool
+	tx.QueryRow("SELECT EXISTS(SELECT 1 FROM pipelines WHERE org_id = ? AND LOWER(name) = LOWER(?))", orgID, pipeline.Name).Scan(&exists)
+	if exists {
+		utils.RespondError(w, http.StatusConflict, "A pipeline with this name already exists")
+		return
+	}
+	if pipeline.IsDefault {
+		if _, err := tx.Exec("UPDATE pipelines SET is_default = 0 WHERE org_id = ?", orgID); err != nil {
+			log.Printf("Error clearing default pipeline: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create pipeline")
+			return
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO pipelines (user_id, org_id, name, is_default) VALUES (?, ?, ?, ?)", userID, orgID, pipeline.Name, pipeline.IsDefault)
+	if err != nil {
+		log.Printf("Error inserting pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create pipeline")
+		return
+	}
+	id, _ := result.LastInsertId()
+	for i, s := range pipeline.Stages {
+		if _, err := tx.Exec(`
+		INSERT INTO pipeline_stages (pipeline_id, name, position, color, probability, outcome) VALUES (?, ?, ?, ?, ?, ?)`,
+			id, s.Name, i, s.Color, s.Probability, s.Outcome,
+		); err != nil {
+			log.Printf("Error inserting pipeline stage: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create pipeline")
+			return
+		}
+	}
+	if pipeline.IsDefault {
+		if conflict, err := stagesMissingFrom(tx, orgID, int(id)); err != nil || conflict {
+			respondDefaultConflict(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create pipeline")
+		return
+	}
+
+	c.respondPipeline(w, http.StatusCreated, int(id))
+}
+
+// ListPipelines retrieves the organization's pipelines with their stages.
+func (c *CRMHandlers) ListPipelines(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	if _, err := pipelines.EnsureDefault(c.DB, orgID, userID); err != nil {
+		log.Printf("Error ensuring default pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT "+pipelineColumns+" FROM pipelines WHERE org_id = ? ORDER BY is_default DESC, name", orgID)
+	if err != nil {
+		log.Printf("Error querying pipelines: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	var list []models.Pipeline
+	for rows.Next() {
+		var pipeline models.Pipeline
+		if err := scanPipeline(rows, &pipeline); err != nil {
+			log.Printf("Error scanning pipeline row: %v", err)
+			continue
+		}
+		list = append(list, pipeline)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating pipeline rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	rows.Close()
+
+	for i := range list {
+		if list[i].Stages, err = pipelines.Stages(c.DB, list[i].ID); err != nil {
+			log.Printf("Error querying pipeline stages: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// GetPipeline retrieves a single pipeline with its stages.
+func (c *CRMHandlers) GetPipeline(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	c.respondPipeline(w, http.StatusOK, pipeline.ID)
+}
+
+// UpdatePipeline renames a pipeline or makes it the default. Stages are managed
+// through the stage endpoints.
+func (c *CRMHandlers) UpdatePipeline(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	var payload models.Pipeline
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	payload.Name = strings.TrimSpace(payload.Name)
+	if payload.Name == "" {
+		utils.RespondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if pipeline.IsDefault && !payload.IsDefault {
+		utils.RespondError(w, http.StatusBadRequest, "Make another pipeline the default instead")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	tx.QueryRow("SELECT EXISTS(SELECT 1 FROM pipelines WHERE org_id = ? AND LOWER(name) = LOWER(?) AND id != ?)", orgID, payload.Name, pipeline.ID).Scan(&exists)
+	if exists {
+		utils.RespondError(w, http.StatusConflict, "A pipeline with this name already exists")
+		return
+	}
+
+	if payload.IsDefault && !pipeline.IsDefault {
+		// Company and contact stages follow the default pipeline, so they must fit the new one
+		oldDefault, err := pipelines.EnsureDefault(tx, orgID, userID)
+		if err != nil {
+			log.Printf("Error loading default pipeline: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if conflict, err := stagesMissingFrom(tx, orgID, pipeline.ID); err != nil || conflict {
+			respondDefaultConflict(w, err)
+			return
+		}
+		if _, err := tx.Exec("UPDATE pipelines SET is_default = 0 WHERE id = ?", oldDefault); err != nil {
+			log.Printf("Error clearing default pipeline: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update pipeline")
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE pipelines SET name = ?, is_default = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		payload.Name, payload.IsDefault, pipeline.ID); err != nil {
+		log.Printf("Error updating pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update pipeline")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline update: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update pipeline")
+		return
+	}
+
+	c.respondPipeline(w, http.StatusOK, pipeline.ID)
+}
+
+// DeletePipeline deletes a pipeline that is not the default and has no deals.
+func (c *CRMHandlers) DeletePipeline(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	if pipeline.IsDefault {
+		utils.RespondError(w, http.StatusConflict, "The default pipeline cannot be deleted")
+		return
+	}
+	var inUse bool
+	c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM deals WHERE pipeline_id = ?)", pipeline.ID).Scan(&inUse)
+	if inUse {
+		utils.RespondError(w, http.StatusConflict, "Pipeline still has deals")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM pipelines WHERE id = ?", pipeline.ID); err != nil {
+		log.Printf("Error deleting pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete pipeline")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete pipeline")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// CreatePipelineStage adds a stage, at the end unless a position is given.
+func (c *CRMHandlers) CreatePipelineStage(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	stage := models.Stage{Position: -1}
+	if err := json.NewDecoder(r.Body).Decode(&stage); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateStage(&stage); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	if taken, err := stageNameTaken(tx, pipeline.ID, 0, stage.Name); err != nil || taken {
+		utils.RespondError(w, http.StatusConflict, "A stage with this name already exists")
+		return
+	}
+	result, err := tx.Exec(`
+	INSERT INTO pipeline_stages (pipeline_id, name, position, color, probability, outcome) VALUES (?, ?, ?, ?, ?, ?)`,
+		pipeline.ID, stage.Name, 1<<30, stage.Color, stage.Probability, stage.Outcome,
+	)
+	if err != nil {
+		log.Printf("Error inserting pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+	id, _ := result.LastInsertId()
+	position := stage.Position
+	if position < 0 {
+		position = 1 << 30
+	}
+	if err := renumberStages(tx, pipeline.ID, int(id), position); err != nil {
+		log.Printf("Error ordering pipeline stages: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create stage")
+		return
+	}
+
+	c.respondPipeline(w, http.StatusCreated, pipeline.ID)
+}
+
+// UpdatePipelineStage changes a stage. Renaming carries the records in that stage along.
+func (c *CRMHandlers) UpdatePipelineStage(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	stageID, err := strconv.Atoi(mux.Vars(r)["stageId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid stage ID")
+		return
+	}
+
+	stage := models.Stage{Position: -1} // Omitted position keeps the current one
+	if err := json.NewDecoder(r.Body).Decode(&stage); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateStage(&stage); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRow("SELECT name FROM pipeline_stages WHERE id = ? AND pipeline_id = ?", stageID, pipeline.ID).Scan(&oldName)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Stage not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken, err := stageNameTaken(tx, pipeline.ID, stageID, stage.Name); err != nil || taken {
+		utils.RespondError(w, http.StatusConflict, "A stage with this name already exists")
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE pipeline_stages SET name = ?, color = ?, probability = ?, outcome = ? WHERE id = ?",
+		stage.Name, stage.Color, stage.Probability, stage.Outcome, stageID); err != nil {
+		log.Printf("Error updating pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update stage")
+		return
+	}
+	if stage.Position >= 0 {
+		if err := renumberStages(tx, pipeline.ID, stageID, stage.Position); err != nil {
+			log.Printf("Error ordering pipeline stages: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update stage")
+			return
+		}
+	}
+	var moved []pendingAudit
+	if oldName != stage.Name {
+		if moved, err = renameStage(tx, pipeline, oldName, stage.Name); err != nil {
+			log.Printf("Error renaming stage on records: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update stage")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update stage")
+		return
+	}
+
+	c.auditPending(w, r, moved)
+	c.respondPipeline(w, http.StatusOK, pipeline.ID)
+}
+
+// DeletePipelineStage removes a stage. Records still in it must be moved with ?move_to={stageId}.
+func (c *CRMHandlers) DeletePipelineStage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	pipeline, ok := c.pipelineFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	stageID, err := strconv.Atoi(mux.Vars(r)["stageId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid stage ID")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	stages, err := pipelines.Stages(tx, pipeline.ID)
+	if err != nil {
+		log.Printf("Error querying pipeline stages: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	var stage, target *models.Stage
+	moveTo, _ := strconv.Atoi(r.URL.Query().Get("move_to"))
+	for i := range stages {
+		if stages[i].ID == stageID {
+			stage = &stages[i]
+		}
+		if stages[i].ID == moveTo && moveTo != stageID {
+			target = &stages[i]
+		}
+	}
+	if stage == nil {
+		utils.RespondError(w, http.StatusNotFound, "Stage not found or unauthorized")
+		return
+	}
+	if len(stages) == 1 {
+		utils.RespondError(w, http.StatusConflict, "A pipeline needs at least one stage")
+		return
+	}
+
+	var moved []pendingAudit
+	if target != nil {
+		if moved, err = moveStageRecords(tx, pipeline, stage.Name, target.Name, userID); err != nil {
+			log.Printf("Error moving records to stage: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete stage")
+			return
+		}
+	} else {
+		inUse, err := stageInUse(tx, pipeline, stage.Name)
+		if err != nil {
+			log.Printf("Error checking stage usage: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if inUse {
+			utils.RespondError(w, http.StatusConflict, "Stage is in use; pass move_to with another stage ID")
+			return
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM pipeline_stages WHERE id = ?", stageID); err != nil {
+		log.Printf("Error deleting pipeline stage: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete stage")
+		return
+	}
+	if err := renumberStages(tx, pipeline.ID, 0, 0); err != nil {
+		log.Printf("Error ordering pipeline stages: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete stage")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing pipeline stage delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete stage")
+		return
+	}
+
+	c.auditPending(w, r, moved)
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// stagesMissingFrom reports whether any company or contact of the organization is in a
+// stage the pipeline lacks, which would leave them invalid if it became the default.
+func stagesMissingFrom(tx *sql.Tx, orgID, pipelineID int) (bool, error) {
+	var unmapped int
+	err := tx.QueryRow(`
+	SELECT COUNT(*) FROM (
+		SELECT pipeline_stage AS v FROM companies WHERE org_id = ? AND pipeline_stage IS NOT NULL
+		UNION SELECT pipeline_stage FROM contacts WHERE org_id = ? AND pipeline_stage IS NOT NULL
+	) WHERE v NOT IN (SELECT name FROM pipeline_stages WHERE pipeline_id = ?)`,
+		orgID, orgID, pipelineID).Scan(&unmapped)
+	return unmapped > 0, err
+}
+
+func respondDefaultConflict(w http.ResponseWriter, err error) {
+	if err != nil {
+		log.Printf("Error checking pipeline stages: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	utils.RespondError(w, http.StatusConflict, "Companies or contacts use stages this pipeline does not have")
+}
+
+// renameStage moves every record in stage from to stage to and rewrites the stage
+// history to match, since the stage itself was only renamed.
+func renameStage(tx *sql.Tx, pipeline models.Pipeline, from, to string) ([]pendingAudit, error) {
+	moved, err := updateStageRecords(tx, pipeline, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE stage_transitions SET to_stage = ? WHERE pipeline_id = ? AND to_stage = ?", to, pipeline.ID, from); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE stage_transitions SET from_stage = ? WHERE pipeline_id = ? AND from_stage = ?", to, pipeline.ID, from)
+	return moved, err
+}
+
+// moveStageRecords moves every record in stage from to stage to, recording the move
+// as a transition made by actorID.
+func moveStageRecords(tx *sql.Tx, pipeline models.Pipeline, from, to string, actorID int) ([]pendingAudit, error) {
+	_, err := tx.Exec(`
+	INSERT INTO stage_transitions (user_id, org_id, entity_type, entity_id, pipeline_id, from_stage, to_stage, changed_by)
+	SELECT user_id, org_id, ?, id, ?, stage, ?, ? FROM deals WHERE pipeline_id = ? AND stage = ?`,
+		models.EntityDeal, pipeline.ID, to, actorID, pipeline.ID, from)
+	if err != nil {
+		return nil, err
+	}
+	if pipeline.IsDefault {
+		for entityType, table := range map[string]string{models.EntityCompany: "companies", models.EntityContact: "contacts"} {
+			_, err := tx.Exec(`
+			INSERT INTO stage_transitions (user_id, org_id, entity_type, entity_id, pipeline_id, from_stage, to_stage, changed_by)
+			SELECT user_id, org_id, ?, id, ?, pipeline_stage, ?, ? FROM `+table+` WHERE org_id = ? AND pipeline_stage = ?`,
+				entityType, pipeline.ID, to, actorID, pipeline.OrgID, from)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updateStageRecords(tx, pipeline, from, to)
+}
+
+// updateStageRecords rewrites the stage on deals of the pipeline and, for the
+// default pipeline, on the organization's companies and contacts, which it
+// returns for auditing.
+func updateStageRecords(tx *sql.Tx, pipeline models.Pipeline, from, to string) ([]pendingAudit, error) {
+	if _, err := tx.Exec("UPDATE deals SET stage = ?, updated_at = CURRENT_TIMESTAMP WHERE pipeline_id = ? AND stage = ?", to, pipeline.ID, from); err != nil {
+		return nil, err
+	}
+	if !pipeline.IsDefault {
+		return nil, nil
+	}
+	var moved []pendingAudit
+	for _, entityType := range []string{models.EntityCompany, models.EntityContact} {
+		table := audit.Tables[entityType]
+		records, err := snapshotRecords(tx, entityType, "SELECT id FROM "+table+" WHERE org_id = ? AND pipeline_stage = ?", pipeline.OrgID, from)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE "+table+" SET pipeline_stage = ? WHERE org_id = ? AND pipeline_stage = ?", to, pipeline.OrgID, from); err != nil {
+			return nil, err
+		}
+		moved = append(moved, records...)
+	}
+	return moved, nil
+}
+
+func stageInUse(tx *sql.Tx, pipeline models.Pipeline, name string) (bool, error) {
+	var inUse bool
+	err := tx.QueryRow(`
+	SELECT EXISTS(SELECT 1 FROM deals WHERE pipeline_id = ? AND stage = ?)
+		OR (? AND (EXISTS(SELECT 1 FROM companies WHERE org_id = ? AND pipeline_stage = ?)
+			OR EXISTS(SELECT 1 FROM contacts WHERE org_id = ? AND pipeline_stage = ?)))`,
+		pipeline.ID, name, pipeline.IsDefault, pipeline.OrgID, name, pipeline.OrgID, name,
+	).Scan(&inUse)
+	return inUse, err
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
 	"micro-CRM/internal/utils"
 	"net/http"
@@ -83,6 +84,7 @@ func (c *CRMHandlers) UpdateUserInfo(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	before := c.snapshot(models.EntityUser, userID)
 	stmt, err := c.DB.Prepare(query)
 	if err != nil {
 		c.Log.Error("Failed to prepare update statement: ", err)
@@ -103,6 +105,7 @@ func (c *CRMHandlers) UpdateUserInfo(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusNotFound, "User not found")
 		return
 	}
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, userID, before)
 
 	updateResponse = models.UpdateUserResponse{
 		Message:   "User updated",
@@ -111,27 +114,67 @@ func (c *CRMHandlers) UpdateUserInfo(w http.ResponseWriter, r *http.Request) {
 	utils.RespondJSON(w, http.StatusOK, updateResponse)
 	return
 }
+
+// DeleteUser deactivates the user's own account rather than deleting it, so their
+// records stay with the organization. The last active owner of a team must hand
+// the owner role on first.
 func (c *CRMHandlers) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	UserID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 	var (
 		deleteResponse models.UserDeleteResponse
 	)
-	res, err := c.DB.Exec("UPDATE users SET status='incative' WHERE id=?", UserID)
+	before := c.snapshot(models.EntityUser, UserID)
+	tx, err := c.DB.Begin()
 	if err != nil {
 		c.Log.Error("Error deleting user : ", err.Error())
-		utils.RespondError(w, http.StatusInternalServerError, err.Error())
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
-		c.Log.Error("Error deleting user : ", UserID)
+	defer tx.Rollback()
+
+	var role string
+	var teammates int
+	err = tx.QueryRow(`
+	SELECT org_role, (SELECT COUNT(*) FROM users WHERE org_id = ? AND id != ? AND status = 'active')
+	FROM users WHERE id = ?`, orgID, UserID, UserID).Scan(&role, &teammates)
+	if errors.Is(err, sql.ErrNoRows) {
 		utils.RespondError(w, http.StatusNotFound, "User Not found or unauthorized to delete")
 		return
 	}
+	if err != nil {
+		c.Log.Error("Error deleting user : ", err.Error())
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if teammates > 0 {
+		blocked, err := c.lastOwner(w, tx, orgID, role)
+		if err != nil {
+			c.Log.Error("Error deleting user : ", err.Error())
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if blocked {
+			return
+		}
+	}
+	unassigned, err := deactivateMember(tx, orgID, UserID)
+	if err != nil {
+		c.Log.Error("Error deleting user : ", err.Error())
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to disable user")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Log.Error("Error deleting user : ", err.Error())
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to disable user")
+		return
+	}
+	c.audit(w, r, events.ActionUpdated, models.EntityUser, UserID, before)
+	c.auditPending(w, r, unassigned)
 	deleteResponse.Message = "Success disabling user"
 	utils.RespondJSON(w, http.StatusOK, deleteResponse)
 }
@@ -148,10 +191,10 @@ func (c *CRMHandlers) GetProfileStats(w http.ResponseWriter, r *http.Request) {
 	query := `
 	SELECT
 	  (SELECT created_at FROM users WHERE id = $1) AS member_since,
-	  (SELECT COUNT(*) FROM contacts WHERE user_id = $1) AS total_contacts,
-	  (SELECT COUNT(*) FROM companies WHERE user_id = $1) AS companies_managed,
-	  (SELECT COUNT(*) FROM interactions WHERE user_id = $1) AS total_interactions,
-	  (SELECT COUNT(*) FROM tasks WHERE user_id = $1) AS total_tasks;
+	  (SELECT COUNT(*) FROM contacts WHERE user_id = $1 AND deleted_at IS NULL) AS total_contacts,
+	  (SELECT COUNT(*) FROM companies WHERE user_id = $1 AND deleted_at IS NULL) AS companies_managed,
+	  (SELECT COUNT(*) FROM interactions WHERE user_id = $1 AND deleted_at IS NULL) AS total_interactions,
+	  (SELECT COUNT(*) FROM tasks WHERE user_id = $1 AND deleted_at IS NULL) AS total_tasks;
 	`
 
 	err := c.DB.QueryRow(query, userID).Scan(
@@ -0,0 +1,552 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/relationships"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const relationshipColumns = `cr.id, cr.contact_id, cr.related_id, cr.type, cr.notes, cr.created_by, cr.created_at,
+	o.id, o.first_name, o.last_name, o.job_title, o.company_id`
+
+// relationshipQuery selects the relationships of the contact given as the first
+// argument, with the live contact at the other end aliased o.
+const relationshipQuery = `SELECT ` + relationshipColumns + `
+	FROM contact_relationships cr
+	JOIN contacts o ON o.id = CASE WHEN cr.contact_id = ?1 THEN cr.related_id ELSE cr.contact_id END
+	WHERE (cr.contact_id = ?1 OR cr.related_id = ?1) AND o.deleted_at IS NULL`
+
+func scanRelationship(row interface{ Scan(...interface{}) error }, rel *models.ContactRelationship) error {
+	rel.Other = &models.ContactBrief{}
+	return row.Scan(&rel.ID, &rel.ContactID, &rel.RelatedID, &rel.Type, &rel.Notes, &rel.CreatedBy, &rel.CreatedAt,
+		&rel.Other.ID, &rel.Other.FirstName, &rel.Other.LastName, &rel.Other.JobTitle, &rel.Other.CompanyID)
+}
+
+const affiliationColumns = `a.id, a.contact_id, a.company_id, a.title, a.start_date, a.end_date, a.created_at, a.updated_at`
+
+func scanAffiliation(row interface{ Scan(...interface{}) error }, a *models.ContactAffiliation, extra ...interface{}) error {
+	return row.Scan(append([]interface{}{&a.ID, &a.ContactID, &a.CompanyID, &a.Title, &a.StartDate, &a.EndDate, &a.CreatedAt, &a.UpdatedAt}, extra...)...)
+}
+
+// routeRecord reads an id route variable naming a live record of the
+// organization in table, writing the error response itself when not ok.
+func (c *CRMHandlers) routeRecord(w http.ResponseWriter, r *http.Request, orgID int, variable, table, label string) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)[variable])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid "+strings.ToLower(label)+" ID")
+		return 0, false
+	}
+	if err := utils.ValidateOwnership(c.DB, table, id, orgID); err != nil {
+		utils.RespondError(w, http.StatusNotFound, label+" not found or unauthorized")
+		return 0, false
+	}
+	return id, true
+}
+
+// ListContactRelationships lists the relationships of a contact of the
+// organization in either direction, each with the contact at the other end.
+// Query parameters: type.
+func (c *CRMHandlers) ListContactRelationships(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+
+	query := relationshipQuery
+	args := []interface{}{contactID}
+	if relationshipType := r.URL.Query().Get("type"); relationshipType != "" {
+		if !slices.Contains(relationships.Types, relationshipType) {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid type parameter")
+			return
+		}
+		query += " AND cr.type = ?2"
+		args = append(args, relationshipType)
+	}
+	rows, err := c.DB.Query(query+" ORDER BY cr.type, o.last_name, o.first_name, cr.id", args...)
+	if err != nil {
+		log.Printf("Error querying contact relationships: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.ContactRelationship{}
+	for rows.Next() {
+		var rel models.ContactRelationship
+		if err := scanRelationship(rows, &rel); err != nil {
+			log.Printf("Error scanning contact relationship row: %v", err)
+			continue
+		}
+		list = append(list, rel)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating contact relationship rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// CreateContactRelationship links a contact of the organization to another
+// one. A contact reports to one person at most, and reports_to links cannot
+// loop.
+func (c *CRMHandlers) CreateContactRelationship(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+	var rel models.ContactRelationship
+	if err := json.NewDecoder(r.Body).Decode(&rel); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !slices.Contains(relationships.Types, rel.Type) {
+		utils.RespondError(w, http.StatusBadRequest, "type must be one of "+strings.Join(relationships.Types, ", "))
+		return
+	}
+	if rel.RelatedID == contactID {
+		utils.RespondError(w, http.StatusBadRequest, "A contact cannot be related to itself")
+		return
+	}
+	if err := utils.ValidateOwnership(c.DB, "contacts", rel.RelatedID, orgID); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "related_id must be a contact of the organization")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	exists, err := relationships.Exists(tx, contactID, rel.RelatedID, rel.Type)
+	if err != nil {
+		log.Printf("Error checking contact relationship: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if exists {
+		utils.RespondError(w, http.StatusConflict, "The contacts are already related this way")
+		return
+	}
+	if rel.Type == models.RelationshipReportsTo {
+		managerID, err := relationships.Manager(tx, contactID)
+		if err != nil {
+			log.Printf("Error checking reporting line: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if managerID != 0 {
+			utils.RespondError(w, http.StatusConflict, "The contact already reports to someone; remove that relationship first")
+			return
+		}
+		loops, err := relationships.WouldCycle(tx, contactID, rel.RelatedID)
+		if err != nil {
+			log.Printf("Error checking reporting line: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if loops {
+			utils.RespondError(w, http.StatusBadRequest, "The contact cannot report to someone who reports to them")
+			return
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO contact_relationships (contact_id, related_id, type, notes, created_by) VALUES (?, ?, ?, ?, ?)",
+		contactID, rel.RelatedID, rel.Type, rel.Notes, userID)
+	if err != nil {
+		log.Printf("Error inserting contact relationship: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create relationship")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing contact relationship: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create relationship")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	if err := scanRelationship(c.DB.QueryRow(relationshipQuery+" AND cr.id = ?2", contactID, id), &rel); err != nil {
+		log.Printf("Error fetching contact relationship: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve relationship")
+		return
+	}
+	utils.RespondJSON(w, http.StatusCreated, rel)
+}
+
+// DeleteContactRelationship removes a relationship of a contact of the organization.
+func (c *CRMHandlers) DeleteContactRelationship(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+	relationshipID, err := strconv.Atoi(mux.Vars(r)["relationshipId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid relationship ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM contact_relationships WHERE id = ? AND (contact_id = ?2 OR related_id = ?2)", relationshipID, contactID)
+	if err != nil {
+		log.Printf("Error deleting contact relationship: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete relationship")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Relationship not found")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// validateAffiliation checks an affiliation payload and returns a client-facing
+// message when it is invalid for the organization.
+func (c *CRMHandlers) validateAffiliation(a *models.ContactAffiliation, orgID int) string {
+	if err := utils.ValidateOwnership(c.DB, "companies", a.CompanyID, orgID); err != nil {
+		return "company_id must be a company of the organization"
+	}
+	for _, d := range []**string{&a.StartDate, &a.EndDate} {
+		if *d != nil && strings.TrimSpace(**d) == "" {
+			*d = nil
+		}
+		if *d != nil {
+			if _, err := time.Parse("2006-01-02", **d); err != nil {
+				return "start_date and end_date must be formatted as YYYY-MM-DD"
+			}
+		}
+	}
+	if a.StartDate != nil && a.EndDate != nil && *a.EndDate < *a.StartDate {
+		return "end_date cannot be before start_date"
+	}
+	return ""
+}
+
+// respondAffiliation writes a stored affiliation with its company's name.
+func (c *CRMHandlers) respondAffiliation(w http.ResponseWriter, status, affiliationID int) {
+	var a models.ContactAffiliation
+	err := scanAffiliation(c.DB.QueryRow("SELECT "+affiliationColumns+", co.name FROM contact_affiliations a JOIN companies co ON co.id = a.company_id WHERE a.id = ?",
+		affiliationID), &a, &a.CompanyName)
+	if err != nil {
+		log.Printf("Error fetching contact affiliation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve affiliation")
+		return
+	}
+	utils.RespondJSON(w, status, a)
+}
+
+// ListContactAffiliations lists a contact's positions at companies, current
+// ones first, then by most recent start.
+func (c *CRMHandlers) ListContactAffiliations(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT `+affiliationColumns+`, co.name
+	FROM contact_affiliations a JOIN companies co ON co.id = a.company_id
+	WHERE a.contact_id = ? AND co.deleted_at IS NULL
+	ORDER BY a.end_date IS NOT NULL, a.end_date DESC, a.start_date DESC, a.id DESC`, contactID)
+	if err != nil {
+		log.Printf("Error querying contact affiliations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.ContactAffiliation{}
+	for rows.Next() {
+		var a models.ContactAffiliation
+		if err := scanAffiliation(rows, &a, &a.CompanyName); err != nil {
+			log.Printf("Error scanning contact affiliation row: %v", err)
+			continue
+		}
+		list = append(list, a)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating contact affiliation rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// CreateContactAffiliation records a position a contact holds or held at a
+// company of the organization. The contact's company_id is left as it is.
+func (c *CRMHandlers) CreateContactAffiliation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+	var a models.ContactAffiliation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := c.validateAffiliation(&a, orgID); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	result, err := c.DB.Exec("INSERT INTO contact_affiliations (contact_id, company_id, title, start_date, end_date) VALUES (?, ?, ?, ?, ?)",
+		contactID, a.CompanyID, a.Title, a.StartDate, a.EndDate)
+	if err != nil {
+		log.Printf("Error inserting contact affiliation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create affiliation")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	c.respondAffiliation(w, http.StatusCreated, int(id))
+}
+
+// UpdateContactAffiliation replaces a position of a contact, e.g. to set the
+// end_date when they leave.
+func (c *CRMHandlers) UpdateContactAffiliation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+	affiliationID, err := strconv.Atoi(mux.Vars(r)["affiliationId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid affiliation ID")
+		return
+	}
+	var a models.ContactAffiliation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := c.validateAffiliation(&a, orgID); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	UPDATE contact_affiliations SET company_id = ?, title = ?, start_date = ?, end_date = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND contact_id = ?`, a.CompanyID, a.Title, a.StartDate, a.EndDate, affiliationID, contactID)
+	if err != nil {
+		log.Printf("Error updating contact affiliation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update affiliation")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Affiliation not found")
+		return
+	}
+
+	c.respondAffiliation(w, http.StatusOK, affiliationID)
+}
+
+// DeleteContactAffiliation removes a position of a contact.
+func (c *CRMHandlers) DeleteContactAffiliation(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	contactID, ok := c.routeRecord(w, r, orgID, "id", "contacts", "Contact")
+	if !ok {
+		return
+	}
+	affiliationID, err := strconv.Atoi(mux.Vars(r)["affiliationId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid affiliation ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM contact_affiliations WHERE id = ? AND contact_id = ?", affiliationID, contactID)
+	if err != nil {
+		log.Printf("Error deleting contact affiliation: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete affiliation")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Affiliation not found")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// ListCompanyAffiliations lists the people who hold or held a position at a
+// company of the organization, current ones first.
+// Query parameters: current (true for today's positions only, false for past ones only).
+func (c *CRMHandlers) ListCompanyAffiliations(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	companyID, ok := c.routeRecord(w, r, orgID, "id", "companies", "Company")
+	if !ok {
+		return
+	}
+
+	query := `
+	SELECT ` + affiliationColumns + `, o.id, o.first_name, o.last_name, o.job_title, o.company_id
+	FROM contact_affiliations a JOIN contacts o ON o.id = a.contact_id
+	WHERE a.company_id = ? AND o.deleted_at IS NULL`
+	if currentStr := r.URL.Query().Get("current"); currentStr != "" {
+		current, err := strconv.ParseBool(currentStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid current parameter")
+			return
+		}
+		if current {
+			query += " AND " + relationships.CurrentAffiliation
+		} else {
+			query += " AND NOT (" + relationships.CurrentAffiliation + ")"
+		}
+	}
+	rows, err := c.DB.Query(query+" ORDER BY a.end_date IS NOT NULL, a.end_date DESC, o.last_name, o.first_name, a.id", companyID)
+	if err != nil {
+		log.Printf("Error querying company affiliations: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.ContactAffiliation{}
+	for rows.Next() {
+		var a models.ContactAffiliation
+		a.Contact = &models.ContactBrief{}
+		if err := scanAffiliation(rows, &a, &a.Contact.ID, &a.Contact.FirstName, &a.Contact.LastName, &a.Contact.JobTitle, &a.Contact.CompanyID); err != nil {
+			log.Printf("Error scanning company affiliation row: %v", err)
+			continue
+		}
+		list = append(list, a)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating company affiliation rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// GetCompanyOrgChart builds the org chart of a company of the organization
+// from the reports_to links between the people working there: its contacts and
+// those with a current position at it, titled by that position when it has one.
+func (c *CRMHandlers) GetCompanyOrgChart(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	companyID, ok := c.routeRecord(w, r, orgID, "id", "companies", "Company")
+	if !ok {
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT c.id, c.first_name, c.last_name,
+		COALESCE((SELECT a.title FROM contact_affiliations a
+			WHERE a.contact_id = c.id AND a.company_id = ?1 AND a.title IS NOT NULL AND `+relationships.CurrentAffiliation+`
+			ORDER BY a.start_date DESC LIMIT 1), c.job_title),
+		c.company_id
+	FROM contacts c
+	WHERE c.org_id = ?2 AND c.deleted_at IS NULL AND (c.company_id = ?1 OR c.id IN (
+		SELECT a.contact_id FROM contact_affiliations a WHERE a.company_id = ?1 AND `+relationships.CurrentAffiliation+`))
+	ORDER BY c.last_name, c.first_name, c.id`, companyID, orgID)
+	if err != nil {
+		log.Printf("Error querying company people: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+	var members []models.ContactBrief
+	for rows.Next() {
+		var m models.ContactBrief
+		if err := rows.Scan(&m.ID, &m.FirstName, &m.LastName, &m.JobTitle, &m.CompanyID); err != nil {
+			log.Printf("Error scanning company person row: %v", err)
+			continue
+		}
+		members = append(members, m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating company people rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	rows.Close()
+
+	links, err := c.reportingLinks(orgID)
+	if err != nil {
+		log.Printf("Error querying reporting lines: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, relationships.Chart(members, links))
+}
+
+// reportingLinks loads the reports_to and assistant_of links from the
+// organization's contacts; Chart keeps those between people of the company.
+func (c *CRMHandlers) reportingLinks(orgID int) ([]models.ContactRelationship, error) {
+	rows, err := c.DB.Query(`
+	SELECT cr.contact_id, cr.related_id, cr.type
+	FROM contact_relationships cr JOIN contacts c ON c.id = cr.contact_id
+	WHERE c.org_id = ? AND cr.type IN (?, ?)
+	ORDER BY cr.id`, orgID, models.RelationshipReportsTo, models.RelationshipAssistantOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var links []models.ContactRelationship
+	for rows.Next() {
+		var link models.ContactRelationship
+		if err := rows.Scan(&link.ContactID, &link.RelatedID, &link.Type); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
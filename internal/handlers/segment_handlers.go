@@ -0,0 +1,564 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"micro-CRM/internal/customfields"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/segments"
+	"micro-CRM/internal/tags"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// exportColumns are the record columns of a segment export, before its tags
+// and custom fields.
+var exportColumns = map[string][]string{
+	models.EntityContact: {
+		"id", "first_name", "last_name", "email", "phone_number", "job_title", "company_id", "pipeline_stage",
+		"last_interaction_at", "next_action_at", "next_action_description", "created_at", "updated_at",
+	},
+	models.EntityCompany: {
+		"id", "name", "website", "industry", "company_size", "address", "phone_number", "pipeline_stage",
+		"created_at", "updated_at",
+	},
+}
+
+// unsafeFileName matches what cannot go in an export's file name.
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// segmentFilter reads the segment and filter query parameters of a list request
+// for records of entityType whose qualified id is column: segment names a saved
+// segment and filter an expression, and records must match both. It returns the
+// condition to AND to the query with its arguments, and writes the error
+// response itself when not ok.
+func (c *CRMHandlers) segmentFilter(w http.ResponseWriter, r *http.Request, orgID int, entityType, column string) (string, []interface{}, bool) {
+	params := r.URL.Query()
+	var expressions, problems []string
+	if idStr := params.Get("segment"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid segment parameter")
+			return "", nil, false
+		}
+		segment, ok := c.loadSegment(w, orgID, id)
+		if !ok {
+			return "", nil, false
+		}
+		if segment.EntityType != entityType {
+			utils.RespondError(w, http.StatusBadRequest, "The segment holds records of type "+segment.EntityType)
+			return "", nil, false
+		}
+		expressions = append(expressions, segment.Expression)
+		problems = append(problems, "The segment no longer applies: ")
+	}
+	if expression := params.Get("filter"); expression != "" {
+		expressions = append(expressions, expression)
+		problems = append(problems, "Invalid filter: ")
+	}
+	if len(expressions) == 0 {
+		return "", nil, true
+	}
+
+	custom, err := customfields.Definitions(c.DB, orgID, entityType)
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return "", nil, false
+	}
+	var (
+		filter string
+		args   []interface{}
+	)
+	for i, expression := range expressions {
+		condition, conditionArgs, err := segments.Filter(expression, orgID, entityType, column, custom, time.Now().UTC())
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, problems[i]+err.Error())
+			return "", nil, false
+		}
+		filter += condition
+		args = append(args, conditionArgs...)
+	}
+	return filter, args, true
+}
+
+// segmentRecords returns the condition keeping the records of a segment visible
+// to the user, to AND to a query on its table, with its arguments. It is ""
+// with the reason in the segment's Error when the expression no longer applies.
+func segmentRecords(segment *models.Segment, orgID, userID int, custom []models.CustomField) (string, []interface{}) {
+	table := segments.Tables[segment.EntityType]
+	filter, args, err := segments.Filter(segment.Expression, orgID, segment.EntityType, table+".id", custom, time.Now().UTC())
+	if err != nil {
+		segment.Error = err.Error()
+		return "", nil
+	}
+	return visibleClause(false) + filter, append(visibleArgs(segment.EntityType, orgID, userID), args...)
+}
+
+// countSegment sets the live count of the segment's records, or its Error.
+func (c *CRMHandlers) countSegment(segment *models.Segment, orgID, userID int, custom []models.CustomField) error {
+	condition, args := segmentRecords(segment, orgID, userID, custom)
+	if condition == "" {
+		return nil
+	}
+	var n int
+	if err := c.DB.QueryRow("SELECT COUNT(*) FROM "+segments.Tables[segment.EntityType]+" WHERE "+condition, args...).Scan(&n); err != nil {
+		return err
+	}
+	segment.Records = &n
+	return nil
+}
+
+// validateSegment normalizes a segment payload and returns a client-facing
+// message when it is invalid for the organization.
+func (c *CRMHandlers) validateSegment(s *models.Segment, orgID int) (string, error) {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return "name is required", nil
+	}
+	if _, ok := segments.Tables[s.EntityType]; !ok {
+		return "entity_type must be contact or company", nil
+	}
+	custom, err := customfields.Definitions(c.DB, orgID, s.EntityType)
+	if err != nil {
+		return "", err
+	}
+	if err := segments.Check(s.Expression, s.EntityType, custom); err != nil {
+		return "Invalid expression: " + err.Error(), nil
+	}
+	return "", nil
+}
+
+// segmentNameTaken reports whether another segment of the organization already uses name, ignoring case.
+func (c *CRMHandlers) segmentNameTaken(orgID, exceptID int, name string) (bool, error) {
+	var taken bool
+	err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM segments WHERE org_id = ? AND id != ? AND name = ?)", orgID, exceptID, name).Scan(&taken)
+	return taken, err
+}
+
+// loadSegment loads a segment of the organization, writing the error response
+// itself when it is missing or belongs to another organization.
+func (c *CRMHandlers) loadSegment(w http.ResponseWriter, orgID, segmentID int) (models.Segment, bool) {
+	var segment models.Segment
+	err := segments.Scan(c.DB.QueryRow("SELECT "+segments.Columns+" FROM segments WHERE id = ? AND org_id = ?", segmentID, orgID), &segment)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Segment not found or unauthorized")
+		return segment, false
+	}
+	if err != nil {
+		log.Printf("Error querying segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return segment, false
+	}
+	return segment, true
+}
+
+// segmentFromRequest loads the segment named by the {id} route variable,
+// writing the error response itself when not ok.
+func (c *CRMHandlers) segmentFromRequest(w http.ResponseWriter, r *http.Request, orgID int) (models.Segment, bool) {
+	segmentID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid segment ID")
+		return models.Segment{}, false
+	}
+	return c.loadSegment(w, orgID, segmentID)
+}
+
+// respondSegment writes the stored segment with its live count.
+func (c *CRMHandlers) respondSegment(w http.ResponseWriter, status, orgID, userID, segmentID int) {
+	segment, ok := c.loadSegment(w, orgID, segmentID)
+	if !ok {
+		return
+	}
+	custom, err := customfields.Definitions(c.DB, orgID, segment.EntityType)
+	if err == nil {
+		err = c.countSegment(&segment, orgID, userID, custom)
+	}
+	if err != nil {
+		log.Printf("Error counting segment records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve segment")
+		return
+	}
+	utils.RespondJSON(w, status, segment)
+}
+
+// CreateSegment saves a filter expression over the organization's contacts or
+// companies under a name.
+func (c *CRMHandlers) CreateSegment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var segment models.Segment
+	if err := json.NewDecoder(r.Body).Decode(&segment); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	msg, err := c.validateSegment(&segment, orgID)
+	if err != nil {
+		log.Printf("Error validating segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	taken, err := c.segmentNameTaken(orgID, 0, segment.Name)
+	if err != nil {
+		log.Printf("Error checking segment name: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken {
+		utils.RespondError(w, http.StatusConflict, "A segment with this name already exists")
+		return
+	}
+
+	result, err := c.DB.Exec("INSERT INTO segments (org_id, name, entity_type, expression, created_by) VALUES (?, ?, ?, ?, ?)",
+		orgID, segment.Name, segment.EntityType, segment.Expression, userID)
+	if err != nil {
+		log.Printf("Error inserting segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create segment")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	c.respondSegment(w, http.StatusCreated, orgID, userID, int(id))
+}
+
+// ListSegments retrieves the organization's segments by name, with how many
+// records visible to the user each one holds now.
+// Query parameters: entity_type.
+func (c *CRMHandlers) ListSegments(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	query := "SELECT " + segments.Columns + " FROM segments WHERE org_id = ?"
+	args := []interface{}{orgID}
+	if entityType := r.URL.Query().Get("entity_type"); entityType != "" {
+		if _, ok := segments.Tables[entityType]; !ok {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid entity_type parameter")
+			return
+		}
+		query += " AND entity_type = ?"
+		args = append(args, entityType)
+	}
+	rows, err := c.DB.Query(query+" ORDER BY name, id", args...)
+	if err != nil {
+		log.Printf("Error querying segments: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.Segment{}
+	for rows.Next() {
+		var segment models.Segment
+		if err := segments.Scan(rows, &segment); err != nil {
+			log.Printf("Error scanning segment row: %v", err)
+			continue
+		}
+		list = append(list, segment)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating segment rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	rows.Close()
+
+	custom := make(map[string][]models.CustomField)
+	for entityType := range segments.Tables {
+		if custom[entityType], err = customfields.Definitions(c.DB, orgID, entityType); err != nil {
+			log.Printf("Error loading custom fields: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+	for i := range list {
+		if err := c.countSegment(&list[i], orgID, userID, custom[list[i].EntityType]); err != nil {
+			log.Printf("Error counting segment records: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// GetSegment retrieves a segment of the organization with its live count.
+func (c *CRMHandlers) GetSegment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	segment, ok := c.segmentFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	c.respondSegment(w, http.StatusOK, orgID, userID, segment.ID)
+}
+
+// UpdateSegment renames a segment or changes its expression; its record type
+// stays.
+func (c *CRMHandlers) UpdateSegment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	segment, ok := c.segmentFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	var payload models.Segment
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if payload.EntityType != "" && payload.EntityType != segment.EntityType {
+		utils.RespondError(w, http.StatusBadRequest, "entity_type cannot be changed")
+		return
+	}
+	payload.EntityType = segment.EntityType
+	msg, err := c.validateSegment(&payload, orgID)
+	if err != nil {
+		log.Printf("Error validating segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	taken, err := c.segmentNameTaken(orgID, segment.ID, payload.Name)
+	if err != nil {
+		log.Printf("Error checking segment name: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken {
+		utils.RespondError(w, http.StatusConflict, "A segment with this name already exists")
+		return
+	}
+
+	if _, err := c.DB.Exec("UPDATE segments SET name = ?, expression = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		payload.Name, payload.Expression, segment.ID); err != nil {
+		log.Printf("Error updating segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update segment")
+		return
+	}
+
+	c.respondSegment(w, http.StatusOK, orgID, userID, segment.ID)
+}
+
+// DeleteSegment removes a segment; its records are left as they are.
+func (c *CRMHandlers) DeleteSegment(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	segment, ok := c.segmentFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	if _, err := c.DB.Exec("DELETE FROM segments WHERE id = ?", segment.ID); err != nil {
+		log.Printf("Error deleting segment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete segment")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// segmentIDs returns the ids of the organization's live records in a segment,
+// writing the error response itself when not ok. Used by bulk actions, which
+// only change records of the organization.
+func (c *CRMHandlers) segmentIDs(w http.ResponseWriter, orgID int, segment models.Segment) ([]int, bool) {
+	custom, err := customfields.Definitions(c.DB, orgID, segment.EntityType)
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	table := segments.Tables[segment.EntityType]
+	filter, args, err := segments.Filter(segment.Expression, orgID, segment.EntityType, table+".id", custom, time.Now().UTC())
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "The segment no longer applies: "+err.Error())
+		return nil, false
+	}
+	rows, err := c.DB.Query("SELECT id FROM "+table+" WHERE org_id = ? AND deleted_at IS NULL"+filter+" ORDER BY id",
+		append([]interface{}{orgID}, args...)...)
+	if err != nil {
+		log.Printf("Error querying segment records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Error scanning segment record: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating segment records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	return ids, true
+}
+
+// ExportSegment downloads the records of a segment visible to the user as CSV,
+// with their tags and custom fields.
+func (c *CRMHandlers) ExportSegment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	segment, ok := c.segmentFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	custom, err := customfields.Definitions(c.DB, orgID, segment.EntityType)
+	if err != nil {
+		log.Printf("Error loading custom fields: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	condition, args := segmentRecords(&segment, orgID, userID, custom)
+	if condition == "" {
+		utils.RespondError(w, http.StatusBadRequest, "The segment no longer applies: "+segment.Error)
+		return
+	}
+
+	columns := exportColumns[segment.EntityType]
+	rows, err := c.DB.Query("SELECT "+strings.Join(columns, ", ")+" FROM "+segments.Tables[segment.EntityType]+" WHERE "+condition+" ORDER BY id", args...)
+	if err != nil {
+		log.Printf("Error querying segment records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+	var (
+		records [][]string
+		ids     []int
+	)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			log.Printf("Error scanning segment record: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = exportValue(v)
+		}
+		id, _ := strconv.Atoi(record[0])
+		records = append(records, record)
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating segment records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	rows.Close()
+
+	tagged, err := tags.Load(c.DB, orgID, segment.EntityType, ids)
+	if err != nil {
+		log.Printf("Error loading %s tags: %v", segment.EntityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	values, err := customfields.Load(c.DB, segment.EntityType, ids)
+	if err != nil {
+		log.Printf("Error loading custom field values: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	header := append(append([]string{}, columns...), "tags")
+	for _, f := range custom {
+		header = append(header, customfields.ParamPrefix+f.Key)
+	}
+	name := strings.Trim(unsafeFileName.ReplaceAllString(segment.Name, "-"), "-")
+	if name == "" {
+		name = "segment"
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write(header)
+	for i, record := range records {
+		var names []string
+		for _, t := range tagged[ids[i]] {
+			names = append(names, t.Name)
+		}
+		record = append(record, strings.Join(names, "; "))
+		for _, f := range custom {
+			record = append(record, exportValue(values[ids[i]][f.Key]))
+		}
+		out.Write(record)
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Error writing segment export: %v", err)
+	}
+}
+
+// exportValue formats a stored or custom field value for a CSV cell.
+func exportValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, "; ")
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
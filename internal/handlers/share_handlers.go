@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// shareable maps the record types that can be shared outside their organization
+// to their table and the expression naming a record in notifications.
+var shareable = map[string]struct{ table, label string }{
+	models.EntityCompany: {"companies", "name"},
+	models.EntityContact: {"contacts", "first_name || ' ' || last_name"},
+	models.EntityDeal:    {"deals", "title"},
+	models.EntityFile:    {"files", "file_name"},
+}
+
+// shareRoutes maps the {entity} route variable of the share endpoints to a record type.
+var shareRoutes = map[string]string{
+	"companies": models.EntityCompany,
+	"contacts":  models.EntityContact,
+	"deals":     models.EntityDeal,
+	"files":     models.EntityFile,
+}
+
+const shareColumns = `id, entity_type, entity_id, user_id, org_id, permission, granted_by, created_at`
+
+func scanShare(row interface{ Scan(...interface{}) error }, s *models.RecordShare) error {
+	return row.Scan(&s.ID, &s.EntityType, &s.EntityID, &s.UserID, &s.OrgID, &s.Permission, &s.GrantedBy, &s.CreatedAt)
+}
+
+// visibleClause limits a query on a shareable table to records of the
+// organization and records shared with the user or their organization; with
+// write, only write grants count. Trashed records are left out. Its arguments
+// come from visibleArgs.
+func visibleClause(write bool) string {
+	clause := "deleted_at IS NULL AND (org_id = ? OR id IN (SELECT entity_id FROM record_shares WHERE entity_type = ? AND (user_id = ? OR org_id = ?)"
+	if write {
+		clause += " AND permission = '" + models.SharePermissionWrite + "'"
+	}
+	return clause + "))"
+}
+
+func visibleArgs(entityType string, orgID, userID int) []interface{} {
+	return []interface{}{orgID, entityType, userID, orgID}
+}
+
+// writableRecord returns the organization and user owning a record the user may
+// edit, either one of their organization or one shared with them for writing. It
+// writes a 404 when the user may not edit it.
+func (c *CRMHandlers) writableRecord(w http.ResponseWriter, entityType string, id, orgID, userID int) (int, int, bool) {
+	var ownerOrg, ownerID int
+	err := c.DB.QueryRow("SELECT org_id, user_id FROM "+shareable[entityType].table+" WHERE id = ? AND "+visibleClause(true),
+		append([]interface{}{id}, visibleArgs(entityType, orgID, userID)...)...).Scan(&ownerOrg, &ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Record not found or unauthorized to update")
+		return 0, 0, false
+	}
+	if err != nil {
+		log.Printf("Error checking record access: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return 0, 0, false
+	}
+	return ownerOrg, ownerID, true
+}
+
+// sharedRecord reads the {entity} and {id} route variables and checks that the
+// record belongs to the organization, which alone manages its shares. It writes
+// the error response when not ok.
+func (c *CRMHandlers) sharedRecord(w http.ResponseWriter, r *http.Request, orgID int) (string, int, bool) {
+	vars := mux.Vars(r)
+	entityType, ok := shareRoutes[vars["entity"]]
+	if !ok {
+		utils.RespondError(w, http.StatusNotFound, "Records of this type cannot be shared")
+		return "", 0, false
+	}
+	entityID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return "", 0, false
+	}
+	if err := utils.ValidateOwnership(c.DB, shareable[entityType].table, entityID, orgID); err != nil {
+		utils.RespondError(w, http.StatusNotFound, "Record not found or unauthorized")
+		return "", 0, false
+	}
+	return entityType, entityID, true
+}
+
+// ListShares lists who a record of the user's organization is shared with.
+func (c *CRMHandlers) ListShares(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	entityType, entityID, ok := c.sharedRecord(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT "+shareColumns+" FROM record_shares WHERE entity_type = ? AND entity_id = ? ORDER BY id", entityType, entityID)
+	if err != nil {
+		log.Printf("Error querying shares: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	shares := []models.RecordShare{}
+	for rows.Next() {
+		var s models.RecordShare
+		if err := scanShare(rows, &s); err != nil {
+			log.Printf("Error scanning share: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		shares = append(shares, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating shares: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, shares)
+}
+
+// checkShareGrantee returns a client-facing message unless the share names
+// exactly one grantee outside the organization: an active user or another
+// organization.
+func checkShareGrantee(q notifications.Querier, s models.RecordShare, orgID int) (string, error) {
+	if (s.UserID == nil) == (s.OrgID == nil) {
+		return "Set exactly one of user_id and org_id", nil
+	}
+	var granteeOrg sql.NullInt64
+	if s.UserID != nil {
+		err := q.QueryRow("SELECT org_id FROM users WHERE id = ? AND status = 'active'", *s.UserID).Scan(&granteeOrg)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "User not found or inactive", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	} else {
+		err := q.QueryRow("SELECT id FROM organizations WHERE id = ?", *s.OrgID).Scan(&granteeOrg)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "Organization not found", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if granteeOrg.Valid && int(granteeOrg.Int64) == orgID {
+		return "The organization already has access to its own records", nil
+	}
+	return "", nil
+}
+
+// ShareRecord grants a user or another organization read or write access to a
+// record of the user's organization. Sharing again with the same grantee changes
+// the permission. Grantees are notified.
+func (c *CRMHandlers) ShareRecord(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	entityType, entityID, ok := c.sharedRecord(w, r, orgID)
+	if !ok {
+		return
+	}
+	var share models.RecordShare
+	if err := json.NewDecoder(r.Body).Decode(&share); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if share.Permission == "" {
+		share.Permission = models.SharePermissionRead
+	}
+	if share.Permission != models.SharePermissionRead && share.Permission != models.SharePermissionWrite {
+		utils.RespondError(w, http.StatusBadRequest, "permission must be read or write")
+		return
+	}
+	msg, err := checkShareGrantee(c.DB, share, orgID)
+	if err != nil {
+		log.Printf("Error checking share grantee: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	status := http.StatusOK
+	var shareID int64
+	err = c.DB.QueryRow(`
+	SELECT id FROM record_shares WHERE entity_type = ? AND entity_id = ? AND (user_id = ? OR org_id = ?)`,
+		entityType, entityID, share.UserID, share.OrgID).Scan(&shareID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var res sql.Result
+		res, err = c.DB.Exec(`
+		INSERT INTO record_shares (entity_type, entity_id, user_id, org_id, permission, granted_by) VALUES (?, ?, ?, ?, ?, ?)`,
+			entityType, entityID, share.UserID, share.OrgID, share.Permission, userID)
+		if err == nil {
+			shareID, _ = res.LastInsertId()
+			status = http.StatusCreated
+		}
+	} else if err == nil {
+		_, err = c.DB.Exec("UPDATE record_shares SET permission = ?, granted_by = ? WHERE id = ?", share.Permission, userID, shareID)
+	}
+	if err != nil {
+		log.Printf("Error saving share: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to share record")
+		return
+	}
+
+	if err := scanShare(c.DB.QueryRow("SELECT "+shareColumns+" FROM record_shares WHERE id = ?", shareID), &share); err != nil {
+		log.Printf("Error querying share: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if status == http.StatusCreated {
+		c.notifyShare(userID, share)
+	}
+	utils.RespondJSON(w, status, share)
+}
+
+// notifyShare tells the grantee, or every active member of the grantee
+// organization, about a new share. Failures are logged rather than failing the
+// write.
+func (c *CRMHandlers) notifyShare(actorID int, share models.RecordShare) {
+	var actor, label string
+	err := c.DB.QueryRow("SELECT username FROM users WHERE id = ?", actorID).Scan(&actor)
+	if err == nil {
+		s := shareable[share.EntityType]
+		err = c.DB.QueryRow("SELECT COALESCE("+s.label+", '') FROM "+s.table+" WHERE id = ?", share.EntityID).Scan(&label)
+	}
+	if err != nil {
+		log.Printf("Error loading shared record: %v", err)
+		return
+	}
+
+	var recipients []int
+	if share.UserID != nil {
+		recipients = []int{*share.UserID}
+	} else {
+		rows, err := c.DB.Query("SELECT id FROM users WHERE org_id = ? AND status = 'active'", *share.OrgID)
+		if err != nil {
+			log.Printf("Error loading organization members: %v", err)
+			return
+		}
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				recipients = append(recipients, id)
+			}
+		}
+		rows.Close()
+	}
+
+	notificationType := models.NotificationRecordShared
+	if share.EntityType == models.EntityFile {
+		notificationType = models.NotificationFileShared
+	}
+	for _, recipient := range recipients {
+		entityType, entityID := share.EntityType, share.EntityID
+		if _, err := notifications.Notify(c.DB, models.Notification{
+			UserID:     recipient,
+			Type:       notificationType,
+			Title:      fmt.Sprintf("%s shared %s %q with you", actor, share.EntityType, label),
+			EntityType: &entityType,
+			EntityID:   &entityID,
+			ActorID:    &actorID,
+		}); err != nil {
+			log.Printf("Error notifying share: %v", err)
+		}
+	}
+}
+
+// UnshareRecord revokes a share of a record of the user's organization.
+func (c *CRMHandlers) UnshareRecord(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	entityType, entityID, ok := c.sharedRecord(w, r, orgID)
+	if !ok {
+		return
+	}
+	shareID, err := strconv.Atoi(mux.Vars(r)["shareId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid share ID")
+		return
+	}
+
+	result, err := c.DB.Exec("DELETE FROM record_shares WHERE id = ? AND entity_type = ? AND entity_id = ?", shareID, entityType, entityID)
+	if err != nil {
+		log.Printf("Error deleting share: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete share")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Share not found")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
@@ -0,0 +1,446 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/pipelines"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Without an explicit ?days=, a deal counts as stuck after twice the usual time in
+// its stage, or defaultStuckDays when there is too little history to tell.
+const (
+	defaultStuckDays = 30
+	minStaysForAvg   = 3
+)
+
+// stay is one uninterrupted period a record spent in a stage.
+type stay struct {
+	entityID   int
+	pipelineID int
+	stage      string
+	start, end time.Time
+	current    bool // still in the stage; end is now
+}
+
+func parseDBTime(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func daysBetween(start, end time.Time) float64 {
+	return end.Sub(start).Hours() / 24
+}
+
+// loadStays turns the stage history of the organization's records of one type into stays.
+func (c *CRMHandlers) loadStays(orgID int, entityType string) ([]stay, error) {
+	rows, err := c.DB.Query(`
+	SELECT entity_id, COALESCE(pipeline_id, 0), to_stage, changed_at
+	FROM stage_transitions
+	WHERE org_id = ? AND entity_type = ?
+	ORDER BY entity_id, changed_at, id`, orgID, entityType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	var stays []stay
+	for rows.Next() {
+		var (
+			s         stay
+			changedAt string
+		)
+		if err := rows.Scan(&s.entityID, &s.pipelineID, &s.stage, &changedAt); err != nil {
+			return nil, err
+		}
+		s.start = parseDBTime(changedAt)
+		if n := len(stays); n > 0 && stays[n-1].entityID == s.entityID {
+			stays[n-1].end = s.start
+			stays[n-1].current = false
+		}
+		s.end = now
+		s.current = true
+		stays = append(stays, s)
+	}
+	return stays, rows.Err()
+}
+
+// pipelineParam returns ?pipeline_id= when it names one of the organization's pipelines, or the default pipeline.
+func (c *CRMHandlers) pipelineParam(w http.ResponseWriter, r *http.Request, orgID, userID int) (int, bool) {
+	if pipelineIDStr := r.URL.Query().Get("pipeline_id"); pipelineIDStr != "" {
+		id, err := strconv.Atoi(pipelineIDStr)
+		if err != nil || utils.ValidateOwnership(c.DB, "pipelines", id, orgID) != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid pipeline_id parameter")
+			return 0, false
+		}
+		return id, true
+	}
+	id, err := pipelines.EnsureDefault(c.DB, orgID, userID)
+	if err != nil {
+		log.Printf("Error loading default pipeline: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return 0, false
+	}
+	return id, true
+}
+
+// entityParam reads ?entity= for the analytics endpoints, defaulting to deals.
+func entityParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch entity := r.URL.Query().Get("entity"); entity {
+	case "", models.EntityDeal:
+		return models.EntityDeal, true
+	case models.EntityCompany, models.EntityContact:
+		return entity, true
+	default:
+		utils.RespondError(w, http.StatusBadRequest, "entity must be deal, company or contact")
+		return "", false
+	}
+}
+
+// stageHistory responds with the stage timeline of one record, oldest first.
+func (c *CRMHandlers) stageHistory(w http.ResponseWriter, r *http.Request, entityType, table string) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	entityID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+	if err := utils.ValidateOwnership(c.DB, table, entityID, orgID); err != nil {
+		utils.RespondError(w, http.StatusNotFound, "Record not found or unauthorized")
+		return
+	}
+
+	rows, err := c.DB.Query(`
+	SELECT id, entity_type, entity_id, pipeline_id, from_stage, to_stage, changed_by, changed_at
+	FROM stage_transitions
+	WHERE entity_type = ? AND entity_id = ?
+	ORDER BY changed_at, id`, entityType, entityID)
+	if err != nil {
+		log.Printf("Error querying stage history: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	history := []models.StageTransition{}
+	for rows.Next() {
+		var t models.StageTransition
+		if err := rows.Scan(&t.ID, &t.EntityType, &t.EntityID, &t.PipelineID, &t.FromStage, &t.ToStage, &t.ChangedBy, &t.ChangedAt); err != nil {
+			log.Printf("Error scanning stage history row: %v", err)
+			continue
+		}
+		history = append(history, t)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating stage history rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range history {
+		end := now
+		if i+1 < len(history) {
+			end = parseDBTime(history[i+1].ChangedAt)
+		}
+		history[i].DurationSeconds = int64(end.Sub(parseDBTime(history[i].ChangedAt)).Seconds())
+	}
+	utils.RespondJSON(w, http.StatusOK, history)
+}
+
+// GetCompanyStageHistory returns the pipeline stage timeline of a company.
+func (c *CRMHandlers) GetCompanyStageHistory(w http.ResponseWriter, r *http.Request) {
+	c.stageHistory(w, r, models.EntityCompany, "companies")
+}
+
+// GetContactStageHistory returns the pipeline stage timeline of a contact.
+func (c *CRMHandlers) GetContactStageHistory(w http.ResponseWriter, r *http.Request) {
+	c.stageHistory(w, r, models.EntityContact, "contacts")
+}
+
+// GetDealStageHistory returns the pipeline stage timeline of a deal.
+func (c *CRMHandlers) GetDealStageHistory(w http.ResponseWriter, r *http.Request) {
+	c.stageHistory(w, r, models.EntityDeal, "deals")
+}
+
+// GetStageVelocity reports how long records stay in each stage of a pipeline.
+// Query parameters: pipeline_id (default pipeline) and entity (deal, company or contact).
+func (c *CRMHandlers) GetStageVelocity(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
+
+	pipelineID, ok := c.pipelineParam(w, r, orgID, userID)
+	if !ok {
+		return
+	}
+	entityType, ok := entityParam(w, r)
+	if !ok {
+		return
+	}
+	stages, err := pipelines.Stages(c.DB, pipelineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stays, err := c.loadStays(orgID, entityType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	completed := make(map[string][]float64)
+	current := make(map[string][]float64)
+	for _, s := range stays {
+		if s.pipelineID != pipelineID {
+			continue
+		}
+		days := daysBetween(s.start, s.end)
+		if s.current {
+			current[s.stage] = append(current[s.stage], days)
+		} else {
+			completed[s.stage] = append(completed[s.stage], days)
+		}
+	}
+
+	velocity := make([]models.StageVelocity, 0, len(stages))
+	for _, stage := range stages {
+		v := models.StageVelocity{Stage: stage.Name, Color: stage.Color}
+		done := completed[stage.Name]
+		v.Transitions = len(done)
+		v.AvgDays = average(done)
+		v.MedianDays = median(done)
+		// Records sitting in a won or lost stage are finished, not slow
+		if stage.Outcome == models.StageOpen {
+			v.CurrentCount = len(current[stage.Name])
+			v.CurrentAvgDays = average(current[stage.Name])
+		}
+		velocity = append(velocity, v)
+	}
+	utils.RespondJSON(w, http.StatusOK, velocity)
+}
+
+// GetStageConversion reports, for each stage of a pipeline, how many records that
+// entered it later advanced to a further open or won stage and how many were won.
+// Query parameters: pipeline_id (default pipeline) and entity (deal, company or contact).
+func (c *CRMHandlers) GetStageConversion(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(models.UserIDContextKey).(int)
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
+
+	pipelineID, ok := c.pipelineParam(w, r, orgID, userID)
+	if !ok {
+		return
+	}
+	entityType, ok := entityParam(w, r)
+	if !ok {
+		return
+	}
+	stages, err := pipelines.Stages(c.DB, pipelineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stays, err := c.loadStays(orgID, entityType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	index := make(map[string]int, len(stages))
+	for i, s := range stages {
+		index[s.Name] = i
+	}
+
+	// Per record, the stage indexes it entered in this pipeline in order
+	paths := make(map[int][]int)
+	var order []int
+	for _, s := range stays {
+		i, known := index[s.stage]
+		if s.pipelineID != pipelineID || !known {
+			continue
+		}
+		if _, seen := paths[s.entityID]; !seen {
+			order = append(order, s.entityID)
+		}
+		paths[s.entityID] = append(paths[s.entityID], i)
+	}
+
+	conversion := make([]models.StageConversion, len(stages))
+	for i, s := range stages {
+		conversion[i] = models.StageConversion{Stage: s.Name, Color: s.Color}
+	}
+	for _, entityID := range order {
+		path := paths[entityID]
+		for i := range stages {
+			first := -1
+			for k, stageIndex := range path {
+				if stageIndex == i {
+					first = k
+					break
+				}
+			}
+			if first == -1 {
+				continue
+			}
+			conversion[i].Entered++
+			advanced, won := false, false
+			for _, later := range path[first:] {
+				if later > i && stages[later].Outcome != models.StageLost {
+					advanced = true
+				}
+				if stages[later].Outcome == models.StageWon {
+					won = true
+				}
+			}
+			if advanced {
+				conversion[i].Advanced++
+			}
+			if won {
+				conversion[i].Won++
+			}
+		}
+	}
+	for i := range conversion {
+		if conversion[i].Entered > 0 {
+			conversion[i].AdvanceRate = float64(conversion[i].Advanced) / float64(conversion[i].Entered)
+			conversion[i].WinRate = float64(conversion[i].Won) / float64(conversion[i].Entered)
+		}
+	}
+	utils.RespondJSON(w, http.StatusOK, conversion)
+}
+
+// GetStuckDeals lists open deals that have sat in their stage for too long, longest first.
+// ?days= sets a fixed threshold; otherwise it is twice the usual time in each stage.
+func (c *CRMHandlers) GetStuckDeals(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Context().Value(models.OrgIDContextKey).(int)
+
+	fixedDays := 0.0
+	if daysStr := r.URL.Query().Get("days"); daysStr != "" {
+		days, err := strconv.ParseFloat(daysStr, 64)
+		if err != nil || days <= 0 {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid days parameter")
+			return
+		}
+		fixedDays = days
+	}
+
+	stays, err := c.loadStays(orgID, models.EntityDeal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type stageKey struct {
+		pipelineID int
+		stage      string
+	}
+	completed := make(map[stageKey][]float64)
+	entered := make(map[int]time.Time)
+	for _, s := range stays {
+		if s.current {
+			entered[s.entityID] = s.start
+		} else {
+			key := stageKey{s.pipelineID, s.stage}
+			completed[key] = append(completed[key], daysBetween(s.start, s.end))
+		}
+	}
+
+	query := `
+	SELECT d.id, d.title, d.stage, d.amount, d.currency, COALESCE(d.pipeline_id, 0), d.updated_at
+	FROM deals d
+	JOIN pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.name = d.stage
+	WHERE d.org_id = ? AND d.deleted_at IS NULL AND ps.outcome = ?`
+	args := []interface{}{orgID, models.StageOpen}
+	if pipelineIDStr := r.URL.Query().Get("pipeline_id"); pipelineIDStr != "" {
+		pipelineID, err := strconv.Atoi(pipelineIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid pipeline_id parameter")
+			return
+		}
+		query += " AND d.pipeline_id = ?"
+		args = append(args, pipelineID)
+	}
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	stuck := []models.StuckDeal{}
+	for rows.Next() {
+		var (
+			d          models.StuckDeal
+			pipelineID int
+			updatedAt  string
+		)
+		if err := rows.Scan(&d.DealID, &d.Title, &d.Stage, &d.Amount, &d.Currency, &pipelineID, &updatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		since, ok := entered[d.DealID]
+		if !ok {
+			since = parseDBTime(updatedAt)
+		}
+		d.EnteredAt = since.Format(time.RFC3339)
+		d.DaysInStage = daysBetween(since, now)
+
+		d.ThresholdDays = fixedDays
+		if d.ThresholdDays == 0 {
+			d.ThresholdDays = defaultStuckDays
+			if history := completed[stageKey{pipelineID, d.Stage}]; len(history) >= minStaysForAvg {
+				d.ThresholdDays = 2 * average(history)
+			}
+		}
+		if d.DaysInStage > d.ThresholdDays {
+			stuck = append(stuck, d)
+		}
+	}
+	if err := rows.Err(); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(stuck, func(i, j int) bool { return stuck[i].DaysInStage > stuck[j].DaysInStage })
+	utils.RespondJSON(w, http.StatusOK, stuck)
+}
+
+func average(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,480 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/tags"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// tagRoutes maps the {entity} route variable of the record tag endpoints to a record type.
+var tagRoutes = map[string]string{
+	"companies":    models.EntityCompany,
+	"contacts":     models.EntityContact,
+	"tasks":        models.EntityTask,
+	"interactions": models.EntityInteraction,
+	"files":        models.EntityFile,
+}
+
+// tagFilter returns the condition keeping the records of entityType that carry
+// every tag named by the request's tag query parameters, which may repeat.
+func tagFilter(r *http.Request, orgID int, entityType, column string) (string, []interface{}) {
+	return tags.Filter(orgID, entityType, column, r.URL.Query()["tag"])
+}
+
+// loadTags loads the organization's tags on records of entityType by record id,
+// writing the error response itself when it fails.
+func (c *CRMHandlers) loadTags(w http.ResponseWriter, orgID int, entityType string, ids []int) (map[int][]models.Tag, bool) {
+	tagged, err := tags.Load(c.DB, orgID, entityType, ids)
+	if err != nil {
+		log.Printf("Error loading %s tags: %v", entityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return nil, false
+	}
+	return tagged, true
+}
+
+// validateTag normalizes a tag payload and returns a client-facing message when it is invalid.
+func validateTag(t *models.Tag) string {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" {
+		return "name is required"
+	}
+	if t.Color == "" {
+		t.Color = tags.DefaultColor
+	}
+	if !tags.ValidColor(t.Color) {
+		return "color must be a hex color such as #1f77b4"
+	}
+	return ""
+}
+
+// validTagIDs checks that tag ids are distinct and all belong to the
+// organization, writing the error response itself when they do not.
+func (c *CRMHandlers) validTagIDs(w http.ResponseWriter, orgID int, tagIDs []int) bool {
+	seen := make(map[int]bool, len(tagIDs))
+	for _, id := range tagIDs {
+		if seen[id] {
+			utils.RespondError(w, http.StatusBadRequest, "tag_ids must be distinct")
+			return false
+		}
+		seen[id] = true
+	}
+	owned, err := tags.Owned(c.DB, orgID, tagIDs)
+	if err != nil {
+		log.Printf("Error checking tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return false
+	}
+	if !owned {
+		utils.RespondError(w, http.StatusBadRequest, "tag_ids must be tags of the organization")
+		return false
+	}
+	return true
+}
+
+// tagNameTaken reports whether another tag of the organization already uses name, ignoring case.
+func (c *CRMHandlers) tagNameTaken(orgID, exceptID int, name string) (bool, error) {
+	var taken bool
+	err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE org_id = ? AND id != ? AND name = ?)", orgID, exceptID, name).Scan(&taken)
+	return taken, err
+}
+
+// tagFromRequest loads the tag named by the {id} route variable, writing the
+// error response itself when it is missing or belongs to another organization.
+func (c *CRMHandlers) tagFromRequest(w http.ResponseWriter, r *http.Request, orgID int) (models.Tag, bool) {
+	var tag models.Tag
+	tagID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid tag ID")
+		return tag, false
+	}
+	err = tags.Scan(c.DB.QueryRow("SELECT "+tags.Columns+" FROM tags WHERE id = ? AND org_id = ?", tagID, orgID), &tag)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Tag not found or unauthorized")
+		return tag, false
+	}
+	if err != nil {
+		log.Printf("Error querying tag: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return tag, false
+	}
+	return tag, true
+}
+
+// respondTag writes the stored tag.
+func (c *CRMHandlers) respondTag(w http.ResponseWriter, status int, tagID int) {
+	var tag models.Tag
+	if err := tags.Scan(c.DB.QueryRow("SELECT "+tags.Columns+" FROM tags WHERE id = ?", tagID), &tag); err != nil {
+		log.Printf("Error fetching tag: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve tag")
+		return
+	}
+	utils.RespondJSON(w, status, tag)
+}
+
+// CreateTag adds a tag to the organization's catalogue.
+func (c *CRMHandlers) CreateTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var tag models.Tag
+	if err := json.NewDecoder(r.Body).Decode(&tag); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateTag(&tag); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	taken, err := c.tagNameTaken(orgID, 0, tag.Name)
+	if err != nil {
+		log.Printf("Error checking tag name: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken {
+		utils.RespondError(w, http.StatusConflict, "A tag with this name already exists")
+		return
+	}
+
+	result, err := c.DB.Exec("INSERT INTO tags (org_id, name, color, created_by) VALUES (?, ?, ?, ?)", orgID, tag.Name, tag.Color, userID)
+	if err != nil {
+		log.Printf("Error inserting tag: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create tag")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	c.respondTag(w, http.StatusCreated, int(id))
+}
+
+// ListTags retrieves the organization's tag catalogue by name, with how many
+// live records carry each tag.
+func (c *CRMHandlers) ListTags(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var live []string
+	for entityType, table := range tags.Tables {
+		live = append(live, "(rt.entity_type = '"+entityType+"' AND rt.entity_id IN (SELECT id FROM "+table+" WHERE deleted_at IS NULL))")
+	}
+	rows, err := c.DB.Query(`
+	SELECT t.id, t.org_id, t.name, t.color, t.created_by, t.created_at, t.updated_at,
+		(SELECT COUNT(*) FROM record_tags rt WHERE rt.tag_id = t.id AND (`+strings.Join(live, " OR ")+`))
+	FROM tags t WHERE t.org_id = ? ORDER BY t.name, t.id`, orgID)
+	if err != nil {
+		log.Printf("Error querying tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.Tag{}
+	for rows.Next() {
+		var (
+			tag     models.Tag
+			records int
+		)
+		if err := rows.Scan(&tag.ID, &tag.OrgID, &tag.Name, &tag.Color, &tag.CreatedBy, &tag.CreatedAt, &tag.UpdatedAt, &records); err != nil {
+			log.Printf("Error scanning tag row: %v", err)
+			continue
+		}
+		tag.Records = &records
+		list = append(list, tag)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating tag rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// UpdateTag renames or recolors a tag; records keep carrying it.
+func (c *CRMHandlers) UpdateTag(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	tag, ok := c.tagFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+	var payload models.Tag
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateTag(&payload); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	taken, err := c.tagNameTaken(orgID, tag.ID, payload.Name)
+	if err != nil {
+		log.Printf("Error checking tag name: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if taken {
+		utils.RespondError(w, http.StatusConflict, "A tag with this name already exists")
+		return
+	}
+
+	if _, err := c.DB.Exec("UPDATE tags SET name = ?, color = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		payload.Name, payload.Color, tag.ID); err != nil {
+		log.Printf("Error updating tag: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update tag")
+		return
+	}
+
+	c.respondTag(w, http.StatusOK, tag.ID)
+}
+
+// DeleteTag removes a tag from the catalogue and from every record carrying it.
+func (c *CRMHandlers) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	tag, ok := c.tagFromRequest(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if err := tags.Delete(tx, tag.ID); err != nil {
+		log.Printf("Error deleting tag: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete tag")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing tag delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete tag")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// BulkTagRecords adds tags to or removes them from many records of one type of
+// the organization at once, given by id or as the records of a segment. Records
+// already carrying, or not carrying, a tag are left as they are.
+func (c *CRMHandlers) BulkTagRecords(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	var payload models.TagBulkPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if payload.Action != models.TagActionAdd && payload.Action != models.TagActionRemove {
+		utils.RespondError(w, http.StatusBadRequest, "action must be add or remove")
+		return
+	}
+	if payload.SegmentID != nil {
+		if len(payload.EntityIDs) > 0 {
+			utils.RespondError(w, http.StatusBadRequest, "entity_ids and segment_id cannot both be set")
+			return
+		}
+		segment, ok := c.loadSegment(w, orgID, *payload.SegmentID)
+		if !ok {
+			return
+		}
+		if payload.EntityType != "" && payload.EntityType != segment.EntityType {
+			utils.RespondError(w, http.StatusBadRequest, "The segment holds records of type "+segment.EntityType)
+			return
+		}
+		payload.EntityType = segment.EntityType
+		if payload.EntityIDs, ok = c.segmentIDs(w, orgID, segment); !ok {
+			return
+		}
+		if len(payload.EntityIDs) == 0 {
+			if c.validTagIDs(w, orgID, payload.TagIDs) {
+				utils.RespondJSON(w, http.StatusOK, models.TagBulkResult{})
+			}
+			return
+		}
+	}
+	if _, ok := tags.Tables[payload.EntityType]; !ok {
+		utils.RespondError(w, http.StatusBadRequest, "entity_type must be company, contact, task, interaction or file")
+		return
+	}
+	if len(payload.TagIDs) == 0 || len(payload.EntityIDs) == 0 {
+		utils.RespondError(w, http.StatusBadRequest, "tag_ids and entity_ids or segment_id are required")
+		return
+	}
+	seen := make(map[int]bool, len(payload.EntityIDs))
+	for _, id := range payload.EntityIDs {
+		if seen[id] {
+			utils.RespondError(w, http.StatusBadRequest, "entity_ids must be distinct")
+			return
+		}
+		seen[id] = true
+	}
+	if !c.validTagIDs(w, orgID, payload.TagIDs) {
+		return
+	}
+	taggable, err := tags.Taggable(c.DB, orgID, payload.EntityType, payload.EntityIDs)
+	if err != nil {
+		log.Printf("Error checking records: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if !taggable {
+		utils.RespondError(w, http.StatusNotFound, "Record not found or unauthorized")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var changed int64
+	if payload.Action == models.TagActionAdd {
+		changed, err = tags.Add(tx, payload.TagIDs, payload.EntityType, payload.EntityIDs, userID)
+	} else {
+		changed, err = tags.Remove(tx, payload.TagIDs, payload.EntityType, payload.EntityIDs)
+	}
+	if err != nil {
+		log.Printf("Error changing record tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing record tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, models.TagBulkResult{Changed: changed})
+}
+
+// taggedRecord reads the {entity} and {id} route variables and checks that the
+// record is a live one of the organization. It writes the error response when
+// not ok.
+func (c *CRMHandlers) taggedRecord(w http.ResponseWriter, r *http.Request, orgID int) (string, int, bool) {
+	vars := mux.Vars(r)
+	entityType, ok := tagRoutes[vars["entity"]]
+	if !ok {
+		utils.RespondError(w, http.StatusNotFound, "Records of this type cannot be tagged")
+		return "", 0, false
+	}
+	entityID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return "", 0, false
+	}
+	if err := utils.ValidateOwnership(c.DB, tags.Tables[entityType], entityID, orgID); err != nil {
+		utils.RespondError(w, http.StatusNotFound, "Record not found or unauthorized")
+		return "", 0, false
+	}
+	return entityType, entityID, true
+}
+
+// respondRecordTags writes the tags of one record.
+func (c *CRMHandlers) respondRecordTags(w http.ResponseWriter, orgID int, entityType string, entityID int) {
+	tagged, ok := c.loadTags(w, orgID, entityType, []int{entityID})
+	if !ok {
+		return
+	}
+	list := tagged[entityID]
+	if list == nil {
+		list = []models.Tag{}
+	}
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+// ListRecordTags lists the tags of a record of the user's organization.
+func (c *CRMHandlers) ListRecordTags(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	entityType, entityID, ok := c.taggedRecord(w, r, orgID)
+	if !ok {
+		return
+	}
+
+	c.respondRecordTags(w, orgID, entityType, entityID)
+}
+
+// SetRecordTags replaces the tags of a record of the user's organization; an
+// empty tag_ids removes them all.
+func (c *CRMHandlers) SetRecordTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	entityType, entityID, ok := c.taggedRecord(w, r, orgID)
+	if !ok {
+		return
+	}
+	var payload models.RecordTagsPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if !c.validTagIDs(w, orgID, payload.TagIDs) {
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if err := tags.Set(tx, entityType, entityID, payload.TagIDs, userID); err != nil {
+		log.Printf("Error setting record tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing record tags: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update tags")
+		return
+	}
+
+	c.respondRecordTags(w, orgID, entityType, entityID)
+}
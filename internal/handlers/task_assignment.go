@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// checkAssignee returns a client-facing message unless assigneeID is an active
+// member of the organization.
+func checkAssignee(q notifications.Querier, orgID, assigneeID int) (string, error) {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND org_id = ? AND status = 'active')", assigneeID, orgID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "Assignee not found, inactive or not in the organization", nil
+	}
+	return "", nil
+}
+
+// assignTask records actorID giving the task to assigneeID, or unassigns it when
+// assigneeID is nil.
+func assignTask(tx *sql.Tx, taskID int, assigneeID *int, actorID int) error {
+	if assigneeID == nil {
+		_, err := tx.Exec("UPDATE tasks SET assignee_id = NULL, assigned_by = NULL, assigned_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?", taskID)
+		return err
+	}
+	_, err := tx.Exec(`
+	UPDATE tasks SET assignee_id = ?, assigned_by = ?, assigned_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`, *assigneeID, actorID, taskID)
+	return err
+}
+
+// notifyAssignment tells the new assignee about the task, unless they assigned it
+// to themselves. Failures are logged rather than failing the write.
+func (c *CRMHandlers) notifyAssignment(actorID, taskID, assigneeID int, title string) {
+	if assigneeID == actorID {
+		return
+	}
+	var actor string
+	if err := c.DB.QueryRow("SELECT username FROM users WHERE id = ?", actorID).Scan(&actor); err != nil {
+		log.Printf("Error loading assigning user: %v", err)
+		return
+	}
+	entityType := models.EntityTask
+	if _, err := notifications.Notify(c.DB, models.Notification{
+		UserID:     assigneeID,
+		Type:       models.NotificationTaskAssigned,
+		Title:      fmt.Sprintf("%s assigned you task %q", actor, title),
+		EntityType: &entityType,
+		EntityID:   &taskID,
+		ActorID:    &actorID,
+	}); err != nil {
+		log.Printf("Error notifying task assignee: %v", err)
+	}
+}
+
+// userFilter reads a query parameter naming a user, either "me" or a user id.
+func userFilter(r *http.Request, name string, userID int) (int, bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, false, nil
+	}
+	if value == "me" {
+		return userID, true, nil
+	}
+	id, err := strconv.Atoi(value)
+	return id, true, err
+}
+
+// AssignTask gives a task to another member of the organization, or back to its
+// creator with a null assignee_id. Any member may (re)assign it, so an assignee
+// can delegate further; the new assignee is notified.
+func (c *CRMHandlers) AssignTask(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	vars := mux.Vars(r)
+	taskID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid task ID")
+		return
+	}
+
+	var payload models.TaskAssignment
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if payload.AssigneeID != nil && *payload.AssigneeID == 0 {
+		payload.AssigneeID = nil
+	}
+
+	before := c.snapshot(models.EntityTask, taskID)
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		title      string
+		assigneeID *int
+	)
+	err = tx.QueryRow("SELECT title, assignee_id FROM tasks WHERE id = ? AND org_id = ? AND deleted_at IS NULL", taskID, orgID).Scan(&title, &assigneeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Task not found or unauthorized to assign")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	changed := (assigneeID == nil) != (payload.AssigneeID == nil) ||
+		(assigneeID != nil && *assigneeID != *payload.AssigneeID)
+	if !changed {
+		c.respondTask(w, http.StatusOK, taskID, nil)
+		return
+	}
+	if payload.AssigneeID != nil {
+		msg, err := checkAssignee(tx, orgID, *payload.AssigneeID)
+		if err != nil {
+			log.Printf("Error checking assignee: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if msg != "" {
+			utils.RespondError(w, http.StatusBadRequest, msg)
+			return
+		}
+	}
+	if err := assignTask(tx, taskID, payload.AssigneeID, userID); err != nil {
+		log.Printf("Error assigning task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to assign task")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing task assignment: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to assign task")
+		return
+	}
+
+	if payload.AssigneeID != nil {
+		c.notifyAssignment(userID, taskID, *payload.AssigneeID, title)
+	}
+	c.audit(w, r, events.ActionUpdated, models.EntityTask, taskID, before)
+	c.publishTask(userID, events.ActionAssigned, taskID)
+	c.respondTask(w, http.StatusOK, taskID, nil)
+}
@@ -6,12 +6,80 @@ import (
 	"errors"
 	"github.com/gorilla/mux"
 	"log"
+	"micro-CRM/internal/events"
 	"micro-CRM/internal/models"
+	"micro-CRM/internal/recurrence"
+	"micro-CRM/internal/trash"
 	"micro-CRM/internal/utils"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
+// taskRecurrence validates the rule in a task payload; it returns nil when the
+// payload has no rule. Recurring tasks need a due date to count occurrences from.
+func taskRecurrence(task *models.Task) (*recurrence.Rule, string) {
+	if task.Recurrence == nil || strings.TrimSpace(*task.Recurrence) == "" {
+		return nil, ""
+	}
+	rule, err := recurrence.Parse(*task.Recurrence)
+	if err != nil {
+		return nil, "Invalid recurrence: " + err.Error()
+	}
+	if task.DueDate == nil {
+		return nil, "Recurring tasks need a due_date"
+	}
+	if _, _, err := utils.ParseDueDate(*task.DueDate); err != nil {
+		return nil, "Recurring tasks need a due_date formatted as YYYY-MM-DD or an RFC 3339 time"
+	}
+	return &rule, ""
+}
+
+// taskScope reads ?scope= for edits of recurring tasks, defaulting to this occurrence.
+func taskScope(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch scope := r.URL.Query().Get("scope"); scope {
+	case "", models.TaskScopeThis:
+		return models.TaskScopeThis, true
+	case models.TaskScopeFuture:
+		return scope, true
+	default:
+		utils.RespondError(w, http.StatusBadRequest, "scope must be this or future")
+		return "", false
+	}
+}
+
+// loadTask reads a stored task with its series fields, dependencies and checklist.
+func (c *CRMHandlers) loadTask(taskID int) (models.Task, error) {
+	tasks := make([]models.Task, 1)
+	if err := scanTask(c.DB.QueryRow("SELECT "+taskColumns+taskFrom+" WHERE t.id = ?", taskID), &tasks[0]); err != nil {
+		return tasks[0], err
+	}
+	err := c.taskDetails(tasks)
+	return tasks[0], err
+}
+
+// respondTask writes the stored task.
+func (c *CRMHandlers) respondTask(w http.ResponseWriter, status int, taskID int, nextTaskID *int) {
+	task, err := c.loadTask(taskID)
+	if err != nil {
+		log.Printf("Error loading task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	task.NextTaskID = nextTaskID
+	utils.RespondJSON(w, status, task)
+}
+
+// publishTask sends the stored task to the event streams of the user's organization.
+func (c *CRMHandlers) publishTask(userID int, action string, taskID int) {
+	task, err := c.loadTask(taskID)
+	if err != nil {
+		log.Printf("Error loading task for event: %v", err)
+		return
+	}
+	c.publish(userID, models.EntityTask, action, taskID, task)
+}
+
 // CreateTask handles the creation of a new task.
 func (c *CRMHandlers) CreateTask(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
@@ -19,6 +87,7 @@ func (c *CRMHandlers) CreateTask(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	var task models.Task
 	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
@@ -32,14 +101,62 @@ func (c *CRMHandlers) CreateTask(w http.ResponseWriter, r *http.Request) {
 	// Validate contact_id belongs to the user if provided
 	if task.ContactID != nil && *task.ContactID != 0 {
 		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND user_id = ?)", *task.ContactID, userID).Scan(&exists)
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", *task.ContactID, orgID).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
 			return
 		}
 	}
 
-	stmt, err := db.Prepare(`INSERT INTO tasks (user_id, contact_id, title, description, due_date, status, priority) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	rule, msg := taskRecurrence(&task)
+	if msg == "" {
+		msg = validateTaskRelations(&task)
+	}
+	if msg == "" && task.AssigneeID != nil {
+		if *task.AssigneeID == 0 {
+			task.AssigneeID = nil
+		} else {
+			var err error
+			if msg, err = checkAssignee(db, orgID, *task.AssigneeID); err != nil {
+				log.Printf("Error checking assignee: %v", err)
+				utils.RespondError(w, http.StatusInternalServerError, "Database error")
+				return
+			}
+		}
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	customValues, ok := c.customFieldValues(w, orgID, models.EntityTask, task.CustomFields, true)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+	if !taskParentOK(w, tx, orgID, 0, &task) {
+		return
+	}
+
+	var seriesID, occurrence *int
+	if rule != nil {
+		id, err := createTaskSeries(tx, userID, *rule, &task)
+		if err != nil {
+			log.Printf("Error inserting task series: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create task")
+			return
+		}
+		first := 1
+		seriesID, occurrence = &id, &first
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO tasks (user_id, contact_id, title, description, due_date, status, priority, series_id, occurrence, parent_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
 	if err != nil {
 		log.Printf("Error preparing statement: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
@@ -55,27 +172,47 @@ func (c *CRMHandlers) CreateTask(w http.ResponseWriter, r *http.Request) {
 		task.DueDate,
 		task.Status,
 		task.Priority,
+		seriesID,
+		occurrence,
+		task.ParentID,
 	)
 	if err != nil {
 		log.Printf("Error inserting task: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to create task")
 		return
 	}
-
 	id, _ := result.LastInsertId()
-	task.ID = int(id)
-	err = db.QueryRow("SELECT created_at, updated_at FROM tasks WHERE id = ?", id).Scan(&task.CreatedAt, &task.UpdatedAt)
-	if err != nil {
-		log.Printf("Failed to fetch timestamps: %v", err)
-		utils.RespondError(w, http.StatusInternalServerError, "Error fetching created task")
+	if !saveTaskRelations(w, tx, orgID, int(id), &task) {
+		return
+	}
+	if !c.saveCustomFields(w, tx, models.EntityTask, int(id), customValues) {
 		return
 	}
-	utils.RespondJSON(w, http.StatusCreated, task)
+	if task.AssigneeID != nil {
+		if err := assignTask(tx, int(id), task.AssigneeID, userID); err != nil {
+			log.Printf("Error assigning task: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create task")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create task")
+		return
+	}
+
+	c.notifyMentions(userID, models.EntityTask, int(id), task.Title, task.Description, nil)
+	if task.AssigneeID != nil {
+		c.notifyAssignment(userID, int(id), *task.AssigneeID, task.Title)
+	}
+	c.audit(w, r, events.ActionCreated, models.EntityTask, int(id), nil)
+	c.publishTask(userID, events.ActionCreated, int(id))
+	c.respondTask(w, http.StatusCreated, int(id), nil)
 }
 
-// GetTask retrieves a single task by ID.
+// GetTask retrieves a single task of the user's organization by ID.
 func (c *CRMHandlers) GetTask(w http.ResponseWriter, r *http.Request) {
-	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
@@ -89,36 +226,46 @@ func (c *CRMHandlers) GetTask(w http.ResponseWriter, r *http.Request) {
 	}
 
 	db := c.DB
-	var task models.Task
-	err = db.QueryRow(`SELECT id, user_id, contact_id, title, description, due_date, status, priority, created_at, updated_at FROM tasks WHERE id = ? AND user_id = ?`,
-		taskID, userID).Scan(
-		&task.ID, &task.UserID, &task.ContactID, &task.Title, &task.Description,
-		&task.DueDate, &task.Status, &task.Priority, &task.CreatedAt, &task.UpdatedAt,
-	)
+	tasks := make([]models.Task, 1)
+	err = scanTask(db.QueryRow("SELECT "+taskColumns+taskFrom+" WHERE t.id = ? AND t.org_id = ? AND t.deleted_at IS NULL", taskID, orgID), &tasks[0])
 	if errors.Is(err, sql.ErrNoRows) {
 		utils.RespondError(w, http.StatusNotFound, "Task not found or unauthorized")
 		return
 	}
+	if err == nil {
+		err = c.taskDetails(tasks)
+	}
 	if err != nil {
 		log.Printf("Error querying task: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityTask, []int{taskID})
+	if !ok {
+		return
+	}
+	tasks[0].Tags = tagged[taskID]
 
-	utils.RespondJSON(w, http.StatusOK, task)
+	utils.RespondJSON(w, http.StatusOK, tasks[0])
 }
 
-// ListTasks retrieves all tasks for the authenticated user (or filtered by contact_id/status).
+// ListTasks retrieves the tasks of the authenticated user's organization,
+// optionally filtered by contact_id, status, series_id, parent_id (0 for top-level
+// tasks), actionable, assigned_to, delegated_by or tag. The assignment filters
+// take a user id or "me": assigned_to=me lists tasks assigned to the user and
+// delegated_by=me those the user assigned to someone else. Tag may repeat,
+// keeping the tasks that carry every tag named. Custom fields filter and sort too.
 func (c *CRMHandlers) ListTasks(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	db := c.DB
-	query := `SELECT id, user_id, contact_id, title, description, due_date, status, priority, created_at, updated_at FROM tasks WHERE user_id = ?`
-	args := []interface{}{userID}
+	query := "SELECT " + taskColumns + taskFrom + " WHERE t.org_id = ? AND t.deleted_at IS NULL"
+	args := []interface{}{orgID}
 
 	// Optional filtering by contact_id
 	contactIDStr := r.URL.Query().Get("contact_id")
@@ -128,17 +275,88 @@ func (c *CRMHandlers) ListTasks(w http.ResponseWriter, r *http.Request) {
 			utils.RespondError(w, http.StatusBadRequest, "Invalid contact_id parameter")
 			return
 		}
-		query += ` AND contact_id = ?`
+		query += ` AND t.contact_id = ?`
 		args = append(args, contactID)
 	}
 
 	// Optional filtering by status
 	status := r.URL.Query().Get("status")
 	if status != "" {
-		query += ` AND status = ?`
+		query += ` AND t.status = ?`
 		args = append(args, status)
 	}
 
+	// Optional filtering by recurring series
+	if seriesIDStr := r.URL.Query().Get("series_id"); seriesIDStr != "" {
+		seriesID, err := strconv.Atoi(seriesIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid series_id parameter")
+			return
+		}
+		query += ` AND t.series_id = ?`
+		args = append(args, seriesID)
+	}
+
+	// Optional filtering by parent task
+	if parentIDStr := r.URL.Query().Get("parent_id"); parentIDStr != "" {
+		parentID, err := strconv.Atoi(parentIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid parent_id parameter")
+			return
+		}
+		if parentID == 0 {
+			query += ` AND t.parent_id IS NULL`
+		} else {
+			query += ` AND t.parent_id = ?`
+			args = append(args, parentID)
+		}
+	}
+
+	// Optional filtering by assignment
+	assignedTo, ok, err := userFilter(r, "assigned_to", userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid assigned_to parameter")
+		return
+	}
+	if ok {
+		query += ` AND t.assignee_id = ?`
+		args = append(args, assignedTo)
+	}
+	delegatedBy, ok, err := userFilter(r, "delegated_by", userID)
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid delegated_by parameter")
+		return
+	}
+	if ok {
+		query += ` AND t.assigned_by = ? AND t.assignee_id != t.assigned_by`
+		args = append(args, delegatedBy)
+	}
+
+	filter, filterArgs := tagFilter(r, orgID, models.EntityTask, "t.id")
+	query += filter
+	args = append(args, filterArgs...)
+	filter, filterArgs, order, orderArgs, ok := c.customFieldQuery(w, r, orgID, models.EntityTask, "t.id")
+	if !ok {
+		return
+	}
+	query += filter
+	args = append(args, filterArgs...)
+	if order != "" {
+		query += " ORDER BY " + order + ", t.id"
+		args = append(args, orderArgs...)
+	}
+
+	// Actionability depends on other tasks, so it is filtered after loading
+	var actionable *bool
+	if actionableStr := r.URL.Query().Get("actionable"); actionableStr != "" {
+		b, err := strconv.ParseBool(actionableStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid actionable parameter")
+			return
+		}
+		actionable = &b
+	}
+
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying tasks: %v", err)
@@ -150,10 +368,7 @@ func (c *CRMHandlers) ListTasks(w http.ResponseWriter, r *http.Request) {
 	var tasks []models.Task
 	for rows.Next() {
 		var task models.Task
-		if err := rows.Scan(
-			&task.ID, &task.UserID, &task.ContactID, &task.Title, &task.Description,
-			&task.DueDate, &task.Status, &task.Priority, &task.CreatedAt, &task.UpdatedAt,
-		); err != nil {
+		if err := scanTask(rows, &task); err != nil {
 			log.Printf("Error scanning task row: %v", err)
 			continue
 		}
@@ -165,17 +380,47 @@ func (c *CRMHandlers) ListTasks(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	if err := c.taskDetails(tasks); err != nil {
+		log.Printf("Error loading task details: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if actionable != nil {
+		filtered := tasks[:0]
+		for _, task := range tasks {
+			if task.Actionable == *actionable {
+				filtered = append(filtered, task)
+			}
+		}
+		tasks = filtered
+	}
+
+	ids := make([]int, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	tagged, ok := c.loadTags(w, orgID, models.EntityTask, ids)
+	if !ok {
+		return
+	}
+	for i := range tasks {
+		tasks[i].Tags = tagged[tasks[i].ID]
+	}
 
 	utils.RespondJSON(w, http.StatusOK, tasks)
 }
 
-// UpdateTask updates an existing task.
+// UpdateTask updates an existing task of the user's organization. The assignment
+// itself only changes through AssignTask. For an occurrence of a recurring task,
+// ?scope=future also applies the change to the occurrences after it; the default
+// ?scope=this changes only this one. Marking an occurrence done creates the next.
 func (c *CRMHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	taskID, err := strconv.Atoi(vars["id"])
@@ -183,6 +428,10 @@ func (c *CRMHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusBadRequest, "Invalid task ID")
 		return
 	}
+	scope, ok := taskScope(w, r)
+	if !ok {
+		return
+	}
 
 	var task models.Task
 	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
@@ -190,20 +439,69 @@ func (c *CRMHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	task.ID = taskID // Ensure the ID from the URL is used
+	if msg := validateTaskRelations(&task); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	customValues, ok := c.customFieldValues(w, orgID, models.EntityTask, task.CustomFields, false)
+	if !ok {
+		return
+	}
 
 	db := c.DB
+	before := c.snapshot(models.EntityTask, taskID)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	// A series split off the task stays with its creator, who may not be the user editing it
+	var (
+		ownerID              int
+		previousStatus       string
+		previousDescription  *string
+		seriesID, occurrence *int
+	)
+	err = tx.QueryRow("SELECT t.user_id, t.status, t.description, t.series_id, t.occurrence FROM tasks t WHERE t.id = ? AND t.org_id = ? AND t.deleted_at IS NULL", taskID, orgID).
+		Scan(&ownerID, &previousStatus, &previousDescription, &seriesID, &occurrence)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Task not found or unauthorized to update")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
 
-	// Validate contact_id belongs to the user if provided in payload
+	// Validate contact_id belongs to the organization if provided in payload
 	if task.ContactID != nil && *task.ContactID != 0 {
 		var exists bool
-		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND user_id = ?)", *task.ContactID, userID).Scan(&exists)
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM contacts WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", *task.ContactID, orgID).Scan(&exists)
 		if err != nil || !exists {
-			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the user")
+			utils.RespondError(w, http.StatusForbidden, "Contact not found or does not belong to the organization")
+			return
+		}
+	}
+	if !taskParentOK(w, tx, orgID, taskID, &task) {
+		return
+	}
+
+	// The rule only matters when it starts a series or applies to future occurrences
+	var rule *recurrence.Rule
+	if seriesID == nil || scope == models.TaskScopeFuture {
+		var msg string
+		if rule, msg = taskRecurrence(&task); msg != "" {
+			utils.RespondError(w, http.StatusBadRequest, msg)
 			return
 		}
 	}
 
-	stmt, err := db.Prepare(`UPDATE tasks SET contact_id = ?, title = ?, description = ?, due_date = ?, status = ?, priority = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`)
+	stmt, err := tx.Prepare(`UPDATE tasks SET contact_id = ?, title = ?, description = ?, due_date = ?, status = ?, priority = ?, parent_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND user_id = ?`)
 	if err != nil {
 		log.Printf("Error preparing statement: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Database error")
@@ -211,46 +509,102 @@ func (c *CRMHandlers) UpdateTask(w http.ResponseWriter, r *http.Request) {
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(
+	_, err = stmt.Exec(
 		task.ContactID,
 		task.Title,
 		task.Description,
 		task.DueDate,
 		task.Status,
 		task.Priority,
+		task.ParentID,
 		task.ID,
-		userID,
+		ownerID,
 	)
 	if err != nil {
 		log.Printf("Error updating task: %v", err)
 		utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
 		return
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		utils.RespondError(w, http.StatusNotFound, "Task not found or unauthorized to update")
+	if !saveTaskRelations(w, tx, orgID, taskID, &task) {
+		return
+	}
+	if !c.saveCustomFields(w, tx, models.EntityTask, taskID, customValues) {
 		return
 	}
 
-	// Fetch latest updated_at from DB
-	err = db.QueryRow("SELECT updated_at FROM tasks WHERE id = ?", task.ID).Scan(&task.UpdatedAt)
-	if err != nil {
-		log.Printf("Failed to fetch updated timestamp: %v", err)
-		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve updated task")
+	var later []pendingAudit
+	switch {
+	case seriesID == nil && rule != nil:
+		id, err := createTaskSeries(tx, ownerID, *rule, &task)
+		if err == nil {
+			_, err = tx.Exec("UPDATE tasks SET series_id = ?, occurrence = 1 WHERE id = ?", id, taskID)
+		}
+		if err != nil {
+			log.Printf("Error creating task series: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
+			return
+		}
+	case seriesID != nil && scope == models.TaskScopeFuture:
+		later, err = snapshotRecords(tx, models.EntityTask, "SELECT id FROM tasks WHERE series_id = ? AND occurrence > ?", *seriesID, *occurrence)
+		if err == nil {
+			err = applyToFutureOccurrences(tx, ownerID, &task, *seriesID, *occurrence, rule)
+		}
+		if err != nil {
+			log.Printf("Error updating task series: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
+			return
+		}
+	}
+
+	var nextTaskID *int
+	if task.Status == models.TaskStatusDone && previousStatus != models.TaskStatusDone {
+		// Re-read: the edit may have started, split or ended the series
+		if err := tx.QueryRow("SELECT series_id, occurrence FROM tasks WHERE id = ?", taskID).Scan(&seriesID, &occurrence); err != nil {
+			log.Printf("Error querying task: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
+			return
+		}
+		if seriesID != nil {
+			if nextTaskID, err = createNextOccurrence(tx, *seriesID, *occurrence); err != nil {
+				log.Printf("Error creating next task occurrence: %v", err)
+				utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing task update: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update task")
 		return
 	}
 
-	utils.RespondJSON(w, http.StatusOK, task)
+	c.audit(w, r, events.ActionUpdated, models.EntityTask, taskID, before)
+	c.auditPending(w, r, later)
+	if nextTaskID != nil {
+		c.audit(w, r, events.ActionCreated, models.EntityTask, *nextTaskID, nil)
+	}
+	c.notifyMentions(userID, models.EntityTask, taskID, task.Title, task.Description, previousDescription)
+	c.publishTask(userID, events.ActionUpdated, taskID)
+	if task.Status == models.TaskStatusDone && previousStatus != models.TaskStatusDone {
+		c.publishTask(userID, events.ActionCompleted, taskID)
+	}
+	if nextTaskID != nil {
+		c.publishTask(userID, events.ActionCreated, *nextTaskID)
+	}
+	c.respondTask(w, http.StatusOK, taskID, nextTaskID)
 }
 
-// DeleteTask deletes a task.
+// DeleteTask moves a task together with its subtasks to the trash. Deleting an open occurrence of a recurring task skips it and
+// schedules the next one; ?scope=future deletes it together with any later
+// occurrences and ends the series.
 func (c *CRMHandlers) DeleteTask(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
 	if !ok {
 		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
 		return
 	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
 
 	vars := mux.Vars(r)
 	taskID, err := strconv.Atoi(vars["id"])
@@ -258,20 +612,85 @@ func (c *CRMHandlers) DeleteTask(w http.ResponseWriter, r *http.Request) {
 		utils.RespondError(w, http.StatusBadRequest, "Invalid task ID")
 		return
 	}
+	scope, ok := taskScope(w, r)
+	if !ok {
+		return
+	}
 
-	db := c.DB
-	result, err := db.Exec("DELETE FROM tasks WHERE id = ? AND user_id = ?", taskID, userID)
+	tx, err := c.DB.Begin()
 	if err != nil {
-		log.Printf("Error deleting task: %v", err)
-		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
 		return
 	}
+	defer tx.Rollback()
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	var (
+		status               string
+		seriesID, occurrence *int
+	)
+	err = tx.QueryRow("SELECT status, series_id, occurrence FROM tasks WHERE id = ? AND org_id = ? AND deleted_at IS NULL", taskID, orgID).Scan(&status, &seriesID, &occurrence)
+	if errors.Is(err, sql.ErrNoRows) {
 		utils.RespondError(w, http.StatusNotFound, "Task not found or unauthorized to delete")
 		return
 	}
+	if err != nil {
+		log.Printf("Error querying task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+		return
+	}
+
+	deleted := []int{taskID}
+	if seriesID != nil && scope == models.TaskScopeFuture {
+		later, err := futureOccurrences(tx, *seriesID, *occurrence)
+		if err != nil {
+			log.Printf("Error querying task series: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+			return
+		}
+		deleted = append(deleted, later...)
+	}
+	// The next occurrence is created from this one, so before deleting it
+	var nextTaskID *int
+	if seriesID != nil {
+		if scope == models.TaskScopeFuture {
+			err = endSeriesBefore(tx, *seriesID, *occurrence)
+		} else if status != models.TaskStatusDone {
+			nextTaskID, err = createNextOccurrence(tx, *seriesID, *occurrence)
+		}
+		if err != nil {
+			log.Printf("Error updating task series: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+			return
+		}
+	}
+
+	// Subtasks go to the trash with their parent
+	var trashed []trash.Record
+	deletedAt := trash.Now()
+	for _, id := range deleted {
+		moved, err := trash.Move(tx, models.EntityTask, id, orgID, deletedAt)
+		if err != nil {
+			log.Printf("Error deleting task: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+			return
+		}
+		trashed = append(trashed, moved...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing task delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete task")
+		return
+	}
+	c.auditTrash(w, r, events.ActionDeleted, trashed)
+	for _, record := range trashed {
+		c.publish(userID, models.EntityTask, events.ActionDeleted, record.ID, nil)
+	}
+	if nextTaskID != nil {
+		c.audit(w, r, events.ActionCreated, models.EntityTask, *nextTaskID, nil)
+		c.publishTask(userID, events.ActionCreated, *nextTaskID)
+	}
 
 	utils.RespondJSON(w, http.StatusNoContent, nil)
 }
@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"micro-CRM/internal/customfields"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"strings"
+)
+
+// validateTaskRelations checks the parts of a task payload that don't need the
+// database and returns a client-facing message when they are invalid.
+func validateTaskRelations(task *models.Task) string {
+	if task.ParentID != nil && *task.ParentID == 0 {
+		task.ParentID = nil
+	}
+	if task.ParentID != nil && *task.ParentID == task.ID {
+		return "A task cannot be its own parent"
+	}
+	for i := range task.Checklist {
+		task.Checklist[i].Text = strings.TrimSpace(task.Checklist[i].Text)
+		if task.Checklist[i].Text == "" {
+			return "Checklist items need text"
+		}
+	}
+	return ""
+}
+
+// checkTaskParent returns a client-facing message unless parentID is one of the
+// organization's tasks that is not taskID itself or one of its subtasks. taskID is
+// 0 for a new task.
+func checkTaskParent(tx *sql.Tx, orgID, taskID, parentID int) (string, error) {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tasks WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", parentID, orgID).Scan(&exists); err != nil {
+		return "", err
+	}
+	if !exists {
+		return "Parent task not found or does not belong to the organization", nil
+	}
+	if taskID == 0 {
+		return "", nil
+	}
+	var cycle bool
+	err := tx.QueryRow(`
+	WITH RECURSIVE ancestors(id) AS (
+		SELECT ?
+		UNION
+		SELECT t.parent_id FROM tasks t JOIN ancestors a ON t.id = a.id WHERE t.parent_id IS NOT NULL
+	)
+	SELECT EXISTS(SELECT 1 FROM ancestors WHERE id = ?)`, parentID, taskID).Scan(&cycle)
+	if err != nil {
+		return "", err
+	}
+	if cycle {
+		return "A task cannot be moved under one of its own subtasks", nil
+	}
+	return "", nil
+}
+
+// setTaskDependencies replaces the tasks blocking taskID. It returns a
+// client-facing message for unknown tasks and for dependencies that would make a
+// task wait on itself, directly or through other tasks.
+func setTaskDependencies(tx *sql.Tx, orgID, taskID int, blockedBy []int) (string, error) {
+	if _, err := tx.Exec("DELETE FROM task_dependencies WHERE task_id = ?", taskID); err != nil {
+		return "", err
+	}
+	for _, blockerID := range blockedBy {
+		if blockerID == taskID {
+			return "A task cannot be blocked by itself", nil
+		}
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tasks WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", blockerID, orgID).Scan(&exists); err != nil {
+			return "", err
+		}
+		if !exists {
+			return fmt.Sprintf("Blocking task %d not found or does not belong to the organization", blockerID), nil
+		}
+		// The blocker must not already be waiting on this task
+		var cycle bool
+		err := tx.QueryRow(`
+		WITH RECURSIVE blockers(id) AS (
+			SELECT ?
+			UNION
+			SELECT d.blocked_by_id FROM task_dependencies d JOIN blockers b ON d.task_id = b.id
+		)
+		SELECT EXISTS(SELECT 1 FROM blockers WHERE id = ?)`, blockerID, taskID).Scan(&cycle)
+		if err != nil {
+			return "", err
+		}
+		if cycle {
+			return fmt.Sprintf("Blocking task %d would create a dependency cycle", blockerID), nil
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO task_dependencies (task_id, blocked_by_id) VALUES (?, ?)", taskID, blockerID); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// setTaskChecklist replaces a task's checklist, keeping the given order.
+func setTaskChecklist(tx *sql.Tx, taskID int, items []models.TaskChecklistItem) error {
+	if _, err := tx.Exec("DELETE FROM task_checklist_items WHERE task_id = ?", taskID); err != nil {
+		return err
+	}
+	for i, item := range items {
+		if _, err := tx.Exec("INSERT INTO task_checklist_items (task_id, text, done, position) VALUES (?, ?, ?, ?)", taskID, item.Text, item.Done, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveTaskRelations stores the task's dependencies and checklist when the payload
+// has them, writing the error response when not ok.
+func saveTaskRelations(w http.ResponseWriter, tx *sql.Tx, orgID, taskID int, task *models.Task) bool {
+	if task.BlockedBy != nil {
+		msg, err := setTaskDependencies(tx, orgID, taskID, task.BlockedBy)
+		if err != nil {
+			log.Printf("Error saving task dependencies: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to save task")
+			return false
+		}
+		if msg != "" {
+			utils.RespondError(w, http.StatusBadRequest, msg)
+			return false
+		}
+	}
+	if task.Checklist != nil {
+		if err := setTaskChecklist(tx, taskID, task.Checklist); err != nil {
+			log.Printf("Error saving task checklist: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to save task")
+			return false
+		}
+	}
+	return true
+}
+
+// taskParentOK checks the payload's parent inside tx, writing the error response when not ok.
+func taskParentOK(w http.ResponseWriter, tx *sql.Tx, orgID, taskID int, task *models.Task) bool {
+	if task.ParentID == nil {
+		return true
+	}
+	msg, err := checkTaskParent(tx, orgID, taskID, *task.ParentID)
+	if err != nil {
+		log.Printf("Error checking parent task: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return false
+	}
+	if msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return false
+	}
+	return true
+}
+
+// taskDetails fills BlockedBy, Checklist, Progress, Actionable and CustomFields
+// for every task in the slice. A task is actionable while it is open and none of its blockers or
+// direct subtasks are.
+func (c *CRMHandlers) taskDetails(tasks []models.Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	index := make(map[int]*models.Task, len(tasks))
+	args := make([]interface{}, len(tasks))
+	for i := range tasks {
+		tasks[i].BlockedBy = []int{}
+		tasks[i].Checklist = []models.TaskChecklistItem{}
+		tasks[i].Progress = nil
+		tasks[i].Actionable = tasks[i].Status != models.TaskStatusDone
+		index[tasks[i].ID] = &tasks[i]
+		args[i] = tasks[i].ID
+	}
+	in := "(?" + strings.Repeat(", ?", len(tasks)-1) + ")"
+
+	rows, err := c.DB.Query(`
+	SELECT d.task_id, d.blocked_by_id, b.status FROM task_dependencies d JOIN tasks b ON b.id = d.blocked_by_id
+	WHERE b.deleted_at IS NULL AND d.task_id IN `+in+` ORDER BY d.task_id, d.blocked_by_id`, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var (
+			taskID, blockerID int
+			status            string
+		)
+		if err := rows.Scan(&taskID, &blockerID, &status); err != nil {
+			rows.Close()
+			return err
+		}
+		task := index[taskID]
+		task.BlockedBy = append(task.BlockedBy, blockerID)
+		if status != models.TaskStatusDone {
+			task.Actionable = false
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = c.DB.Query(`
+	SELECT parent_id, COUNT(*), COALESCE(SUM(status = ?), 0) FROM tasks
+	WHERE deleted_at IS NULL AND parent_id IN `+in+` GROUP BY parent_id`, append([]interface{}{models.TaskStatusDone}, args...)...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var parentID, total, done int
+		if err := rows.Scan(&parentID, &total, &done); err != nil {
+			rows.Close()
+			return err
+		}
+		task := index[parentID]
+		task.Progress = &models.TaskProgress{SubtasksDone: done, SubtasksTotal: total}
+		if done < total {
+			task.Actionable = false
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = c.DB.Query(`
+	SELECT task_id, id, text, done FROM task_checklist_items
+	WHERE task_id IN `+in+` ORDER BY task_id, position`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			taskID int
+			item   models.TaskChecklistItem
+		)
+		if err := rows.Scan(&taskID, &item.ID, &item.Text, &item.Done); err != nil {
+			return err
+		}
+		task := index[taskID]
+		task.Checklist = append(task.Checklist, item)
+		if task.Progress == nil {
+			task.Progress = &models.TaskProgress{}
+		}
+		task.Progress.ChecklistTotal++
+		if item.Done {
+			task.Progress.ChecklistDone++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range tasks {
+		if p := tasks[i].Progress; p != nil {
+			if total := p.SubtasksTotal + p.ChecklistTotal; total > 0 {
+				p.Percent = (p.SubtasksDone + p.ChecklistDone) * 100 / total
+			}
+		}
+	}
+
+	ids := make([]int, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+	}
+	custom, err := customfields.Load(c.DB, models.EntityTask, ids)
+	if err != nil {
+		return err
+	}
+	for i := range tasks {
+		tasks[i].CustomFields = custom[tasks[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/recurrence"
+	"micro-CRM/internal/utils"
+	"time"
+)
+
+const taskColumns = `t.id, t.user_id, t.contact_id, t.title, t.description, t.due_date, t.status, t.priority,
+	t.created_at, t.updated_at, t.series_id, t.occurrence, s.rrule, t.parent_id,
+	t.assignee_id, t.assigned_by, t.assigned_at`
+
+// taskFrom joins each task to its series so the rule is returned with it.
+const taskFrom = ` FROM tasks t LEFT JOIN task_series s ON s.id = t.series_id`
+
+func scanTask(row interface{ Scan(...interface{}) error }, task *models.Task) error {
+	return row.Scan(
+		&task.ID, &task.UserID, &task.ContactID, &task.Title, &task.Description,
+		&task.DueDate, &task.Status, &task.Priority, &task.CreatedAt, &task.UpdatedAt,
+		&task.SeriesID, &task.Occurrence, &task.Recurrence, &task.ParentID,
+		&task.AssigneeID, &task.AssignedBy, &task.AssignedAt,
+	)
+}
+
+// createTaskSeries starts a series at the task's due date, using the task as the
+// template for later occurrences.
+func createTaskSeries(tx *sql.Tx, userID int, rule recurrence.Rule, task *models.Task) (int, error) {
+	res, err := tx.Exec(`
+	INSERT INTO task_series (user_id, rrule, dtstart, contact_id, title, description, priority)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, rule.String(), *task.DueDate, task.ContactID, task.Title, task.Description, task.Priority,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// updateSeriesTemplate makes future occurrences use the task's fields.
+func updateSeriesTemplate(tx *sql.Tx, seriesID int, task *models.Task) error {
+	_, err := tx.Exec(`
+	UPDATE task_series SET contact_id = ?, title = ?, description = ?, priority = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`,
+		task.ContactID, task.Title, task.Description, task.Priority, seriesID,
+	)
+	return err
+}
+
+// endSeriesBefore stops a series after the occurrence preceding the given one.
+// A series that would be left without occurrences is removed.
+func endSeriesBefore(tx *sql.Tx, seriesID, occurrence int) error {
+	if occurrence <= 1 {
+		// Deleting the series clears series_id; the occurrence number goes with it
+		if _, err := tx.Exec("UPDATE tasks SET occurrence = NULL WHERE series_id = ?", seriesID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM task_series WHERE id = ?", seriesID)
+		return err
+	}
+	var rrule string
+	if err := tx.QueryRow("SELECT rrule FROM task_series WHERE id = ?", seriesID).Scan(&rrule); err != nil {
+		return err
+	}
+	rule, err := recurrence.Parse(rrule)
+	if err != nil {
+		return err
+	}
+	rule.Count, rule.Until = occurrence-1, time.Time{}
+	_, err = tx.Exec("UPDATE task_series SET rrule = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", rule.String(), seriesID)
+	return err
+}
+
+// futureOccurrences returns the ids of the occurrences after the given one.
+func futureOccurrences(tx *sql.Tx, seriesID, occurrence int) ([]int, error) {
+	rows, err := tx.Query("SELECT id FROM tasks WHERE series_id = ? AND occurrence > ?", seriesID, occurrence)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// createNextOccurrence adds the occurrence following the given one, unless it
+// already exists or the series has ended. It returns the new task's id, or nil.
+func createNextOccurrence(tx *sql.Tx, seriesID, occurrence int) (*int, error) {
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tasks WHERE series_id = ? AND occurrence > ?)", seriesID, occurrence).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, nil
+	}
+
+	var (
+		series  models.Task
+		rrule   string
+		dtstart string
+	)
+	err := tx.QueryRow(`
+	SELECT user_id, rrule, dtstart, contact_id, title, description, priority FROM task_series WHERE id = ?`, seriesID,
+	).Scan(&series.UserID, &rrule, &dtstart, &series.ContactID, &series.Title, &series.Description, &series.Priority)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rule, err := recurrence.Parse(rrule)
+	if err != nil {
+		return nil, err
+	}
+	start, layout, err := utils.ParseDueDate(dtstart)
+	if err != nil {
+		return nil, err
+	}
+	due, ok := rule.Occurrence(start, occurrence)
+	if !ok {
+		return nil, nil
+	}
+
+	// The next occurrence stays with whoever the current one is assigned to
+	err = tx.QueryRow("SELECT assignee_id, assigned_by, assigned_at FROM tasks WHERE series_id = ? AND occurrence = ?", seriesID, occurrence).
+		Scan(&series.AssigneeID, &series.AssignedBy, &series.AssignedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	res, err := tx.Exec(`
+	INSERT INTO tasks (user_id, contact_id, title, description, due_date, status, priority, series_id, occurrence, assignee_id, assigned_by, assigned_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		series.UserID, series.ContactID, series.Title, series.Description, due.Format(layout),
+		models.TaskStatusToDo, series.Priority, seriesID, occurrence+1,
+		series.AssigneeID, series.AssignedBy, series.AssignedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := res.LastInsertId()
+	next := int(id)
+	return &next, nil
+}
+
+// applyToFutureOccurrences carries an edit of one occurrence over to the rest of
+// its series. Changing the rule or moving the due date off the schedule splits
+// the series at this occurrence so earlier ones keep their history; clearing the
+// rule detaches this and later occurrences and ends the series before them.
+func applyToFutureOccurrences(tx *sql.Tx, userID int, task *models.Task, seriesID, occurrence int, rule *recurrence.Rule) error {
+	if rule == nil {
+		if _, err := tx.Exec("UPDATE tasks SET series_id = NULL, occurrence = NULL WHERE series_id = ? AND occurrence >= ?", seriesID, occurrence); err != nil {
+			return err
+		}
+		return endSeriesBefore(tx, seriesID, occurrence)
+	}
+
+	// Later occurrences only exist when an earlier one was completed; they take the
+	// new fields but keep their own due dates and status
+	if _, err := tx.Exec(`
+	UPDATE tasks SET contact_id = ?, title = ?, description = ?, priority = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE series_id = ? AND occurrence > ? AND status != ?`,
+		task.ContactID, task.Title, task.Description, task.Priority, seriesID, occurrence, models.TaskStatusDone,
+	); err != nil {
+		return err
+	}
+
+	var rrule, dtstart string
+	if err := tx.QueryRow("SELECT rrule, dtstart FROM task_series WHERE id = ?", seriesID).Scan(&rrule, &dtstart); err != nil {
+		return err
+	}
+	if rule.String() == rrule {
+		oldRule, err := recurrence.Parse(rrule)
+		if err != nil {
+			return err
+		}
+		if start, layout, err := utils.ParseDueDate(dtstart); err == nil {
+			if due, ok := oldRule.Occurrence(start, occurrence-1); ok && due.Format(layout) == *task.DueDate {
+				return updateSeriesTemplate(tx, seriesID, task)
+			}
+		}
+		// Same rule from a new date: the remaining occurrences move, they don't restart
+		if rule.Count > 0 {
+			rule.Count = max(rule.Count-(occurrence-1), 1)
+		}
+	}
+
+	if occurrence == 1 {
+		if _, err := tx.Exec("UPDATE task_series SET rrule = ?, dtstart = ? WHERE id = ?", rule.String(), *task.DueDate, seriesID); err != nil {
+			return err
+		}
+		return updateSeriesTemplate(tx, seriesID, task)
+	}
+	newID, err := createTaskSeries(tx, userID, *rule, task)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+	UPDATE tasks SET series_id = ?, occurrence = occurrence - ? WHERE series_id = ? AND occurrence >= ?`,
+		newID, occurrence-1, seriesID, occurrence,
+	); err != nil {
+		return err
+	}
+	return endSeriesBefore(tx, seriesID, occurrence)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/timeline"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTimelineLimit = 50
+	maxTimelineLimit     = 200
+)
+
+// timelineOf responds with a page of the activity timeline of a contact or
+// company the user can see, newest first. Items of other organizations on
+// shared records are left out.
+// Query parameters: kind, a comma-separated list of interaction, task, file,
+// stage_change and note; limit; and before, the cursor of the last item of the
+// previous page.
+func (c *CRMHandlers) timelineOf(w http.ResponseWriter, r *http.Request, entityType, table, label string) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid "+strings.ToLower(label)+" ID")
+		return
+	}
+	var found int
+	err = c.DB.QueryRow("SELECT 1 FROM "+table+" WHERE id = ? AND "+visibleClause(false),
+		append([]interface{}{id}, visibleArgs(entityType, orgID, userID)...)...).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, label+" not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking %s: %v", entityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	params := r.URL.Query()
+	kinds := timeline.Kinds
+	if kindParam := params.Get("kind"); kindParam != "" {
+		kinds = nil
+		for _, kind := range strings.Split(kindParam, ",") {
+			kind = strings.TrimSpace(kind)
+			if !slices.Contains(timeline.Kinds, kind) {
+				utils.RespondError(w, http.StatusBadRequest, "kind must be one or more of "+strings.Join(timeline.Kinds, ", "))
+				return
+			}
+			if !slices.Contains(kinds, kind) {
+				kinds = append(kinds, kind)
+			}
+		}
+	}
+	var before *timeline.Cursor
+	if beforeParam := params.Get("before"); beforeParam != "" {
+		cursor, err := timeline.DecodeCursor(beforeParam)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid before parameter")
+			return
+		}
+		before = &cursor
+	}
+	limit := defaultTimelineLimit
+	if limitStr := params.Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxTimelineLimit {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid limit parameter")
+			return
+		}
+		limit = n
+	}
+
+	items, err := timeline.List(c.DB, orgID, entityType, id, kinds, before, limit)
+	if err != nil {
+		log.Printf("Error querying %s timeline: %v", entityType, err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, items)
+}
+
+// GetContactTimeline returns the interactions, tasks, files, stage changes and
+// notes edits of a contact and its deals as one stream.
+func (c *CRMHandlers) GetContactTimeline(w http.ResponseWriter, r *http.Request) {
+	c.timelineOf(w, r, models.EntityContact, "contacts", "Contact")
+}
+
+// GetCompanyTimeline returns the interactions, tasks, files, stage changes and
+// notes edits of a company, its contacts and its deals as one stream.
+func (c *CRMHandlers) GetCompanyTimeline(w http.ResponseWriter, r *http.Request) {
+	c.timelineOf(w, r, models.EntityCompany, "companies", "Company")
+}
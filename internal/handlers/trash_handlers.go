@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/trash"
+	"micro-CRM/internal/utils"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashRoutes maps the {entity} route variable of the restore endpoint to a record type.
+var trashRoutes = map[string]string{
+	"companies":    models.EntityCompany,
+	"contacts":     models.EntityContact,
+	"deals":        models.EntityDeal,
+	"interactions": models.EntityInteraction,
+	"tasks":        models.EntityTask,
+	"files":        models.EntityFile,
+}
+
+// moveToTrash deletes a record of the organization by moving it and its children
+// to the trash. It returns the records moved, none when the record was not found.
+func (c *CRMHandlers) moveToTrash(orgID int, entityType string, id int) ([]trash.Record, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	trashed, err := trash.Move(tx, entityType, id, orgID, trash.Now())
+	if err != nil {
+		return nil, err
+	}
+	return trashed, tx.Commit()
+}
+
+// auditTrash audits records moved to or restored from the trash. Only their
+// deleted_at changed, so it stands in for the snapshot taken before.
+func (c *CRMHandlers) auditTrash(w http.ResponseWriter, r *http.Request, action string, records []trash.Record) {
+	for _, record := range records {
+		if _, audited := audit.Tables[record.EntityType]; !audited {
+			continue
+		}
+		before := c.snapshot(record.EntityType, record.ID)
+		if before == nil {
+			continue
+		}
+		if action == events.ActionDeleted {
+			before["deleted_at"] = nil
+		} else {
+			before["deleted_at"] = record.DeletedAt
+		}
+		c.audit(w, r, action, record.EntityType, record.ID, before)
+	}
+}
+
+// ListTrash lists the deleted records of the user's organization, most recently
+// deleted first, with the time each will be purged.
+// Query parameters: entity_type.
+func (c *CRMHandlers) ListTrash(w http.ResponseWriter, r *http.Request) {
+	orgID, ok := r.Context().Value(models.OrgIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	var entityTypes []string
+	if entityType := r.URL.Query().Get("entity_type"); entityType != "" {
+		if _, ok := trash.Entities[entityType]; !ok {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid entity_type parameter")
+			return
+		}
+		entityTypes = []string{entityType}
+	} else {
+		for entityType := range trash.Entities {
+			entityTypes = append(entityTypes, entityType)
+		}
+		sort.Strings(entityTypes)
+	}
+
+	var (
+		selects []string
+		args    []interface{}
+	)
+	for _, entityType := range entityTypes {
+		e := trash.Entities[entityType]
+		selects = append(selects, "SELECT '"+entityType+"', id, COALESCE("+e.Label+", ''), user_id, deleted_at FROM "+e.Table+
+			" WHERE org_id = ? AND deleted_at IS NOT NULL")
+		args = append(args, orgID)
+	}
+	rows, err := c.DB.Query(strings.Join(selects, " UNION ALL ")+" ORDER BY 5 DESC, 1, 2", args...)
+	if err != nil {
+		log.Printf("Error querying trash: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	list := []models.TrashedRecord{}
+	for rows.Next() {
+		var t models.TrashedRecord
+		if err := rows.Scan(&t.EntityType, &t.EntityID, &t.Label, &t.UserID, &t.DeletedAt); err != nil {
+			log.Printf("Error scanning trashed record: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if deletedAt, err := time.Parse(trash.Layout, t.DeletedAt); err == nil {
+			t.PurgeAt = deletedAt.Add(c.trashRetention()).Format(time.RFC3339)
+		}
+		list = append(list, t)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating trash: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, list)
+}
+
+func (c *CRMHandlers) trashRetention() time.Duration {
+	if c.TrashRetention > 0 {
+		return c.TrashRetention
+	}
+	return trash.DefaultRetention
+}
+
+// RestoreRecord takes a deleted record of the user's organization out of the
+// trash together with the records deleted along with it, such as a contact's
+// interactions or a task's subtasks.
+func (c *CRMHandlers) RestoreRecord(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	orgID, _ := r.Context().Value(models.OrgIDContextKey).(int)
+
+	vars := mux.Vars(r)
+	entityType, ok := trashRoutes[vars["entity"]]
+	if !ok {
+		utils.RespondError(w, http.StatusNotFound, "Records of this type cannot be restored")
+		return
+	}
+	entityID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid ID")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	restored, err := trash.Restore(tx, entityType, entityID, orgID)
+	if errors.Is(err, trash.ErrNotFound) {
+		utils.RespondError(w, http.StatusNotFound, "Record not found in the trash")
+		return
+	}
+	if errors.Is(err, trash.ErrParentTrashed) {
+		utils.RespondError(w, http.StatusConflict, "The record it belongs to is in the trash; restore that first")
+		return
+	}
+	if err != nil {
+		log.Printf("Error restoring record: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to restore record")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing restore: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to restore record")
+		return
+	}
+
+	c.auditTrash(w, r, events.ActionRestored, restored)
+	for _, record := range restored {
+		c.publish(userID, record.EntityType, events.ActionRestored, record.ID, nil)
+	}
+	utils.RespondJSON(w, http.StatusOK, models.TrashRestore{EntityType: entityType, EntityID: entityID, Restored: len(restored)})
+}
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"micro-CRM/internal/webhooks"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	webhookColumns  = `id, user_id, url, events, enabled, failure_count, disabled_reason, created_at, updated_at`
+	deliveryColumns = `id, webhook_id, event_id, event_type, payload, status, attempts, response_status, response_body,
+	last_error, duration_ms, next_attempt_at, delivered_at, redelivery_of, created_at, updated_at`
+
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+func scanWebhook(row interface{ Scan(...interface{}) error }, hook *models.Webhook) error {
+	var subscribed string
+	err := row.Scan(
+		&hook.ID, &hook.UserID, &hook.URL, &subscribed, &hook.Enabled, &hook.FailureCount,
+		&hook.DisabledReason, &hook.CreatedAt, &hook.UpdatedAt,
+	)
+	hook.Events = strings.Split(subscribed, ",")
+	return err
+}
+
+func scanDelivery(row interface{ Scan(...interface{}) error }, d *models.WebhookDelivery) error {
+	var payload string
+	err := row.Scan(
+		&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody,
+		&d.LastError, &d.DurationMS, &d.NextAttemptAt, &d.DeliveredAt, &d.RedeliveryOf, &d.CreatedAt, &d.UpdatedAt,
+	)
+	d.Payload = json.RawMessage(payload)
+	return err
+}
+
+// validateWebhook normalizes a webhook payload and returns a client-facing message when it is invalid.
+func validateWebhook(hook *models.Webhook) string {
+	hook.URL = strings.TrimSpace(hook.URL)
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "url must be an absolute http or https URL"
+	}
+	if len(hook.Events) == 0 {
+		return "events must list at least one event type"
+	}
+	seen := make(map[string]bool)
+	var types []string
+	for _, t := range hook.Events {
+		t = strings.TrimSpace(t)
+		if !webhooks.ValidEventType(t) {
+			return "Unknown event type: " + t
+		}
+		if t == webhooks.AllEvents {
+			types = []string{webhooks.AllEvents}
+			break
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	hook.Events = types
+	return ""
+}
+
+// webhookParam reads the webhook id from the URL and checks that the user owns it,
+// writing the error response when not.
+func (c *CRMHandlers) webhookParam(w http.ResponseWriter, r *http.Request, userID int) (int, bool) {
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return 0, false
+	}
+	var exists bool
+	if err := c.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM webhooks WHERE id = ? AND user_id = ?)", webhookID, userID).Scan(&exists); err != nil {
+		log.Printf("Error querying webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return 0, false
+	}
+	if !exists {
+		utils.RespondError(w, http.StatusNotFound, "Webhook not found or unauthorized")
+		return 0, false
+	}
+	return webhookID, true
+}
+
+// ListWebhookEventTypes returns the event types webhooks can subscribe to.
+func (c *CRMHandlers) ListWebhookEventTypes(w http.ResponseWriter, r *http.Request) {
+	utils.RespondJSON(w, http.StatusOK, webhooks.EventTypes)
+}
+
+// CreateWebhook subscribes a URL to event types of the authenticated user. A
+// signing secret is generated unless one is given; this response is the only
+// one that includes it.
+func (c *CRMHandlers) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	hook := models.Webhook{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateWebhook(&hook); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if hook.Secret == "" {
+		secret, err := webhooks.NewSecret()
+		if err != nil {
+			log.Printf("Error generating webhook secret: %v", err)
+			utils.RespondError(w, http.StatusInternalServerError, "Failed to create webhook")
+			return
+		}
+		hook.Secret = secret
+	}
+
+	result, err := c.DB.Exec("INSERT INTO webhooks (user_id, url, secret, events, enabled) VALUES (?, ?, ?, ?, ?)",
+		userID, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.Enabled,
+	)
+	if err != nil {
+		log.Printf("Error inserting webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to create webhook")
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	if err := scanWebhook(c.DB.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id), &hook); err != nil {
+		log.Printf("Error fetching created webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Error fetching created webhook")
+		return
+	}
+	utils.RespondJSON(w, http.StatusCreated, hook)
+}
+
+// ListWebhooks retrieves the authenticated user's webhooks.
+func (c *CRMHandlers) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	rows, err := c.DB.Query("SELECT "+webhookColumns+" FROM webhooks WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		log.Printf("Error querying webhooks: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	hooks := []models.Webhook{}
+	for rows.Next() {
+		var hook models.Webhook
+		if err := scanWebhook(rows, &hook); err != nil {
+			log.Printf("Error scanning webhook row: %v", err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating webhook rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, hooks)
+}
+
+// GetWebhook retrieves a single webhook.
+func (c *CRMHandlers) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var hook models.Webhook
+	err = scanWebhook(c.DB.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID), &hook)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Webhook not found or unauthorized")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, hook)
+}
+
+// UpdateWebhook changes a webhook's URL, event types and enabled state. An empty
+// secret keeps the stored one. Enabling a webhook that was turned off for failing
+// clears its failure count, and its queued deliveries resume.
+func (c *CRMHandlers) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	var hook models.Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	if msg := validateWebhook(&hook); msg != "" {
+		utils.RespondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	UPDATE webhooks SET
+		url = ?, secret = COALESCE(NULLIF(?, ''), secret), events = ?,
+		failure_count = CASE WHEN ? AND enabled = 0 THEN 0 ELSE failure_count END,
+		enabled = ?, disabled_reason = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ?`,
+		hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.Enabled, hook.Enabled, webhookID, userID,
+	)
+	if err != nil {
+		log.Printf("Error updating webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to update webhook")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Webhook not found or unauthorized to update")
+		return
+	}
+	if hook.Enabled && c.Webhooks != nil {
+		c.Webhooks.Wake()
+	}
+
+	hook.Secret = ""
+	if err := scanWebhook(c.DB.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", webhookID), &hook); err != nil {
+		log.Printf("Error fetching updated webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Could not retrieve updated webhook")
+		return
+	}
+	utils.RespondJSON(w, http.StatusOK, hook)
+}
+
+// DeleteWebhook removes a webhook together with its delivery log.
+func (c *CRMHandlers) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+
+	webhookID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+
+	tx, err := c.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID)
+	if err != nil {
+		log.Printf("Error deleting webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Webhook not found or unauthorized to delete")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing webhook delete: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to delete webhook")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusNoContent, nil)
+}
+
+// ListWebhookDeliveries returns a webhook's delivery log, newest first.
+// Query parameters: status, limit, and before_id to page back from the oldest
+// id of the previous page.
+func (c *CRMHandlers) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	webhookID, ok := c.webhookParam(w, r, userID)
+	if !ok {
+		return
+	}
+
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ?"
+	args := []interface{}{webhookID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		switch status {
+		case models.DeliveryPending, models.DeliveryDelivering, models.DeliverySucceeded, models.DeliveryFailed:
+		default:
+			utils.RespondError(w, http.StatusBadRequest, "Invalid status parameter")
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if beforeIDStr := r.URL.Query().Get("before_id"); beforeIDStr != "" {
+		beforeID, err := strconv.Atoi(beforeIDStr)
+		if err != nil {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid before_id parameter")
+			return
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	limit := defaultDeliveryLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n < 1 || n > maxDeliveryLimit {
+			utils.RespondError(w, http.StatusBadRequest, "Invalid limit parameter")
+			return
+		}
+		limit = n
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error querying webhook deliveries: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		var d models.WebhookDelivery
+		if err := scanDelivery(rows, &d); err != nil {
+			log.Printf("Error scanning webhook delivery row: %v", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating webhook delivery rows: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, deliveries)
+}
+
+// GetWebhookDelivery retrieves one delivery with its payload and last response.
+func (c *CRMHandlers) GetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	webhookID, ok := c.webhookParam(w, r, userID)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.Atoi(mux.Vars(r)["deliveryId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	var d models.WebhookDelivery
+	err = scanDelivery(c.DB.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ? AND webhook_id = ?", deliveryID, webhookID), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.RespondError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Error querying webhook delivery: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+
+	utils.RespondJSON(w, http.StatusOK, d)
+}
+
+// RedeliverWebhookDelivery queues the payload of an earlier delivery again as a new
+// delivery, e.g. after fixing the receiver. The original keeps its log.
+func (c *CRMHandlers) RedeliverWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+	if !ok {
+		utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	webhookID, ok := c.webhookParam(w, r, userID)
+	if !ok {
+		return
+	}
+	deliveryID, err := strconv.Atoi(mux.Vars(r)["deliveryId"])
+	if err != nil {
+		utils.RespondError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	var enabled bool
+	if err := c.DB.QueryRow("SELECT enabled FROM webhooks WHERE id = ?", webhookID).Scan(&enabled); err != nil {
+		log.Printf("Error querying webhook: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if !enabled {
+		utils.RespondError(w, http.StatusConflict, "Webhook is disabled; enable it before redelivering")
+		return
+	}
+
+	result, err := c.DB.Exec(`
+	INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, next_attempt_at, redelivery_of)
+	SELECT webhook_id, event_id, event_type, payload, ?, id FROM webhook_deliveries WHERE id = ? AND webhook_id = ?`,
+		time.Now().UTC().Format(time.RFC3339), deliveryID, webhookID,
+	)
+	if err != nil {
+		log.Printf("Error queueing webhook redelivery: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Failed to redeliver")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		utils.RespondError(w, http.StatusNotFound, "Delivery not found")
+		return
+	}
+	if c.Webhooks != nil {
+		c.Webhooks.Wake()
+	}
+
+	id, _ := result.LastInsertId()
+	var d models.WebhookDelivery
+	if err := scanDelivery(c.DB.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = ?", id), &d); err != nil {
+		log.Printf("Error fetching webhook redelivery: %v", err)
+		utils.RespondError(w, http.StatusInternalServerError, "Error fetching webhook redelivery")
+		return
+	}
+	utils.RespondJSON(w, http.StatusCreated, d)
+}
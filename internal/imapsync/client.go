@@ -0,0 +1,206 @@
+package imapsync
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a deliberately small IMAP4rev1 client covering what incremental sync needs:
+// LOGIN, SELECT, UID SEARCH and UID FETCH of whole messages.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// response is one untagged server line with any literals it carried.
+type response struct {
+	line     string
+	literals [][]byte
+}
+
+const ioTimeout = 2 * time.Minute
+
+// Dial connects and consumes the server greeting. Plain connections are only meant
+// for local test servers.
+func Dial(host string, port int, useTLS bool) (*Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", addr, err)
+	}
+
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no greeting from server: %w", err)
+	}
+	if !strings.HasPrefix(greeting.line, "* OK") && !strings.HasPrefix(greeting.line, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting: %s", greeting.line)
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) Login(username, password string) error {
+	_, err := c.execute("LOGIN " + quote(username) + " " + quote(password))
+	return err
+}
+
+// Select opens mailbox read-only and returns its UIDVALIDITY.
+func (c *Client) Select(mailbox string) (uint32, error) {
+	responses, err := c.execute("EXAMINE " + quote(mailbox))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range responses {
+		if i := strings.Index(resp.line, "[UIDVALIDITY "); i != -1 {
+			rest := resp.line[i+len("[UIDVALIDITY "):]
+			if end := strings.IndexByte(rest, ']'); end != -1 {
+				v, err := strconv.ParseUint(rest[:end], 10, 32)
+				if err == nil {
+					return uint32(v), nil
+				}
+			}
+		}
+	}
+	return 0, errors.New("server did not report UIDVALIDITY")
+}
+
+// UIDsAfter lists message UIDs strictly greater than uid, in ascending order.
+func (c *Client) UIDsAfter(uid uint32) ([]uint32, error) {
+	responses, err := c.execute(fmt.Sprintf("UID SEARCH UID %d:*", uid+1))
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range responses {
+		if !strings.HasPrefix(resp.line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(resp.line, "* SEARCH")) {
+			v, err := strconv.ParseUint(field, 10, 32)
+			// "n:*" always matches the last message, even when its UID is below n
+			if err == nil && uint32(v) > uid {
+				uids = append(uids, uint32(v))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// FetchMessage returns the full RFC 822 source of a message without setting \Seen.
+func (c *Client) FetchMessage(uid uint32) ([]byte, error) {
+	responses, err := c.execute(fmt.Sprintf("UID FETCH %d (BODY.PEEK[])", uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range responses {
+		if strings.Contains(resp.line, " FETCH ") && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("message %d not returned by server", uid)
+}
+
+func (c *Client) Logout() error {
+	_, err := c.execute("LOGOUT")
+	return err
+}
+
+// execute sends a tagged command and collects untagged responses until its completion.
+func (c *Client) execute(command string) ([]response, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%03d", c.tag)
+
+	c.conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, err
+	}
+
+	var responses []response
+	for {
+		resp, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp.line, tag+" ") {
+			status := strings.TrimPrefix(resp.line, tag+" ")
+			if strings.HasPrefix(status, "OK") {
+				return responses, nil
+			}
+			verb, _, _ := strings.Cut(command, " ")
+			return nil, fmt.Errorf("%s failed: %s", verb, status)
+		}
+		responses = append(responses, resp)
+	}
+}
+
+// readLine reads one logical response line, pulling in any {n} literals it announces.
+func (c *Client) readLine() (response, error) {
+	var resp response
+	var sb strings.Builder
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(ioTimeout))
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return resp, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		sb.WriteString(line)
+
+		size, ok := literalSize(line)
+		if !ok {
+			resp.line = sb.String()
+			return resp, nil
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return resp, err
+		}
+		resp.literals = append(resp.literals, literal)
+	}
+}
+
+func literalSize(line string) (int, bool) {
+	if !strings.HasSuffix(line, "}") {
+		return 0, false
+	}
+	open := strings.LastIndexByte(line, '{')
+	if open == -1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[open+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
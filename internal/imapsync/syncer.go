@@ -0,0 +1,183 @@
+package imapsync
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/mailin"
+	"sync"
+	"time"
+)
+
+// batchSize caps how many messages one pass imports per account, so a large first
+// sync makes steady progress instead of holding a connection open for hours.
+const batchSize = 200
+
+// Syncer polls every enabled IMAP account and logs new mail exchanged with known contacts.
+type Syncer struct {
+	DB       *sql.DB
+	Log      logger.Logger
+	Ingester *mailin.Ingester
+	Interval time.Duration
+
+	// running guards against two passes over the same account at once
+	running sync.Map
+}
+
+func NewSyncer(db *sql.DB, log logger.Logger, ingester *mailin.Ingester, interval time.Duration) *Syncer {
+	return &Syncer{
+		DB:       db,
+		Log:      log,
+		Ingester: ingester,
+		Interval: interval,
+	}
+}
+
+type account struct {
+	id          int
+	userID      int
+	host        string
+	port        int
+	username    string
+	password    string
+	mailbox     string
+	useTLS      bool
+	uidValidity uint32
+	lastUID     uint32
+}
+
+// Run blocks until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.SyncAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncAll runs one pass over every enabled account.
+func (s *Syncer) SyncAll() {
+	rows, err := s.DB.Query("SELECT id FROM imap_accounts WHERE enabled = 1")
+	if err != nil {
+		s.Log.Error("IMAPSync: cannot list accounts: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := s.SyncAccount(id); err != nil {
+			s.Log.Warn("IMAPSync: account %d: %v", id, err)
+		}
+	}
+}
+
+// SyncAccount imports new messages for one account and returns how many interactions were created.
+// The outcome is recorded on the account row either way.
+func (s *Syncer) SyncAccount(accountID int) (int, error) {
+	if _, busy := s.running.LoadOrStore(accountID, true); busy {
+		return 0, fmt.Errorf("sync already in progress")
+	}
+	defer s.running.Delete(accountID)
+
+	var acc account
+	err := s.DB.QueryRow(`
+	SELECT id, user_id, host, port, username, password, mailbox, use_tls, uid_validity, last_uid
+	FROM imap_accounts WHERE id = ?`, accountID,
+	).Scan(&acc.id, &acc.userID, &acc.host, &acc.port, &acc.username, &acc.password,
+		&acc.mailbox, &acc.useTLS, &acc.uidValidity, &acc.lastUID)
+	if err != nil {
+		return 0, fmt.Errorf("cannot load account: %w", err)
+	}
+
+	created, syncErr := s.sync(&acc)
+
+	var lastError *string
+	if syncErr != nil {
+		msg := syncErr.Error()
+		lastError = &msg
+	}
+	_, err = s.DB.Exec(`
+	UPDATE imap_accounts SET uid_validity = ?, last_uid = ?, last_error = ?, last_synced_at = ?
+	WHERE id = ?`,
+		acc.uidValidity, acc.lastUID, lastError, time.Now().Format(time.RFC3339), acc.id,
+	)
+	if err != nil {
+		s.Log.Error("IMAPSync: cannot save state for account %d: %v", acc.id, err)
+	}
+	return created, syncErr
+}
+
+// sync advances acc.uidValidity/lastUID as it goes so partial progress survives an error.
+func (s *Syncer) sync(acc *account) (int, error) {
+	client, err := Dial(acc.host, acc.port, acc.useTLS)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+
+	if err := client.Login(acc.username, acc.password); err != nil {
+		return 0, err
+	}
+	defer client.Logout()
+
+	validity, err := client.Select(acc.mailbox)
+	if err != nil {
+		return 0, err
+	}
+	if validity != acc.uidValidity {
+		// UIDs from a previous incarnation of the mailbox mean nothing now; start over.
+		// Already-logged messages are skipped by Message-ID so this does not duplicate.
+		if acc.uidValidity != 0 {
+			s.Log.Info("IMAPSync: UIDVALIDITY changed for account %d, resyncing", acc.id)
+		}
+		acc.uidValidity = validity
+		acc.lastUID = 0
+	}
+
+	uids, err := client.UIDsAfter(acc.lastUID)
+	if err != nil {
+		return 0, err
+	}
+	if len(uids) > batchSize {
+		uids = uids[:batchSize]
+	}
+
+	created := 0
+	for _, uid := range uids {
+		raw, err := client.FetchMessage(uid)
+		if err != nil {
+			return created, err
+		}
+		msg, err := mailin.Parse(bytes.NewReader(raw))
+		if err != nil {
+			// A single unparsable message must not wedge the account forever
+			s.Log.Warn("IMAPSync: skipping unparsable message %d in account %d: %v", uid, acc.id, err)
+			acc.lastUID = uid
+			continue
+		}
+		n, err := s.Ingester.IngestMessage(acc.userID, msg)
+		if err != nil {
+			return created, err
+		}
+		created += n
+		acc.lastUID = uid
+	}
+	if created > 0 {
+		s.Log.Info("IMAPSync: account %d logged %d interactions", acc.id, created)
+	}
+	return created, nil
+}
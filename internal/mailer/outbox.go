@@ -0,0 +1,212 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay = time.Minute
+	retryMaxDelay  = time.Hour
+)
+
+// Outbox delivers queued messages once they are due, retrying failures with exponential
+// backoff. A delivered message is logged as an interaction with its contact.
+type Outbox struct {
+	DB          *sql.DB
+	Log         logger.Logger
+	Sender      Sender
+	Interval    time.Duration
+	MaxAttempts int
+
+	wake chan struct{}
+	mu   sync.Mutex
+}
+
+func NewOutbox(db *sql.DB, log logger.Logger, sender Sender, interval time.Duration) *Outbox {
+	return &Outbox{
+		DB:          db,
+		Log:         log,
+		Sender:      sender,
+		Interval:    interval,
+		MaxAttempts: 5,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Run blocks until ctx is cancelled. Messages left in "sending" by a crash are re-queued first.
+func (o *Outbox) Run(ctx context.Context) {
+	if _, err := o.DB.Exec("UPDATE outbox SET status = ? WHERE status = ?", models.OutboxQueued, models.OutboxSending); err != nil {
+		o.Log.Error("Outbox: cannot recover interrupted messages: %v", err)
+	}
+
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+	for {
+		o.ProcessDue()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// Wake asks the worker to look at the queue now rather than at the next tick.
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+type outboxItem struct {
+	id        int
+	userID    int
+	contactID int
+	to        string
+	replyTo   string
+	subject   string
+	body      string
+	messageID string
+	attempts  int
+}
+
+// ProcessDue sends every queued message whose send time has passed.
+func (o *Outbox) ProcessDue() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	rows, err := o.DB.Query(`
+	SELECT o.id, o.user_id, o.contact_id, o.to_address, u.email, o.subject, o.body, o.message_id, o.attempts
+	FROM outbox o JOIN users u ON u.id = o.user_id
+	WHERE o.status = ? AND o.next_attempt_at <= ?
+	ORDER BY o.next_attempt_at`, models.OutboxQueued, now)
+	if err != nil {
+		o.Log.Error("Outbox: cannot query due messages: %v", err)
+		return
+	}
+	var due []outboxItem
+	for rows.Next() {
+		var item outboxItem
+		if err := rows.Scan(&item.id, &item.userID, &item.contactID, &item.to, &item.replyTo,
+			&item.subject, &item.body, &item.messageID, &item.attempts); err != nil {
+			o.Log.Error("Outbox: cannot scan message: %v", err)
+			continue
+		}
+		due = append(due, item)
+	}
+	rows.Close()
+
+	for _, item := range due {
+		o.deliver(item)
+	}
+}
+
+func (o *Outbox) deliver(item outboxItem) {
+	// Claim the row so a concurrent cancel cannot race with delivery
+	result, err := o.DB.Exec("UPDATE outbox SET status = ? WHERE id = ? AND status = ?", models.OutboxSending, item.id, models.OutboxQueued)
+	if err != nil {
+		o.Log.Error("Outbox: cannot claim message %d: %v", item.id, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	sendErr := o.Sender.Send(Email{
+		To:        item.to,
+		ReplyTo:   item.replyTo,
+		Subject:   item.subject,
+		Body:      item.body,
+		MessageID: item.messageID,
+	})
+	item.attempts++
+
+	if sendErr != nil {
+		status := models.OutboxQueued
+		if item.attempts >= o.MaxAttempts {
+			status = models.OutboxFailed
+		}
+		next := time.Now().UTC().Add(backoff(item.attempts)).Format(time.RFC3339)
+		_, err := o.DB.Exec(`
+		UPDATE outbox SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, status, item.attempts, sendErr.Error(), next, item.id)
+		if err != nil {
+			o.Log.Error("Outbox: cannot record failure for message %d: %v", item.id, err)
+		}
+		o.Log.Warn("Outbox: message %d attempt %d failed: %v", item.id, item.attempts, sendErr)
+		return
+	}
+
+	// Mark the message sent on its own first: a delivered message must never go
+	// back to the queue, even if logging the interaction fails below
+	sentAt := time.Now().UTC()
+	if _, err := o.DB.Exec(`
+	UPDATE outbox SET status = ?, attempts = ?, last_error = NULL, sent_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`, models.OutboxSent, item.attempts, sentAt.Format(time.RFC3339), item.id,
+	); err != nil {
+		o.Log.Error("Outbox: message %d sent but not marked sent: %v", item.id, err)
+		return
+	}
+
+	if err := o.recordSent(item, sentAt); err != nil {
+		o.Log.Error("Outbox: message %d sent but not logged as an interaction: %v", item.id, err)
+	}
+}
+
+// recordSent logs a delivered message as an email interaction. The Message-ID is
+// registered too so syncing the Sent folder later won't log it twice.
+func (o *Outbox) recordSent(item outboxItem, sentAt time.Time) error {
+	tx, err := o.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	INSERT INTO interactions (user_id, contact_id, type, subject, description, interaction_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		item.userID, item.contactID, models.InteractionTypeEmail, item.subject, item.body, sentAt.Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert interaction: %w", err)
+	}
+	interactionID, _ := result.LastInsertId()
+
+	if _, err := tx.Exec(
+		`INSERT OR IGNORE INTO email_messages (user_id, org_id, contact_id, message_id, interaction_id)
+		VALUES (?1, (SELECT org_id FROM users WHERE id = ?1), ?2, ?3, ?4)`,
+		item.userID, item.contactID, item.messageID, interactionID,
+	); err != nil {
+		return fmt.Errorf("cannot record message id: %w", err)
+	}
+
+	if _, err := tx.Exec("UPDATE outbox SET interaction_id = ? WHERE id = ?", interactionID, item.id); err != nil {
+		return fmt.Errorf("cannot link interaction: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := audit.Track(o.DB, 0, 0, "", events.ActionCreated, models.EntityInteraction, int(interactionID), nil); err != nil {
+		o.Log.Error("Outbox: cannot audit interaction %d: %v", interactionID, err)
+	}
+	return nil
+}
+
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay << (attempts - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
@@ -0,0 +1,102 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email is a single outgoing plain-text message.
+type Email struct {
+	To        string
+	ReplyTo   string
+	Subject   string
+	Body      string
+	MessageID string
+}
+
+// Sender delivers an Email. The outbox only depends on this so delivery can be swapped out.
+type Sender interface {
+	Send(e Email) error
+}
+
+// SMTPSender relays through a configured SMTP server, upgrading to TLS when offered.
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func NewSMTPSender(host string, port int, username, password, from string) *SMTPSender {
+	return &SMTPSender{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+func (s *SMTPSender) Send(e Email) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %w", err)
+	}
+	to, err := mail.ParseAddress(e.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	return smtp.SendMail(addr, auth, from.Address, []string{to.Address}, BuildMessage(s.From, e))
+}
+
+// BuildMessage renders e as an RFC 5322 message with a quoted-printable UTF-8 body.
+func BuildMessage(from string, e Email) []byte {
+	var buf bytes.Buffer
+	header := func(key, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	header("From", from)
+	header("To", e.To)
+	if e.ReplyTo != "" {
+		header("Reply-To", e.ReplyTo)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+e.MessageID+">")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(e.Body, "\r\n", "\n"), "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+// NewMessageID returns a globally unique Message-ID (without angle brackets) for domain.
+func NewMessageID(domain string) string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	if domain == "" {
+		domain = "micro-crm"
+	}
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
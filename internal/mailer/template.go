@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"micro-CRM/internal/models"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what email templates can reference, e.g. {{.Contact.FirstName}} or
+// {{.Company.Name}}. Every field is a plain string so missing values render as "".
+type TemplateData struct {
+	Contact ContactFields
+	Company CompanyFields
+	Sender  SenderFields
+}
+
+type ContactFields struct {
+	FirstName     string
+	LastName      string
+	FullName      string
+	Email         string
+	PhoneNumber   string
+	JobTitle      string
+	PipelineStage string
+}
+
+type CompanyFields struct {
+	Name          string
+	Website       string
+	Industry      string
+	Address       string
+	PhoneNumber   string
+	PipelineStage string
+}
+
+type SenderFields struct {
+	FirstName string
+	LastName  string
+	FullName  string
+	Email     string
+}
+
+// NewTemplateData flattens the records behind a message into template fields.
+// company may be nil for contacts without one.
+func NewTemplateData(contact models.Contact, company *models.Company, sender models.User) TemplateData {
+	var d TemplateData
+	d.Contact.FirstName = contact.FirstName
+	d.Contact.LastName = contact.LastName
+	d.Contact.FullName = strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+	d.Contact.Email = deref(contact.Email)
+	d.Contact.PhoneNumber = deref(contact.PhoneNumber)
+	d.Contact.JobTitle = deref(contact.JobTitle)
+	d.Contact.PipelineStage = deref(contact.PipelineStage)
+	if company != nil {
+		d.Company.Name = company.Name
+		d.Company.Website = deref(company.Website)
+		d.Company.Industry = deref(company.Industry)
+		d.Company.Address = deref(company.Address)
+		d.Company.PhoneNumber = deref(company.PhoneNumber)
+		d.Company.PipelineStage = company.PipelineStage
+	}
+	d.Sender.FirstName = sender.FirstName
+	d.Sender.LastName = sender.LastName
+	d.Sender.FullName = strings.TrimSpace(sender.FirstName + " " + sender.LastName)
+	d.Sender.Email = sender.Email
+	return d
+}
+
+// Render executes the subject and body templates against data.
+func Render(subject, body string, data TemplateData) (string, string, error) {
+	renderedSubject, err := execute("subject", subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	renderedBody, err := execute("body", body, data)
+	if err != nil {
+		return "", "", err
+	}
+	// A subject is a single header line
+	renderedSubject = strings.Join(strings.Fields(renderedSubject), " ")
+	return renderedSubject, renderedBody, nil
+}
+
+// Validate reports template syntax errors without needing any data.
+func Validate(subject, body string) error {
+	if _, err := template.New("subject").Option("missingkey=error").Parse(subject); err != nil {
+		return fmt.Errorf("subject: %w", err)
+	}
+	if _, err := template.New("body").Option("missingkey=error").Parse(body); err != nil {
+		return fmt.Errorf("body: %w", err)
+	}
+	return nil
+}
+
+func execute(name, text string, data TemplateData) (string, error) {
+	tpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
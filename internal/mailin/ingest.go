@@ -0,0 +1,237 @@
+package mailin
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Ingester turns parsed mail into interactions and file records.
+type Ingester struct {
+	DB        *sql.DB
+	Log       logger.Logger
+	UploadDir string
+}
+
+func NewIngester(db *sql.DB, log logger.Logger, uploadDir string) *Ingester {
+	return &Ingester{
+		DB:        db,
+		Log:       log,
+		UploadDir: uploadDir,
+	}
+}
+
+// Ingest parses a raw message and logs it for every user whose address appears on it.
+// It returns the number of interactions created.
+func (in *Ingester) Ingest(r io.Reader, envelope ...string) (int, error) {
+	msg, err := Parse(r, envelope...)
+	if err != nil {
+		return 0, err
+	}
+
+	owners, err := in.matchUsers(msg.Addresses())
+	if err != nil {
+		return 0, err
+	}
+	if len(owners) == 0 {
+		in.Log.Info("MailIngest: no user matched message %s", msg.MessageID)
+		return 0, nil
+	}
+
+	created := 0
+	for _, userID := range owners {
+		n, err := in.IngestMessage(userID, msg)
+		if err != nil {
+			return created, err
+		}
+		created += n
+	}
+	return created, nil
+}
+
+// IngestMessage logs msg against every contact of userID's organization that sent
+// or received it. Messages already recorded for a contact by anyone in the
+// organization are skipped, so re-delivery and copies to other members are harmless.
+func (in *Ingester) IngestMessage(userID int, msg *Message) (int, error) {
+	contacts, err := in.matchContacts(userID, msg.Addresses())
+	if err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, contactID := range contacts {
+		var exists bool
+		err := in.DB.QueryRow(
+			`SELECT EXISTS(SELECT 1 FROM email_messages
+			WHERE org_id = (SELECT org_id FROM users WHERE id = ?) AND contact_id = ? AND message_id = ?)`,
+			userID, contactID, msg.MessageID,
+		).Scan(&exists)
+		if err != nil {
+			return created, fmt.Errorf("cannot check for duplicate message: %w", err)
+		}
+		if exists {
+			continue
+		}
+		if err := in.createInteraction(userID, contactID, msg); err != nil {
+			return created, err
+		}
+		created++
+	}
+	return created, nil
+}
+
+func (in *Ingester) createInteraction(userID, contactID int, msg *Message) error {
+	tx, err := in.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	subject := msg.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	var description *string
+	if msg.Body != "" {
+		description = &msg.Body
+	}
+
+	result, err := tx.Exec(`
+	INSERT INTO interactions (user_id, contact_id, type, subject, description, interaction_at)
+	VALUES (?, ?, ?, ?, ?, ?)`,
+		userID, contactID, models.InteractionTypeEmail, subject, description, msg.Date.UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot insert interaction: %w", err)
+	}
+	interactionID, _ := result.LastInsertId()
+
+	if _, err := tx.Exec(
+		`INSERT INTO email_messages (user_id, org_id, contact_id, message_id, interaction_id)
+		VALUES (?1, (SELECT org_id FROM users WHERE id = ?1), ?2, ?3, ?4)`,
+		userID, contactID, msg.MessageID, interactionID,
+	); err != nil {
+		return fmt.Errorf("cannot record message: %w", err)
+	}
+
+	var (
+		written []string
+		fileIDs []int
+	)
+	for _, att := range msg.Attachments {
+		path, err := in.storeAttachment(att)
+		if err != nil {
+			removeAll(written)
+			return err
+		}
+		written = append(written, path)
+		res, err := tx.Exec(`
+		INSERT INTO files (user_id, contact_id, interaction_id, file_name, storage_path, file_type, file_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			userID, contactID, interactionID, filepath.Base(att.FileName), path, att.ContentType, len(att.Data),
+		)
+		if err != nil {
+			removeAll(written)
+			return fmt.Errorf("cannot insert attachment record: %w", err)
+		}
+		fileID, _ := res.LastInsertId()
+		fileIDs = append(fileIDs, int(fileID))
+	}
+
+	if err := tx.Commit(); err != nil {
+		removeAll(written)
+		return fmt.Errorf("cannot commit interaction: %w", err)
+	}
+	in.audit(models.EntityInteraction, int(interactionID))
+	for _, fileID := range fileIDs {
+		in.audit(models.EntityFile, fileID)
+	}
+	in.Log.Info("MailIngest: logged message %s for contact %d (%d attachments)", msg.MessageID, contactID, len(msg.Attachments))
+	return nil
+}
+
+// audit records a record created from mail, with no actor. The record is already
+// saved, so a failure is logged.
+func (in *Ingester) audit(entityType string, id int) {
+	if err := audit.Track(in.DB, 0, 0, "", events.ActionCreated, entityType, id, nil); err != nil {
+		in.Log.Error("MailIngest: cannot audit %s %d: %v", entityType, id, err)
+	}
+}
+
+// storeAttachment writes the attachment next to regular uploads using the same naming scheme.
+func (in *Ingester) storeAttachment(att Attachment) (string, error) {
+	if err := os.MkdirAll(in.UploadDir, 0755); err != nil {
+		return "", fmt.Errorf("cannot create upload directory: %w", err)
+	}
+	base := utils.SanitizeFilename(filepath.Base(att.FileName))
+	ext := filepath.Ext(base)
+	name := base[:len(base)-len(ext)]
+	storagePath := filepath.Join(in.UploadDir, fmt.Sprintf("%s-%d%s", name, time.Now().UnixNano(), ext))
+
+	if err := os.WriteFile(storagePath, att.Data, 0644); err != nil {
+		return "", fmt.Errorf("cannot write attachment: %w", err)
+	}
+	return storagePath, nil
+}
+
+func (in *Ingester) matchUsers(addresses []string) ([]int, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf("SELECT id FROM users WHERE LOWER(email) IN (%s) AND status = 'active'", placeholders(len(addresses)))
+	return in.queryIDs(query, stringArgs(addresses)...)
+}
+
+func (in *Ingester) matchContacts(userID int, addresses []string) ([]int, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	query := fmt.Sprintf("SELECT id FROM contacts WHERE org_id = (SELECT org_id FROM users WHERE id = ?) AND deleted_at IS NULL AND LOWER(email) IN (%s)", placeholders(len(addresses)))
+	args := append([]interface{}{userID}, stringArgs(addresses)...)
+	return in.queryIDs(query, args...)
+}
+
+func (in *Ingester) queryIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := in.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot match addresses: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+func removeAll(paths []string) {
+	for _, p := range paths {
+		_ = os.Remove(p)
+	}
+}
@@ -0,0 +1,87 @@
+package mailin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaildirWatcher polls the new/ folder of a Maildir, ingests every message it finds
+// and moves it to cur/ so it is processed only once.
+type MaildirWatcher struct {
+	Dir      string
+	Interval time.Duration
+	Ingester *Ingester
+}
+
+func NewMaildirWatcher(dir string, interval time.Duration, ingester *Ingester) *MaildirWatcher {
+	return &MaildirWatcher{
+		Dir:      dir,
+		Interval: interval,
+		Ingester: ingester,
+	}
+}
+
+// Run blocks until ctx is cancelled.
+func (m *MaildirWatcher) Run(ctx context.Context) error {
+	for _, sub := range []string{"new", "cur", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(m.Dir, sub), 0700); err != nil {
+			return fmt.Errorf("cannot prepare maildir: %w", err)
+		}
+	}
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+	for {
+		m.Poll()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll processes everything currently waiting in new/.
+func (m *MaildirWatcher) Poll() {
+	entries, err := os.ReadDir(filepath.Join(m.Dir, "new"))
+	if err != nil {
+		m.Ingester.Log.Error("MailIngest: cannot read maildir: %v", err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		m.deliver(entry.Name())
+	}
+}
+
+func (m *MaildirWatcher) deliver(name string) {
+	src := filepath.Join(m.Dir, "new", name)
+	f, err := os.Open(src)
+	if err != nil {
+		m.Ingester.Log.Error("MailIngest: cannot open %s: %v", src, err)
+		return
+	}
+	_, ingestErr := m.Ingester.Ingest(f)
+	f.Close()
+
+	// Seen messages are flagged S, failed ones F so they can be found and replayed by hand
+	flag := "S"
+	if ingestErr != nil {
+		m.Ingester.Log.Error("MailIngest: cannot ingest %s: %v", name, ingestErr)
+		flag = "F"
+	}
+	base := strings.SplitN(name, ":", 2)[0]
+	dst := filepath.Join(m.Dir, "cur", base+":2,"+flag)
+	if err := os.Rename(src, dst); err != nil {
+		m.Ingester.Log.Error("MailIngest: cannot move %s to cur: %v", name, err)
+	}
+}
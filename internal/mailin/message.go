@@ -0,0 +1,260 @@
+package mailin
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Attachment is a decoded MIME part that carries a file.
+type Attachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// Message is the subset of an RFC 5322 message the CRM cares about.
+type Message struct {
+	MessageID   string
+	Subject     string
+	From        []string
+	Recipients  []string // To, Cc, Bcc and any envelope recipients, lower-cased
+	Date        time.Time
+	Body        string
+	Attachments []Attachment
+}
+
+// Addresses returns every address on the message, sender first.
+func (m *Message) Addresses() []string {
+	return append(append([]string{}, m.From...), m.Recipients...)
+}
+
+var (
+	wordDecoder = &mime.WordDecoder{
+		// Unknown charsets are passed through untouched rather than failing the whole message
+		CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		},
+	}
+	htmlTagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// Parse reads a raw RFC 5322 message. envelope holds any extra recipients known only
+// to the transport (SMTP RCPT TO, Delivered-To), which is how BCC'd copies are matched.
+func Parse(r io.Reader, envelope ...string) (*Message, error) {
+	raw, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+
+	msg := &Message{
+		MessageID: strings.Trim(strings.TrimSpace(raw.Header.Get("Message-Id")), "<>"),
+		Subject:   decodeHeader(raw.Header.Get("Subject")),
+	}
+	if date, err := raw.Header.Date(); err == nil {
+		msg.Date = date
+	} else {
+		msg.Date = time.Now()
+	}
+
+	msg.From = headerAddresses(raw.Header, "From")
+	seen := make(map[string]bool)
+	for _, key := range []string{"To", "Cc", "Bcc", "Delivered-To", "X-Original-To"} {
+		for _, addr := range headerAddresses(raw.Header, key) {
+			if !seen[addr] {
+				seen[addr] = true
+				msg.Recipients = append(msg.Recipients, addr)
+			}
+		}
+	}
+	for _, addr := range envelope {
+		addr = normalizeAddress(addr)
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			msg.Recipients = append(msg.Recipients, addr)
+		}
+	}
+
+	var text, html string
+	if err := walkPart(raw.Header, raw.Body, msg, &text, &html); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.TrimSpace(text) != "":
+		msg.Body = strings.TrimSpace(text)
+	case html != "":
+		msg.Body = stripHTML(html)
+	}
+
+	if msg.MessageID == "" {
+		// Without an ID there is nothing to de-duplicate on, so derive a stable one
+		msg.MessageID = fallbackID(raw.Header, msg)
+	}
+	return msg, nil
+}
+
+// fallbackID hashes what stays the same when a message is delivered again: its
+// headers as sent and its content. Envelope recipients and the parse time are
+// left out as they change between deliveries.
+func fallbackID(h mail.Header, msg *Message) string {
+	sum := sha256.New()
+	for _, key := range []string{"From", "To", "Cc", "Subject", "Date"} {
+		fmt.Fprintf(sum, "%s:%s\n", key, h.Get(key))
+	}
+	fmt.Fprintf(sum, "%d:%s", len(msg.Body), msg.Body)
+	for _, att := range msg.Attachments {
+		fmt.Fprintf(sum, "%d:%s%d:", len(att.FileName), att.FileName, len(att.Data))
+		sum.Write(att.Data)
+	}
+	return fmt.Sprintf("%x@micro-crm", sum.Sum(nil)[:16])
+}
+
+// header is the minimal view of MIME headers shared by mail.Header and multipart.Part.
+type header interface {
+	Get(key string) string
+}
+
+// walkPart collects the first text/plain and text/html bodies and every attachment,
+// descending into nested multipart containers.
+func walkPart(h header, body io.Reader, msg *Message, text, html *string) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("invalid multipart body: %w", err)
+			}
+			if err := walkPart(part.Header, part, msg, text, html); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransfer(h.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("cannot decode message part: %w", err)
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	fileName := decodeHeader(dispParams["filename"])
+	if fileName == "" {
+		fileName = decodeHeader(params["name"])
+	}
+
+	switch {
+	case disposition == "attachment" || fileName != "":
+		if fileName == "" {
+			fileName = "attachment"
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{
+			FileName:    fileName,
+			ContentType: mediaType,
+			Data:        data,
+		})
+	case mediaType == "text/plain" && *text == "":
+		*text = string(data)
+	case mediaType == "text/html" && *html == "":
+		*html = string(data)
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// newlineStripper drops CR/LF so base64 bodies wrapped at 76 columns decode cleanly.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		count, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:count] {
+			if b != '\r' && b != '\n' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+func headerAddresses(h mail.Header, key string) []string {
+	value := h.Get(key)
+	if value == "" {
+		return nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		// Fall back to a plain split so one malformed display name doesn't hide the rest
+		var out []string
+		for _, piece := range strings.Split(value, ",") {
+			if addr := normalizeAddress(piece); addr != "" {
+				out = append(out, addr)
+			}
+		}
+		return out
+	}
+	out := make([]string, 0, len(list))
+	for _, a := range list {
+		out = append(out, strings.ToLower(a.Address))
+	}
+	return out
+}
+
+func normalizeAddress(s string) string {
+	s = strings.TrimSpace(s)
+	if a, err := mail.ParseAddress(s); err == nil {
+		return strings.ToLower(a.Address)
+	}
+	s = strings.Trim(s, "<>")
+	if !strings.Contains(s, "@") {
+		return ""
+	}
+	return strings.ToLower(s)
+}
+
+func decodeHeader(s string) string {
+	decoded, err := wordDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+func stripHTML(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n\n", "</div>", "\n").Replace(s)
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&#39;", "'").Replace(s)
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(s, "\n\n"))
+}
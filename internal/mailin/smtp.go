@@ -0,0 +1,172 @@
+package mailin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const defaultMaxMessageSize = 25 << 20
+
+// SMTPServer is a minimal receive-only SMTP listener meant to sit behind a real MTA
+// or be pointed at directly as a BCC/forwarding target. It does no relaying and no
+// auth, so anyone who can connect can log mail against contacts: an address
+// without a host such as ":2525" listens on loopback only, and exposing it more
+// widely takes an explicit host such as "0.0.0.0:2525".
+type SMTPServer struct {
+	Addr     string
+	Hostname string
+	MaxSize  int64
+	Ingester *Ingester
+}
+
+func NewSMTPServer(addr string, ingester *Ingester) *SMTPServer {
+	return &SMTPServer{
+		Addr:     listenAddr(addr),
+		Hostname: "micro-crm",
+		MaxSize:  defaultMaxMessageSize,
+		Ingester: ingester,
+	}
+}
+
+// listenAddr binds addresses without a host to loopback.
+func listenAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// ListenAndServe accepts connections until ctx is cancelled.
+func (s *SMTPServer) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", s.Addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	s.Ingester.Log.Info("MailIngest: SMTP listener on %s", s.Addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+type smtpSession struct {
+	from       string
+	recipients []string
+}
+
+func (s *SMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+
+	reply := func(code int, msg string) bool {
+		conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	if !reply(220, s.Hostname+" ESMTP micro-CRM ready") {
+		return
+	}
+	var session smtpSession
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reply(250, s.Hostname)
+		case "EHLO":
+			conn.SetWriteDeadline(time.Now().Add(time.Minute))
+			tp.PrintfLine("250-%s", s.Hostname)
+			tp.PrintfLine("250-SIZE %d", s.MaxSize)
+			tp.PrintfLine("250 8BITMIME")
+		case "MAIL":
+			session = smtpSession{from: pathArgument(arg, "FROM:")}
+			reply(250, "OK")
+		case "RCPT":
+			to := pathArgument(arg, "TO:")
+			if to == "" {
+				reply(501, "Syntax: RCPT TO:<address>")
+				continue
+			}
+			session.recipients = append(session.recipients, to)
+			reply(250, "OK")
+		case "DATA":
+			if len(session.recipients) == 0 {
+				reply(503, "RCPT first")
+				continue
+			}
+			if !reply(354, "End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(tp.DotReader(), s.MaxSize+1))
+			if err != nil {
+				return
+			}
+			if int64(len(data)) > s.MaxSize {
+				reply(552, "Message exceeds fixed maximum message size")
+				session = smtpSession{}
+				continue
+			}
+			if _, err := s.Ingester.Ingest(bytes.NewReader(data), session.recipients...); err != nil {
+				s.Ingester.Log.Error("MailIngest: SMTP message from %s rejected: %v", session.from, err)
+				reply(554, "Transaction failed")
+			} else {
+				reply(250, "OK: queued")
+			}
+			session = smtpSession{}
+		case "RSET":
+			session = smtpSession{}
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "VRFY":
+			reply(252, "Cannot VRFY user")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// pathArgument extracts the address from "FROM:<a@b> SIZE=123" style arguments.
+func pathArgument(arg, prefix string) string {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return ""
+	}
+	path := strings.TrimSpace(arg[len(prefix):])
+	if end := strings.Index(path, ">"); end != -1 {
+		path = path[:end+1]
+	} else if sp := strings.IndexByte(path, ' '); sp != -1 {
+		path = path[:sp]
+	}
+	return normalizeAddress(path)
+}
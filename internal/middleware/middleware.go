@@ -2,9 +2,16 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
 	"micro-CRM/internal/models"
+	"micro-CRM/internal/orgs"
 	"micro-CRM/internal/utils"
 	"net/http"
+	"regexp"
 	"strings"
 )
 
@@ -33,3 +40,59 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// OrgMiddleware stores the authenticated user's organization in the request
+// context. It runs after AuthMiddleware, turns away deactivated users, whose
+// tokens may outlive their account, and gives users who have no organization
+// yet a personal one.
+func OrgMiddleware(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := r.Context().Value(models.UserIDContextKey).(int)
+			if !ok {
+				utils.RespondError(w, http.StatusUnauthorized, "User not authenticated")
+				return
+			}
+			var status sql.NullString
+			if err := db.QueryRow("SELECT status FROM users WHERE id = ?", userID).Scan(&status); err != nil {
+				if !errors.Is(err, sql.ErrNoRows) {
+					log.Printf("Error loading user status: %v", err)
+				}
+				utils.RespondError(w, http.StatusUnauthorized, "User not found")
+				return
+			}
+			if status.String == models.UserStatusInactive {
+				utils.RespondError(w, http.StatusForbidden, "User is inactive")
+				return
+			}
+			orgID, err := orgs.Ensure(db, userID)
+			if err != nil {
+				log.Printf("Error loading organization: %v", err)
+				utils.RespondError(w, http.StatusUnauthorized, "User not found")
+				return
+			}
+			ctx := context.WithValue(r.Context(), models.OrgIDContextKey, orgID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestIDPattern limits client-supplied request IDs to something safe to log.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID tags each request with an ID, taken from a well-formed X-Request-ID
+// header or generated, stores it in the request context and echoes it in the
+// response so clients can correlate logs and audit events.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), models.RequestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
 )
 
 // User represents a user in the system.
@@ -19,6 +20,12 @@ type User struct {
 	UpdatedAt    string `json:"updated_at,omitempty"`
 }
 
+// User statuses; inactive users cannot sign in and keep their records.
+const (
+	UserStatusActive   = "active"
+	UserStatusInactive = "inactive"
+)
+
 // GetUserPayload payload for GetUserinfo handler
 type GetUserPayload struct {
 	ID int `json:"id"`
@@ -91,6 +98,9 @@ type Company struct {
 	CreatedAt     string  `json:"created_at" db:"created_at"`
 	UpdatedAt     string  `json:"updated_at" db:"updated_at"`
 	PipelineStage string  `json:"pipeline_stage" db:"pipeline_stage"`
+	Tags          []Tag   `json:"tags,omitempty" db:"-"` // Managed through the tag endpoints
+	// CustomFields holds values by field key; on updates, fields left out keep theirs and null clears one
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty" db:"-"`
 }
 
 // Contact represents a contact person.
@@ -110,6 +120,31 @@ type Contact struct {
 	NextActionAt          *string `json:"next_action_at,omitempty"`
 	NextActionDescription *string `json:"next_action_description,omitempty"`
 	PipelineStage         *string `json:"pipeline_stage,omitempty"`
+	Tags                  []Tag   `json:"tags,omitempty"` // Managed through the tag endpoints
+	// CustomFields holds values by field key; on updates, fields left out keep theirs and null clears one
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}
+
+// Reasons two contacts are reported as duplicates
+const (
+	DuplicateEmail = "email"        // Same email address
+	DuplicatePhone = "phone"        // Same phone number once normalized
+	DuplicateName  = "name_company" // Similar names at the same company
+)
+
+// ContactDuplicate is a pair of contacts that look like the same person.
+type ContactDuplicate struct {
+	Contacts       []Contact `json:"contacts"` // Lowest id first
+	Reasons        []string  `json:"reasons"`
+	NameSimilarity float64   `json:"name_similarity"` // 0 to 1
+}
+
+// ContactMergePayload merges duplicates into the contact of the request path.
+type ContactMergePayload struct {
+	DuplicateIDs []int `json:"duplicate_ids"`
+	// Fields picks the contact whose value is kept, by field name. Other fields
+	// keep the surviving contact's value, or the first duplicate's that has one.
+	Fields map[string]int `json:"fields,omitempty"`
 }
 
 // Interaction represents a recorded interaction with a contact.
@@ -126,8 +161,15 @@ type Interaction struct {
 	InteractionAt *string `json:"interaction_at"`           // Default: CURRENT_TIMESTAMP
 	FollowUpDate  *string `json:"follow_up_date,omitempty"` // Optional
 	CreatedAt     string  `json:"created_at"`               // Default: CURRENT_TIMESTAMP
+	Tags          []Tag   `json:"tags,omitempty"`           // Managed through the tag endpoints
 }
 
+// Interaction types produced by the server itself; user-entered types are free text.
+const (
+	InteractionTypeEmail   = "Email"
+	InteractionTypeMeeting = "Meeting"
+)
+
 // RecentInteraction Dashboard recent interactions
 type RecentInteraction struct {
 	ContactID     int     `json:"contact_id"`
@@ -160,6 +202,439 @@ type Task struct {
 	Priority    string  `json:"priority"`
 	CreatedAt   string  `json:"created_at"`
 	UpdatedAt   string  `json:"updated_at"`
+	Recurrence  *string `json:"recurrence,omitempty"` // RRULE such as "FREQ=WEEKLY;COUNT=10"; requires due_date
+	SeriesID    *int    `json:"series_id,omitempty"`
+	Occurrence  *int    `json:"occurrence,omitempty"`   // 1-based position in the series
+	NextTaskID  *int    `json:"next_task_id,omitempty"` // Set when completing this task created the next occurrence
+	ParentID    *int    `json:"parent_id,omitempty"`
+	// AssigneeID is who works on the task; unset means the creator (user_id). It is
+	// set on create or through the assign endpoint, never by an update
+	AssigneeID *int    `json:"assignee_id,omitempty"`
+	AssignedBy *int    `json:"assigned_by,omitempty"`
+	AssignedAt *string `json:"assigned_at,omitempty"`
+	// BlockedBy and Checklist replace the stored ones when present in a payload and are kept when omitted
+	BlockedBy  []int               `json:"blocked_by"`
+	Checklist  []TaskChecklistItem `json:"checklist"`
+	Progress   *TaskProgress       `json:"progress,omitempty"` // Only for tasks with subtasks or checklist items
+	Actionable bool                `json:"actionable"`         // Open, not waiting on open blockers or subtasks
+	Tags       []Tag               `json:"tags,omitempty"`     // Managed through the tag endpoints
+	// CustomFields holds values by field key; on updates, fields left out keep theirs and null clears one
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}
+
+// TaskAssignment is the payload for assigning a task; a null assignee_id unassigns it.
+type TaskAssignment struct {
+	AssigneeID *int `json:"assignee_id"`
+}
+
+// TaskChecklistItem is one line of a task's checklist.
+type TaskChecklistItem struct {
+	ID   int    `json:"id"`
+	Text string `json:"text"`
+	Done bool   `json:"done"`
+}
+
+// TaskProgress rolls a task's completion up from its direct subtasks and checklist items.
+type TaskProgress struct {
+	SubtasksDone   int `json:"subtasks_done"`
+	SubtasksTotal  int `json:"subtasks_total"`
+	ChecklistDone  int `json:"checklist_done"`
+	ChecklistTotal int `json:"checklist_total"`
+	Percent        int `json:"percent"`
+}
+
+// Task statuses the server acts on; other statuses are free text.
+const (
+	TaskStatusToDo = "To Do"
+	TaskStatusDone = "Done"
+)
+
+// Scopes for editing a task that belongs to a recurring series.
+const (
+	TaskScopeThis   = "this"   // Only this occurrence
+	TaskScopeFuture = "future" // This occurrence and all future ones
+)
+
+// Deal represents a sales opportunity owned by UserID.
+type Deal struct {
+	ID                int     `json:"id"`
+	UserID            int     `json:"user_id"`
+	CompanyID         *int    `json:"company_id,omitempty"`
+	ContactIDs        []int   `json:"contact_ids"`
+	PipelineID        *int    `json:"pipeline_id"` // Omitted means the owner's default pipeline
+	Title             string  `json:"title"`
+	Amount            float64 `json:"amount"`
+	Currency          string  `json:"currency"`
+	Stage             string  `json:"stage"`
+	Probability       *int    `json:"probability"` // Percentage; omitted means the stage default
+	ExpectedCloseDate *string `json:"expected_close_date,omitempty"`
+	Notes             *string `json:"notes,omitempty"`
+	CreatedAt         string  `json:"created_at"`
+	UpdatedAt         string  `json:"updated_at"`
+	// CustomFields holds values by field key; on updates, fields left out keep theirs and null clears one
+	CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
+}
+
+// Pipeline is a named, ordered set of stages. Companies and contacts use the
+// owner's default pipeline; each deal belongs to one pipeline.
+type Pipeline struct {
+	ID        int     `json:"id"`
+	UserID    int     `json:"user_id"`
+	OrgID     int     `json:"org_id"`
+	Name      string  `json:"name"`
+	IsDefault bool    `json:"is_default"`
+	Stages    []Stage `json:"stages"`
+	CreatedAt string  `json:"created_at"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+// Stage is one step of a pipeline.
+type Stage struct {
+	ID          int    `json:"id"`
+	PipelineID  int    `json:"pipeline_id"`
+	Name        string `json:"name"`
+	Position    int    `json:"position"`
+	Color       string `json:"color"`
+	Probability int    `json:"probability"` // Default win probability for deals entering the stage
+	Outcome     string `json:"outcome"`     // StageOpen, StageWon or StageLost
+}
+
+// Stage outcomes; won and lost stages close a deal
+const (
+	StageOpen = "open"
+	StageWon  = "won"
+	StageLost = "lost"
+)
+
+// StageTransition is one entry of a record's pipeline stage history.
+type StageTransition struct {
+	ID              int     `json:"id"`
+	EntityType      string  `json:"entity_type"`
+	EntityID        int     `json:"entity_id"`
+	PipelineID      *int    `json:"pipeline_id,omitempty"`
+	FromStage       *string `json:"from_stage"` // nil for the record's first stage
+	ToStage         string  `json:"to_stage"`
+	ChangedBy       int     `json:"changed_by"`
+	ChangedAt       string  `json:"changed_at"`
+	DurationSeconds int64   `json:"duration_seconds"` // Time spent in ToStage, up to now for the current stage
+}
+
+// Entity types for records that are tracked across tables
+const (
+	EntityCompany     = "company"
+	EntityContact     = "contact"
+	EntityDeal        = "deal"
+	EntityTask        = "task"
+	EntityInteraction = "interaction"
+	EntityFile        = "file"
+	EntityUser        = "user"
+)
+
+// Organization is a team whose members share companies, contacts, deals, tasks,
+// interactions, files and pipelines. Every user belongs to exactly one.
+type Organization struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role,omitempty"` // The requesting user's role
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// OrganizationMember is a user as listed in their organization.
+type OrganizationMember struct {
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
+	Role      string `json:"role"`
+	Status    string `json:"status"`
+}
+
+// OrganizationInvitation invites whoever owns an email address to join an
+// organization. The token is only shown to the inviter on creation and to the
+// invitee.
+type OrganizationInvitation struct {
+	ID               int     `json:"id"`
+	OrgID            int     `json:"org_id"`
+	OrganizationName string  `json:"organization_name,omitempty"`
+	Email            string  `json:"email"`
+	Role             string  `json:"role"`
+	Token            string  `json:"token,omitempty"`
+	InvitedBy        *int    `json:"invited_by,omitempty"`
+	CreatedAt        string  `json:"created_at"`
+	ExpiresAt        string  `json:"expires_at"`
+	AcceptedAt       *string `json:"accepted_at,omitempty"`
+}
+
+// Organization roles. Admins manage members and invitations; only owners can
+// grant or take away the owner role, and an organization always keeps one.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+// RecordShare grants a user, or every member of another organization (team),
+// access to one record outside their own organization.
+type RecordShare struct {
+	ID         int    `json:"id"`
+	EntityType string `json:"entity_type"`
+	EntityID   int    `json:"entity_id"`
+	UserID     *int   `json:"user_id,omitempty"` // Grantee user, or
+	OrgID      *int   `json:"org_id,omitempty"`  // grantee organization
+	Permission string `json:"permission"`
+	GrantedBy  *int   `json:"granted_by,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// Share permissions. Write lets the grantee edit the record but not delete or
+// re-share it.
+const (
+	SharePermissionRead  = "read"
+	SharePermissionWrite = "write"
+)
+
+// OwnershipTransfer hands every record a member created in the organization to
+// another member; the response counts the records moved per table.
+type OwnershipTransfer struct {
+	ToUserID    int              `json:"to_user_id"`
+	Transferred map[string]int64 `json:"transferred,omitempty"`
+}
+
+// Notification is an entry in a user's in-app inbox.
+type Notification struct {
+	ID         int     `json:"id"`
+	UserID     int     `json:"user_id"`
+	Type       string  `json:"type"`
+	Title      string  `json:"title"`
+	Body       *string `json:"body,omitempty"`
+	EntityType *string `json:"entity_type,omitempty"`
+	EntityID   *int    `json:"entity_id,omitempty"`
+	ActorID    *int    `json:"actor_id,omitempty"` // User whose action caused it; nil for system events
+	ReadAt     *string `json:"read_at"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// Notification types; users can turn each one off in their preferences.
+const (
+	NotificationTaskAssigned = "task_assigned"
+	NotificationReminder     = "reminder"
+	NotificationMention      = "mention"
+	NotificationFileShared   = "file_shared"
+	NotificationRecordShared = "record_shared"
+)
+
+// NotificationTypes lists every notification type.
+var NotificationTypes = []string{NotificationTaskAssigned, NotificationReminder, NotificationMention, NotificationFileShared, NotificationRecordShared}
+
+// AuditEvent records one change to a record: who made it, in which request, and
+// the fields it changed. Hash covers the event and PrevHash, the hash of the
+// organization's previous event, so altering or removing an event is detectable.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	OrgID      int             `json:"org_id"`
+	ActorID    *int            `json:"actor_id"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   int             `json:"entity_id"`
+	RequestID  *string         `json:"request_id,omitempty"`
+	Changes    json.RawMessage `json:"changes"` // field -> AuditChange
+	CreatedAt  string          `json:"created_at"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// AuditChange is a field's value before and after a change; Before is null for
+// created records and After for deleted ones.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditVerification reports whether an organization's audit chain is intact.
+type AuditVerification struct {
+	Valid    bool `json:"valid"`
+	Checked  int  `json:"checked"`
+	BrokenAt *int `json:"broken_at,omitempty"` // First event whose hash or link does not match
+}
+
+// TrashedRecord is a deleted record that can be restored until it is purged.
+type TrashedRecord struct {
+	EntityType string `json:"entity_type"`
+	EntityID   int    `json:"entity_id"`
+	Label      string `json:"label"`
+	UserID     int    `json:"user_id"`
+	DeletedAt  string `json:"deleted_at"`
+	PurgeAt    string `json:"purge_at"`
+}
+
+// TrashRestore reports a restored record and the records restored along with it.
+type TrashRestore struct {
+	EntityType string `json:"entity_type"`
+	EntityID   int    `json:"entity_id"`
+	Restored   int    `json:"restored"`
+}
+
+// Tag is a label from the organization's catalogue that can be put on companies,
+// contacts, tasks, interactions and files.
+type Tag struct {
+	ID        int    `json:"id"`
+	OrgID     int    `json:"org_id"`
+	Name      string `json:"name"`
+	Color     string `json:"color"` // #RRGGBB
+	CreatedBy *int   `json:"created_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	Records   *int   `json:"records,omitempty"` // Tagged records, in the catalogue listing
+}
+
+// Custom field types
+const (
+	CustomFieldText        = "text"
+	CustomFieldNumber      = "number"
+	CustomFieldDate        = "date" // YYYY-MM-DD
+	CustomFieldSelect      = "select"
+	CustomFieldMultiSelect = "multi_select"
+	CustomFieldBoolean     = "boolean"
+)
+
+// CustomField is a field an organization adds to its contacts, companies, tasks
+// or deals. Records carry its value under Key in their custom_fields.
+type CustomField struct {
+	ID         int      `json:"id"`
+	OrgID      int      `json:"org_id"`
+	EntityType string   `json:"entity_type"`
+	Key        string   `json:"key"` // Fixed once created
+	Label      string   `json:"label"`
+	Type       string   `json:"type"`              // Fixed once created
+	Options    []string `json:"options,omitempty"` // Choices of select and multi_select fields
+	Required   bool     `json:"required"`          // Enforced when records are created or the value is cleared
+	Position   int      `json:"position"`
+	CreatedAt  string   `json:"created_at"`
+	UpdatedAt  string   `json:"updated_at"`
+}
+
+// Contact relationship types; a relationship reads "contact <type> related".
+const (
+	RelationshipReportsTo       = "reports_to"
+	RelationshipAssistantOf     = "assistant_of"
+	RelationshipReferredBy      = "referred_by"
+	RelationshipFormerColleague = "former_colleague" // Goes both ways
+)
+
+// ContactBrief names a contact in listings of other records.
+type ContactBrief struct {
+	ID        int     `json:"id"`
+	FirstName string  `json:"first_name"`
+	LastName  string  `json:"last_name"`
+	JobTitle  *string `json:"job_title,omitempty"`
+	CompanyID *int    `json:"company_id,omitempty"`
+}
+
+// ContactRelationship links two contacts of an organization.
+type ContactRelationship struct {
+	ID        int     `json:"id"`
+	ContactID int     `json:"contact_id"`
+	RelatedID int     `json:"related_id"`
+	Type      string  `json:"type"`
+	Notes     *string `json:"notes,omitempty"`
+	CreatedBy *int    `json:"created_by,omitempty"`
+	CreatedAt string  `json:"created_at"`
+	// Other is the contact at the other end, in a contact's listing
+	Other *ContactBrief `json:"other,omitempty"`
+}
+
+// ContactAffiliation is a position a contact holds or held at a company.
+type ContactAffiliation struct {
+	ID          int           `json:"id"`
+	ContactID   int           `json:"contact_id"`
+	CompanyID   int           `json:"company_id"`
+	Title       *string       `json:"title,omitempty"`
+	StartDate   *string       `json:"start_date,omitempty"` // YYYY-MM-DD
+	EndDate     *string       `json:"end_date,omitempty"`   // YYYY-MM-DD; omitted while current
+	CreatedAt   string        `json:"created_at"`
+	UpdatedAt   string        `json:"updated_at"`
+	CompanyName string        `json:"company_name,omitempty"` // In a contact's listing
+	Contact     *ContactBrief `json:"contact,omitempty"`      // In a company's listing
+}
+
+// OrgChartNode is a contact in a company's org chart with the people reporting
+// to them.
+type OrgChartNode struct {
+	ContactBrief
+	Assistants []ContactBrief  `json:"assistants,omitempty"`
+	Reports    []*OrgChartNode `json:"reports"`
+}
+
+// Kinds of timeline items
+const (
+	TimelineInteraction = "interaction"
+	TimelineTask        = "task"
+	TimelineFile        = "file"
+	TimelineStageChange = "stage_change"
+	TimelineNote        = "note"
+)
+
+// TimelineItem is one entry of the merged activity stream of a contact or
+// company. Only the fields of its kind are set.
+type TimelineItem struct {
+	Kind       string `json:"kind"`
+	ID         int    `json:"id"` // Of the interaction, task, file, stage transition or audit event
+	OccurredAt string `json:"occurred_at"`
+	UserID     *int   `json:"user_id,omitempty"` // Who logged, created, uploaded or changed it
+	ContactID  *int   `json:"contact_id,omitempty"`
+	// EntityType and EntityID are the company, contact or deal whose stage or notes changed
+	EntityType  *string `json:"entity_type,omitempty"`
+	EntityID    *int    `json:"entity_id,omitempty"`
+	Title       *string `json:"title,omitempty"`       // Interaction subject, task title or file name
+	Description *string `json:"description,omitempty"` // Interaction or task description, or the new notes
+	Type        *string `json:"type,omitempty"`        // Interaction type or file MIME type
+	Status      *string `json:"status,omitempty"`      // Task status
+	FromStage   *string `json:"from_stage,omitempty"`
+	ToStage     *string `json:"to_stage,omitempty"`
+	Cursor      string  `json:"cursor"` // Pass as ?before= for the items after this one
+}
+
+// Segment is a saved filter expression over the organization's contacts or
+// companies, whose records are recomputed every time it is used.
+type Segment struct {
+	ID         int    `json:"id"`
+	OrgID      int    `json:"org_id"`
+	Name       string `json:"name"`
+	EntityType string `json:"entity_type"` // EntityContact or EntityCompany; fixed once created
+	Expression string `json:"expression"`
+	CreatedBy  *int   `json:"created_by,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+	Records    *int   `json:"records,omitempty"` // Live count of matching records
+	Error      string `json:"error,omitempty"`   // Why the expression no longer applies, e.g. after a custom field was deleted
+}
+
+// Bulk tag actions
+const (
+	TagActionAdd    = "add"
+	TagActionRemove = "remove"
+)
+
+// TagBulkPayload adds tags to or removes them from records of one type, given
+// by id or as the records of a segment.
+type TagBulkPayload struct {
+	Action     string `json:"action"` // TagActionAdd or TagActionRemove
+	TagIDs     []int  `json:"tag_ids"`
+	EntityType string `json:"entity_type"` // Taken from the segment when SegmentID is set
+	EntityIDs  []int  `json:"entity_ids"`
+	SegmentID  *int   `json:"segment_id,omitempty"` // Instead of EntityIDs
+}
+
+// TagBulkResult reports how many record tags a bulk action added or removed.
+type TagBulkResult struct {
+	Changed int64 `json:"changed"`
+}
+
+// RecordTagsPayload replaces the tags of one record.
+type RecordTagsPayload struct {
+	TagIDs []int `json:"tag_ids"`
 }
 
 // File represents metadata for an uploaded file.
@@ -174,7 +649,134 @@ type File struct {
 	FileSize      *int    `json:"file_size,omitempty"` // In bytes
 	UploadedAt    string  `json:"uploaded_at,omitempty"`
 	InteractionID *int    `json:"interaction_id,omitempty"`
+	Tags          []Tag   `json:"tags,omitempty"` // Managed through the tag endpoints
+}
+
+// IMAPAccount is a mailbox polled for mail exchanged with the user's contacts.
+type IMAPAccount struct {
+	ID           int     `json:"id"`
+	UserID       int     `json:"user_id"`
+	Host         string  `json:"host"`
+	Port         int     `json:"port"`
+	Username     string  `json:"username"`
+	Password     string  `json:"password,omitempty"` // Write-only, never returned
+	Mailbox      string  `json:"mailbox"`
+	UseTLS       bool    `json:"use_tls"`
+	Enabled      bool    `json:"enabled"`
+	UIDValidity  int64   `json:"uid_validity"`
+	LastUID      int64   `json:"last_uid"`
+	LastSyncedAt *string `json:"last_synced_at,omitempty"`
+	LastError    *string `json:"last_error,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+	UpdatedAt    string  `json:"updated_at"`
 }
+
+// EmailTemplate is a reusable text/template subject and body for outgoing mail.
+type EmailTemplate struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Name      string `json:"name"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// OutboxMessage is an outgoing email and its delivery state.
+type OutboxMessage struct {
+	ID            int     `json:"id"`
+	UserID        int     `json:"user_id"`
+	ContactID     int     `json:"contact_id"`
+	TemplateID    *int    `json:"template_id,omitempty"`
+	ToAddress     string  `json:"to_address"`
+	Subject       string  `json:"subject"`
+	Body          string  `json:"body"`
+	MessageID     string  `json:"message_id"`
+	Status        string  `json:"status"`
+	Attempts      int     `json:"attempts"`
+	LastError     *string `json:"last_error,omitempty"`
+	SendAt        string  `json:"send_at"`
+	NextAttemptAt string  `json:"next_attempt_at"`
+	SentAt        *string `json:"sent_at,omitempty"`
+	InteractionID *int    `json:"interaction_id,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+	UpdatedAt     string  `json:"updated_at"`
+}
+
+// SendEmailPayload queues a message to a contact, either from a template or ad hoc.
+type SendEmailPayload struct {
+	ContactID  int     `json:"contact_id"`
+	TemplateID *int    `json:"template_id,omitempty"`
+	Subject    string  `json:"subject,omitempty"`
+	Body       string  `json:"body,omitempty"`
+	SendAt     *string `json:"send_at,omitempty"` // RFC3339; omitted means now
+}
+
+// Outbox statuses
+const (
+	OutboxQueued    = "queued"
+	OutboxSending   = "sending"
+	OutboxSent      = "sent"
+	OutboxFailed    = "failed"
+	OutboxCancelled = "cancelled"
+)
+
+// Webhook posts the user's events of the subscribed types to an external URL.
+type Webhook struct {
+	ID             int      `json:"id"`
+	UserID         int      `json:"user_id"`
+	URL            string   `json:"url"`
+	Secret         string   `json:"secret,omitempty"` // Signs deliveries; only returned when the webhook is created
+	Events         []string `json:"events"`           // Event types such as "task.completed", or "*" for all
+	Enabled        bool     `json:"enabled"`
+	FailureCount   int      `json:"failure_count"` // Consecutive deliveries that failed every attempt
+	DisabledReason *string  `json:"disabled_reason,omitempty"`
+	CreatedAt      string   `json:"created_at"`
+	UpdatedAt      string   `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent, or to be sent, to a webhook.
+type WebhookDelivery struct {
+	ID             int             `json:"id"`
+	WebhookID      int             `json:"webhook_id"`
+	EventID        int64           `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	ResponseBody   *string         `json:"response_body,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	DurationMS     *int            `json:"duration_ms,omitempty"`
+	NextAttemptAt  string          `json:"next_attempt_at"`
+	DeliveredAt    *string         `json:"delivered_at,omitempty"`
+	RedeliveryOf   *int            `json:"redelivery_of,omitempty"`
+	CreatedAt      string          `json:"created_at"`
+	UpdatedAt      string          `json:"updated_at"`
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending    = "pending"
+	DeliveryDelivering = "delivering"
+	DeliverySucceeded  = "succeeded"
+	DeliveryFailed     = "failed"
+)
+
+// CalDAVAccount is a calendar collection synced with the user's meeting interactions.
+type CalDAVAccount struct {
+	ID           int     `json:"id"`
+	UserID       int     `json:"user_id"`
+	CalendarURL  string  `json:"calendar_url"`
+	Username     string  `json:"username"`
+	Password     string  `json:"password,omitempty"` // Write-only, never returned
+	Enabled      bool    `json:"enabled"`
+	LastSyncedAt *string `json:"last_synced_at,omitempty"`
+	LastError    *string `json:"last_error,omitempty"`
+	CreatedAt    string  `json:"created_at"`
+	UpdatedAt    string  `json:"updated_at"`
+}
+
 type EnvParams struct {
 	DbPath       string
 	JWTToken     string
@@ -183,6 +785,27 @@ type EnvParams struct {
 	CertFilePath string
 	DataPath     string
 	WebUiUrl     string
+
+	// Inbound mail; either or both may be empty to disable that path. The SMTP
+	// listener has no auth and binds to loopback unless the address names a host
+	MailIngestMaildir  string
+	MailIngestSMTPAddr string
+	IMAPSyncInterval   string
+	CalDAVSyncInterval string
+
+	// Outbound mail; sending is disabled when SMTPHost is empty
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// Reminders ahead of task due dates and interaction follow-ups
+	ReminderLeadTime string
+	ReminderSchedule string
+
+	// How long deleted records stay restorable before they are purged
+	TrashRetention string
 }
 type Handlers struct {
 	Db *sql.DB
@@ -193,6 +816,12 @@ type ContextKey string
 
 const UserIDContextKey ContextKey = "userID"
 
+// OrgIDContextKey stores the authenticated user's organization ID in context.
+const OrgIDContextKey ContextKey = "orgID"
+
+// RequestIDContextKey stores the ID tagging the request in logs and audit events.
+const RequestIDContextKey ContextKey = "requestID"
+
 // DashboardStats represents dashboard statistics
 type DashboardStats struct {
 	TotalContacts        int `json:"totalContacts"`
@@ -205,9 +834,83 @@ type DashboardStats struct {
 
 // PipelineStage represents pipeline distribution data
 type PipelineStage struct {
-	Stage string `json:"stage"`
-	Count int    `json:"count"`
-	Color string `json:"color"`
+	Stage         string  `json:"stage"`
+	Count         int     `json:"count"`
+	Value         float64 `json:"value"`
+	WeightedValue float64 `json:"weighted_value"`
+	Color         string  `json:"color"`
+}
+
+// StageVelocity is the time records spend in a stage before moving on.
+type StageVelocity struct {
+	Stage          string  `json:"stage"`
+	Transitions    int     `json:"transitions"` // Completed stays in the stage
+	AvgDays        float64 `json:"avg_days"`
+	MedianDays     float64 `json:"median_days"`
+	CurrentCount   int     `json:"current_count"` // Records in the stage right now
+	CurrentAvgDays float64 `json:"current_avg_days"`
+	Color          string  `json:"color"`
+}
+
+// StageConversion is the funnel step for a stage: how many records that entered
+// it made it further, and how many were eventually won.
+type StageConversion struct {
+	Stage       string  `json:"stage"`
+	Entered     int     `json:"entered"`
+	Advanced    int     `json:"advanced"`
+	Won         int     `json:"won"`
+	AdvanceRate float64 `json:"advance_rate"`
+	WinRate     float64 `json:"win_rate"`
+	Color       string  `json:"color"`
+}
+
+// StuckDeal is an open deal that has not changed stage for too long.
+type StuckDeal struct {
+	DealID        int     `json:"deal_id"`
+	Title         string  `json:"title"`
+	Stage         string  `json:"stage"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	EnteredAt     string  `json:"entered_at"`
+	DaysInStage   float64 `json:"days_in_stage"`
+	ThresholdDays float64 `json:"threshold_days"`
+}
+
+// ForecastTotals are the forecast categories for a set of deals. Categories are
+// cumulative: pipeline covers every open deal, best case the likelier ones and
+// commit only those expected to close.
+type ForecastTotals struct {
+	Pipeline  float64 `json:"pipeline"`
+	BestCase  float64 `json:"best_case"`
+	Commit    float64 `json:"commit"`
+	Weighted  float64 `json:"weighted"`   // Amount times probability
+	ClosedWon float64 `json:"closed_won"` // Actual revenue won in the period
+	OpenDeals int     `json:"open_deals"`
+	WonDeals  int     `json:"won_deals"`
+}
+
+// ForecastMonth is the forecast for one calendar month (YYYY-MM).
+type ForecastMonth struct {
+	Month string `json:"month"`
+	ForecastTotals
+}
+
+// ForecastOwner is one deal owner's share of the forecast window.
+type ForecastOwner struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	ForecastTotals
+}
+
+// Forecast projects revenue by month from open deals. Overdue holds open deals
+// whose expected close date has passed, Undated those without one.
+type Forecast struct {
+	Currency string          `json:"currency,omitempty"`
+	Months   []ForecastMonth `json:"months"`
+	Total    ForecastTotals  `json:"total"`
+	Overdue  ForecastTotals  `json:"overdue"`
+	Undated  ForecastTotals  `json:"undated"`
+	Owners   []ForecastOwner `json:"owners"`
 }
 
 // InteractionTrend represents daily interaction trends
@@ -226,11 +929,12 @@ type OidcConfig struct {
 }
 
 const (
-	DefaultDBPath   = "./data/database/micro-crm.db"
-	DefaultKeyPath  = "./data/certs/micro-crm-key.pem"
-	DefaultCertPath = "./data/certs/micro-crm-cert.pem"
-	DefaultApiPort  = "9080"
-	StartupText     = `
+	DefaultDBPath    = "./data/database/micro-crm.db"
+	DefaultKeyPath   = "./data/certs/micro-crm-key.pem"
+	DefaultCertPath  = "./data/certs/micro-crm-cert.pem"
+	DefaultApiPort   = "9080"
+	DefaultUploadDir = "./data/uploads"
+	StartupText      = `
 
 	███╗   ███╗██╗ ██████╗██████╗  ██████╗        ██████╗██████╗ ███╗   ███╗
 	████╗ ████║██║██╔════╝██╔══██╗██╔═══██╗      ██╔════╝██╔══██╗████╗ ████║
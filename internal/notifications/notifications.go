@@ -0,0 +1,105 @@
+// Package notifications writes events to users' in-app inboxes, honouring the
+// per-user preferences that turn event types off.
+package notifications
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/models"
+	"regexp"
+	"strings"
+)
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Enabled reports whether the user wants notifications of the given type.
+func Enabled(q Querier, userID int, notificationType string) (bool, error) {
+	var enabled bool
+	err := q.QueryRow("SELECT enabled FROM notification_preferences WHERE user_id = ? AND type = ?", userID, notificationType).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot load notification preferences: %w", err)
+	}
+	return enabled, nil
+}
+
+// Notify adds n to its user's inbox unless they turned its type off. It returns
+// the new notification's id, or 0 when nothing was written.
+func Notify(q Querier, n models.Notification) (int, error) {
+	enabled, err := Enabled(q, n.UserID, n.Type)
+	if err != nil || !enabled {
+		return 0, err
+	}
+	result, err := q.Exec(`
+	INSERT INTO notifications (user_id, type, title, body, entity_type, entity_id, actor_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		n.UserID, n.Type, n.Title, n.Body, n.EntityType, n.EntityID, n.ActorID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create notification: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9_.-]*[A-Za-z0-9_])`)
+
+// Mentions returns the distinct usernames mentioned as @username in text.
+func Mentions(text string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.ToLower(m[1])
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// NotifyMentions notifies users mentioned in text who were not already mentioned
+// in previous, so editing a note does not repeat notifications. The actor is
+// never notified about mentioning themselves.
+func NotifyMentions(q Querier, actorID int, entityType string, entityID int, title, text, previous string) error {
+	already := make(map[string]bool)
+	for _, name := range Mentions(previous) {
+		already[name] = true
+	}
+	for _, name := range Mentions(text) {
+		if already[name] {
+			continue
+		}
+		var userID int
+		err := q.QueryRow("SELECT id FROM users WHERE LOWER(username) = ? AND status = 'active'", name).Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot look up mentioned user: %w", err)
+		}
+		if userID == actorID {
+			continue
+		}
+		if _, err := Notify(q, models.Notification{
+			UserID:     userID,
+			Type:       models.NotificationMention,
+			Title:      title,
+			Body:       &text,
+			EntityType: &entityType,
+			EntityID:   &entityID,
+			ActorID:    &actorID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
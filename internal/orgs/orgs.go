@@ -0,0 +1,247 @@
+// Package orgs manages organizations, the teams whose members share CRM records.
+// Shared tables carry an org_id that triggers fill in from the creating user, so
+// only code that reads records needs to scope by organization.
+package orgs
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/models"
+	"time"
+)
+
+// InvitationTTL is how long an invitation can be accepted.
+const InvitationTTL = 7 * 24 * time.Hour
+
+// Tables lists the tables whose records belong to an organization.
+var Tables = []string{"companies", "contacts", "interactions", "tasks", "deals", "pipelines", "files", "stage_transitions", "email_messages"}
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Create starts an organization named name with userID as its only member and
+// owner, moving the user out of any organization they were in.
+func Create(q Querier, name string, userID int) (int, error) {
+	res, err := q.Exec("INSERT INTO organizations (name) VALUES (?)", name)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create organization: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	if _, err := q.Exec("UPDATE users SET org_id = ?, org_role = ? WHERE id = ?", id, models.OrgRoleOwner, userID); err != nil {
+		return 0, fmt.Errorf("cannot join organization: %w", err)
+	}
+	return int(id), nil
+}
+
+// Ensure returns the user's organization, creating a personal one named after
+// the user when they have none yet.
+func Ensure(q Querier, userID int) (int, error) {
+	var (
+		orgID    *int
+		username string
+	)
+	if err := q.QueryRow("SELECT org_id, username FROM users WHERE id = ?", userID).Scan(&orgID, &username); err != nil {
+		return 0, fmt.Errorf("cannot load user organization: %w", err)
+	}
+	if orgID != nil {
+		return *orgID, nil
+	}
+
+	res, err := q.Exec("INSERT INTO organizations (name) VALUES (?)", username)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create organization: %w", err)
+	}
+	id, _ := res.LastInsertId()
+	res, err = q.Exec("UPDATE users SET org_id = ?, org_role = ? WHERE id = ? AND org_id IS NULL", id, models.OrgRoleOwner, userID)
+	if err != nil {
+		return 0, fmt.Errorf("cannot join organization: %w", err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		// Lost a race with a concurrent request creating the same organization
+		q.Exec("DELETE FROM organizations WHERE id = ?", id)
+		if err := q.QueryRow("SELECT org_id FROM users WHERE id = ?", userID).Scan(&orgID); err != nil || orgID == nil {
+			return 0, errors.New("cannot load user organization")
+		}
+		return *orgID, nil
+	}
+	return int(id), nil
+}
+
+// Role returns the user's role in the organization, or "" when they are not a member.
+func Role(q Querier, orgID, userID int) (string, error) {
+	var role string
+	err := q.QueryRow("SELECT org_role FROM users WHERE id = ? AND org_id = ?", userID, orgID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// CanManage reports whether a role may manage members and invitations.
+func CanManage(role string) bool {
+	return role == models.OrgRoleOwner || role == models.OrgRoleAdmin
+}
+
+// ValidRole reports whether role is an organization role.
+func ValidRole(role string) bool {
+	switch role {
+	case models.OrgRoleOwner, models.OrgRoleAdmin, models.OrgRoleMember:
+		return true
+	}
+	return false
+}
+
+// Members counts the organization's members.
+func Members(q Querier, orgID int) (int, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM users WHERE org_id = ?", orgID).Scan(&n)
+	return n, err
+}
+
+// Owners counts the organization's active owners.
+func Owners(q Querier, orgID int) (int, error) {
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM users WHERE org_id = ? AND org_role = ? AND status = 'active'", orgID, models.OrgRoleOwner).Scan(&n)
+	return n, err
+}
+
+// MoveData moves every record of one organization into another, e.g. when the
+// only member of an organization joins a team. Moved pipelines whose name is
+// already taken get the old organization's name appended, and the team keeps
+// its own default pipeline. Tags whose name is taken are merged into the team's,
+// and so are custom fields whose key is taken by one of the same type. Segments
+// whose name is taken are renamed the same way as pipelines.
+func MoveData(q Querier, from, to int) error {
+	var fromName string
+	if err := q.QueryRow("SELECT name FROM organizations WHERE id = ?", from).Scan(&fromName); err != nil {
+		return fmt.Errorf("cannot load organization: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE pipelines SET name = name || ' (' || ? || ')'
+	WHERE org_id = ? AND LOWER(name) IN (SELECT LOWER(name) FROM pipelines WHERE org_id = ?)`, fromName, from, to); err != nil {
+		return fmt.Errorf("cannot rename pipelines: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE pipelines SET is_default = 0
+	WHERE org_id = ? AND EXISTS (SELECT 1 FROM pipelines WHERE org_id = ? AND is_default = 1)`, from, to); err != nil {
+		return fmt.Errorf("cannot update default pipeline: %w", err)
+	}
+	for _, table := range Tables {
+		if _, err := q.Exec(fmt.Sprintf("UPDATE %s SET org_id = ? WHERE org_id = ?", table), to, from); err != nil {
+			return fmt.Errorf("cannot move %s: %w", table, err)
+		}
+	}
+	// Records shared with the old organization are now shared with the team
+	if _, err := q.Exec("UPDATE record_shares SET org_id = ? WHERE org_id = ?", to, from); err != nil {
+		return fmt.Errorf("cannot move record shares: %w", err)
+	}
+	// unless they already belong to it
+	if _, err := q.Exec(`
+	DELETE FROM record_shares
+	WHERE org_id = ? AND (
+		(entity_type = 'company' AND entity_id IN (SELECT id FROM companies WHERE org_id = ?))
+		OR (entity_type = 'contact' AND entity_id IN (SELECT id FROM contacts WHERE org_id = ?))
+		OR (entity_type = 'deal' AND entity_id IN (SELECT id FROM deals WHERE org_id = ?))
+		OR (entity_type = 'file' AND entity_id IN (SELECT id FROM files WHERE org_id = ?)))`, to, to, to, to, to); err != nil {
+		return fmt.Errorf("cannot remove record shares: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE OR IGNORE record_tags
+	SET tag_id = (SELECT kept.id FROM tags moved JOIN tags kept ON kept.org_id = ? AND kept.name = moved.name WHERE moved.id = record_tags.tag_id)
+	WHERE tag_id IN (SELECT id FROM tags WHERE org_id = ? AND name IN (SELECT name FROM tags WHERE org_id = ?))`, to, from, to); err != nil {
+		return fmt.Errorf("cannot merge tags: %w", err)
+	}
+	if _, err := q.Exec(`
+	DELETE FROM record_tags
+	WHERE tag_id IN (SELECT id FROM tags WHERE org_id = ? AND name IN (SELECT name FROM tags WHERE org_id = ?))`, from, to); err != nil {
+		return fmt.Errorf("cannot merge tags: %w", err)
+	}
+	if _, err := q.Exec("DELETE FROM tags WHERE org_id = ? AND name IN (SELECT name FROM tags WHERE org_id = ?)", from, to); err != nil {
+		return fmt.Errorf("cannot merge tags: %w", err)
+	}
+	if _, err := q.Exec("UPDATE tags SET org_id = ? WHERE org_id = ?", to, from); err != nil {
+		return fmt.Errorf("cannot move tags: %w", err)
+	}
+	// Custom fields merge into the one with the same key and type; a field whose
+	// key is taken by one of another type keeps its values under a new key
+	if _, err := q.Exec(`
+	UPDATE custom_field_values
+	SET field_id = (SELECT kept.id FROM custom_fields moved JOIN custom_fields kept
+		ON kept.org_id = ? AND kept.entity_type = moved.entity_type AND kept.field_key = moved.field_key
+		WHERE moved.id = custom_field_values.field_id AND kept.field_type = moved.field_type)
+	WHERE field_id IN (SELECT moved.id FROM custom_fields moved JOIN custom_fields kept
+		ON kept.org_id = ? AND kept.entity_type = moved.entity_type AND kept.field_key = moved.field_key
+		WHERE moved.org_id = ? AND kept.field_type = moved.field_type)`, to, to, from); err != nil {
+		return fmt.Errorf("cannot merge custom fields: %w", err)
+	}
+	if _, err := q.Exec(`
+	DELETE FROM custom_fields
+	WHERE org_id = ? AND EXISTS (SELECT 1 FROM custom_fields kept
+		WHERE kept.org_id = ? AND kept.entity_type = custom_fields.entity_type
+		AND kept.field_key = custom_fields.field_key AND kept.field_type = custom_fields.field_type)`, from, to); err != nil {
+		return fmt.Errorf("cannot merge custom fields: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE custom_fields SET field_key = SUBSTR(field_key, 1, 40) || '_' || ?
+	WHERE org_id = ? AND EXISTS (SELECT 1 FROM custom_fields kept
+		WHERE kept.org_id = ? AND kept.entity_type = custom_fields.entity_type AND kept.field_key = custom_fields.field_key)`, from, from, to); err != nil {
+		return fmt.Errorf("cannot rename custom fields: %w", err)
+	}
+	if _, err := q.Exec("UPDATE custom_fields SET org_id = ? WHERE org_id = ?", to, from); err != nil {
+		return fmt.Errorf("cannot move custom fields: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE segments SET name = name || ' (' || ? || ')'
+	WHERE org_id = ? AND name IN (SELECT name FROM segments WHERE org_id = ?)`, fromName, from, to); err != nil {
+		return fmt.Errorf("cannot rename segments: %w", err)
+	}
+	if _, err := q.Exec("UPDATE segments SET org_id = ? WHERE org_id = ?", to, from); err != nil {
+		return fmt.Errorf("cannot move segments: %w", err)
+	}
+	return nil
+}
+
+// NewInvitationToken returns a random token for an invitation link.
+func NewInvitationToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// TransferRecords hands every record that from created in the organization to
+// to, together with the open tasks assigned to from, and returns how many
+// records moved per table. Stage history keeps who owned the record at the time.
+func TransferRecords(q Querier, orgID, from, to int) (map[string]int64, error) {
+	moved := make(map[string]int64)
+	for _, table := range Tables {
+		if table == "stage_transitions" {
+			continue
+		}
+		res, err := q.Exec(fmt.Sprintf("UPDATE %s SET user_id = ? WHERE org_id = ? AND user_id = ?", table), to, orgID, from)
+		if err != nil {
+			return nil, fmt.Errorf("cannot transfer %s: %w", table, err)
+		}
+		moved[table], _ = res.RowsAffected()
+	}
+	// Later occurrences of recurring tasks are created for the series owner
+	if _, err := q.Exec(`
+	UPDATE task_series SET user_id = ?
+	WHERE user_id = ? AND id IN (SELECT series_id FROM tasks WHERE org_id = ? AND series_id IS NOT NULL)`, to, from, orgID); err != nil {
+		return nil, fmt.Errorf("cannot transfer task series: %w", err)
+	}
+	if _, err := q.Exec(`
+	UPDATE tasks SET assignee_id = ?, assigned_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE org_id = ? AND assignee_id = ? AND status != ?`, to, orgID, from, models.TaskStatusDone); err != nil {
+		return nil, fmt.Errorf("cannot transfer task assignments: %w", err)
+	}
+	return moved, nil
+}
@@ -0,0 +1,148 @@
+// Package pipelines resolves pipeline stages for companies, contacts and deals.
+package pipelines
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/models"
+	"strings"
+)
+
+// ErrUnknownStage is returned when a stage name is not part of the pipeline.
+var ErrUnknownStage = errors.New("unknown pipeline stage")
+
+// DefaultPipelineName is the pipeline every organization starts with.
+const DefaultPipelineName = "Sales"
+
+// DefaultStages seeds an organization's first pipeline. The names are the stages the
+// application used before pipelines were configurable.
+var DefaultStages = []models.Stage{
+	{Name: "Lead", Color: "#8884d8", Probability: 10, Outcome: models.StageOpen},
+	{Name: "Prospect", Color: "#aabbcc", Probability: 20, Outcome: models.StageOpen},
+	{Name: "Qualified", Color: "#82ca9d", Probability: 30, Outcome: models.StageOpen},
+	{Name: "Proposal", Color: "#ffc658", Probability: 50, Outcome: models.StageOpen},
+	{Name: "Negotiation", Color: "#ff7300", Probability: 75, Outcome: models.StageOpen},
+	{Name: "Closed Won", Color: "#00ff00", Probability: 100, Outcome: models.StageWon},
+	{Name: "Closed Lost", Color: "#ff0000", Probability: 0, Outcome: models.StageLost},
+}
+
+// DefaultColor is used for stages created without one.
+const DefaultColor = "#999999"
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// EnsureDefault returns the id of the organization's default pipeline, creating
+// it with DefaultStages, credited to userID, when the organization has none yet.
+func EnsureDefault(q Querier, orgID, userID int) (int, error) {
+	var id int
+	err := q.QueryRow("SELECT id FROM pipelines WHERE org_id = ? AND is_default = 1", orgID).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("cannot load default pipeline: %w", err)
+	}
+
+	// An organization whose default was unset keeps its pipelines; promote the oldest one
+	err = q.QueryRow("SELECT id FROM pipelines WHERE org_id = ? ORDER BY id LIMIT 1", orgID).Scan(&id)
+	if err == nil {
+		_, err = q.Exec("UPDATE pipelines SET is_default = 1 WHERE id = ?", id)
+		return id, err
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("cannot load pipelines: %w", err)
+	}
+
+	res, err := q.Exec("INSERT INTO pipelines (user_id, org_id, name, is_default) VALUES (?, ?, ?, 1)", userID, orgID, DefaultPipelineName)
+	if err != nil {
+		// Lost a race with a concurrent request creating the same default
+		if q.QueryRow("SELECT id FROM pipelines WHERE org_id = ? AND is_default = 1", orgID).Scan(&id) == nil {
+			return id, nil
+		}
+		return 0, fmt.Errorf("cannot create default pipeline: %w", err)
+	}
+	newID, _ := res.LastInsertId()
+	id = int(newID)
+	for i, s := range DefaultStages {
+		if _, err := q.Exec(`
+		INSERT INTO pipeline_stages (pipeline_id, name, position, color, probability, outcome) VALUES (?, ?, ?, ?, ?, ?)`,
+			id, s.Name, i, s.Color, s.Probability, s.Outcome,
+		); err != nil {
+			return 0, fmt.Errorf("cannot create default stages: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// Stages lists a pipeline's stages in order.
+func Stages(q Querier, pipelineID int) ([]models.Stage, error) {
+	rows, err := q.Query(`
+	SELECT id, pipeline_id, name, position, color, probability, outcome
+	FROM pipeline_stages WHERE pipeline_id = ? ORDER BY position, id`, pipelineID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stages := []models.Stage{}
+	for rows.Next() {
+		var s models.Stage
+		if err := rows.Scan(&s.ID, &s.PipelineID, &s.Name, &s.Position, &s.Color, &s.Probability, &s.Outcome); err != nil {
+			return nil, err
+		}
+		stages = append(stages, s)
+	}
+	return stages, rows.Err()
+}
+
+// FindStage looks a stage up by name, ignoring case and surrounding spaces so
+// "closed won" resolves to "Closed Won". An empty name resolves to the first stage.
+func FindStage(q Querier, pipelineID int, name string) (models.Stage, error) {
+	stages, err := Stages(q, pipelineID)
+	if err != nil {
+		return models.Stage{}, err
+	}
+	if len(stages) == 0 {
+		return models.Stage{}, ErrUnknownStage
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return stages[0], nil
+	}
+	for _, s := range stages {
+		if strings.EqualFold(s.Name, name) {
+			return s, nil
+		}
+	}
+	return models.Stage{}, ErrUnknownStage
+}
+
+// ResolveDefaultStage validates a company or contact stage against the
+// organization's default pipeline and returns the matching stage.
+func ResolveDefaultStage(q Querier, orgID, userID int, name string) (models.Stage, error) {
+	pipelineID, err := EnsureDefault(q, orgID, userID)
+	if err != nil {
+		return models.Stage{}, err
+	}
+	return FindStage(q, pipelineID, name)
+}
+
+// RecordTransition appends a stage change to a record's history; from is nil for
+// the first stage of a new record.
+func RecordTransition(q Querier, userID, actorID int, entityType string, entityID, pipelineID int, from *string, to string) error {
+	_, err := q.Exec(`
+	INSERT INTO stage_transitions (user_id, entity_type, entity_id, pipeline_id, from_stage, to_stage, changed_by)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, entityType, entityID, pipelineID, from, to, actorID,
+	)
+	if err != nil {
+		return fmt.Errorf("cannot record stage transition: %w", err)
+	}
+	return nil
+}
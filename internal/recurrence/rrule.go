@@ -0,0 +1,143 @@
+// Package recurrence implements the subset of RFC 5545 RRULEs used for
+// recurring tasks: FREQ=DAILY|WEEKLY|MONTHLY with INTERVAL, UNTIL and COUNT.
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+)
+
+// Rule is a parsed recurrence rule. Count and Until are mutually exclusive; zero
+// values mean the series never ends.
+type Rule struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    time.Time
+}
+
+// Parse reads a rule such as "FREQ=WEEKLY;INTERVAL=2;COUNT=10". An "RRULE:"
+// prefix is accepted. UNTIL may be YYYYMMDD, YYYYMMDDTHHMMSSZ or YYYY-MM-DD.
+func Parse(s string) (Rule, error) {
+	rule := Rule{Interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return rule, errors.New("empty recurrence rule")
+	}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return rule, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(strings.TrimSpace(key)) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, errors.New("INTERVAL must be a positive integer")
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return rule, errors.New("COUNT must be a positive integer")
+			}
+			rule.Count = n
+		case "UNTIL":
+			t, err := parseUntil(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.Until = t
+		default:
+			return rule, fmt.Errorf("unsupported recurrence rule part %q", key)
+		}
+	}
+	switch rule.Freq {
+	case Daily, Weekly, Monthly:
+	case "":
+		return rule, errors.New("FREQ is required")
+	default:
+		return rule, fmt.Errorf("FREQ must be %s, %s or %s", Daily, Weekly, Monthly)
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, errors.New("COUNT and UNTIL cannot be combined")
+	}
+	return rule, nil
+}
+
+func parseUntil(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102T150405Z", "20060102", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			if len(value) != len("20060102T150405Z") {
+				// A bare date includes the whole day
+				t = t.Add(24*time.Hour - time.Second)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", value)
+}
+
+// String formats the rule in canonical RRULE form, without the "RRULE:" prefix.
+func (r Rule) String() string {
+	s := "FREQ=" + r.Freq
+	if r.Interval > 1 {
+		s += ";INTERVAL=" + strconv.Itoa(r.Interval)
+	}
+	if r.Count > 0 {
+		s += ";COUNT=" + strconv.Itoa(r.Count)
+	}
+	if !r.Until.IsZero() {
+		s += ";UNTIL=" + r.Until.UTC().Format("20060102T150405Z")
+	}
+	return s
+}
+
+// Occurrence returns the n-th occurrence (0 is start itself) of a series that
+// starts at start, and false once the series has ended. Occurrences are computed
+// from start rather than from the previous one, so a monthly series on the 31st
+// falls on the last day of shorter months without drifting to the 28th.
+func (r Rule) Occurrence(start time.Time, n int) (time.Time, bool) {
+	if n < 0 || (r.Count > 0 && n >= r.Count) {
+		return time.Time{}, false
+	}
+	steps := n * r.Interval
+	var t time.Time
+	switch r.Freq {
+	case Daily:
+		t = start.AddDate(0, 0, steps)
+	case Weekly:
+		t = start.AddDate(0, 0, 7*steps)
+	case Monthly:
+		t = addMonths(start, steps)
+	default:
+		return time.Time{}, false
+	}
+	if !r.Until.IsZero() && t.After(r.Until) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// addMonths adds months to t, clamping the day to the end of the target month.
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
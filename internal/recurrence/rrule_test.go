@@ -0,0 +1,110 @@
+package recurrence
+
+import (
+	"testing"
+	"time"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 9, 30, 0, 0, time.UTC)
+}
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		name   string
+		start  time.Time
+		months int
+		want   time.Time
+	}{
+		{"same day", date(2024, 1, 15), 1, date(2024, 2, 15)},
+		{"31st to leap february", date(2024, 1, 31), 1, date(2024, 2, 29)},
+		{"31st to february", date(2023, 1, 31), 1, date(2023, 2, 28)},
+		{"31st to 30-day month", date(2024, 3, 31), 1, date(2024, 4, 30)},
+		{"31st to 31-day month", date(2024, 1, 31), 2, date(2024, 3, 31)},
+		{"30th to february", date(2024, 1, 30), 1, date(2024, 2, 29)},
+		{"across year end", date(2024, 12, 31), 2, date(2025, 2, 28)},
+		{"29th of leap february in a year", date(2024, 2, 29), 12, date(2025, 2, 28)},
+		{"zero months", date(2024, 5, 31), 0, date(2024, 5, 31)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addMonths(tt.start, tt.months); !got.Equal(tt.want) {
+				t.Errorf("addMonths(%s, %d) = %s, want %s", tt.start, tt.months, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "FREQ=DAILY", want: "FREQ=DAILY"},
+		{in: "RRULE:freq=weekly;interval=2;count=10", want: "FREQ=WEEKLY;INTERVAL=2;COUNT=10"},
+		{in: "FREQ=MONTHLY;UNTIL=20241231", want: "FREQ=MONTHLY;UNTIL=20241231T235959Z"},
+		{in: "FREQ=MONTHLY;UNTIL=2024-12-31", want: "FREQ=MONTHLY;UNTIL=20241231T235959Z"},
+		{in: "FREQ=DAILY;UNTIL=20241231T120000Z", want: "FREQ=DAILY;UNTIL=20241231T120000Z"},
+		{in: "", wantErr: true},
+		{in: "INTERVAL=2", wantErr: true},
+		{in: "FREQ=YEARLY", wantErr: true},
+		{in: "FREQ=DAILY;INTERVAL=0", wantErr: true},
+		{in: "FREQ=DAILY;COUNT=-1", wantErr: true},
+		{in: "FREQ=DAILY;COUNT=2;UNTIL=20241231", wantErr: true},
+		{in: "FREQ=DAILY;BYDAY=MO", wantErr: true},
+		{in: "FREQ=DAILY;UNTIL=tomorrow", wantErr: true},
+		{in: "FREQ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			rule, err := Parse(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse(%q) = %s, want an error", tt.in, rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.in, err)
+			}
+			if got := rule.String(); got != tt.want {
+				t.Errorf("Parse(%q).String() = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOccurrence(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		start  time.Time
+		n      int
+		want   time.Time
+		wantOK bool
+	}{
+		{"start itself", "FREQ=DAILY", date(2024, 1, 31), 0, date(2024, 1, 31), true},
+		{"daily interval", "FREQ=DAILY;INTERVAL=3", date(2024, 2, 27), 1, date(2024, 3, 1), true},
+		{"weekly", "FREQ=WEEKLY;INTERVAL=2", date(2024, 1, 1), 2, date(2024, 1, 29), true},
+		{"monthly clamps", "FREQ=MONTHLY", date(2024, 1, 31), 1, date(2024, 2, 29), true},
+		{"monthly does not drift", "FREQ=MONTHLY", date(2024, 1, 31), 2, date(2024, 3, 31), true},
+		{"last of count", "FREQ=DAILY;COUNT=3", date(2024, 1, 1), 2, date(2024, 1, 3), true},
+		{"past count", "FREQ=DAILY;COUNT=3", date(2024, 1, 1), 3, time.Time{}, false},
+		{"on until day", "FREQ=DAILY;UNTIL=20240103", date(2024, 1, 1), 2, date(2024, 1, 3), true},
+		{"past until", "FREQ=DAILY;UNTIL=20240103", date(2024, 1, 1), 3, time.Time{}, false},
+		{"negative", "FREQ=DAILY", date(2024, 1, 1), -1, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := Parse(tt.rule)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.rule, err)
+			}
+			got, ok := rule.Occurrence(tt.start, tt.n)
+			if ok != tt.wantOK || !got.Equal(tt.want) {
+				t.Errorf("Occurrence(%s, %d) = %s, %v, want %s, %v", tt.start, tt.n, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Package relationships keeps the typed links between contacts and their
+// positions at companies over time, and builds company org charts from the
+// reports_to links.
+package relationships
+
+import (
+	"database/sql"
+	"errors"
+	"micro-CRM/internal/models"
+	"slices"
+)
+
+// Types are the relationship types contacts can be linked by.
+var Types = []string{
+	models.RelationshipReportsTo,
+	models.RelationshipAssistantOf,
+	models.RelationshipReferredBy,
+	models.RelationshipFormerColleague,
+}
+
+// Symmetric reports whether a relationship type goes both ways, so that
+// linking b to a is the same as linking a to b.
+func Symmetric(relationshipType string) bool {
+	return relationshipType == models.RelationshipFormerColleague
+}
+
+// CurrentAffiliation is the condition on contact_affiliations aliased a
+// keeping the positions held today.
+const CurrentAffiliation = "(a.start_date IS NULL OR a.start_date <= date('now')) AND (a.end_date IS NULL OR a.end_date >= date('now'))"
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Exists reports whether the contacts are already linked by the type, either
+// way round for symmetric types.
+func Exists(q Querier, contactID, relatedID int, relationshipType string) (bool, error) {
+	query := "SELECT EXISTS(SELECT 1 FROM contact_relationships WHERE type = ? AND ((contact_id = ? AND related_id = ?)"
+	if Symmetric(relationshipType) {
+		query += " OR (contact_id = ?3 AND related_id = ?2)"
+	}
+	var exists bool
+	err := q.QueryRow(query+"))", relationshipType, contactID, relatedID).Scan(&exists)
+	return exists, err
+}
+
+// Manager returns the live contact whom contactID reports to, or 0.
+func Manager(q Querier, contactID int) (int, error) {
+	var managerID int
+	err := q.QueryRow(`
+	SELECT cr.related_id FROM contact_relationships cr JOIN contacts m ON m.id = cr.related_id
+	WHERE cr.contact_id = ? AND cr.type = ? AND m.deleted_at IS NULL
+	ORDER BY cr.id LIMIT 1`, contactID, models.RelationshipReportsTo).Scan(&managerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return managerID, err
+}
+
+// WouldCycle reports whether contactID reporting to managerID would close a
+// loop of reports_to links.
+func WouldCycle(q Querier, contactID, managerID int) (bool, error) {
+	seen := map[int]bool{}
+	for id := managerID; id != 0 && !seen[id]; {
+		if id == contactID {
+			return true, nil
+		}
+		seen[id] = true
+		next, err := Manager(q, id)
+		if err != nil {
+			return false, err
+		}
+		id = next
+	}
+	return false, nil
+}
+
+// Chart builds an org chart of members, in their order, from the reports_to
+// and assistant_of links among them. Members whose manager is not among them
+// are at the top, except assistants nobody reports to, who are only listed
+// with the person they assist.
+func Chart(members []models.ContactBrief, links []models.ContactRelationship) []*models.OrgChartNode {
+	byID := make(map[int]models.ContactBrief, len(members))
+	for _, m := range members {
+		byID[m.ID] = m
+	}
+	var (
+		managed    = map[int]bool{}
+		reports    = map[int][]int{}
+		assistants = map[int][]models.ContactBrief{}
+		assisting  = map[int]bool{}
+	)
+	for _, link := range links {
+		contact, ok := byID[link.ContactID]
+		if _, related := byID[link.RelatedID]; !ok || !related || link.ContactID == link.RelatedID {
+			continue
+		}
+		switch link.Type {
+		case models.RelationshipReportsTo:
+			if !managed[link.ContactID] {
+				managed[link.ContactID] = true
+				reports[link.RelatedID] = append(reports[link.RelatedID], link.ContactID)
+			}
+		case models.RelationshipAssistantOf:
+			assistants[link.RelatedID] = append(assistants[link.RelatedID], contact)
+			assisting[link.ContactID] = true
+		}
+	}
+	position := make(map[int]int, len(members))
+	for i, m := range members {
+		position[m.ID] = i
+	}
+	for id := range reports {
+		slices.SortFunc(reports[id], func(a, b int) int { return position[a] - position[b] })
+	}
+
+	placed := map[int]bool{}
+	var build func(id int) *models.OrgChartNode
+	build = func(id int) *models.OrgChartNode {
+		placed[id] = true
+		node := &models.OrgChartNode{ContactBrief: byID[id], Assistants: assistants[id], Reports: []*models.OrgChartNode{}}
+		for _, report := range reports[id] {
+			if !placed[report] {
+				node.Reports = append(node.Reports, build(report))
+			}
+		}
+		return node
+	}
+	top := func(id int) bool {
+		return !placed[id] && !(assisting[id] && len(reports[id]) == 0)
+	}
+	roots := []*models.OrgChartNode{}
+	for _, m := range members {
+		if !managed[m.ID] && top(m.ID) {
+			roots = append(roots, build(m.ID))
+		}
+	}
+	// Loops of reports_to links, e.g. after a merge, start at their first member
+	for _, m := range members {
+		if managed[m.ID] && top(m.ID) {
+			roots = append(roots, build(m.ID))
+		}
+	}
+	return roots
+}
@@ -0,0 +1,77 @@
+package reminders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/mailer"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"strings"
+	"time"
+)
+
+// Subject is the one-line summary of a reminder.
+func (r Reminder) Subject() string {
+	label := "Task"
+	if r.EntityType == models.EntityInteraction {
+		label = "Follow-up"
+	}
+	if r.Kind == KindOverdue {
+		return fmt.Sprintf("%s overdue: %s", label, r.Title)
+	}
+	return fmt.Sprintf("%s due %s: %s", label, r.DueAt.Format("Mon 2 Jan 15:04 MST"), r.Title)
+}
+
+// LogChannel writes reminders to the server log.
+type LogChannel struct {
+	Log logger.Logger
+}
+
+func (c LogChannel) Name() string { return "log" }
+
+func (c LogChannel) Deliver(_ context.Context, r Reminder) error {
+	c.Log.Info("Reminder for %s: %s", r.Username, r.Subject())
+	return nil
+}
+
+// InAppChannel adds reminders to the user's notification inbox.
+type InAppChannel struct {
+	DB *sql.DB
+}
+
+func (c InAppChannel) Name() string { return "in-app" }
+
+func (c InAppChannel) Deliver(_ context.Context, r Reminder) error {
+	_, err := notifications.Notify(c.DB, models.Notification{
+		UserID:     r.UserID,
+		Type:       models.NotificationReminder,
+		Title:      r.Subject(),
+		EntityType: &r.EntityType,
+		EntityID:   &r.EntityID,
+	})
+	return err
+}
+
+// EmailChannel mails reminders to the user's own address.
+type EmailChannel struct {
+	Sender mailer.Sender
+}
+
+func (c EmailChannel) Name() string { return "email" }
+
+func (c EmailChannel) Deliver(_ context.Context, r Reminder) error {
+	if r.Email == "" {
+		return errors.New("user has no email address")
+	}
+	body := fmt.Sprintf("Hello %s,\n\n%s\nDue: %s\n", r.Username, r.Subject(), r.DueAt.Format(time.RFC1123))
+	_, domain, _ := strings.Cut(r.Email, "@")
+	return c.Sender.Send(mailer.Email{
+		To:        r.Email,
+		Subject:   r.Subject(),
+		Body:      body,
+		MessageID: mailer.NewMessageID(domain),
+	})
+}
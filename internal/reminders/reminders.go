@@ -0,0 +1,174 @@
+// Package reminders notifies users ahead of task due dates and interaction
+// follow-ups, and again once they are overdue, through pluggable channels.
+package reminders
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"micro-CRM/internal/notifications"
+	"micro-CRM/internal/utils"
+	"time"
+)
+
+// Reminder kinds
+const (
+	KindUpcoming = "upcoming"
+	KindOverdue  = "overdue"
+)
+
+// Reminder is one notification about a task or follow-up.
+type Reminder struct {
+	UserID     int
+	Username   string
+	Email      string
+	Kind       string
+	EntityType string // models.EntityTask or models.EntityInteraction
+	EntityID   int
+	Title      string
+	DueAt      time.Time
+	ContactID  *int
+}
+
+// Channel delivers reminders, e.g. by email. A failing channel does not stop the
+// others, and the reminder is not retried.
+type Channel interface {
+	Name() string
+	Deliver(ctx context.Context, r Reminder) error
+}
+
+// Notifier finds due reminders each time it runs; it is meant to be registered
+// as a scheduler job.
+type Notifier struct {
+	DB  *sql.DB
+	Log logger.Logger
+	// LeadTime is how long before the due time the upcoming reminder goes out
+	LeadTime time.Duration
+	// OverdueWindow limits overdue notices to records that fell due recently, so
+	// enabling reminders does not flood users about long-forgotten tasks
+	OverdueWindow time.Duration
+	Channels      []Channel
+}
+
+func NewNotifier(db *sql.DB, log logger.Logger, leadTime time.Duration, channels ...Channel) *Notifier {
+	return &Notifier{
+		DB:            db,
+		Log:           log,
+		LeadTime:      leadTime,
+		OverdueWindow: 24 * time.Hour,
+		Channels:      channels,
+	}
+}
+
+// candidate is a record with a due time, before the reminder kind is decided.
+type candidate struct {
+	Reminder
+	due string
+}
+
+// Run sends every reminder that has become due since the last run.
+func (n *Notifier) Run(ctx context.Context) error {
+	now := time.Now().UTC()
+	candidates, err := n.candidates(now)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		due, layout, err := utils.ParseDueDate(c.due)
+		if err != nil {
+			continue
+		}
+		// A date without a time is due by the end of that day
+		if layout == "2006-01-02" {
+			due = due.Add(24*time.Hour - time.Second)
+		}
+		c.DueAt = due
+
+		switch {
+		case !due.After(now) && now.Sub(due) <= n.OverdueWindow:
+			c.Kind = KindOverdue
+		case due.After(now) && due.Sub(now) <= n.LeadTime:
+			c.Kind = KindUpcoming
+		default:
+			continue
+		}
+		if err := n.send(ctx, c.Reminder); err != nil {
+			n.Log.Error("Reminders: %v", err)
+		}
+	}
+	return nil
+}
+
+// candidates loads open tasks and unanswered follow-ups whose date falls between
+// the overdue window and the lead time. Dates are free text, so the SQL filter
+// only compares the date part and Run does the exact check.
+func (n *Notifier) candidates(now time.Time) ([]candidate, error) {
+	from := now.Add(-n.OverdueWindow).AddDate(0, 0, -1).Format("2006-01-02")
+	to := now.Add(n.LeadTime).Format("2006-01-02")
+
+	rows, err := n.DB.Query(`
+	SELECT ?, t.id, u.id, u.username, u.email, t.title, t.due_date, t.contact_id
+	FROM tasks t JOIN users u ON u.id = COALESCE(t.assignee_id, t.user_id)
+	WHERE t.deleted_at IS NULL AND t.status != ? AND t.due_date IS NOT NULL AND substr(t.due_date, 1, 10) BETWEEN ? AND ?
+	UNION ALL
+	SELECT ?, i.id, i.user_id, u.username, u.email, i.subject, i.follow_up_date, i.contact_id
+	FROM interactions i JOIN users u ON u.id = i.user_id
+	WHERE i.deleted_at IS NULL AND i.follow_up_date IS NOT NULL AND substr(i.follow_up_date, 1, 10) BETWEEN ? AND ?
+		-- A later interaction with the contact counts as the follow-up
+		AND NOT EXISTS (
+			SELECT 1 FROM interactions later
+			WHERE later.contact_id = i.contact_id AND later.interaction_at > i.interaction_at AND later.deleted_at IS NULL
+		)`,
+		models.EntityTask, models.TaskStatusDone, from, to,
+		models.EntityInteraction, from, to,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query reminder candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.EntityType, &c.EntityID, &c.UserID, &c.Username, &c.Email, &c.Title, &c.due, &c.ContactID); err != nil {
+			return nil, fmt.Errorf("cannot scan reminder candidate: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// send records the reminder and hands it to every channel, unless the user turned
+// reminders off. Recording first means a reminder is sent at most once even if a
+// channel fails or the job is retried.
+func (n *Notifier) send(ctx context.Context, r Reminder) error {
+	// The preference covers every channel, not just the in-app inbox
+	enabled, err := notifications.Enabled(n.DB, r.UserID, models.NotificationReminder)
+	if err != nil || !enabled {
+		return err
+	}
+
+	result, err := n.DB.Exec(`
+	INSERT OR IGNORE INTO reminders_sent (user_id, entity_type, entity_id, kind, due_at) VALUES (?, ?, ?, ?, ?)`,
+		r.UserID, r.EntityType, r.EntityID, r.Kind, r.DueAt.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("cannot record %s reminder for %s %d: %w", r.Kind, r.EntityType, r.EntityID, err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return nil
+	}
+
+	for _, ch := range n.Channels {
+		if err := ch.Deliver(ctx, r); err != nil {
+			n.Log.Warn("Reminders: %s channel failed for %s %d: %v", ch.Name(), r.EntityType, r.EntityID, err)
+		}
+	}
+	return nil
+}
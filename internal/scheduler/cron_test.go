@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func at(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2024, month, day, hour, minute, 0, 0, time.UTC)
+}
+
+func TestNext(t *testing.T) {
+	// 1 January 2024 is a Monday
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"every minute", "* * * * *", at(1, 1, 0, 0), at(1, 1, 0, 1)},
+		{"strictly after", "30 9 * * *", at(1, 1, 9, 30), at(1, 2, 9, 30)},
+		{"hour range with step", "0 8-18/4 * * *", at(1, 1, 12, 1), at(1, 1, 16, 0)},
+		{"list", "15,45 * * * *", at(1, 1, 10, 20), at(1, 1, 10, 45)},
+		{"month rollover", "0 0 1 * *", at(1, 31, 12, 0), at(2, 1, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(1, 1, 0, 0), at(2, 29, 0, 0)},
+		{"7 is sunday", "0 0 * * 7", at(1, 1, 0, 0), at(1, 7, 0, 0)},
+		{"macro", "@weekly", at(1, 1, 0, 0), at(1, 7, 0, 0)},
+		{"impossible date", "0 0 30 2 *", at(1, 1, 0, 0), time.Time{}},
+
+		// Both day fields restricted: a day matching either runs
+		{"dom or dow, dow first", "0 9 13 * 5", at(1, 1, 0, 0), at(1, 5, 9, 0)},
+		{"dom or dow, next friday", "0 9 13 * 5", at(1, 5, 9, 0), at(1, 12, 9, 0)},
+		{"dom or dow, dom on a saturday", "0 9 13 * 5", at(1, 12, 9, 0), at(1, 13, 9, 0)},
+		// One day field unrestricted: the other alone decides
+		{"dom only", "0 9 13 * *", at(1, 1, 0, 0), at(1, 13, 9, 0)},
+		{"dow only", "0 9 * * 5", at(1, 1, 0, 0), at(1, 5, 9, 0)},
+		// A stepped star still counts as unrestricted, so both must match
+		{"stepped dom and dow", "0 9 */2 * 1", at(1, 1, 9, 0), at(1, 15, 9, 0)},
+		{"dom and stepped dow", "0 9 1 * */2", at(1, 1, 9, 0), at(2, 1, 9, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.spec)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.spec, err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) for %q = %s, want %s", tt.from, tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEvery(t *testing.T) {
+	s, err := Parse("@every 10m")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 500, time.UTC)
+	if got, want := s.Next(from), at(1, 1, 0, 10); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@every 10",
+		"@every 500ms",
+		"@sometimes",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
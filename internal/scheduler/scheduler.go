@@ -0,0 +1,158 @@
+// Package scheduler runs recurring background jobs on cron schedules. Job state
+// lives in the scheduled_jobs table so a run is neither repeated nor lost across
+// restarts, and a lease keeps two server processes sharing the database from
+// running the same job at once.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"micro-CRM/internal/logger"
+	"sync"
+	"time"
+)
+
+// JobFunc is the work of a job. Returning an error records it against the run.
+type JobFunc func(ctx context.Context) error
+
+type job struct {
+	name     string
+	schedule Schedule
+	run      JobFunc
+}
+
+// Scheduler checks every Interval for jobs whose next run time has passed.
+type Scheduler struct {
+	DB       *sql.DB
+	Log      logger.Logger
+	Interval time.Duration
+	// Lease is how long a claimed run may take before another process may assume
+	// it crashed and run the job itself
+	Lease time.Duration
+
+	owner string
+	mu    sync.Mutex
+	jobs  []*job
+}
+
+func NewScheduler(db *sql.DB, log logger.Logger) *Scheduler {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return &Scheduler{
+		DB:       db,
+		Log:      log,
+		Interval: 30 * time.Second,
+		Lease:    10 * time.Minute,
+		owner:    hex.EncodeToString(buf),
+	}
+}
+
+// Register adds a job. Its stored next run time is kept across restarts unless
+// the schedule itself changed, so a job missed while the server was down runs
+// once at startup rather than once per missed slot.
+func (s *Scheduler) Register(name, spec string, run JobFunc) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	next := schedule.Next(time.Now().UTC())
+	if next.IsZero() {
+		return fmt.Errorf("job %s: schedule %q never runs", name, spec)
+	}
+
+	_, err = s.DB.Exec(`
+	INSERT INTO scheduled_jobs (name, schedule, next_run_at) VALUES (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET
+		next_run_at = CASE WHEN scheduled_jobs.schedule = excluded.schedule THEN scheduled_jobs.next_run_at ELSE excluded.next_run_at END,
+		schedule = excluded.schedule`,
+		name, spec, next.Format(time.RFC3339),
+	)
+	if err != nil {
+		return fmt.Errorf("job %s: cannot store state: %w", name, err)
+	}
+
+	s.mu.Lock()
+	s.jobs = append(s.jobs, &job{name: name, schedule: schedule, run: run})
+	s.mu.Unlock()
+	return nil
+}
+
+// Run blocks until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		s.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue runs every registered job whose next run time has passed, one at a time.
+func (s *Scheduler) RunDue(ctx context.Context) {
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		if s.claim(j) {
+			s.execute(ctx, j)
+		}
+	}
+}
+
+// claim takes the job's lease if it is due and nobody else holds a live lease.
+func (s *Scheduler) claim(j *job) bool {
+	now := time.Now().UTC()
+	result, err := s.DB.Exec(`
+	UPDATE scheduled_jobs SET locked_by = ?, locked_until = ?
+	WHERE name = ? AND next_run_at <= ? AND (locked_until IS NULL OR locked_until <= ?)`,
+		s.owner, now.Add(s.Lease).Format(time.RFC3339), j.name, now.Format(time.RFC3339), now.Format(time.RFC3339),
+	)
+	if err != nil {
+		s.Log.Error("Scheduler: cannot claim job %s: %v", j.name, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job) {
+	started := time.Now().UTC()
+	runErr := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return j.run(ctx)
+	}()
+
+	status, lastError := "ok", ""
+	if runErr != nil {
+		status, lastError = "error", runErr.Error()
+		s.Log.Error("Scheduler: job %s failed: %v", j.name, runErr)
+	}
+	// The next slot is computed from now, so a run that overran skips the slots it missed
+	next := j.schedule.Next(time.Now().UTC())
+	_, err := s.DB.Exec(`
+	UPDATE scheduled_jobs SET
+		next_run_at = ?, last_run_at = ?, last_duration_ms = ?, last_status = ?, last_error = ?,
+		run_count = run_count + 1, locked_by = NULL, locked_until = NULL
+	WHERE name = ? AND locked_by = ?`,
+		next.Format(time.RFC3339), started.Format(time.RFC3339), time.Since(started).Milliseconds(),
+		status, lastError, j.name, s.owner,
+	)
+	if err != nil {
+		s.Log.Error("Scheduler: cannot record run of job %s: %v", j.name, err)
+	}
+}
@@ -0,0 +1,535 @@
+// Package segments compiles the filter expressions of saved segments into SQL
+// conditions on contacts or companies.
+//
+// An expression compares fields with values and combines the comparisons with
+// AND, OR, NOT and parentheses, e.g.
+//
+//	pipeline_stage = "Qualified" AND company.industry ~ "fintech"
+//	AND (interactions.last < -30d OR interactions.last = null)
+//
+// The operators are =, !=, <, <=, >, >=, ~ (contains) and IN ("a", "b"). Text
+// compares ignoring case. Values are quoted strings, numbers, true, false, null
+// and dates: YYYY-MM-DD, today, or a number of days from today such as -30d.
+// tag = "VIP" matches the records carrying the tag, and cf.<key> reads a custom
+// field.
+package segments
+
+import (
+	"fmt"
+	"micro-CRM/internal/customfields"
+	"micro-CRM/internal/models"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxLength is the longest expression accepted, in bytes.
+const MaxLength = 2000
+
+// Tables maps the record types segments can hold to their table.
+var Tables = map[string]string{
+	models.EntityCompany: "companies",
+	models.EntityContact: "contacts",
+}
+
+// Columns are the segments columns in the order Scan reads them.
+const Columns = `id, org_id, name, entity_type, expression, created_by, created_at, updated_at`
+
+// Scan reads a row selected with Columns.
+func Scan(row interface{ Scan(...interface{}) error }, s *models.Segment) error {
+	return row.Scan(&s.ID, &s.OrgID, &s.Name, &s.EntityType, &s.Expression, &s.CreatedBy, &s.CreatedAt, &s.UpdatedAt)
+}
+
+type kind int
+
+const (
+	text kind = iota
+	number
+	date
+	boolean
+)
+
+// field is a field expressions can compare; sql reads it from the record aliased r.
+type field struct {
+	kind kind
+	sql  string
+}
+
+// companyOf reads a column of a contact's company.
+func companyOf(column string) string {
+	return "(SELECT co." + column + " FROM companies co WHERE co.id = r.company_id AND co.deleted_at IS NULL)"
+}
+
+// companyInteractions aggregates the interactions with a company's contacts.
+func companyInteractions(aggregate string) string {
+	return "(SELECT " + aggregate + ` FROM interactions i
+	WHERE i.deleted_at IS NULL AND i.contact_id IN (SELECT id FROM contacts WHERE company_id = r.id AND deleted_at IS NULL))`
+}
+
+var fields = map[string]map[string]field{
+	models.EntityContact: {
+		"first_name":              {text, "r.first_name"},
+		"last_name":               {text, "r.last_name"},
+		"name":                    {text, "r.first_name || ' ' || r.last_name"},
+		"email":                   {text, "r.email"},
+		"phone_number":            {text, "r.phone_number"},
+		"job_title":               {text, "r.job_title"},
+		"notes":                   {text, "r.notes"},
+		"pipeline_stage":          {text, "r.pipeline_stage"},
+		"next_action_description": {text, "r.next_action_description"},
+		"company_id":              {number, "r.company_id"},
+		"owner_id":                {number, "r.user_id"},
+		"created_at":              {date, "r.created_at"},
+		"updated_at":              {date, "r.updated_at"},
+		"last_interaction_at":     {date, "r.last_interaction_at"},
+		"next_action_at":          {date, "r.next_action_at"},
+		"company.name":            {text, companyOf("name")},
+		"company.industry":        {text, companyOf("industry")},
+		"company.website":         {text, companyOf("website")},
+		"company.pipeline_stage":  {text, companyOf("pipeline_stage")},
+		"company.size":            {number, companyOf("company_size")},
+		"interactions.count":      {number, "(SELECT COUNT(*) FROM interactions i WHERE i.contact_id = r.id AND i.deleted_at IS NULL)"},
+		"interactions.last":       {date, "(SELECT MAX(i.interaction_at) FROM interactions i WHERE i.contact_id = r.id AND i.deleted_at IS NULL)"},
+		"tasks.open": {number, "(SELECT COUNT(*) FROM tasks t WHERE t.contact_id = r.id AND t.deleted_at IS NULL AND t.status != '" +
+			models.TaskStatusDone + "')"},
+		"deals.count": {number, "(SELECT COUNT(*) FROM deal_contacts dc JOIN deals d ON d.id = dc.deal_id WHERE dc.contact_id = r.id AND d.deleted_at IS NULL)"},
+	},
+	models.EntityCompany: {
+		"name":               {text, "r.name"},
+		"website":            {text, "r.website"},
+		"industry":           {text, "r.industry"},
+		"notes":              {text, "r.notes"},
+		"address":            {text, "r.address"},
+		"phone_number":       {text, "r.phone_number"},
+		"pipeline_stage":     {text, "r.pipeline_stage"},
+		"company_size":       {number, "r.company_size"},
+		"owner_id":           {number, "r.user_id"},
+		"created_at":         {date, "r.created_at"},
+		"updated_at":         {date, "r.updated_at"},
+		"contacts.count":     {number, "(SELECT COUNT(*) FROM contacts c WHERE c.company_id = r.id AND c.deleted_at IS NULL)"},
+		"interactions.count": {number, companyInteractions("COUNT(*)")},
+		"interactions.last":  {date, companyInteractions("MAX(i.interaction_at)")},
+		"deals.count":        {number, "(SELECT COUNT(*) FROM deals d WHERE d.company_id = r.id AND d.deleted_at IS NULL)"},
+	},
+}
+
+// Filter returns the condition, to AND to a query on records of entityType,
+// keeping those whose id column matches expression. column must be qualified
+// with its table, as in contacts.id. Tag names and custom fields are the
+// organization's, and relative dates count from now.
+func Filter(expression string, orgID int, entityType, column string, custom []models.CustomField, now time.Time) (string, []interface{}, error) {
+	condition, args, err := compile(expression, orgID, entityType, custom, now)
+	if err != nil {
+		return "", nil, err
+	}
+	return " AND EXISTS (SELECT 1 FROM " + Tables[entityType] + " r WHERE r.id = " + column + " AND (" + condition + "))", args, nil
+}
+
+// Check returns why expression is not a valid one for records of entityType, or nil.
+func Check(expression, entityType string, custom []models.CustomField) error {
+	_, _, err := compile(expression, 0, entityType, custom, time.Now())
+	return err
+}
+
+func compile(expression string, orgID int, entityType string, custom []models.CustomField, now time.Time) (string, []interface{}, error) {
+	if strings.TrimSpace(expression) == "" {
+		return "", nil, fmt.Errorf("expression is empty")
+	}
+	if len(expression) > MaxLength {
+		return "", nil, fmt.Errorf("expression must be at most %d bytes", MaxLength)
+	}
+	tokens, err := lex(expression)
+	if err != nil {
+		return "", nil, err
+	}
+	p := &parser{tokens: tokens, orgID: orgID, entityType: entityType, custom: custom, now: now}
+	condition, err := p.or()
+	if err != nil {
+		return "", nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return "", nil, fmt.Errorf("at %d: unexpected %q", t.pos, t.text)
+	}
+	return condition, p.args, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenWord
+	tokenString
+	tokenNumber
+	tokenDays
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string // Unquoted for strings, without the d for days
+	pos  int    // Byte offset, from 1
+}
+
+var operators = []string{"<=", ">=", "!=", "=", "<", ">", "~"}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.'
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		pos := i + 1
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "(", pos})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")", pos})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", pos})
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("at %d: unterminated string", pos)
+			}
+			tokens = append(tokens, token{tokenString, b.String(), pos})
+			i = j + 1
+		case c == '-' || c == '+' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			// 2024-01-31 reads as a date
+			if c != '-' && c != '+' && j-i == 4 && j < len(s) && s[j] == '-' {
+				for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '-') {
+					j++
+				}
+				tokens = append(tokens, token{tokenString, s[i:j], pos})
+			} else if j < len(s) && s[j] == 'd' && (j+1 == len(s) || !isWordRune(rune(s[j+1]))) {
+				tokens = append(tokens, token{tokenDays, s[i:j], pos})
+				j++
+			} else {
+				tokens = append(tokens, token{tokenNumber, s[i:j], pos})
+			}
+			i = j
+		case strings.ContainsRune("<>=!~", rune(c)):
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("at %d: unexpected %q", pos, c)
+			}
+			tokens = append(tokens, token{tokenOperator, op, pos})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && isWordRune(rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("at %d: unexpected %q", pos, c)
+			}
+			tokens = append(tokens, token{tokenWord, s[i:j], pos})
+			i = j
+		}
+	}
+	return append(tokens, token{tokenEnd, "end of expression", len(s) + 1}), nil
+}
+
+type parser struct {
+	tokens     []token
+	next       int
+	orgID      int
+	entityType string
+	custom     []models.CustomField
+	now        time.Time
+	args       []interface{}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.next]
+	if t.kind != tokenEnd {
+		p.next++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the keyword, and takes it if so.
+func (p *parser) keyword(word string) bool {
+	if t := p.peek(); t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (string, error) {
+	left, err := p.and()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return "", err
+		}
+		left = "(" + left + " OR " + right + ")"
+	}
+	return left, nil
+}
+
+func (p *parser) and() (string, error) {
+	left, err := p.not()
+	if err != nil {
+		return "", err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return "", err
+		}
+		left = left + " AND " + right
+	}
+	return left, nil
+}
+
+func (p *parser) not() (string, error) {
+	if p.keyword("NOT") {
+		operand, err := p.not()
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + operand + ")", nil
+	}
+	if p.peek().kind == tokenOpen {
+		p.take()
+		inner, err := p.or()
+		if err != nil {
+			return "", err
+		}
+		if t := p.take(); t.kind != tokenClose {
+			return "", fmt.Errorf("at %d: expected ) but found %q", t.pos, t.text)
+		}
+		return "(" + inner + ")", nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (string, error) {
+	name := p.take()
+	if name.kind != tokenWord {
+		return "", fmt.Errorf("at %d: expected a field but found %q", name.pos, name.text)
+	}
+	if p.keyword("IN") {
+		if t := p.take(); t.kind != tokenOpen {
+			return "", fmt.Errorf("at %d: expected ( after IN", t.pos)
+		}
+		var alternatives []string
+		for {
+			condition, err := p.compare(name, "=", p.take())
+			if err != nil {
+				return "", err
+			}
+			alternatives = append(alternatives, condition)
+			t := p.take()
+			if t.kind == tokenClose {
+				break
+			}
+			if t.kind != tokenComma {
+				return "", fmt.Errorf("at %d: expected , or ) but found %q", t.pos, t.text)
+			}
+		}
+		return "(" + strings.Join(alternatives, " OR ") + ")", nil
+	}
+	op := p.take()
+	if op.kind != tokenOperator {
+		return "", fmt.Errorf("at %d: expected an operator after %s but found %q", op.pos, name.text, op.text)
+	}
+	return p.compare(name, op.text, p.take())
+}
+
+// compare returns the condition comparing a field with a value.
+func (p *parser) compare(name token, op string, value token) (string, error) {
+	fail := func(format string, a ...interface{}) (string, error) {
+		return "", fmt.Errorf("at %d: %s %s", name.pos, name.text, fmt.Sprintf(format, a...))
+	}
+	isNull := value.kind == tokenWord && strings.EqualFold(value.text, "null")
+	if isNull && op != "=" && op != "!=" {
+		return fail("can only be compared with null using = or !=")
+	}
+
+	if name.text == "tag" {
+		return p.membership(name, op, value, isNull, `SELECT 1 FROM record_tags rt JOIN tags t ON t.id = rt.tag_id
+		WHERE rt.entity_type = '`+p.entityType+`' AND rt.entity_id = r.id AND t.org_id = ?`, []interface{}{p.orgID}, "t.name")
+	}
+
+	var f field
+	if key, ok := strings.CutPrefix(name.text, customfields.ParamPrefix); ok {
+		i := slices.IndexFunc(p.custom, func(cf models.CustomField) bool { return cf.Key == key })
+		if i < 0 {
+			return fail("is not a custom field")
+		}
+		cf := p.custom[i]
+		stored := fmt.Sprintf("(SELECT v.value FROM custom_field_values v WHERE v.field_id = %d AND v.entity_id = r.id)", cf.ID)
+		switch cf.Type {
+		case models.CustomFieldMultiSelect:
+			return p.membership(name, op, value, isNull, fmt.Sprintf(
+				"SELECT 1 FROM custom_field_values v, json_each(v.value) o WHERE v.field_id = %d AND v.entity_id = r.id", cf.ID), nil, "o.value")
+		case models.CustomFieldNumber:
+			f = field{number, stored}
+		case models.CustomFieldDate:
+			f = field{date, stored}
+		case models.CustomFieldBoolean:
+			f = field{boolean, stored}
+		default:
+			f = field{text, stored}
+		}
+	} else {
+		var ok bool
+		if f, ok = fields[p.entityType][name.text]; !ok {
+			return fail("is not a field")
+		}
+	}
+
+	if isNull {
+		condition := f.sql + " IS NULL"
+		if f.kind == text {
+			condition = "(" + f.sql + " IS NULL OR " + f.sql + " = '')"
+		}
+		if op == "!=" {
+			condition = "NOT " + condition
+		}
+		return condition, nil
+	}
+
+	var (
+		column = f.sql
+		arg    interface{}
+	)
+	switch f.kind {
+	case text:
+		if value.kind != tokenString {
+			return fail("must be compared with a quoted string")
+		}
+		if op == "~" {
+			p.args = append(p.args, "%"+escapeLike(value.text)+"%")
+			return column + ` LIKE ? ESCAPE '\'`, nil
+		}
+		p.args = append(p.args, value.text)
+		if op == "!=" {
+			return column + " IS NOT ? COLLATE NOCASE", nil
+		}
+		return column + " " + op + " ? COLLATE NOCASE", nil
+	case number:
+		n, err := strconv.ParseFloat(value.text, 64)
+		if value.kind != tokenNumber || err != nil {
+			return fail("must be compared with a number")
+		}
+		arg = n
+	case date:
+		d, ok := p.date(value)
+		if !ok {
+			return fail("must be compared with a date such as 2024-01-31, today or -30d")
+		}
+		column, arg = "date("+column+")", d
+	case boolean:
+		if op != "=" && op != "!=" {
+			return fail("can only be compared using = or !=")
+		}
+		switch {
+		case value.kind == tokenWord && strings.EqualFold(value.text, "true"):
+			arg = 1
+		case value.kind == tokenWord && strings.EqualFold(value.text, "false"):
+			arg = 0
+		default:
+			return fail("must be compared with true or false")
+		}
+	}
+	if op == "~" {
+		return fail("cannot be compared using ~")
+	}
+	p.args = append(p.args, arg)
+	if op == "!=" {
+		return column + " IS NOT ?", nil
+	}
+	return column + " " + op + " ?", nil
+}
+
+// membership returns the condition on a field holding a set of names, read by
+// the query selecting the record's members with their name in column: = and !=
+// test whether one is among them, ~ whether one contains the text, and null
+// compares with an empty set.
+func (p *parser) membership(name token, op string, value token, isNull bool, query string, args []interface{}, column string) (string, error) {
+	p.args = append(p.args, args...)
+	if isNull {
+		if op == "=" {
+			return "NOT EXISTS (" + query + ")", nil
+		}
+		return "EXISTS (" + query + ")", nil
+	}
+	if value.kind != tokenString {
+		return "", fmt.Errorf("at %d: %s must be compared with a quoted string", name.pos, name.text)
+	}
+	switch op {
+	case "=":
+		p.args = append(p.args, value.text)
+		return "EXISTS (" + query + " AND " + column + " = ? COLLATE NOCASE)", nil
+	case "!=":
+		p.args = append(p.args, value.text)
+		return "NOT EXISTS (" + query + " AND " + column + " = ? COLLATE NOCASE)", nil
+	case "~":
+		p.args = append(p.args, "%"+escapeLike(value.text)+"%")
+		return "EXISTS (" + query + " AND " + column + ` LIKE ? ESCAPE '\')`, nil
+	}
+	return "", fmt.Errorf("at %d: %s can only be compared using =, != or ~", name.pos, name.text)
+}
+
+// date reads a date value as YYYY-MM-DD.
+func (p *parser) date(value token) (string, bool) {
+	switch {
+	case value.kind == tokenWord && strings.EqualFold(value.text, "today"):
+		return p.now.Format(customfields.DateLayout), true
+	case value.kind == tokenDays:
+		days, err := strconv.Atoi(value.text)
+		if err != nil {
+			return "", false
+		}
+		return p.now.AddDate(0, 0, days).Format(customfields.DateLayout), true
+	case value.kind == tokenString:
+		if _, err := time.Parse(customfields.DateLayout, value.text); err != nil {
+			return "", false
+		}
+		return value.text, true
+	}
+	return "", false
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
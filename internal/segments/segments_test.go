@@ -0,0 +1,189 @@
+package segments
+
+import (
+	"micro-CRM/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []token
+	}{
+		{"created_at > 2024-01-31", []token{
+			{tokenWord, "created_at", 1}, {tokenOperator, ">", 12}, {tokenString, "2024-01-31", 14},
+		}},
+		{"2024-01-31)", []token{{tokenString, "2024-01-31", 1}, {tokenClose, ")", 11}}},
+		{"-30d", []token{{tokenDays, "-30", 1}}},
+		{"+7d", []token{{tokenDays, "+7", 1}}},
+		{"7days", []token{{tokenNumber, "7", 1}, {tokenWord, "days", 2}}},
+		{"2024", []token{{tokenNumber, "2024", 1}}},
+		{"12.5", []token{{tokenNumber, "12.5", 1}}},
+		{"-2024-01", []token{{tokenNumber, "-2024", 1}, {tokenNumber, "-01", 6}}},
+		{`"a \"b\" c"`, []token{{tokenString, `a "b" c`, 1}}},
+		{`'x'`, []token{{tokenString, "x", 1}}},
+		{"a<=b!=c~d", []token{
+			{tokenWord, "a", 1}, {tokenOperator, "<=", 2}, {tokenWord, "b", 4},
+			{tokenOperator, "!=", 5}, {tokenWord, "c", 7}, {tokenOperator, "~", 8}, {tokenWord, "d", 9},
+		}},
+		{"x IN (1, 2)", []token{
+			{tokenWord, "x", 1}, {tokenWord, "IN", 3}, {tokenOpen, "(", 6},
+			{tokenNumber, "1", 7}, {tokenComma, ",", 8}, {tokenNumber, "2", 10}, {tokenClose, ")", 11},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := lex(tt.in)
+			if err != nil {
+				t.Fatalf("lex(%q): %v", tt.in, err)
+			}
+			want := append(tt.want, token{tokenEnd, "end of expression", len(tt.in) + 1})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("lex(%q) = %v, want %v", tt.in, got, want)
+			}
+		})
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	for _, in := range []string{`name = "open`, "a ! b", "a # b"} {
+		if _, err := lex(in); err == nil {
+			t.Errorf("lex(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"fintech", "fintech"},
+		{"100%", `100\%`},
+		{"first_name", `first\_name`},
+		{`C:\temp`, `C:\\temp`},
+		{`\%_`, `\\\%\_`},
+	}
+	for _, tt := range tests {
+		if got := escapeLike(tt.in); got != tt.want {
+			t.Errorf("escapeLike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+var custom = []models.CustomField{
+	{ID: 4, Key: "renewal", Type: models.CustomFieldDate},
+	{ID: 5, Key: "seats", Type: models.CustomFieldNumber},
+	{ID: 6, Key: "regions", Type: models.CustomFieldMultiSelect},
+}
+
+func TestCompile(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		in        string
+		entity    string
+		condition string
+		args      []interface{}
+	}{
+		{"text", `pipeline_stage = "Qualified"`, models.EntityContact,
+			"r.pipeline_stage = ? COLLATE NOCASE", []interface{}{"Qualified"}},
+		{"not equal", `email != "a@b.c"`, models.EntityContact,
+			"r.email IS NOT ? COLLATE NOCASE", []interface{}{"a@b.c"}},
+		{"contains escapes wildcards", `company.industry ~ "50%_off"`, models.EntityContact,
+			companyOf("industry") + ` LIKE ? ESCAPE '\'`, []interface{}{`%50\%\_off%`}},
+		{"date literal", "created_at >= 2024-01-31", models.EntityContact,
+			"date(r.created_at) >= ?", []interface{}{"2024-01-31"}},
+		{"relative date", "last_interaction_at < -30d", models.EntityContact,
+			"date(r.last_interaction_at) < ?", []interface{}{"2024-02-14"}},
+		{"today", "next_action_at = today", models.EntityContact,
+			"date(r.next_action_at) = ?", []interface{}{"2024-03-15"}},
+		{"number", "company_size > 50", models.EntityCompany,
+			"r.company_size > ?", []interface{}{50.0}},
+		{"null text", "job_title = null", models.EntityContact,
+			"(r.job_title IS NULL OR r.job_title = '')", nil},
+		{"not null", "company_id != null", models.EntityContact,
+			"NOT r.company_id IS NULL", nil},
+		{"precedence", `name = "a" OR name = "b" AND NOT notes ~ "c"`, models.EntityCompany,
+			`(r.name = ? COLLATE NOCASE OR r.name = ? COLLATE NOCASE AND NOT (r.notes LIKE ? ESCAPE '\'))`,
+			[]interface{}{"a", "b", "%c%"}},
+		{"in", `industry IN ("saas", "retail")`, models.EntityCompany,
+			"(r.industry = ? COLLATE NOCASE OR r.industry = ? COLLATE NOCASE)", []interface{}{"saas", "retail"}},
+		{"custom date", "cf.renewal < 2024-06-01", models.EntityCompany,
+			"date((SELECT v.value FROM custom_field_values v WHERE v.field_id = 4 AND v.entity_id = r.id)) < ?",
+			[]interface{}{"2024-06-01"}},
+		{"tag", `tag = "VIP"`, models.EntityContact,
+			`EXISTS (SELECT 1 FROM record_tags rt JOIN tags t ON t.id = rt.tag_id
+		WHERE rt.entity_type = 'contact' AND rt.entity_id = r.id AND t.org_id = ? AND t.name = ? COLLATE NOCASE)`,
+			[]interface{}{7, "VIP"}},
+		{"multi-select contains", `cf.regions ~ "eu_"`, models.EntityContact,
+			`EXISTS (SELECT 1 FROM custom_field_values v, json_each(v.value) o WHERE v.field_id = 6 AND v.entity_id = r.id AND o.value LIKE ? ESCAPE '\')`,
+			[]interface{}{`%eu\_%`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition, args, err := compile(tt.in, 7, tt.entity, custom, now)
+			if err != nil {
+				t.Fatalf("compile(%q): %v", tt.in, err)
+			}
+			if condition != tt.condition {
+				t.Errorf("compile(%q) condition = %s, want %s", tt.in, condition, tt.condition)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("compile(%q) args = %#v, want %#v", tt.in, args, tt.args)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		in     string
+		entity string
+		errHas string // Empty for a valid expression
+	}{
+		{`name ~ "acme" AND (contacts.count > 2 OR tag != null)`, models.EntityCompany, ""},
+		{"cf.seats >= 10", models.EntityContact, ""},
+		{"", models.EntityContact, "empty"},
+		{strings.Repeat("a", MaxLength+1), models.EntityContact, "at most"},
+		{`colour = "red"`, models.EntityContact, "is not a field"},
+		{`contacts.count > 2`, models.EntityContact, "is not a field"},
+		{`cf.missing = "x"`, models.EntityContact, "is not a custom field"},
+		{"name = acme", models.EntityCompany, "quoted string"},
+		{`company_size > "big"`, models.EntityCompany, "number"},
+		{"created_at > 2024-02-30", models.EntityCompany, "date"},
+		{"created_at > 2024-1-5", models.EntityCompany, "date"},
+		{"company_size ~ 5", models.EntityCompany, "cannot be compared using ~"},
+		{"name > null", models.EntityCompany, "null"},
+		{`(name = "a"`, models.EntityCompany, "expected )"},
+		{`name = "a" name = "b"`, models.EntityCompany, "unexpected"},
+		{`name "a"`, models.EntityCompany, "expected an operator"},
+		{`name IN ("a" "b")`, models.EntityCompany, "expected , or )"},
+		{`tag > "VIP"`, models.EntityCompany, "=, != or ~"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			err := Check(tt.in, tt.entity, custom)
+			switch {
+			case tt.errHas == "" && err != nil:
+				t.Errorf("Check(%q): %v", tt.in, err)
+			case tt.errHas != "" && (err == nil || !strings.Contains(err.Error(), tt.errHas)):
+				t.Errorf("Check(%q) = %v, want an error containing %q", tt.in, err, tt.errHas)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	condition, args, err := Filter(`first_name = "Ada"`, 1, models.EntityContact, "contacts.id", nil, time.Now())
+	if err != nil {
+		t.Fatalf("Filter: %v", err)
+	}
+	want := " AND EXISTS (SELECT 1 FROM contacts r WHERE r.id = contacts.id AND (r.first_name = ? COLLATE NOCASE))"
+	if condition != want {
+		t.Errorf("Filter condition = %s, want %s", condition, want)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"Ada"}) {
+		t.Errorf("Filter args = %#v", args)
+	}
+}
@@ -0,0 +1,178 @@
+// Package tags keeps each organization's tag catalogue and the tags put on its
+// companies, contacts, tasks, interactions and files.
+package tags
+
+import (
+	"database/sql"
+	"micro-CRM/internal/models"
+	"regexp"
+	"strings"
+)
+
+// DefaultColor is used for tags created without one.
+const DefaultColor = "#999999"
+
+// Tables maps the record types that can be tagged to their table.
+var Tables = map[string]string{
+	models.EntityCompany:     "companies",
+	models.EntityContact:     "contacts",
+	models.EntityTask:        "tasks",
+	models.EntityInteraction: "interactions",
+	models.EntityFile:        "files",
+}
+
+// Columns are the tags columns in the order Scan reads them.
+const Columns = `id, org_id, name, color, created_by, created_at, updated_at`
+
+// Querier is satisfied by both *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// ValidColor reports whether color is a #RRGGBB hex color.
+func ValidColor(color string) bool {
+	return colorPattern.MatchString(color)
+}
+
+// Scan reads a row selected with Columns.
+func Scan(row interface{ Scan(...interface{}) error }, t *models.Tag) error {
+	return row.Scan(&t.ID, &t.OrgID, &t.Name, &t.Color, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt)
+}
+
+func placeholders(n int) string {
+	return "(?" + strings.Repeat(", ?", n-1) + ")"
+}
+
+func intArgs(ids []int) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
+
+// Filter returns the condition, to AND to a query on records of entityType,
+// keeping those whose id column carries every one of the organization's tags
+// named in names. Names match ignoring case.
+func Filter(orgID int, entityType, column string, names []string) (string, []interface{}) {
+	var (
+		clause string
+		args   []interface{}
+	)
+	for _, name := range names {
+		clause += " AND " + column + ` IN (
+		SELECT rt.entity_id FROM record_tags rt JOIN tags t ON t.id = rt.tag_id
+		WHERE rt.entity_type = ? AND t.org_id = ? AND t.name = ?)`
+		args = append(args, entityType, orgID, strings.TrimSpace(name))
+	}
+	return clause, args
+}
+
+// Load returns the organization's tags on the records of entityType with the
+// given ids, by record id and sorted by name.
+func Load(q Querier, orgID int, entityType string, ids []int) (map[int][]models.Tag, error) {
+	byRecord := make(map[int][]models.Tag)
+	if len(ids) == 0 {
+		return byRecord, nil
+	}
+	rows, err := q.Query(`
+	SELECT rt.entity_id, t.id, t.org_id, t.name, t.color, t.created_by, t.created_at, t.updated_at
+	FROM record_tags rt JOIN tags t ON t.id = rt.tag_id
+	WHERE t.org_id = ? AND rt.entity_type = ? AND rt.entity_id IN `+placeholders(len(ids))+`
+	ORDER BY t.name, t.id`, append([]interface{}{orgID, entityType}, intArgs(ids)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			recordID int
+			t        models.Tag
+		)
+		if err := rows.Scan(&recordID, &t.ID, &t.OrgID, &t.Name, &t.Color, &t.CreatedBy, &t.CreatedAt, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		byRecord[recordID] = append(byRecord[recordID], t)
+	}
+	return byRecord, rows.Err()
+}
+
+// Owned reports whether every tag id belongs to the organization.
+func Owned(q Querier, orgID int, tagIDs []int) (bool, error) {
+	if len(tagIDs) == 0 {
+		return true, nil
+	}
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM tags WHERE org_id = ? AND id IN "+placeholders(len(tagIDs)),
+		append([]interface{}{orgID}, intArgs(tagIDs)...)...).Scan(&n)
+	return n == len(tagIDs), err
+}
+
+// Taggable reports whether every id is a live record of entityType belonging to
+// the organization.
+func Taggable(q Querier, orgID int, entityType string, ids []int) (bool, error) {
+	if len(ids) == 0 {
+		return true, nil
+	}
+	var n int
+	err := q.QueryRow("SELECT COUNT(*) FROM "+Tables[entityType]+" WHERE org_id = ? AND deleted_at IS NULL AND id IN "+placeholders(len(ids)),
+		append([]interface{}{orgID}, intArgs(ids)...)...).Scan(&n)
+	return n == len(ids), err
+}
+
+// Add puts every tag on every record, skipping the tags a record already has,
+// and returns how many it added. Ids must be distinct.
+func Add(q Querier, tagIDs []int, entityType string, ids []int, userID int) (int64, error) {
+	var added int64
+	for _, tagID := range tagIDs {
+		for _, id := range ids {
+			res, err := q.Exec("INSERT OR IGNORE INTO record_tags (tag_id, entity_type, entity_id, tagged_by) VALUES (?, ?, ?, ?)",
+				tagID, entityType, id, userID)
+			if err != nil {
+				return added, err
+			}
+			n, _ := res.RowsAffected()
+			added += n
+		}
+	}
+	return added, nil
+}
+
+// Remove takes the tags off the records and returns how many it removed.
+func Remove(q Querier, tagIDs []int, entityType string, ids []int) (int64, error) {
+	if len(tagIDs) == 0 || len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := q.Exec("DELETE FROM record_tags WHERE entity_type = ? AND tag_id IN "+placeholders(len(tagIDs))+" AND entity_id IN "+placeholders(len(ids)),
+		append(append([]interface{}{entityType}, intArgs(tagIDs)...), intArgs(ids)...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Set replaces the tags of one record with tagIDs, keeping when and by whom
+// the tags it already had were put on it.
+func Set(q Querier, entityType string, id int, tagIDs []int, userID int) error {
+	query := "DELETE FROM record_tags WHERE entity_type = ? AND entity_id = ?"
+	args := []interface{}{entityType, id}
+	if len(tagIDs) > 0 {
+		query += " AND tag_id NOT IN " + placeholders(len(tagIDs))
+		args = append(args, intArgs(tagIDs)...)
+	}
+	if _, err := q.Exec(query, args...); err != nil {
+		return err
+	}
+	_, err := Add(q, tagIDs, entityType, []int{id}, userID)
+	return err
+}
+
+// Delete removes a tag from the catalogue and from every record carrying it.
+func Delete(q Querier, tagID int) error {
+	_, err := q.Exec("DELETE FROM tags WHERE id = ?", tagID)
+	return err
+}
@@ -0,0 +1,155 @@
+// Package timeline merges the interactions, tasks, files, stage changes and
+// notes edits of a contact or company into one stream, newest first.
+package timeline
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/models"
+	"strconv"
+	"strings"
+)
+
+// Kinds are the kinds of items a timeline merges.
+var Kinds = []string{
+	models.TimelineInteraction,
+	models.TimelineTask,
+	models.TimelineFile,
+	models.TimelineStageChange,
+	models.TimelineNote,
+}
+
+// Cursor is the position of an item in a timeline; the items after it are
+// older, or as old with a lower kind and id.
+type Cursor struct {
+	OccurredAt string
+	Kind       string
+	ID         int
+}
+
+// Encode returns the cursor as an opaque URL-safe string.
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.OccurredAt + "|" + c.Kind + "|" + strconv.Itoa(c.ID)))
+}
+
+// ErrCursor is returned by DecodeCursor for strings Encode did not produce.
+var ErrCursor = errors.New("invalid cursor")
+
+// DecodeCursor reverses Encode.
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrCursor
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return Cursor{}, ErrCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return Cursor{}, ErrCursor
+	}
+	return Cursor{OccurredAt: parts[0], Kind: parts[1], ID: id}, nil
+}
+
+// scope holds the conditions picking the rows of one contact or company.
+type scope struct {
+	contacts func(column string) string // the record's contacts
+	files    string                     // files aliased f
+	records  string                     // stage_transitions or audit_events aliased e
+}
+
+func scopeOf(entityType string) scope {
+	const companyContacts = "(SELECT id FROM contacts WHERE company_id = ?2 AND deleted_at IS NULL)"
+	if entityType == models.EntityCompany {
+		return scope{
+			contacts: func(column string) string { return column + " IN " + companyContacts },
+			files:    "(f.company_id = ?2 OR f.contact_id IN " + companyContacts + ")",
+			records: fmt.Sprintf(`((e.entity_type = '%s' AND e.entity_id = ?2)
+			OR (e.entity_type = '%s' AND e.entity_id IN %s)
+			OR (e.entity_type = '%s' AND e.entity_id IN (SELECT id FROM deals WHERE company_id = ?2 AND deleted_at IS NULL)))`,
+				models.EntityCompany, models.EntityContact, companyContacts, models.EntityDeal),
+		}
+	}
+	return scope{
+		contacts: func(column string) string { return column + " = ?2" },
+		files:    "f.contact_id = ?2",
+		records: fmt.Sprintf(`((e.entity_type = '%s' AND e.entity_id = ?2)
+			OR (e.entity_type = '%s' AND e.entity_id IN (
+				SELECT dc.deal_id FROM deal_contacts dc JOIN deals d ON d.id = dc.deal_id
+				WHERE dc.contact_id = ?2 AND d.deleted_at IS NULL)))`,
+			models.EntityContact, models.EntityDeal),
+	}
+}
+
+// Each kind selects kind, id, occurred_at, user_id, contact_id, entity_type,
+// entity_id, title, description, type, status, from_stage and to_stage. Times
+// are normalized by datetime() so that they sort together.
+func kindQuery(kind string, s scope) string {
+	switch kind {
+	case models.TimelineInteraction:
+		return `SELECT '` + kind + `', i.id, COALESCE(datetime(i.interaction_at), datetime(i.created_at)), i.user_id, i.contact_id,
+			NULL, NULL, i.subject, i.description, i.type, NULL, NULL, NULL
+		FROM interactions i WHERE i.org_id = ?1 AND i.deleted_at IS NULL AND ` + s.contacts("i.contact_id")
+	case models.TimelineTask:
+		return `SELECT '` + kind + `', t.id, datetime(t.created_at), t.user_id, t.contact_id,
+			NULL, NULL, t.title, t.description, NULL, t.status, NULL, NULL
+		FROM tasks t WHERE t.org_id = ?1 AND t.deleted_at IS NULL AND ` + s.contacts("t.contact_id")
+	case models.TimelineFile:
+		return `SELECT '` + kind + `', f.id, datetime(f.uploaded_at), f.user_id, f.contact_id,
+			NULL, NULL, f.file_name, NULL, f.file_type, NULL, NULL, NULL
+		FROM files f WHERE f.org_id = ?1 AND f.deleted_at IS NULL AND ` + s.files
+	case models.TimelineStageChange:
+		return `SELECT '` + kind + `', e.id, datetime(e.changed_at), e.changed_by,
+			CASE WHEN e.entity_type = '` + models.EntityContact + `' THEN e.entity_id END,
+			e.entity_type, e.entity_id, NULL, NULL, NULL, NULL, e.from_stage, e.to_stage
+		FROM stage_transitions e WHERE e.org_id = ?1 AND ` + s.records
+	case models.TimelineNote:
+		return `SELECT '` + kind + `', e.id, datetime(e.created_at), e.actor_id,
+			CASE WHEN e.entity_type = '` + models.EntityContact + `' THEN e.entity_id END,
+			e.entity_type, e.entity_id, NULL, json_extract(e.changes, '$.notes.after'), NULL, NULL, NULL, NULL
+		FROM audit_events e WHERE e.org_id = ?1 AND json_type(e.changes, '$.notes') IS NOT NULL AND ` + s.records
+	}
+	return ""
+}
+
+// List returns up to limit items of the kinds on the timeline of a contact or
+// company of the organization, newest first, starting after before when set.
+func List(db *sql.DB, orgID int, entityType string, entityID int, kinds []string, before *Cursor, limit int) ([]models.TimelineItem, error) {
+	s := scopeOf(entityType)
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = kindQuery(kind, s)
+	}
+	query := `
+	WITH items (kind, id, occurred_at, user_id, contact_id, entity_type, entity_id,
+		title, description, type, status, from_stage, to_stage) AS (` + strings.Join(parts, "\nUNION ALL\n") + `)
+	SELECT * FROM items
+	WHERE occurred_at IS NOT NULL AND (?3 IS NULL OR (occurred_at, kind, id) < (?3, ?4, ?5))
+	ORDER BY occurred_at DESC, kind DESC, id DESC
+	LIMIT ?6`
+	args := []interface{}{orgID, entityID, nil, nil, nil, limit}
+	if before != nil {
+		args[2], args[3], args[4] = before.OccurredAt, before.Kind, before.ID
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []models.TimelineItem{}
+	for rows.Next() {
+		var item models.TimelineItem
+		if err := rows.Scan(&item.Kind, &item.ID, &item.OccurredAt, &item.UserID, &item.ContactID,
+			&item.EntityType, &item.EntityID, &item.Title, &item.Description, &item.Type, &item.Status,
+			&item.FromStage, &item.ToStage); err != nil {
+			return nil, err
+		}
+		item.Cursor = Cursor{OccurredAt: item.OccurredAt, Kind: item.Kind, ID: item.ID}.Encode()
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
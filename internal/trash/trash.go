@@ -0,0 +1,342 @@
+// Package trash keeps deleted CRM records restorable for a retention period.
+// Deleting a record only stamps its deleted_at; queries skip stamped rows, and
+// the Purger removes the ones trashed before the retention period for good.
+package trash
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"micro-CRM/internal/audit"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"os"
+	"time"
+)
+
+// DefaultRetention is how long records stay in the trash before they are purged.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Layout is the format of deleted_at, the same as CURRENT_TIMESTAMP.
+const Layout = "2006-01-02 15:04:05"
+
+var (
+	ErrNotFound      = errors.New("record not found in the trash")
+	ErrParentTrashed = errors.New("record belongs to a record that is in the trash")
+)
+
+// Entity describes a record type that goes to the trash.
+type Entity struct {
+	Table string
+	Label string // Expression naming a record in the trash listing
+	// ParentColumn references the record of ParentType this one cannot be
+	// restored without, if any.
+	ParentColumn, ParentType string
+	// Children are records of that type referencing this one through Column;
+	// they are trashed and restored along with it.
+	Children []Link
+	// cleanup removes or detaches the rows referencing a purged record that no
+	// foreign key action covers; each statement takes its id.
+	cleanup []string
+}
+
+type Link struct {
+	EntityType, Column string
+}
+
+// Entities maps the record types that go to the trash to their description.
+var Entities = map[string]Entity{
+	models.EntityCompany: {
+		Table: "companies",
+		Label: "name",
+		cleanup: []string{
+			"DELETE FROM stage_transitions WHERE entity_type = '" + models.EntityCompany + "' AND entity_id = ?",
+			"DELETE FROM record_shares WHERE entity_type = '" + models.EntityCompany + "' AND entity_id = ?",
+			"DELETE FROM record_tags WHERE entity_type = '" + models.EntityCompany + "' AND entity_id = ?",
+			"DELETE FROM custom_field_values WHERE entity_type = '" + models.EntityCompany + "' AND entity_id = ?",
+		},
+	},
+	models.EntityContact: {
+		Table:    "contacts",
+		Label:    "first_name || ' ' || last_name",
+		Children: []Link{{models.EntityInteraction, "contact_id"}},
+		cleanup: []string{
+			"DELETE FROM stage_transitions WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?",
+			"DELETE FROM record_shares WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?",
+			"DELETE FROM record_tags WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?",
+			"DELETE FROM custom_field_values WHERE entity_type = '" + models.EntityContact + "' AND entity_id = ?",
+		},
+	},
+	models.EntityDeal: {
+		Table: "deals",
+		Label: "title",
+		cleanup: []string{
+			"DELETE FROM stage_transitions WHERE entity_type = '" + models.EntityDeal + "' AND entity_id = ?",
+			"DELETE FROM record_shares WHERE entity_type = '" + models.EntityDeal + "' AND entity_id = ?",
+			"DELETE FROM custom_field_values WHERE entity_type = '" + models.EntityDeal + "' AND entity_id = ?",
+		},
+	},
+	models.EntityInteraction: {
+		Table:        "interactions",
+		Label:        "subject",
+		ParentColumn: "contact_id",
+		ParentType:   models.EntityContact,
+		cleanup: []string{
+			"DELETE FROM reminders_sent WHERE entity_type = '" + models.EntityInteraction + "' AND entity_id = ?",
+			"DELETE FROM record_tags WHERE entity_type = '" + models.EntityInteraction + "' AND entity_id = ?",
+			"UPDATE files SET interaction_id = NULL WHERE interaction_id = ?",
+		},
+	},
+	models.EntityTask: {
+		Table:        "tasks",
+		Label:        "title",
+		ParentColumn: "parent_id",
+		ParentType:   models.EntityTask,
+		Children:     []Link{{models.EntityTask, "parent_id"}},
+		cleanup: []string{
+			"DELETE FROM reminders_sent WHERE entity_type = '" + models.EntityTask + "' AND entity_id = ?",
+			"DELETE FROM record_tags WHERE entity_type = '" + models.EntityTask + "' AND entity_id = ?",
+			"DELETE FROM custom_field_values WHERE entity_type = '" + models.EntityTask + "' AND entity_id = ?",
+			"UPDATE tasks SET parent_id = NULL WHERE parent_id = ?",
+		},
+	},
+	models.EntityFile: {
+		Table: "files",
+		Label: "file_name",
+		cleanup: []string{
+			"DELETE FROM record_shares WHERE entity_type = '" + models.EntityFile + "' AND entity_id = ?",
+			"DELETE FROM record_tags WHERE entity_type = '" + models.EntityFile + "' AND entity_id = ?",
+		},
+	},
+}
+
+// purgeOrder purges records before the ones they hang off, so a contact's
+// interactions go before the contact.
+var purgeOrder = []string{
+	models.EntityFile, models.EntityInteraction, models.EntityTask, models.EntityDeal, models.EntityContact, models.EntityCompany,
+}
+
+// Record identifies a record moved to or restored from the trash.
+type Record struct {
+	EntityType string
+	ID         int
+	DeletedAt  string // The stamp it was trashed with
+}
+
+// Now returns the deleted_at stamp for records trashed now. Records trashed in
+// one operation share a stamp, which is how Restore finds them again.
+func Now() string {
+	return time.Now().UTC().Format(Layout)
+}
+
+// Move puts a live record of the organization in the trash together with its
+// children, stamping them with at. It returns the records it moved, none when
+// no such record is live.
+func Move(q audit.Querier, entityType string, id, orgID int, at string) ([]Record, error) {
+	e, ok := Entities[entityType]
+	if !ok {
+		return nil, fmt.Errorf("%s records have no trash", entityType)
+	}
+	result, err := q.Exec("UPDATE "+e.Table+" SET deleted_at = ? WHERE id = ? AND org_id = ? AND deleted_at IS NULL", at, id, orgID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot trash %s %d: %w", entityType, id, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, nil
+	}
+	moved := []Record{{entityType, id, at}}
+	for _, child := range e.Children {
+		ids, err := childIDs(q, child, id, "deleted_at IS NULL")
+		if err != nil {
+			return nil, err
+		}
+		for _, childID := range ids {
+			records, err := Move(q, child.EntityType, childID, orgID, at)
+			if err != nil {
+				return nil, err
+			}
+			moved = append(moved, records...)
+		}
+	}
+	return moved, nil
+}
+
+// Restore takes a record of the organization out of the trash together with the
+// children trashed along with it. It returns the records it restored, or
+// ErrNotFound and ErrParentTrashed.
+func Restore(q audit.Querier, entityType string, id, orgID int) ([]Record, error) {
+	e, ok := Entities[entityType]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var (
+		deletedAt string
+		parentID  sql.NullInt64
+	)
+	parent := "NULL"
+	if e.ParentColumn != "" {
+		parent = e.ParentColumn
+	}
+	err := q.QueryRow("SELECT deleted_at, "+parent+" FROM "+e.Table+" WHERE id = ? AND org_id = ? AND deleted_at IS NOT NULL", id, orgID).
+		Scan(&deletedAt, &parentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s %d: %w", entityType, id, err)
+	}
+	if parentID.Valid {
+		var trashed bool
+		if err := q.QueryRow("SELECT EXISTS(SELECT 1 FROM "+Entities[e.ParentType].Table+" WHERE id = ? AND deleted_at IS NOT NULL)", parentID.Int64).
+			Scan(&trashed); err != nil {
+			return nil, fmt.Errorf("cannot load %s %d: %w", e.ParentType, parentID.Int64, err)
+		}
+		if trashed {
+			return nil, ErrParentTrashed
+		}
+	}
+	return restore(q, entityType, id, deletedAt)
+}
+
+func restore(q audit.Querier, entityType string, id int, deletedAt string) ([]Record, error) {
+	e := Entities[entityType]
+	if _, err := q.Exec("UPDATE "+e.Table+" SET deleted_at = NULL WHERE id = ?", id); err != nil {
+		return nil, fmt.Errorf("cannot restore %s %d: %w", entityType, id, err)
+	}
+	restored := []Record{{entityType, id, deletedAt}}
+	for _, child := range e.Children {
+		// Children trashed on their own before stay in the trash
+		ids, err := childIDs(q, child, id, "deleted_at = ?", deletedAt)
+		if err != nil {
+			return nil, err
+		}
+		for _, childID := range ids {
+			records, err := restore(q, child.EntityType, childID, deletedAt)
+			if err != nil {
+				return nil, err
+			}
+			restored = append(restored, records...)
+		}
+	}
+	return restored, nil
+}
+
+func childIDs(q audit.Querier, child Link, parentID int, cond string, args ...interface{}) ([]int, error) {
+	rows, err := q.Query("SELECT id FROM "+Entities[child.EntityType].Table+" WHERE "+child.Column+" = ? AND "+cond,
+		append([]interface{}{parentID}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load %s records: %w", child.EntityType, err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Purger removes records trashed longer than Retention ago each time it runs;
+// it is meant to be registered as a scheduler job.
+type Purger struct {
+	DB        *sql.DB
+	Log       logger.Logger
+	Retention time.Duration
+}
+
+func NewPurger(db *sql.DB, log logger.Logger, retention time.Duration) *Purger {
+	return &Purger{DB: db, Log: log, Retention: retention}
+}
+
+// Run purges every expired record along with the rows referencing it and, for
+// files, the stored blob.
+func (p *Purger) Run(ctx context.Context) error {
+	cutoff := time.Now().UTC().Add(-p.Retention).Format(Layout)
+	purged := 0
+	for _, entityType := range purgeOrder {
+		rows, err := p.DB.Query("SELECT id FROM "+Entities[entityType].Table+" WHERE deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+		if err != nil {
+			return fmt.Errorf("cannot load expired %s records: %w", entityType, err)
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("cannot load expired %s records: %w", entityType, err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("cannot load expired %s records: %w", entityType, err)
+		}
+
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := p.purge(entityType, id); err != nil {
+				return err
+			}
+			purged++
+		}
+	}
+	if purged > 0 {
+		p.Log.Info("Purged %d records from the trash", purged)
+	}
+	return nil
+}
+
+func (p *Purger) purge(entityType string, id int) error {
+	e := Entities[entityType]
+	var before map[string]interface{}
+	if _, audited := audit.Tables[entityType]; audited {
+		var err error
+		if before, err = audit.Snapshot(p.DB, entityType, id); err != nil {
+			return err
+		}
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start purge transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var storagePath string
+	if entityType == models.EntityFile {
+		if err := tx.QueryRow("SELECT storage_path FROM files WHERE id = ?", id).Scan(&storagePath); err != nil {
+			return fmt.Errorf("cannot load file %d: %w", id, err)
+		}
+	}
+	for _, stmt := range e.cleanup {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return fmt.Errorf("cannot purge %s %d: %w", entityType, id, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM "+e.Table+" WHERE id = ? AND deleted_at IS NOT NULL", id); err != nil {
+		return fmt.Errorf("cannot purge %s %d: %w", entityType, id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot purge %s %d: %w", entityType, id, err)
+	}
+
+	if storagePath != "" {
+		if err := os.Remove(storagePath); err != nil && !os.IsNotExist(err) {
+			p.Log.Warn("Could not remove purged file %s: %v", storagePath, err)
+		}
+	}
+	if before != nil {
+		orgID, _ := audit.OrgOf(before)
+		event := models.AuditEvent{OrgID: orgID, Action: audit.ActionPurged, EntityType: entityType, EntityID: id}
+		if err := audit.Record(p.DB, event, audit.Diff(before, nil)); err != nil {
+			p.Log.Error("Could not audit purged %s %d: %v", entityType, id, err)
+		}
+	}
+	return nil
+}
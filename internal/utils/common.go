@@ -6,26 +6,32 @@ import (
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"strings"
+	"time"
 )
 
-// ValidateOwnership checks if a record with the given id exists in a known table and belongs to userID.
-func ValidateOwnership(db *sql.DB, table string, id int, userID int) error {
+// ValidateOwnership checks if a record with the given id exists in a known table and belongs to
+// the organization orgID.
+func ValidateOwnership(db *sql.DB, table string, id int, orgID int) error {
 	// Whitelist allowed table names
 	switch table {
-	case "contacts", "companies":
+	case "contacts", "companies", "deals", "pipelines", "interactions", "tasks", "files":
 		// OK
 	default:
 		return errors.New("invalid table for ownership check")
 	}
 
-	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = ? AND user_id = ?)", table)
+	query := fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = ? AND org_id = ?)", table)
+	if table != "pipelines" {
+		// Records in the trash are treated as gone
+		query = fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM %s WHERE id = ? AND org_id = ? AND deleted_at IS NULL)", table)
+	}
 
 	var exists bool
-	if err := db.QueryRow(query, id, userID).Scan(&exists); err != nil {
+	if err := db.QueryRow(query, id, orgID).Scan(&exists); err != nil {
 		return fmt.Errorf("error checking %s ownership: %w", table, err)
 	}
 	if !exists {
-		return fmt.Errorf("%s not found or does not belong to the user", table)
+		return fmt.Errorf("%s not found or does not belong to the organization", table)
 	}
 	return nil
 }
@@ -45,3 +51,17 @@ func SplitName(full string) (string, string) {
 	last := strings.Join(parts[1:], " ")
 	return first, last
 }
+
+// DueDateLayouts are the formats accepted for free-text due dates.
+var DueDateLayouts = []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04", time.RFC3339}
+
+// ParseDueDate parses a due or follow-up date and returns the layout it matched,
+// so dates derived from it can be written back in the same format.
+func ParseDueDate(s string) (time.Time, string, error) {
+	for _, layout := range DueDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, layout, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("cannot parse date %q", s)
+}
@@ -0,0 +1,374 @@
+// Package webhooks posts users' events to the URLs they subscribed, signed with
+// the webhook's secret, retrying failures with exponential backoff.
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"micro-CRM/internal/events"
+	"micro-CRM/internal/logger"
+	"micro-CRM/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = 2 * time.Hour
+	// maxResponseBody is how much of the receiver's response is kept in the log
+	maxResponseBody = 1024
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-CRM-Event"
+	HeaderDelivery  = "X-CRM-Delivery"
+	HeaderSignature = "X-CRM-Signature"
+)
+
+// AllEvents subscribes a webhook to every event type.
+const AllEvents = "*"
+
+// EventTypes lists the event types a webhook can subscribe to.
+var EventTypes = eventTypes()
+
+func eventTypes() []string {
+	var types []string
+	for _, entity := range []string{models.EntityCompany, models.EntityContact, models.EntityTask, models.EntityInteraction, models.EntityFile} {
+		for _, action := range []string{events.ActionCreated, events.ActionUpdated, events.ActionDeleted, events.ActionRestored} {
+			types = append(types, entity+"."+action)
+		}
+	}
+	for _, entity := range []string{models.EntityCompany, models.EntityContact, models.EntityDeal} {
+		types = append(types, entity+"."+events.ActionStageChanged, entity+"."+events.ActionWon)
+	}
+	return append(types, models.EntityTask+"."+events.ActionCompleted, models.EntityTask+"."+events.ActionAssigned)
+}
+
+// ValidEventType reports whether a webhook can subscribe to t.
+func ValidEventType(t string) bool {
+	if t == AllEvents {
+		return true
+	}
+	for _, known := range EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature header value for a delivery body sent at timestamp:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". Receivers recompute the
+// HMAC with their copy of the secret and should reject stale timestamps.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher queues deliveries for published events and sends them once due.
+type Dispatcher struct {
+	DB          *sql.DB
+	Log         logger.Logger
+	Client      *http.Client
+	Interval    time.Duration
+	MaxAttempts int
+	// DisableAfter consecutive deliveries failing every attempt turn the webhook off
+	DisableAfter int
+
+	wake chan struct{}
+	mu   sync.Mutex
+}
+
+func NewDispatcher(db *sql.DB, log logger.Logger, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		DB:           db,
+		Log:          log,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		Interval:     interval,
+		MaxAttempts:  8,
+		DisableAfter: 5,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Enqueue queues e for every enabled webhook of its user subscribed to its type.
+// It is registered with the event bus and only writes to the database; sending
+// happens on the worker.
+func (d *Dispatcher) Enqueue(e events.Event) {
+	rows, err := d.DB.Query("SELECT id, events FROM webhooks WHERE user_id = ? AND enabled = 1", e.UserID)
+	if err != nil {
+		d.Log.Error("Webhooks: cannot query subscriptions: %v", err)
+		return
+	}
+	var targets []int
+	for rows.Next() {
+		var (
+			id         int
+			subscribed string
+		)
+		if err := rows.Scan(&id, &subscribed); err != nil {
+			d.Log.Error("Webhooks: cannot scan subscription: %v", err)
+			continue
+		}
+		if Subscribed(subscribed, e.Type) {
+			targets = append(targets, id)
+		}
+	}
+	rows.Close()
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := Payload(e)
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, id := range targets {
+		if _, err := d.DB.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload, next_attempt_at) VALUES (?, ?, ?, ?, ?)`,
+			id, e.ID, e.Type, payload, now,
+		); err != nil {
+			d.Log.Error("Webhooks: cannot queue event %d for webhook %d: %v", e.ID, id, err)
+		}
+	}
+	d.Wake()
+}
+
+// Subscribed reports whether a webhook's comma separated event list covers eventType.
+func Subscribed(subscribed, eventType string) bool {
+	for _, t := range strings.Split(subscribed, ",") {
+		if t == AllEvents || t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload is the JSON body delivered for e. The user id is left out since the
+// receiver already knows whose webhook it is.
+func Payload(e events.Event) string {
+	body, _ := json.Marshal(struct {
+		ID         int64           `json:"id"`
+		Type       string          `json:"type"`
+		EntityType string          `json:"entity_type"`
+		EntityID   int             `json:"entity_id"`
+		CreatedAt  string          `json:"created_at"`
+		Data       json.RawMessage `json:"data"`
+	}{e.ID, e.Type, e.EntityType, e.EntityID, e.CreatedAt, e.Data})
+	return string(body)
+}
+
+// Run blocks until ctx is cancelled. Deliveries left in "delivering" by a crash
+// are re-queued first.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if _, err := d.DB.Exec("UPDATE webhook_deliveries SET status = ? WHERE status = ?", models.DeliveryPending, models.DeliveryDelivering); err != nil {
+		d.Log.Error("Webhooks: cannot recover interrupted deliveries: %v", err)
+	}
+
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		d.ProcessDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Wake asks the worker to look at the queue now rather than at the next tick.
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+type delivery struct {
+	id        int
+	webhookID int
+	url       string
+	secret    string
+	eventType string
+	payload   string
+	attempts  int
+}
+
+// ProcessDue sends every pending delivery whose attempt time has passed. Deliveries
+// of disabled webhooks wait until the webhook is enabled again.
+func (d *Dispatcher) ProcessDue(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	rows, err := d.DB.Query(`
+	SELECT d.id, d.webhook_id, w.url, w.secret, d.event_type, d.payload, d.attempts
+	FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+	WHERE d.status = ? AND d.next_attempt_at <= ? AND w.enabled = 1
+	ORDER BY d.id`, models.DeliveryPending, now)
+	if err != nil {
+		d.Log.Error("Webhooks: cannot query due deliveries: %v", err)
+		return
+	}
+	var due []delivery
+	for rows.Next() {
+		var item delivery
+		if err := rows.Scan(&item.id, &item.webhookID, &item.url, &item.secret, &item.eventType, &item.payload, &item.attempts); err != nil {
+			d.Log.Error("Webhooks: cannot scan delivery: %v", err)
+			continue
+		}
+		due = append(due, item)
+	}
+	rows.Close()
+
+	for _, item := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		d.deliver(ctx, item)
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, item delivery) {
+	result, err := d.DB.Exec("UPDATE webhook_deliveries SET status = ? WHERE id = ? AND status = ?", models.DeliveryDelivering, item.id, models.DeliveryPending)
+	if err != nil {
+		d.Log.Error("Webhooks: cannot claim delivery %d: %v", item.id, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+
+	started := time.Now()
+	status, body, sendErr := d.post(ctx, item)
+	duration := time.Since(started).Milliseconds()
+	if ctx.Err() != nil {
+		// Shutting down: the attempt was cut short, not refused
+		if _, err := d.DB.Exec("UPDATE webhook_deliveries SET status = ? WHERE id = ?", models.DeliveryPending, item.id); err != nil {
+			d.Log.Error("Webhooks: cannot release delivery %d: %v", item.id, err)
+		}
+		return
+	}
+	item.attempts++
+
+	var responseStatus *int
+	if status != 0 {
+		responseStatus = &status
+	}
+	if sendErr == nil {
+		_, err = d.DB.Exec(`
+		UPDATE webhook_deliveries SET status = ?, attempts = ?, response_status = ?, response_body = ?, last_error = NULL,
+			duration_ms = ?, delivered_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+			models.DeliverySucceeded, item.attempts, responseStatus, body, duration, time.Now().UTC().Format(time.RFC3339), item.id,
+		)
+		if err == nil {
+			_, err = d.DB.Exec("UPDATE webhooks SET failure_count = 0 WHERE id = ? AND failure_count > 0", item.webhookID)
+		}
+		if err != nil {
+			d.Log.Error("Webhooks: delivery %d sent but not recorded: %v", item.id, err)
+		}
+		return
+	}
+
+	deliveryStatus := models.DeliveryPending
+	if item.attempts >= d.MaxAttempts {
+		deliveryStatus = models.DeliveryFailed
+	}
+	next := time.Now().UTC().Add(backoff(item.attempts)).Format(time.RFC3339)
+	_, err = d.DB.Exec(`
+	UPDATE webhook_deliveries SET status = ?, attempts = ?, response_status = ?, response_body = ?, last_error = ?,
+		duration_ms = ?, next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?`,
+		deliveryStatus, item.attempts, responseStatus, body, sendErr.Error(), duration, next, item.id,
+	)
+	if err != nil {
+		d.Log.Error("Webhooks: cannot record failure for delivery %d: %v", item.id, err)
+	}
+	d.Log.Warn("Webhooks: delivery %d to webhook %d attempt %d failed: %v", item.id, item.webhookID, item.attempts, sendErr)
+
+	if deliveryStatus == models.DeliveryFailed {
+		d.recordFailedDelivery(item.webhookID)
+	}
+}
+
+// post sends the delivery and returns the response status and the start of its
+// body. Any status outside 2xx is an error.
+func (d *Dispatcher) post(ctx context.Context, item delivery) (int, *string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, item.url, strings.NewReader(item.payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "micro-CRM-Webhooks/1.0")
+	req.Header.Set(HeaderEvent, item.eventType)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(item.id))
+	req.Header.Set(HeaderSignature, Sign(item.secret, time.Now(), []byte(item.payload)))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	body := string(data)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, &body, fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return resp.StatusCode, &body, nil
+}
+
+// recordFailedDelivery counts a delivery that failed every attempt and disables
+// the webhook once DisableAfter of them happen in a row.
+func (d *Dispatcher) recordFailedDelivery(webhookID int) {
+	reason := fmt.Sprintf("Disabled after %d consecutive failed deliveries", d.DisableAfter)
+	result, err := d.DB.Exec(`
+	UPDATE webhooks SET
+		failure_count = failure_count + 1,
+		enabled = CASE WHEN failure_count + 1 >= ? THEN 0 ELSE enabled END,
+		disabled_reason = CASE WHEN failure_count + 1 >= ? THEN ? ELSE disabled_reason END,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND enabled = 1`,
+		d.DisableAfter, d.DisableAfter, reason, webhookID,
+	)
+	if err != nil {
+		d.Log.Error("Webhooks: cannot record failed delivery for webhook %d: %v", webhookID, err)
+		return
+	}
+	var enabled bool
+	if n, _ := result.RowsAffected(); n > 0 && d.DB.QueryRow("SELECT enabled FROM webhooks WHERE id = ?", webhookID).Scan(&enabled) == nil && !enabled {
+		d.Log.Warn("Webhooks: webhook %d disabled after %d consecutive failed deliveries", webhookID, d.DisableAfter)
+	}
+}
+
+func backoff(attempts int) time.Duration {
+	delay := retryBaseDelay << (attempts - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		return retryMaxDelay
+	}
+	return delay
+}
+
+// NewSecret returns a random signing secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}